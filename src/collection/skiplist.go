@@ -0,0 +1,191 @@
+package collection
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	SKIPLIST_MAX_HEIGHT = 16
+	SKIPLIST_BRANCHING  = 4
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// SkipList
+////////////////////////////////////////////////////////////////////////////////
+
+// SkipList is a sorted map supporting many concurrent readers with a single
+// writer.  Get and iterators are lock free and safe to call concurrently with
+// Put, while Put calls must be serialized by the caller.  Nodes are never
+// removed, a node is visible to readers once it is linked at level 0.
+type SkipList struct {
+	head   *SkipListNode
+	height int32 // current height, accessed atomically
+	size   int32 // number of nodes, accessed atomically
+	rand   *rand.Rand
+}
+
+type SkipListNode struct {
+	key   IComparable
+	value unsafe.Pointer // *skipListValue, accessed atomically
+	next  []unsafe.Pointer
+}
+
+type skipListValue struct {
+	value IObject
+}
+
+func NewSkipList() *SkipList {
+	return &SkipList{
+		head:   &SkipListNode{next: make([]unsafe.Pointer, SKIPLIST_MAX_HEIGHT)},
+		height: 1,
+		rand:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (l *SkipList) Get(k IComparable) IObject {
+	node := l.seek(k, nil)
+	if node != nil && node.key.Compare(k) == 0 {
+		return node.Value()
+	} else {
+		return nil
+	}
+}
+
+// put key and value, returns the previous value if key exists
+func (l *SkipList) Put(k IComparable, v IObject) IObject {
+
+	prev := make([]*SkipListNode, SKIPLIST_MAX_HEIGHT)
+	node := l.seek(k, prev)
+
+	// replace value of existing key
+	if node != nil && node.key.Compare(k) == 0 {
+		old := node.Value()
+		atomic.StorePointer(&node.value, unsafe.Pointer(&skipListValue{value: v}))
+		return old
+	}
+
+	height := l.randomHeight()
+	if curr := int(atomic.LoadInt32(&l.height)); height > curr {
+		for i := curr; i < height; i++ {
+			prev[i] = l.head
+		}
+		atomic.StoreInt32(&l.height, int32(height))
+	}
+
+	node = &SkipListNode{
+		key:   k,
+		value: unsafe.Pointer(&skipListValue{value: v}),
+		next:  make([]unsafe.Pointer, height),
+	}
+
+	// link from bottom up, node is visible once linked at level 0
+	for i := 0; i < height; i++ {
+		node.next[i] = atomic.LoadPointer(&prev[i].next[i])
+		atomic.StorePointer(&prev[i].next[i], unsafe.Pointer(node))
+	}
+
+	atomic.AddInt32(&l.size, 1)
+
+	return nil
+}
+
+func (l *SkipList) Size() int {
+	return int(atomic.LoadInt32(&l.size))
+}
+
+func (l *SkipList) Iterator() ISortedMapIterator {
+	return &SkipListIterator{node: l.head.nextAt(0)}
+}
+
+// iterate keys within [start, end), nil start or end means unbounded
+func (l *SkipList) RangeIterator(start, end IComparable) ISortedMapIterator {
+
+	if start != nil && end != nil && start.Compare(end) > 0 {
+		panic(fmt.Sprintf("SkipList::RangeIterator - start [%v] is larger than end [%v]", start, end))
+	}
+
+	iter := &SkipListIterator{end: end}
+	if start == nil {
+		iter.node = l.head.nextAt(0)
+	} else {
+		iter.node = l.seek(start, nil)
+	}
+
+	return iter
+}
+
+// first node with key no less than k, records the previous node at each level if prev is not nil
+func (l *SkipList) seek(k IComparable, prev []*SkipListNode) *SkipListNode {
+
+	node := l.head
+	for level := int(atomic.LoadInt32(&l.height)) - 1; level >= 0; level-- {
+		next := node.nextAt(level)
+		for next != nil && next.key.Compare(k) < 0 {
+			node = next
+			next = node.nextAt(level)
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+		if level == 0 {
+			return next
+		}
+	}
+
+	return nil
+}
+
+func (l *SkipList) randomHeight() int {
+	height := 1
+	for height < SKIPLIST_MAX_HEIGHT && l.rand.Intn(SKIPLIST_BRANCHING) == 0 {
+		height++
+	}
+	return height
+}
+
+func (n *SkipListNode) Key() IComparable {
+	return n.key
+}
+
+func (n *SkipListNode) Value() IObject {
+	return (*skipListValue)(atomic.LoadPointer(&n.value)).value
+}
+
+func (n *SkipListNode) nextAt(level int) *SkipListNode {
+	return (*SkipListNode)(atomic.LoadPointer(&n.next[level]))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SkipListIterator
+////////////////////////////////////////////////////////////////////////////////
+
+type SkipListIterator struct {
+	node *SkipListNode
+	end  IComparable
+}
+
+func (i *SkipListIterator) Next() (IComparable, IObject) {
+	if !i.HasNext() {
+		return nil, nil
+	}
+	node := i.node
+	i.node = node.nextAt(0)
+	return node.key, node.Value()
+}
+
+func (i *SkipListIterator) HasNext() bool {
+	if i.node != nil && i.end != nil && i.node.key.Compare(i.end) >= 0 {
+		i.node = nil // no more left
+	}
+	return i.node != nil
+}
+
+func (i *SkipListIterator) Peek() (IComparable, IObject) {
+	if !i.HasNext() {
+		return nil, nil
+	}
+	return i.node.key, i.node.Value()
+}
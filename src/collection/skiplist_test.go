@@ -0,0 +1,125 @@
+package collection
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+
+	l := NewSkipList()
+	for _, tt := range avlPutCases {
+		v := l.Put(tt.k, tt.v)
+		if tt.rv == nil && !IsNil(v) || tt.rv != nil && !tt.rv.Equal(v) {
+			t.Errorf("put [%d]: got %v; want %v", tt.k.int, v, tt.rv)
+		}
+	}
+
+	if l.Size() != 9 {
+		t.Errorf("size not match: %d", l.Size())
+	}
+
+	if v := l.Get(&intKey{6}); !(&intKey{6 * 3}).Equal(v) {
+		t.Errorf("get [6]: got %v", v)
+	}
+	if v := l.Get(&intKey{10}); v != nil {
+		t.Errorf("get [10]: got %v", v)
+	}
+
+	// iterate in order
+	expected := 1
+	iter := l.Iterator()
+	for iter.HasNext() {
+		k, _ := iter.Next()
+		if k.(*intKey).int != expected {
+			t.Errorf("iterator: got %d; want %d", k.(*intKey).int, expected)
+		}
+		expected++
+	}
+	if expected != 10 {
+		t.Errorf("iterator count not match: %d", expected-1)
+	}
+}
+
+func TestSkipListRangeIterator(t *testing.T) {
+
+	for trial := 0; trial < 100; trial++ {
+
+		l := NewSkipList()
+		exist := map[int]bool{}
+		n := rand.Intn(200)
+		for i := 0; i < n; i++ {
+			k := rand.Intn(100)
+			exist[k] = true
+			l.Put(&intKey{k}, &intKey{k})
+		}
+
+		start := rand.Intn(100)
+		end := start + rand.Intn(100-start+1)
+
+		want := []int{}
+		for k := start; k < end; k++ {
+			if exist[k] {
+				want = append(want, k)
+			}
+		}
+
+		got := []int{}
+		iter := l.RangeIterator(&intKey{start}, &intKey{end})
+		for iter.HasNext() {
+			k, _ := iter.Next()
+			got = append(got, k.(*intKey).int)
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("range [%d, %d): got %v; want %v", start, end, got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("range [%d, %d): got %v; want %v", start, end, got, want)
+			}
+		}
+	}
+}
+
+func TestSkipListConcurrent(t *testing.T) {
+
+	l := NewSkipList()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// readers always observe sorted keys
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				last := -1
+				iter := l.Iterator()
+				for iter.HasNext() {
+					k, _ := iter.Next()
+					if k.(*intKey).int <= last {
+						t.Errorf("iterator out of order: %d after %d", k.(*intKey).int, last)
+						return
+					}
+					last = k.(*intKey).int
+				}
+			}
+		}()
+	}
+
+	// single writer
+	for i := 0; i < 10000; i++ {
+		k := rand.Intn(5000)
+		l.Put(&intKey{k}, &intKey{k})
+	}
+	close(done)
+	wg.Wait()
+}
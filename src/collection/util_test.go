@@ -0,0 +1,29 @@
+package collection
+
+import (
+	"testing"
+)
+
+var compareByteSliceCases = []struct {
+	s1 []byte
+	s2 []byte
+	r  int
+}{
+	{nil, nil, 0},
+	{nil, []byte{}, -1},
+	{[]byte("abc"), []byte("abc"), 0},
+	{[]byte("abc"), []byte("abd"), -1},
+	{[]byte("abd"), []byte("abc"), 1},
+	{[]byte("ab"), []byte("abc"), -1},
+	{[]byte("abc"), []byte("ab"), 1},
+	{[]byte("abc"), []byte{}, 1},
+	{[]byte{}, []byte("abc"), -1},
+}
+
+func TestCompareByteSlice(t *testing.T) {
+	for _, tt := range compareByteSliceCases {
+		if r := CompareByteSlice(tt.s1, tt.s2); r != tt.r {
+			t.Errorf("CompareByteSlice(%v, %v): got %d; want %d", tt.s1, tt.s2, r, tt.r)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "os"
+    "flag"
+    "fmt"
+    "../pdb"
+)
+
+func usage() {
+    fmt.Fprintf(os.Stderr, "Usage: %s [options] <verify|repair|dump> <sstable> [output]\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "  verify <sstable> ...        verify every record of SSTable files\n")
+    fmt.Fprintf(os.Stderr, "  repair <sstable> <output>   salvage good records of SSTable into output\n")
+    fmt.Fprintf(os.Stderr, "  dump <sstable> ...          print header, statistics and records of SSTable files\n")
+    flag.PrintDefaults()
+}
+
+func print_result(result *pdb.SSTableVerifyResult, quiet bool) {
+
+    status := "OK"
+    if !result.OK() {
+        status = "CORRUPTED"
+    }
+
+    fmt.Printf("%s : version %d, count %d, records %d, valid %d - %s\n",
+        result.Filepath(), result.Version(), result.Count(), result.Records(), result.Valid(), status)
+
+    if quiet {
+        return
+    }
+
+    for _, problem := range result.Problems() {
+        fmt.Printf("  %s\n", problem)
+    }
+    if more := result.ProblemCount() - len(result.Problems()); more > 0 {
+        fmt.Printf("  ... %d more problems\n", more)
+    }
+}
+
+func process_verify(paths []string, quiet bool) int {
+
+    code := 0
+    for _, path := range paths {
+        result, err := pdb.VerifySSTable(path)
+        if err != nil {
+            fmt.Printf("%s : ERROR: %s\n", path, err)
+            code = 1
+            continue
+        }
+        print_result(result, quiet)
+        if !result.OK() {
+            code = 1
+        }
+    }
+
+    return code
+}
+
+func process_repair(path, output string, quiet bool) int {
+
+    result, err := pdb.RepairSSTable(path, output)
+    if err != nil {
+        fmt.Printf("%s : ERROR: %s\n", path, err)
+        return 1
+    }
+
+    print_result(result, quiet)
+    fmt.Printf("Salvaged %d of %d records into %s\n", result.Salvaged(), result.Records(), output)
+
+    return 0
+}
+
+func process_dump(paths []string, format string, limit int) int {
+
+    for _, path := range paths {
+        err := pdb.DumpSSTable(path, os.Stdout, format, limit)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s : ERROR: %s\n", path, err)
+            return 1
+        }
+    }
+
+    return 0
+}
+
+func main() {
+
+    quietPtr    := flag.Bool("quiet", false, "Print summary only, without problems.")
+    formatPtr   := flag.String("format", "text", "Dump format [text|verbose|json].")
+    limitPtr    := flag.Int("limit", -1, "Max number of records to dump, -1 for all, 0 for header only.")
+    flag.Usage  = usage
+    flag.Parse()
+
+    args := flag.Args()
+    if len(args) < 2 {
+        flag.Usage()
+        os.Exit(2)
+    }
+
+    switch args[0] {
+    case "verify":
+        os.Exit(process_verify(args[1:], *quietPtr))
+    case "repair":
+        if len(args) != 3 {
+            flag.Usage()
+            os.Exit(2)
+        }
+        os.Exit(process_repair(args[1], args[2], *quietPtr))
+    case "dump":
+        os.Exit(process_dump(args[1:], *formatPtr, *limitPtr))
+    default:
+        flag.Usage()
+        os.Exit(2)
+    }
+}
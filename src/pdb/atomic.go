@@ -0,0 +1,114 @@
+package pdb
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"../collection"
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Test and Set
+//
+// TestSet is the SET with TEST bit of a request - the record is tested against
+// the current record of its key and group, and written only if the test
+// passes, atomically with respect to other writes of the table:
+//
+//   UPDATE record - set if absent, fails if a record is already set
+//   CLEAR record  - clear if equals, succeeds without write if no record is
+//                   set, fails if the current value differs from the value of
+//                   the CLEAR record.  A CLEAR record without value clears
+//                   any current value
+//
+// With test millis (test millis bit of a request), the timestamp of the
+// current record is checked - a current record without timestamp fails the
+// test, and a current record older than test millis before the timestamp of
+// the record being set is treated as already cleared.  The record being set
+// without timestamp is checked against local time.  Test millis of 0 means
+// no test millis.
+//
+// A failed test returns a *TestConflictError.
+
+// test of a TestSet failed against the current record
+type TestConflictError struct {
+	table   string
+	key     util.IKey
+	group   string
+	current util.IRecord // current record, nil if not set
+	reason  string
+}
+
+func (e *TestConflictError) Error() string {
+	return fmt.Sprintf("TestConflictError - table [%s] key [%s] group [%x] - %s", e.table, e.key.ToString(), e.group, e.reason)
+}
+
+func (e *TestConflictError) Table() string {
+	return e.table
+}
+
+func (e *TestConflictError) Key() util.IKey {
+	return e.key
+}
+
+func (e *TestConflictError) Group() string {
+	return e.group
+}
+
+// current record failed the test, nil if not set
+func (e *TestConflictError) Current() util.IRecord {
+	return e.current
+}
+
+// whether err is a failed test of TestSet
+func IsTestConflict(err error) bool {
+	_, ok := err.(*TestConflictError)
+	return ok
+}
+
+// test record against the current record, returns whether record should be written
+func test_record(table string, group string, current, record util.IRecord, test_millis uint32) (bool, error) {
+
+	conflict := func(reason string) error {
+		return &TestConflictError{table: table, key: record.Key(), group: group, current: current, reason: reason}
+	}
+
+	// records older than test millis are treated as cleared
+	if current != nil && test_millis > 0 {
+		ts := current.Timestamp()
+		if ts == nil {
+			return false, conflict("current record has no timestamp")
+		}
+		now := time.Now()
+		if record.Timestamp() != nil {
+			now = *record.Timestamp()
+		}
+		if ts.Before(now.Add(-time.Duration(test_millis) * time.Millisecond)) {
+			current = nil
+		}
+	}
+
+	if !record_is_clear(record) {
+		if current != nil {
+			return false, conflict("record already set")
+		}
+		return true, nil
+	}
+
+	if current == nil {
+		return false, nil
+	}
+	if !collection.IsNil(record.Value()) && !test_value_equal(current.Value(), record.Value()) {
+		return false, conflict("current value differs")
+	}
+
+	return true, nil
+}
+
+func test_value_equal(a, b util.IValue) bool {
+	if collection.IsNil(a) || collection.IsNil(b) {
+		return collection.IsNil(a) && collection.IsNil(b)
+	}
+	return bytes.Equal(a.Value(), b.Value())
+}
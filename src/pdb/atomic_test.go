@@ -0,0 +1,129 @@
+package pdb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+func newTestClearValueRecord(key, value string, ts time.Time) util.IRecord {
+	r := util.NewRecord().SetKey(newTestKey(key)).SetV([]byte(value)).SetTimestamp(&ts).SetClear(true)
+	if err := r.Encode(nil); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestPdbV1TestSet(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	now := time.Now()
+	epoch := uint32(0)
+	testSet := func(r util.IRecord, millis uint32) error {
+		epoch++
+		return p.TestSet("table", util.NewLedgerTime(epoch), r, millis)
+	}
+
+	// set if absent
+	if err := testSet(newTestTimestampRecord("id", "v1", now.UnixNano()), 0); err != nil {
+		t.Fatal(err)
+	}
+	err = testSet(newTestTimestampRecord("id", "v2", now.UnixNano()), 0)
+	if !IsTestConflict(err) {
+		t.Fatalf("set of existing key: %v; want conflict", err)
+	}
+	if c := err.(*TestConflictError).Current(); c == nil || string(c.Value().Value()) != "v1" {
+		t.Errorf("conflict current record %v; want v1", c)
+	}
+	if v := getTestValue(t, p, "table", "id", ""); v != "v1" {
+		t.Errorf("value %s after conflict; want v1", v)
+	}
+
+	// clear if equals
+	if err := testSet(newTestClearValueRecord("id", "v2", now), 0); !IsTestConflict(err) {
+		t.Errorf("clear of different value: %v; want conflict", err)
+	}
+	if err := testSet(newTestClearValueRecord("id", "v1", now), 0); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := p.Get("table", newTestKey("id"), ""); err != nil || r != nil {
+		t.Errorf("cleared record %v %v", r, err)
+	}
+	// clear of absent key succeeds
+	if err := testSet(newTestClearValueRecord("id", "v1", now), 0); err != nil {
+		t.Errorf("clear of absent key: %s", err)
+	}
+	if err := testSet(newTestTimestampRecord("id", "v3", now.UnixNano()), 0); err != nil {
+		t.Fatal(err)
+	}
+	// CLEAR record not yet encoded
+	if err := testSet(util.NewRecord().SetKey(newTestKey("id")).SetV([]byte("v3")).SetTimestamp(&now).SetClear(true), 0); err != nil {
+		t.Errorf("clear of record not encoded: %s", err)
+	}
+	if err := testSet(newTestTimestampRecord("id", "v3", now.UnixNano()), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired after test millis
+	later := now.Add(2 * time.Second)
+	if err := testSet(newTestTimestampRecord("id", "v4", later.UnixNano()), 5000); !IsTestConflict(err) {
+		t.Errorf("set within test millis: %v; want conflict", err)
+	}
+	if err := testSet(newTestTimestampRecord("id", "v4", later.UnixNano()), 1000); err != nil {
+		t.Errorf("set after test millis: %s", err)
+	}
+	if v := getTestValue(t, p, "table", "id", ""); v != "v4" {
+		t.Errorf("value %s; want v4", v)
+	}
+
+	// record without timestamp fails test millis
+	if err := p.Set("table", util.NewLedgerTime(100), newTestRecord("nots", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.TestSet("table", util.NewLedgerTime(101), newTestRecord("nots", "v"), 1000); !IsTestConflict(err) {
+		t.Errorf("test millis without timestamp: %v; want conflict", err)
+	}
+}
+
+func TestPdbV1TestSetConcurrent(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// only one of concurrent set if absent wins
+	const n = 16
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			results <- p.TestSet("table", util.NewLedgerTime(1), newTestRecord("id", "v"), 0)
+		}()
+	}
+
+	succeeded := 0
+	for i := 0; i < n; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		} else if !IsTestConflict(err) {
+			t.Fatal(err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d set if absent succeeded; want 1", succeeded)
+	}
+}
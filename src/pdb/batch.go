@@ -0,0 +1,59 @@
+package pdb
+
+import (
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Write Batch
+//
+// WriteBatch is a list of records of one or more tables of a pdb, written
+// atomically at one consensus time - the batch is appended to the journal as
+// one entry covered by one crc32, and applied to the memtables of all its
+// tables under the seq of the entry.  On recovery, a batch is replayed as a
+// whole, or not at all if its entry is torn.
+//
+// Records of a table are applied in the order they are added, so a later
+// record of the same key and group wins.
+
+type WriteBatch struct {
+	tables  []string // tables in order of first record
+	records map[string][]util.IRecord
+	count   int
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{tables: []string{}, records: map[string][]util.IRecord{}}
+}
+
+// add a record of table to the batch
+func (b *WriteBatch) Set(table string, record util.IRecord) *WriteBatch {
+	if _, ok := b.records[table]; !ok {
+		b.tables = append(b.tables, table)
+	}
+	b.records[table] = append(b.records[table], record)
+	b.count += 1
+	return b
+}
+
+// tables of the batch, in order of first record
+func (b *WriteBatch) Tables() []string {
+	return append([]string{}, b.tables...)
+}
+
+// records of a table, in order added
+func (b *WriteBatch) Records(table string) []util.IRecord {
+	return b.records[table]
+}
+
+// number of records of all tables
+func (b *WriteBatch) Count() int {
+	return b.count
+}
+
+// remove all records, the batch can be reused
+func (b *WriteBatch) Reset() {
+	b.tables = []string{}
+	b.records = map[string][]util.IRecord{}
+	b.count = 0
+}
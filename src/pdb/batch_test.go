@@ -0,0 +1,171 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"../util"
+)
+
+func newTestWriteBatch(prefix string) *WriteBatch {
+	return NewWriteBatch().
+		Set("t1", newTestRecord(prefix+"a", "1")).
+		Set("t2", newTestRecord(prefix+"b", "2")).
+		Set("t1", newTestRecord(prefix+"c", "3"))
+}
+
+func TestJournalV1AppendBatch(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	j, err := OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed := []string{}
+	j.OnCommitBatch(func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error {
+		committed = append(committed, fmt.Sprintf("%d:%v", seq, batch.Tables()))
+		return nil
+	})
+
+	if err := j.AppendRecord("t1", util.NewLedgerTime(1), newTestRecord("x", "0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.AppendBatch(util.NewLedgerTime(2), newTestWriteBatch("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.AppendBatch(util.NewLedgerTime(3), NewWriteBatch()); err != nil {
+		t.Errorf("empty batch: %s", err)
+	}
+	if err := j.AppendBatch(util.NewLedgerTime(3), NewWriteBatch().Set("", newTestRecord("y", "0"))); err == nil {
+		t.Errorf("batch of empty table should fail")
+	}
+	if err := j.AppendBatch(util.NewLedgerTime(3), newTestWriteBatch("torn/")); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(committed) != "[1:[t1] 2:[t1 t2] 3:[t1 t2]]" {
+		t.Errorf("committed %v", committed)
+	}
+	path := j.segment.Name()
+	j.Close()
+
+	// tear the last batch
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// batch replayed as a whole, torn batch not at all
+	replayed := []string{}
+	err = j.ReplayBatch(0, func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error {
+		for _, table := range batch.Tables() {
+			for _, r := range batch.Records(table) {
+				replayed = append(replayed, fmt.Sprintf("%d:%x:%s/%s", seq, time.Buf(), table, testKeyString(r.Key())))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(replayed) != "[1:0100000001:t1/x 2:0100000002:t1/a 2:0100000002:t1/c 2:0100000002:t2/b]" {
+		t.Errorf("replayed %v", replayed)
+	}
+
+	// replay by table
+	tables := []string{}
+	err = j.Replay(0, func(seq uint64, table string, time util.IConsensusTime, records []util.IRecord) error {
+		tables = append(tables, fmt.Sprintf("%d:%s:%d", seq, table, len(records)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(tables) != "[1:t1:1 2:t1:2 2:t2:1]" {
+		t.Errorf("replayed tables %v", tables)
+	}
+}
+
+func TestPdbV1WriteBatch(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	p, err := OpenPdbV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Write(util.NewLedgerTime(1), newTestWriteBatch("")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a later record of the same key in a batch wins
+	batch := NewWriteBatch().Set("t2", newTestRecord("b", "old")).Set("t2", newTestRecord("b", "new"))
+	if err := p.Write(util.NewLedgerTime(2), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid batch writes nothing
+	batch = NewWriteBatch().Set("t1", newTestRecord("d", "4")).Set("../t3", newTestRecord("e", "5"))
+	if err := p.Write(util.NewLedgerTime(3), batch); err == nil {
+		t.Errorf("batch with invalid table should fail")
+	}
+	if err := p.Write(nil, newTestWriteBatch("")); err == nil {
+		t.Errorf("batch without time should fail")
+	}
+
+	check := func(p IPdb) {
+		for _, tt := range []struct{ table, key, want string }{
+			{"t1", "a", "1"},
+			{"t1", "c", "3"},
+			{"t2", "b", "new"},
+			{"t1", "b", "<nil>"},
+			{"t1", "d", "<nil>"},
+		} {
+			if v := getTestValue(t, p, tt.table, tt.key, ""); v != tt.want {
+				t.Errorf("%s/%s = %q; want %q", tt.table, tt.key, v, tt.want)
+			}
+		}
+	}
+	check(p)
+
+	// recovered from journal
+	p.Close()
+	p, err = OpenPdbV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(p)
+
+	// one table flushed, the other recovered from journal
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(util.NewLedgerTime(4), NewWriteBatch().Set("t1", newTestRecord("a", "5")).Set("t2", newTestRecord("b", "6"))); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	p, err = OpenPdbV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if getTestValue(t, p, "t1", "a", "") != "5" || getTestValue(t, p, "t2", "b", "") != "6" {
+		t.Errorf("batch after flush not recovered")
+	}
+}
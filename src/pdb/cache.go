@@ -0,0 +1,249 @@
+package pdb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BLOCK_CACHE_CAPACITY = uint64(64 * 1024 * 1024) // default byte budget of block cache
+	BLOCK_CACHE_SHARDS   = 16
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Block Cache
+//
+// BlockCache is a sharded LRU cache of decoded SSTable blocks, keyed by file
+// id and block position, with a byte budget shared by all open SSTables.  Each
+// shard holds 1/BLOCK_CACHE_SHARDS of the budget, with its own mutex and LRU
+// list.  A block larger than the budget of a shard is returned pinned but not
+// cached - SSTableV2Builder caps block size at SSTABLE_V2_MAX_BLOCK_SIZE, so
+// decoded blocks, about twice the block size at most, fit a shard of the
+// default budget, and a smaller budget caches smaller blocks only.
+//
+// A block returned by Lookup or Insert is pinned until its handle is
+// released - pinned blocks are never evicted, and still count against the
+// budget, so a shard may go over budget while reads are in flight.  A block
+// replaced while pinned is dropped when released.  Memory of an evicted block
+// is reclaimed once no record decoded from it is referenced.
+//
+// Blocks of a closed file are not erased - file ids are never reused, so they
+// are never looked up again, and age out of the LRU like any cold block.
+
+type BlockCache struct {
+	capacity uint64
+	shards   [BLOCK_CACHE_SHARDS]*block_cache_shard
+	hits     uint64
+	misses   uint64
+}
+
+// handle of a pinned block, must be released after use
+type BlockCacheHandle struct {
+	shard    *block_cache_shard
+	entry    *block_cache_entry
+	released int32
+}
+
+// counters and usage of a block cache
+type BlockCacheStats struct {
+	Capacity uint64 // byte budget
+	Usage    uint64 // bytes of cached blocks, including pinned
+	Entries  int    // number of cached blocks
+	Pinned   int    // number of pinned blocks
+	Hits     uint64 // lookups found
+	Misses   uint64 // lookups not found
+}
+
+type block_cache_key struct {
+	file uint64 // file id
+	pos  uint32 // block position
+}
+
+type block_cache_entry struct {
+	key      block_cache_key
+	value    interface{}
+	size     uint64
+	refs     int           // pins by handles
+	in_cache bool          // whether entry is in shard map
+	elem     *list.Element // position in lru, nil if pinned or not in cache
+}
+
+type block_cache_shard struct {
+	mutex    sync.Mutex
+	capacity uint64
+	usage    uint64
+	entries  map[block_cache_key]*block_cache_entry
+	lru      *list.List // unpinned entries, most recently used first
+	pinned   int
+}
+
+var (
+	default_block_cache = NewBlockCache(BLOCK_CACHE_CAPACITY)
+	block_cache_file_id uint64
+)
+
+// block cache shared by all SSTables by default
+func DefaultBlockCache() *BlockCache {
+	return default_block_cache
+}
+
+func NewBlockCache(capacity uint64) *BlockCache {
+
+	c := &BlockCache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i] = &block_cache_shard{
+			capacity: capacity / BLOCK_CACHE_SHARDS,
+			entries:  map[block_cache_key]*block_cache_entry{},
+			lru:      list.New(),
+		}
+	}
+
+	return c
+}
+
+// unique id of an opened file, files are cached by id so a reopened or
+// replaced file never sees blocks of another
+func NewBlockCacheFileID() uint64 {
+	return atomic.AddUint64(&block_cache_file_id, 1)
+}
+
+// pinned block of file at position, nil if not cached
+func (c *BlockCache) Lookup(file uint64, pos uint32) *BlockCacheHandle {
+
+	key := block_cache_key{file: file, pos: pos}
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+	s.pin(e)
+
+	return &BlockCacheHandle{shard: s, entry: e}
+}
+
+// cache block of file at position with size in bytes, replaces existing block
+// of the same position - returns the pinned block
+func (c *BlockCache) Insert(file uint64, pos uint32, value interface{}, size uint64) *BlockCacheHandle {
+
+	key := block_cache_key{file: file, pos: pos}
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e := &block_cache_entry{key: key, value: value, size: size, refs: 1}
+	s.pinned += 1
+
+	// a block larger than the shard budget is not cached
+	if size > s.capacity {
+		return &BlockCacheHandle{shard: s, entry: e}
+	}
+
+	if old, ok := s.entries[key]; ok {
+		s.remove(old)
+	}
+
+	e.in_cache = true
+	s.entries[key] = e
+	s.usage += size
+	s.evict()
+
+	return &BlockCacheHandle{shard: s, entry: e}
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+
+	stats := BlockCacheStats{
+		Capacity: c.capacity,
+		Hits:     atomic.LoadUint64(&c.hits),
+		Misses:   atomic.LoadUint64(&c.misses),
+	}
+
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		stats.Usage += s.usage
+		stats.Entries += len(s.entries)
+		stats.Pinned += s.pinned
+		s.mutex.Unlock()
+	}
+
+	return stats
+}
+
+func (c *BlockCache) shard(key block_cache_key) *block_cache_shard {
+	// mix file id and position, blocks of a file spread over shards
+	h := key.file*0x9e3779b97f4a7c15 ^ uint64(key.pos)*0xc2b2ae3d27d4eb4f
+	return c.shards[(h>>32)%BLOCK_CACHE_SHARDS]
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// BlockCacheHandle
+
+func (h *BlockCacheHandle) Value() interface{} {
+	return h.entry.value
+}
+
+// unpin the block, the handle must not be used after release - a nil handle
+// is a no-op
+func (h *BlockCacheHandle) Release() {
+
+	if h == nil || !atomic.CompareAndSwapInt32(&h.released, 0, 1) {
+		return
+	}
+
+	s := h.shard
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e := h.entry
+	e.refs -= 1
+	if e.refs > 0 {
+		return
+	}
+
+	s.pinned -= 1
+	if e.in_cache {
+		e.elem = s.lru.PushFront(e)
+		s.evict()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// block_cache_shard, mutex must be held
+
+func (s *block_cache_shard) pin(e *block_cache_entry) {
+	if e.refs == 0 {
+		s.pinned += 1
+		if e.elem != nil {
+			s.lru.Remove(e.elem)
+			e.elem = nil
+		}
+	}
+	e.refs += 1
+}
+
+// remove entry from cache, a pinned entry is kept by its handles
+func (s *block_cache_shard) remove(e *block_cache_entry) {
+	delete(s.entries, e.key)
+	e.in_cache = false
+	s.usage -= e.size
+	if e.elem != nil {
+		s.lru.Remove(e.elem)
+		e.elem = nil
+	}
+}
+
+// evict least recently used unpinned entries until within budget
+func (s *block_cache_shard) evict() {
+	for s.usage > s.capacity && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*block_cache_entry))
+	}
+}
@@ -0,0 +1,232 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"../util"
+)
+
+func TestBlockCache(t *testing.T) {
+
+	// 100 bytes per shard
+	c := NewBlockCache(100 * BLOCK_CACHE_SHARDS)
+
+	if h := c.Lookup(1, 0); h != nil {
+		t.Fatalf("lookup of empty cache: %v", h.Value())
+	}
+
+	// fill one shard with blocks of a file, tracking the shard of each position
+	file := NewBlockCacheFileID()
+	shard := c.shard(block_cache_key{file: file, pos: 0})
+	positions := []uint32{}
+	for pos := uint32(0); len(positions) < 4; pos++ {
+		if c.shard(block_cache_key{file: file, pos: pos}) == shard {
+			positions = append(positions, pos)
+		}
+	}
+
+	// pinned blocks are kept over budget
+	handles := []*BlockCacheHandle{}
+	for _, pos := range positions {
+		handles = append(handles, c.Insert(file, pos, pos, 40))
+	}
+	if shard.usage != 160 || shard.pinned != 4 {
+		t.Errorf("usage %d pinned %d; want 160, 4", shard.usage, shard.pinned)
+	}
+
+	// released in order, least recently used evicted
+	for _, h := range handles {
+		h.Release()
+		h.Release()
+	}
+	if shard.usage != 80 || shard.pinned != 0 {
+		t.Errorf("usage %d pinned %d; want 80, 0", shard.usage, shard.pinned)
+	}
+	for n, pos := range positions {
+		h := c.Lookup(file, pos)
+		if (h != nil) != (n >= 2) {
+			t.Errorf("block %d cached %v", n, h != nil)
+		}
+		if h != nil {
+			if h.Value().(uint32) != pos {
+				t.Errorf("block %d value %v", n, h.Value())
+			}
+			h.Release()
+		}
+	}
+
+	// lookup refreshes block, and a pinned block is not evicted
+	pinned := c.Lookup(file, positions[2])
+	c.Insert(file, positions[0], positions[0], 40).Release()
+	c.Insert(file, positions[1], positions[1], 40).Release()
+	if h := c.Lookup(file, positions[3]); h != nil {
+		t.Errorf("block 3 not evicted")
+	}
+	if h := c.Lookup(file, positions[2]); h == nil {
+		t.Errorf("pinned block 2 evicted")
+	} else {
+		h.Release()
+	}
+
+	// replaced block is dropped when released
+	c.Insert(file, positions[2], uint32(0), 40).Release()
+	if pinned.Value().(uint32) != positions[2] {
+		t.Errorf("pinned value %v after replace", pinned.Value())
+	}
+	pinned.Release()
+	if h := c.Lookup(file, positions[2]); h == nil || h.Value().(uint32) != 0 {
+		t.Errorf("replaced block not cached")
+	} else {
+		h.Release()
+	}
+	if shard.usage != 80 || len(shard.entries) != 2 {
+		t.Errorf("usage %d entries %d after replace; want 80, 2", shard.usage, len(shard.entries))
+	}
+
+	// block larger than shard budget is not cached
+	c.Insert(file, positions[3], positions[3], 200).Release()
+	if h := c.Lookup(file, positions[3]); h != nil {
+		t.Errorf("oversized block cached")
+	}
+
+	stats := c.Stats()
+	if stats.Capacity != 100*BLOCK_CACHE_SHARDS || stats.Entries != 2 || stats.Pinned != 0 || stats.Usage != 80 {
+		t.Errorf("stats %+v", stats)
+	}
+	if stats.Hits != 5 || stats.Misses != 5 {
+		t.Errorf("hits %d misses %d; want 5, 5", stats.Hits, stats.Misses)
+	}
+}
+
+func TestBlockCacheConcurrent(t *testing.T) {
+
+	c := NewBlockCache(4096 * BLOCK_CACHE_SHARDS)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(file uint64) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				pos := uint32(i % 100)
+				h := c.Lookup(file%2, pos)
+				if h == nil {
+					h = c.Insert(file%2, pos, pos, 100)
+				}
+				if h.Value().(uint32) != pos {
+					t.Errorf("value %v; want %d", h.Value(), pos)
+				}
+				h.Release()
+			}
+		}(uint64(g))
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	if stats.Pinned != 0 || stats.Usage > stats.Capacity || stats.Hits+stats.Misses != 8000 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSSTableV2BlockCache(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := newTestV2Records()
+	path := dir + "/v2.sst"
+	buildTestSSTableV2(t, path, records, 512)
+
+	table, err := LoadSSTableV2(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewBlockCache(1024 * 1024)
+	table.SetBlockCache(c)
+
+	// first get of each block misses, later gets hit
+	for n := 0; n < 2; n++ {
+		for _, r := range records {
+			group, _ := RecordGroup(r)
+			if got, err := table.Get(r.Key(), group); err != nil || got == nil {
+				t.Fatalf("get [%s] [%s]: %v %v", testKeyString(r.Key()), group, got, err)
+			}
+		}
+	}
+	stats := c.Stats()
+	if stats.Misses != uint64(len(table.index)) || stats.Hits != uint64(2*len(records)-len(table.index)) {
+		t.Errorf("hits %d misses %d with %d blocks", stats.Hits, stats.Misses, len(table.index))
+	}
+	if stats.Entries != len(table.index) || stats.Pinned != 0 {
+		t.Errorf("entries %d pinned %d", stats.Entries, stats.Pinned)
+	}
+
+	// iterator reads through cache
+	if got := len(testRecordStrings(t, table.Iterator())); got != len(records) {
+		t.Errorf("iterated %d records", got)
+	}
+	if c.Stats().Misses != stats.Misses {
+		t.Errorf("iterator missed cache")
+	}
+
+	// blocks of a closed table stay cached, and a reopened table does not
+	// see them
+	table.Close()
+	table, err = LoadSSTableV2(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	table.SetBlockCache(c)
+	if got := len(testRecordStrings(t, table.Iterator())); got != len(records) {
+		t.Errorf("iterated %d records after reopen", got)
+	}
+	if stats := c.Stats(); stats.Misses != 2*uint64(len(table.index)) || stats.Entries != 2*len(table.index) {
+		t.Errorf("misses %d entries %d after reopen with %d blocks", stats.Misses, stats.Entries, len(table.index))
+	}
+
+	// no cache
+	table.SetBlockCache(nil)
+	if got := len(testRecordStrings(t, table.Iterator())); got != len(records) {
+		t.Errorf("iterated %d records without cache", got)
+	}
+}
+
+func TestSSTableV2MaxBlockCached(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	// records of max value length fill blocks past the max block size
+	records := []util.IRecord{}
+	for k := 0; k < 64; k++ {
+		records = append(records, newTestRecord(fmt.Sprintf("key%03d", k), strings.Repeat("v", util.MAX_VALUE_LENGTH-64)))
+	}
+	path := dir + "/v2.sst"
+	buildTestSSTableV2(t, path, records, SSTABLE_MAX_BLOCK_SIZE)
+
+	table, err := LoadSSTableV2(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if len(table.index) < 2 {
+		t.Fatalf("block size not capped: %d blocks", len(table.index))
+	}
+
+	// every block fits a shard of the default budget
+	c := NewBlockCache(BLOCK_CACHE_CAPACITY)
+	table.SetBlockCache(c)
+	for _, r := range records {
+		if got, err := table.Get(r.Key(), ""); err != nil || got == nil {
+			t.Fatalf("get [%s]: %v %v", testKeyString(r.Key()), got, err)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != len(table.index) || stats.Misses != uint64(len(table.index)) {
+		t.Errorf("%d blocks, entries %d misses %d", len(table.index), stats.Entries, stats.Misses)
+	}
+}
@@ -0,0 +1,195 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Checkpoint
+//
+// A checkpoint is a consistent copy of a pdb directory taken while the pdb is
+// open, and opens as a valid PdbV1 elsewhere:
+//
+//   <dir>/journal/           - journal segments copied up to the last commit
+//   <dir>/tables/<table>/    - MANIFEST of a frozen version, and its SSTables
+//
+// SSTables are immutable once written, so files of a frozen manifest version
+// are hard linked, or copied if the checkpoint is on another file system.
+// The version is referenced until the checkpoint is done, so compaction does
+// not delete its files in between.
+//
+// Journal segments are not purged while a checkpoint is taken.  Manifest
+// versions are frozen first, then the journal is copied up to the end of the
+// last commit - records of a table before its flushed seq are in its frozen
+// SSTables, and the rest are replayed from the copied journal.  The journal is
+// copied from the segment holding the oldest entry not yet flushed - the start
+// seq of the oldest memtables of the flusher - as entries before it are in
+// SSTables of every table, including tables with no manifest yet.
+
+// take a checkpoint of the pdb into dir, which must not exist
+func (p *PdbV1) Checkpoint(dir string) error {
+
+	p.mutex.Lock()
+	closed := p.closed
+	p.mutex.Unlock()
+	if closed {
+		return fmt.Errorf("PdbV1::Checkpoint - pdb closed")
+	}
+
+	return p.flusher.Checkpoint(dir)
+}
+
+// take a checkpoint of SSTables and journal into dir, which must not exist
+func (f *Flusher) Checkpoint(dir string) (err error) {
+
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("Flusher::Checkpoint - [%s] already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// journal entries not yet flushed are kept until done
+	f.journal.purge_mutex.Lock()
+	defer f.journal.purge_mutex.Unlock()
+
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return fmt.Errorf("Flusher::Checkpoint - flusher closed")
+	}
+	if f.err != nil {
+		f.mutex.Unlock()
+		return f.err
+	}
+	// manifests of memtables being flushed may not exist yet
+	from_seq := f.active.start_seq
+	if len(f.immutable) > 0 {
+		from_seq = f.immutable[0].start_seq
+	}
+	manifests := map[string]*ManifestV1{}
+	for table, manifest := range f.manifests {
+		manifests[table] = manifest
+	}
+	f.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(dir, TABLES_DIR), 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// freeze manifest versions before the journal is copied
+	for table, manifest := range manifests {
+		v, buf, err := manifest.freeze()
+		if err != nil {
+			return fmt.Errorf("Flusher::Checkpoint - table [%s] - %s", table, err)
+		}
+		defer v.Release()
+
+		if err := checkpoint_manifest(v, buf, table_dir(dir, table)); err != nil {
+			return fmt.Errorf("Flusher::Checkpoint - table [%s] - %s", table, err)
+		}
+	}
+
+	if err := f.journal.checkpoint(filepath.Join(dir, JOURNAL_DIR), from_seq); err != nil {
+		return fmt.Errorf("Flusher::Checkpoint - %s", err)
+	}
+
+	if err := syncDir(filepath.Join(dir, TABLES_DIR)); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// current version with a reference held, and its snapshot
+func (m *ManifestV1) freeze() (*ManifestVersion, []byte, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil, nil, fmt.Errorf("ManifestV1::freeze - manifest closed")
+	}
+
+	m.current.refs++
+
+	return m.current, m.encodeSnapshot(m.current), nil
+}
+
+// copy segments with entries from specified seq, up to the end of the last
+// commit, into dir - caller must hold purge mutex
+func (j *JournalV1) checkpoint(dir string, from_seq uint64) error {
+
+	// segments after current and bytes after size are not yet committed
+	j.mutex.Lock()
+	if j.err != nil {
+		j.mutex.Unlock()
+		return j.err
+	}
+	current := j.segment_num - 1
+	size := int64(j.segment_size)
+	j.mutex.Unlock()
+
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for i, segment := range segments {
+
+		if segment.num > current {
+			break
+		}
+
+		// entries of a segment are before start seq of the next segment
+		if i+1 < len(segments) && segments[i+1].num <= current {
+			next_start_seq, err := j.startSeq(segments[i+1])
+			if err != nil {
+				return err
+			}
+			if next_start_seq <= from_seq {
+				continue
+			}
+		}
+
+		limit := int64(-1)
+		if segment.num == current {
+			limit = size
+		}
+		if err := copyFile(segment.path, filepath.Join(dir, filepath.Base(segment.path)), limit); err != nil {
+			return fmt.Errorf("JournalV1::checkpoint - segment [%s] - %s", segment.path, err)
+		}
+	}
+
+	return syncDir(dir)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// link SSTables of a version into dir, and write its snapshot as MANIFEST
+func checkpoint_manifest(v *ManifestVersion, snapshot []byte, dir string) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range v.files {
+		src := v.FilePath(file.num)
+		if err := linkFile(src, filepath.Join(dir, filepath.Base(src))); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(filepath.Join(dir, MANIFEST_FILENAME), snapshot)
+}
@@ -0,0 +1,217 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"../util"
+)
+
+func TestPdbV1Checkpoint(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	p, err := OpenPdbV1(filepath.Join(dir, "pdb"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.flusher.max_size = 4 * 1024
+	p.flusher.journal.max_segment_size = 4 * 1024
+
+	for i := 0; i < 200; i++ {
+		setTestRecord(t, p, "t1", newTestRecord(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)))
+	}
+	setTestRecord(t, p, "t2", newTestRecord("key", "value"))
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// not flushed, recovered from journal of checkpoint
+	for i := 200; i < 220; i++ {
+		setTestRecord(t, p, "t1", newTestRecord(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)))
+	}
+	setTestRecord(t, p, "t3", newTestRecord("key", "value"))
+
+	cp := filepath.Join(dir, "checkpoint")
+	if err := p.Checkpoint(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Checkpoint(cp); err == nil {
+		t.Errorf("checkpoint into existing dir should fail")
+	}
+
+	// not in checkpoint
+	setTestRecord(t, p, "t1", newTestRecord("key220", "value220"))
+	setTestRecord(t, p, "t2", newTestRecord("key", "changed"))
+
+	// SSTables are linked
+	manifest := p.flusher.Manifest("t1")
+	files := manifest.Files()
+	if len(files) == 0 {
+		t.Fatalf("no SSTable flushed")
+	}
+	src, err := os.Stat(manifest.FilePath(files[0].Num()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Stat(filepath.Join(table_dir(cp, "t1"), filepath.Base(manifest.FilePath(files[0].Num()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(src, dst) {
+		t.Errorf("SSTable not linked")
+	}
+
+	c, err := OpenPdbV1(cp, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 220; i++ {
+		if v := getTestValue(t, c, "t1", fmt.Sprintf("key%03d", i), ""); v != fmt.Sprintf("value%d", i) {
+			t.Errorf("key%03d = %s", i, v)
+		}
+	}
+	if v := getTestValue(t, c, "t1", "key220", ""); v != "<nil>" {
+		t.Errorf("key220 after checkpoint = %s", v)
+	}
+	if v := getTestValue(t, c, "t2", "key", ""); v != "value" {
+		t.Errorf("t2 = %s", v)
+	}
+	if v := getTestValue(t, c, "t3", "key", ""); v != "value" {
+		t.Errorf("t3 = %s", v)
+	}
+
+	// checkpoint writable independently
+	if err := c.Set("t1", util.NewLedgerTime(2), newTestRecord("key000", "new")); err != nil {
+		t.Fatal(err)
+	}
+	if v := getTestValue(t, p, "t1", "key000", ""); v != "value0" {
+		t.Errorf("checkpoint write seen by pdb: %s", v)
+	}
+
+	p.Close()
+	if err := p.Checkpoint(filepath.Join(dir, "closed")); err == nil {
+		t.Errorf("checkpoint of closed pdb should fail")
+	}
+}
+
+func TestPdbV1CheckpointUnflushed(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	p, err := OpenPdbV1(filepath.Join(dir, "pdb"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.flusher.journal.max_segment_size = 4 * 1024
+
+	// t2 has no manifest, over several journal segments
+	for i := 0; i < 100; i++ {
+		setTestRecord(t, p, "t2", newTestRecord(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)))
+	}
+
+	// t1 flushed up to the latest entry, as if flushed before t2 of the same
+	// memtables
+	manifest, err := p.flusher.manifest("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Apply(nil, nil, p.flusher.journal.NextSeq()); err != nil {
+		t.Fatal(err)
+	}
+
+	cp := filepath.Join(dir, "checkpoint")
+	if err := p.Checkpoint(cp); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := OpenPdbV1(cp, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		if v := getTestValue(t, c, "t2", fmt.Sprintf("key%03d", i), ""); v != fmt.Sprintf("value%d", i) {
+			t.Errorf("key%03d = %s", i, v)
+		}
+	}
+}
+
+func TestPdbV1CheckpointConcurrent(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	p, err := OpenPdbV1(filepath.Join(dir, "pdb"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.flusher.max_size = 4 * 1024
+	p.flusher.journal.max_segment_size = 2 * 1024
+
+	// records written in order while flushed, purged and compacted
+	const count = 2000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			table := fmt.Sprintf("t%d", i%3)
+			if err := p.Set(table, util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%04d", i), "value")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	checkpoints := []string{}
+	for n := 0; n < 5; n++ {
+		cp := filepath.Join(dir, fmt.Sprintf("checkpoint%d", n))
+		if err := p.Checkpoint(cp); err != nil {
+			t.Fatal(err)
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	wg.Wait()
+
+	// each checkpoint has a prefix of the records
+	for _, cp := range checkpoints {
+		c, err := OpenPdbV1(cp, consensus_id, "test.domain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := 0
+		for i := 0; i < count; i++ {
+			table := fmt.Sprintf("t%d", i%3)
+			if getTestValue(t, c, table, fmt.Sprintf("key%04d", i), "") == "<nil>" {
+				break
+			}
+			found++
+		}
+		for i := found; i < count; i++ {
+			table := fmt.Sprintf("t%d", i%3)
+			if getTestValue(t, c, table, fmt.Sprintf("key%04d", i), "") != "<nil>" {
+				t.Errorf("%s: key%04d found after missing key%04d", cp, i, found)
+				break
+			}
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,566 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"../collection"
+	"../util"
+)
+
+const (
+	COMPACTION_MAX_LEVELS       = 7
+	COMPACTION_L0_TRIGGER       = 4                         // compact level 0 when it has this many files
+	COMPACTION_LEVEL_BASE_SIZE  = uint64(256 * 1024 * 1024) // max total file size of level 1
+	COMPACTION_LEVEL_MULTIPLIER = 10                        // max total file size grows by this factor per level
+	COMPACTION_KEY_HEADROOM     = uint64(util.MAX_ATTR_GROUPS) * uint64(util.MAX_KEY_LENGTH+util.MAX_VALUE_LENGTH+util.MAX_SCHEME_LENGTH+128)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Leveled Compaction
+//
+// Level 0 SSTables are flushed from memtables, and may overlap with each other.
+// SSTables of level 1 and above do not overlap with others of the same level.
+//
+// A compaction merges SSTables of level n with the overlapping SSTables of
+// level n+1, and writes the result to level n+1:
+//
+//   - level 0 is compacted when it has COMPACTION_L0_TRIGGER or more files,
+//     all level 0 files are merged together
+//   - level n is compacted when its total file size exceeds
+//     COMPACTION_LEVEL_BASE_SIZE * COMPACTION_LEVEL_MULTIPLIER ^ (n-1), the
+//     oldest file of the level is merged
+//
+// Duplicates of the same key and group are resolved by MergeIterator, the
+// record from the newer SSTable wins.
+// CLEAR (tombstone) records are dropped when no deeper level may hold an older
+// record of the same key.  History versions no longer needed for reads within
+// the history window are dropped, see MVCC - a CLEAR version is dropped as
+// well when it is the newest version of its group, and no deeper level may
+// hold the key.  Output is split into files by sstable_writer, between keys
+// where possible, so output files do not overlap - except adjacent files
+// sharing a key with more records than a file has headroom for.
+//
+// Inputs are picked by key range, size and time range of files recorded in
+// the manifest, and only the inputs are opened through the table cache.
+
+type Compactor struct {
+	manifest *ManifestV1
+	mutex    sync.Mutex // one compaction or ingestion at a time
+	// limits
+	l0_trigger      int
+	level_base_size uint64
+	limits          sstable_limits // limits of output files
+	history_window  uint32         // epochs or terms of history retained
+	sstable_version uint32         // version of output files
+}
+
+type compaction_file struct {
+	file   ManifestFile      // with key range and stats
+	table  ISSTable          // nil until acquired
+	handle *TableCacheHandle // holds table open until released
+}
+
+type compaction struct {
+	level   uint32                // input level, output to level+1
+	inputs  [2][]*compaction_file // inputs from level and level+1
+	deeper  []*compaction_file    // files of levels deeper than level+1
+	horizon util.IConsensusTime   // history before horizon may be dropped, nil to keep all
+}
+
+func NewCompactor(manifest *ManifestV1) *Compactor {
+	return &Compactor{
+		manifest:        manifest,
+		l0_trigger:      COMPACTION_L0_TRIGGER,
+		level_base_size: COMPACTION_LEVEL_BASE_SIZE,
+		limits:          new_sstable_limits(),
+		history_window:  MVCC_HISTORY_WINDOW,
+		sstable_version: SSTABLE_VERSION,
+	}
+}
+
+// run compactions until no level needs compaction
+func (c *Compactor) CompactAll() error {
+	for {
+		compacted, err := c.Compact()
+		if err != nil || !compacted {
+			return err
+		}
+	}
+}
+
+// run one compaction if any level needs compaction, returns whether compacted
+func (c *Compactor) Compact() (bool, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// files of the version are kept until compaction is done
+	version := c.manifest.Current()
+	defer version.Release()
+
+	levels, err := compaction_load(version)
+	if err != nil {
+		return false, err
+	}
+
+	comp := c.pick(levels)
+	if comp == nil {
+		return false, nil
+	}
+
+	// history window is relative to the latest time of the table
+	latest, err := compaction_latest_time(levels)
+	if err != nil {
+		return false, err
+	}
+	comp.horizon = history_horizon(latest, c.history_window)
+
+	return true, c.run(comp)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// pick
+
+// files of each level, level 0 sorted newest first, other levels sorted by
+// start key - no table is held open, a file with stats not in manifest is
+// opened once to read them
+func compaction_load(version *ManifestVersion) ([][]*compaction_file, error) {
+
+	levels := make([][]*compaction_file, COMPACTION_MAX_LEVELS)
+
+	for _, file := range version.Files() {
+
+		if file.level >= COMPACTION_MAX_LEVELS {
+			return nil, fmt.Errorf("compaction_load - file %d level %d exceeding %d", file.num, file.level, COMPACTION_MAX_LEVELS)
+		}
+
+		if !file.HasStats() {
+			handle, err := version.manifest.tables.Acquire(version.FilePath(file.num))
+			if err != nil {
+				return nil, err
+			}
+			file, err = NewManifestTableFile(file.level, file.num, handle.Table(), handle.Size())
+			handle.Release()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		levels[file.level] = append(levels[file.level], &compaction_file{file: file})
+	}
+
+	// files with no key range hold no record, and sort first
+	sort.Slice(levels[0], func(a, b int) bool { return levels[0][a].file.num > levels[0][b].file.num })
+	for _, files := range levels[1:] {
+		files := files
+		sort.Slice(files, func(a, b int) bool {
+			if !files[a].file.HasRange() || !files[b].file.HasRange() {
+				return !files[a].file.HasRange() && files[b].file.HasRange()
+			}
+			return files[a].file.start.Compare(files[b].file.start) < 0
+		})
+	}
+
+	return levels, nil
+}
+
+// open tables of files from table cache of the manifest, tables must be
+// released with compaction_close
+func compaction_acquire(manifest *ManifestV1, levels [][]*compaction_file) error {
+
+	for _, files := range levels {
+		for _, f := range files {
+			if f.handle != nil {
+				continue
+			}
+			handle, err := manifest.tables.Acquire(manifest.FilePath(f.file.num))
+			if err != nil {
+				return err
+			}
+			f.handle, f.table = handle, handle.Table()
+		}
+	}
+
+	return nil
+}
+
+// pick the level with highest score, nil if no level needs compaction
+func (c *Compactor) pick(levels [][]*compaction_file) *compaction {
+
+	best_level := -1
+	best_score := 1.0
+
+	for level := 0; level < COMPACTION_MAX_LEVELS-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(levels[0])) / float64(c.l0_trigger)
+		} else {
+			score = float64(compaction_total_size(levels[level])) / float64(c.maxLevelSize(level))
+		}
+		if score >= best_score {
+			best_level = level
+			best_score = score
+		}
+	}
+
+	if best_level < 0 {
+		return nil
+	}
+
+	comp := &compaction{level: uint32(best_level)}
+	if best_level == 0 {
+		comp.inputs[0] = levels[0]
+	} else {
+		// oldest file of the level
+		oldest := levels[best_level][0]
+		for _, f := range levels[best_level] {
+			if f.file.num < oldest.file.num {
+				oldest = f
+			}
+		}
+		comp.inputs[0] = []*compaction_file{oldest}
+	}
+
+	start, end := compaction_range(comp.inputs[0])
+	comp.inputs[1] = compaction_overlaps(levels[best_level+1], start, end)
+	for _, files := range levels[best_level+2:] {
+		comp.deeper = append(comp.deeper, files...)
+	}
+
+	return comp
+}
+
+func (c *Compactor) maxLevelSize(level int) uint64 {
+	size := c.level_base_size
+	for i := 1; i < level; i++ {
+		size *= COMPACTION_LEVEL_MULTIPLIER
+	}
+	return size
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// run
+
+func (c *Compactor) run(comp *compaction) error {
+
+	output_level := comp.level + 1
+	removed := []ManifestFile{}
+	for _, files := range comp.inputs {
+		for _, f := range files {
+			removed = append(removed, f.file)
+		}
+	}
+
+	// move a single file to the next level if nothing to merge with
+	if len(comp.inputs[0]) == 1 && len(comp.inputs[1]) == 0 && !comp.inputs[0][0].file.HasClear() && !compaction_has_history(comp.inputs[0][0].file, comp.horizon) {
+		moved := comp.inputs[0][0].file.atLevel(output_level)
+		return c.manifest.Apply([]ManifestFile{moved}, removed, 0)
+	}
+
+	// only inputs are opened
+	defer compaction_close(comp.inputs[:])
+	if err := compaction_acquire(c.manifest, comp.inputs[:]); err != nil {
+		return err
+	}
+
+	// inputs newest first - level 0 files are already sorted newest first
+	iters := []ISSTableIterator{}
+	for _, files := range comp.inputs {
+		for _, f := range files {
+			iters = append(iters, f.table.Iterator())
+		}
+	}
+	merged := NewMergeIterator(iters)
+
+	first := comp.inputs[0][0].table
+	start_time, end_time, err := compaction_time_range(comp.inputs)
+	if err != nil {
+		return err
+	}
+
+	nums := []uint64{}
+	w := new_sstable_writer(c.limits, func() (ISSTableBuilder, error) {
+		num := c.manifest.NewFileNum()
+		b, err := NewSSTableBuilder(c.sstable_version, c.manifest.FilePath(num), first.ConsensusID(), first.Domain(), first.Table(), output_level, start_time, end_time)
+		if err != nil {
+			return nil, err
+		}
+		nums = append(nums, num)
+		return b, nil
+	})
+	abort := func() {
+		w.abort()
+		for _, num := range nums {
+			os.Remove(c.manifest.FilePath(num))
+		}
+	}
+
+	// write records of one key
+	write := func(records []util.IRecord) error {
+
+		if len(records) == 0 {
+			return nil
+		}
+		deeper := compaction_may_contain(comp.deeper, records[0].Key())
+
+		records, err := compaction_prune_history(records, comp.horizon, deeper)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			// drop tombstone if no deeper level may hold the key
+			if record_is_clear(r) && !deeper {
+				continue
+			}
+			if err := w.add(r); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	records := []util.IRecord{}
+	for merged.HasNext() {
+		r := merged.Next()
+		if len(records) > 0 && !records[0].Key().Equal(r.Key()) {
+			if err := write(records); err != nil {
+				abort()
+				return err
+			}
+			records = records[:0]
+		}
+		records = append(records, r)
+	}
+
+	if merged.Error() != nil {
+		abort()
+		return merged.Error()
+	}
+
+	if err := write(records); err != nil {
+		abort()
+		return err
+	}
+
+	if err := w.finish(); err != nil {
+		abort()
+		return err
+	}
+
+	// key ranges are copied while inputs are open
+	added := []ManifestFile{}
+	for i, num := range nums {
+		output := w.outputs[i]
+		file, err := NewManifestFileRange(output_level, num, output.start, output.end)
+		if err != nil {
+			abort()
+			return err
+		}
+		info, err := os.Stat(c.manifest.FilePath(num))
+		if err == nil {
+			file, err = file.withStats(uint64(info.Size()), start_time, end_time, output.clear)
+		}
+		if err != nil {
+			abort()
+			return err
+		}
+		added = append(added, file)
+	}
+
+	if err := c.manifest.Apply(added, removed, 0); err != nil {
+		abort()
+		return err
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+func compaction_close(levels [][]*compaction_file) {
+	for _, files := range levels {
+		for _, f := range files {
+			f.handle.Release()
+		}
+	}
+}
+
+func compaction_total_size(files []*compaction_file) uint64 {
+	size := uint64(0)
+	for _, f := range files {
+		size += f.file.size
+	}
+	return size
+}
+
+// smallest start key and largest end key of files
+func compaction_range(files []*compaction_file) (util.IKey, util.IKey) {
+
+	var start, end util.IKey
+	for _, f := range files {
+		if !f.file.HasRange() {
+			continue
+		}
+		if start == nil || f.file.start.Compare(start) < 0 {
+			start = f.file.start
+		}
+		if end == nil || f.file.end.Compare(end) > 0 {
+			end = f.file.end
+		}
+	}
+
+	return start, end
+}
+
+// files with key range overlapping [start, end]
+func compaction_overlaps(files []*compaction_file, start, end util.IKey) []*compaction_file {
+
+	result := []*compaction_file{}
+	if collection.IsNil(start) || collection.IsNil(end) {
+		return result
+	}
+
+	for _, f := range files {
+		if !f.file.HasRange() {
+			continue
+		}
+		if f.file.end.Compare(start) < 0 || f.file.start.Compare(end) > 0 {
+			continue
+		}
+		result = append(result, f)
+	}
+
+	return result
+}
+
+// whether any file may hold the key
+func compaction_may_contain(files []*compaction_file, key util.IKey) bool {
+	return len(compaction_overlaps(files, key, key)) > 0
+}
+
+// whether file may hold history at or before horizon to drop
+func compaction_has_history(file ManifestFile, horizon util.IConsensusTime) bool {
+
+	if horizon == nil || collection.IsNil(file.start_time) {
+		return false
+	}
+
+	le, err := file.start_time.LE(horizon)
+
+	return err != nil || le
+}
+
+// latest end time of all files, nil if no file
+func compaction_latest_time(levels [][]*compaction_file) (util.IConsensusTime, error) {
+
+	var latest util.IConsensusTime
+	for _, files := range levels {
+		for _, f := range files {
+			if latest == nil {
+				latest = f.file.end_time
+			} else if gt, err := f.file.end_time.GT(latest); err != nil {
+				return nil, err
+			} else if gt {
+				latest = f.file.end_time
+			}
+		}
+	}
+
+	return latest, nil
+}
+
+// versions of each group older than the newest version at or before horizon
+// are dropped, and the newest version itself if it is CLEAR, no newer version
+// exists, and deeper levels may not hold the key - records are of one key
+func compaction_prune_history(records []util.IRecord, horizon util.IConsensusTime, deeper bool) ([]util.IRecord, error) {
+
+	if horizon == nil {
+		return records, nil
+	}
+
+	// newest version of each group at or before horizon
+	versions := new_history_versions(horizon)
+	for _, r := range records {
+		if _, err := versions.add(r); err != nil {
+			return nil, err
+		}
+	}
+	if len(versions.versions) == 0 {
+		return records, nil
+	}
+
+	result := []util.IRecord{}
+	cleared := map[string]int{} // index in result of kept CLEAR versions
+	for _, r := range records {
+		v, err := record_history(r)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			if keep, ok := versions.versions[v.group]; ok {
+				c, err := v.compare(keep)
+				if err != nil {
+					return nil, err
+				}
+				if c < 0 {
+					continue
+				} else if c > 0 {
+					// newer version within window, CLEAR version is kept
+					delete(cleared, v.group)
+				} else if keep.clear && !deeper {
+					cleared[v.group] = len(result)
+				}
+			}
+		}
+		result = append(result, r)
+	}
+
+	if len(cleared) == 0 {
+		return result, nil
+	}
+
+	dropped := map[int]bool{}
+	for _, idx := range cleared {
+		dropped[idx] = true
+	}
+	pruned := []util.IRecord{}
+	for idx, r := range result {
+		if !dropped[idx] {
+			pruned = append(pruned, r)
+		}
+	}
+
+	return pruned, nil
+}
+
+// earliest start time and latest end time of files
+func compaction_time_range(inputs [2][]*compaction_file) (util.IConsensusTime, util.IConsensusTime, error) {
+
+	var start, end util.IConsensusTime
+	for _, files := range inputs {
+		for _, f := range files {
+			if start == nil {
+				start, end = f.file.start_time, f.file.end_time
+				continue
+			}
+			if lt, err := f.file.start_time.LT(start); err != nil {
+				return nil, nil, err
+			} else if lt {
+				start = f.file.start_time
+			}
+			if gt, err := f.file.end_time.GT(end); err != nil {
+				return nil, nil, err
+			} else if gt {
+				end = f.file.end_time
+			}
+		}
+	}
+
+	return start, end, nil
+}
@@ -0,0 +1,418 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// test utilities
+
+func newTestTimestampRecord(key, value string, ts int64) util.IRecord {
+	t := time.Unix(0, ts)
+	r := util.NewRecord().SetK([]byte(key)).SetV([]byte(value)).SetTimestamp(&t)
+	if err := r.Encode(nil); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// tombstone record, with CLEAR flag set
+func newTestClearRecord(key string, ts int64) util.IRecord {
+	t := time.Unix(0, ts)
+	r := util.NewRecord().SetKey(newTestKey(key)).SetTimestamp(&t).SetClear(true)
+	if err := r.Encode(nil); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func newTestMemTable(records []util.IRecord) *MemTableV1 {
+	m := NewMemTableV1(newTestConsensusID(), "test.domain", "test.table")
+	for _, r := range records {
+		if err := m.Set(r); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// add a SSTable file with specified records to manifest, with its key range
+func addTestSSTable(t testing.TB, manifest *ManifestV1, consensus_id util.IConsensusID, level uint32, records []util.IRecord) {
+	num := manifest.NewFileNum()
+	buildTestSSTable(t, manifest.FilePath(num), consensus_id, records)
+	info, err := os.Stat(manifest.FilePath(num))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadSSTable(manifest.FilePath(num))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewManifestTableFile(level, num, table, uint64(info.Size()))
+	table.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Apply([]ManifestFile{file}, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// all records of manifest files at each level
+func readTestManifest(t testing.TB, manifest *ManifestV1) map[uint32][]util.IRecord {
+	result := map[uint32][]util.IRecord{}
+	for _, file := range manifest.Files() {
+		table, err := LoadSSTable(manifest.FilePath(file.Num()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, _, err := table.Read(0, ^uint32(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// copy records before unmap
+		for _, r := range records {
+			copied, _, err := util.NewMappedRecord(append([]byte{}, r.Buf()...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result[file.Level()] = append(result[file.Level()], copied)
+		}
+		table.Close()
+	}
+	return result
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestMergeIterator(t *testing.T) {
+
+	newer := newTestMemTable([]util.IRecord{
+		newTestTimestampRecord("a", "a-newer", 10),
+		newTestTimestampRecord("c", "c-newer", 10),
+		newTestTimestampRecord("e", "e-newer", 10),
+		newTestRecord("g", "g-newer"),
+		newTestClearRecord("h", 1),
+	})
+	older := newTestMemTable([]util.IRecord{
+		newTestTimestampRecord("a", "a-older", 5),
+		newTestTimestampRecord("b", "b-older", 5),
+		newTestTimestampRecord("c", "c-older", 20), // newer input wins over later timestamp
+		newTestRecord("g", "g-older"),
+		newTestTimestampRecord("h", "h-older", 20),
+		newTestRecord("i", "i-older"),
+	})
+
+	iter := NewMergeIterator([]ISSTableIterator{newer.Iterator(), older.Iterator()})
+
+	got := []string{}
+	for iter.HasNext() {
+		r := iter.Next()
+		if record_is_clear(r) {
+			got = append(got, "<clear>")
+			continue
+		}
+		got = append(got, string(r.Value().Value()))
+	}
+	if iter.Error() != nil {
+		t.Fatal(iter.Error())
+	}
+
+	want := "[a-newer b-older c-newer e-newer g-newer <clear> i-older]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got %v; want %s", got, want)
+	}
+}
+
+func TestCompactorLevel0(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus_id := newTestConsensusID()
+
+	// deeper level holds key002 and key004
+	addTestSSTable(t, manifest, consensus_id, 2, []util.IRecord{
+		newTestTimestampRecord("key002", "level2", 1),
+		newTestTimestampRecord("key004", "level2", 1),
+	})
+
+	// overlapping level 0 files, newer files added later
+	for i := 0; i < COMPACTION_L0_TRIGGER; i++ {
+		records := []util.IRecord{}
+		for k := i; k < 10; k++ {
+			records = append(records, newTestTimestampRecord(fmt.Sprintf("key%03d", k), fmt.Sprintf("value%d", i), int64(100+i)))
+		}
+		addTestSSTable(t, manifest, consensus_id, 0, records)
+	}
+
+	// tombstones in the newest level 0 file
+	addTestSSTable(t, manifest, consensus_id, 0, []util.IRecord{
+		newTestClearRecord("key001", 200),
+		newTestClearRecord("key002", 200),
+	})
+
+	c := NewCompactor(manifest)
+	c.limits.split_records = 3
+	compacted, err := c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compacted {
+		t.Fatalf("level 0 not compacted")
+	}
+
+	levels := readTestManifest(t, manifest)
+	if len(levels[0]) != 0 {
+		t.Errorf("level 0 not empty: %d", len(levels[0]))
+	}
+
+	got := []string{}
+	for _, r := range levels[1] {
+		if record_is_clear(r) {
+			got = append(got, string(r.Key().Key()[0])+"=CLEAR")
+		} else {
+			got = append(got, string(r.Key().Key()[0])+"="+string(r.Value().Value()))
+		}
+	}
+
+	// key001 tombstone dropped, key002 tombstone kept for level 2
+	want := "[key000=value0 key002=CLEAR key003=value3 key004=value3 key005=value3 key006=value3 key007=value3 key008=value3 key009=value3]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got %v; want %s", got, want)
+	}
+
+	// output is split into non overlapping files
+	files := 0
+	for _, file := range manifest.Files() {
+		if file.Level() == 1 {
+			files++
+		}
+	}
+	if files != 3 {
+		t.Errorf("level 1 files not match: %d", files)
+	}
+
+	if compacted, err := c.Compact(); err != nil || compacted {
+		t.Errorf("no more compaction expected: %v, %v", compacted, err)
+	}
+}
+
+func TestCompactorLevelSize(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus_id := newTestConsensusID()
+
+	addTestSSTable(t, manifest, consensus_id, 1, []util.IRecord{
+		newTestTimestampRecord("key000", "level1", 2),
+		newTestTimestampRecord("key005", "level1", 2),
+	})
+	addTestSSTable(t, manifest, consensus_id, 1, []util.IRecord{
+		newTestTimestampRecord("key010", "level1", 2),
+	})
+	addTestSSTable(t, manifest, consensus_id, 2, []util.IRecord{
+		newTestTimestampRecord("key003", "level2", 1),
+		newTestTimestampRecord("key005", "level2", 1),
+	})
+
+	c := NewCompactor(manifest)
+	c.level_base_size = 1
+	if err := c.CompactAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// all records cascade to the first level within its size limit
+	levels := readTestManifest(t, manifest)
+	if len(levels) != 1 {
+		t.Errorf("records at %d levels", len(levels))
+	}
+	if len(levels[1]) != 0 || len(levels[2]) != 0 {
+		t.Errorf("level 1 or 2 not empty: %d, %d", len(levels[1]), len(levels[2]))
+	}
+
+	// newer record wins
+	values := map[string]string{}
+	for _, records := range levels {
+		for _, r := range records {
+			values[string(r.Key().Key()[0])] = string(r.Value().Value())
+		}
+	}
+	want := "map[key000:level1 key003:level2 key005:level1 key010:level1]"
+	if fmt.Sprint(values) != want {
+		t.Errorf("got %v; want %s", values, want)
+	}
+}
+
+func TestCompactorKeyAcrossFiles(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus_id := newTestConsensusID()
+
+	// a hot key with more versions than a file has headroom for
+	versions := util.MAX_ATTR_GROUPS + 10
+	hot := []util.IRecord{newTestRecord("key001", "latest")}
+	for epoch := 1; epoch <= versions; epoch++ {
+		h, err := NewHistoryRecord(newTestRecord("key001", fmt.Sprintf("v%d", epoch)), util.NewLedgerTime(uint32(epoch)), uint64(epoch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hot = append(hot, h)
+	}
+	addTestSSTable(t, manifest, consensus_id, 0, hot)
+	for i := 1; i < COMPACTION_L0_TRIGGER; i++ {
+		addTestSSTable(t, manifest, consensus_id, 0, []util.IRecord{
+			newTestRecord("key000", fmt.Sprintf("value%d", i)),
+			newTestRecord("key002", fmt.Sprintf("value%d", i)),
+		})
+	}
+
+	// the hot key lands at the file boundary
+	c := NewCompactor(manifest)
+	c.limits.split_records = 2
+	c.limits.max_records = util.MAX_ATTR_GROUPS
+	if err := c.CompactAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	levels := readTestManifest(t, manifest)
+	if len(levels[0]) != 0 || len(levels[1]) != versions+3 {
+		t.Errorf("records at level 0: %d, level 1: %d", len(levels[0]), len(levels[1]))
+	}
+	files := 0
+	for _, file := range manifest.Files() {
+		table, err := LoadSSTable(manifest.FilePath(file.Num()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Count() > util.MAX_ATTR_GROUPS {
+			t.Errorf("file %d with %d records", file.Num(), table.Count())
+		}
+		table.Close()
+		files++
+	}
+	if files < 3 {
+		t.Errorf("hot key not split: %d files", files)
+	}
+
+	// the next compaction merges files sharing the key again
+	c.level_base_size = 1
+	if err := c.CompactAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := tablet_open_view(nil, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.release()
+	for _, tt := range []struct {
+		key   string
+		epoch uint32
+		want  string
+	}{
+		{"key000", 0, "value3"},
+		{"key001", 0, "latest"},
+		{"key001", 1, "v1"},
+		{"key001", uint32(versions), fmt.Sprintf("v%d", versions)},
+		{"key002", 0, "value3"},
+	} {
+		var r util.IRecord
+		if tt.epoch == 0 {
+			r, err = view.get(newTestKey(tt.key), "")
+		} else {
+			r, err = view.getAsOf(newTestKey(tt.key), "", util.NewLedgerTime(tt.epoch))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil || string(r.Value().Value()) != tt.want {
+			t.Errorf("%s as of %d = %v; want %s", tt.key, tt.epoch, r, tt.want)
+		}
+	}
+}
+
+func TestCompactorClearHistory(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus_id := newTestConsensusID()
+
+	history := func(r util.IRecord, epoch uint32) util.IRecord {
+		h, err := NewHistoryRecord(r, util.NewLedgerTime(epoch), uint64(epoch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	// deeper level holds key002
+	addTestSSTable(t, manifest, consensus_id, 2, []util.IRecord{
+		newTestRecord("key002", "level2"),
+	})
+
+	// key000 and key002 set then cleared, key001 set
+	addTestSSTable(t, manifest, consensus_id, 0, []util.IRecord{
+		newTestRecord("key000", "v1"),
+		history(newTestRecord("key000", "v1"), 1),
+		newTestRecord("key001", "v1"),
+		history(newTestRecord("key001", "v1"), 1),
+		newTestRecord("key002", "v1"),
+		history(newTestRecord("key002", "v1"), 1),
+	})
+	addTestSSTable(t, manifest, consensus_id, 0, []util.IRecord{
+		newTestClearRecord("key000", 2),
+		history(newTestClearRecord("key000", 2), 2),
+		newTestClearRecord("key002", 2),
+		history(newTestClearRecord("key002", 2), 2),
+	})
+	for i := 2; i < COMPACTION_L0_TRIGGER; i++ {
+		addTestSSTable(t, manifest, consensus_id, 0, []util.IRecord{
+			newTestRecord("key003", fmt.Sprintf("value%d", i)),
+		})
+	}
+
+	// window passed all versions
+	c := NewCompactor(manifest)
+	c.history_window = 0
+	if compacted, err := c.Compact(); err != nil || !compacted {
+		t.Fatalf("level 0 not compacted: %v, %v", compacted, err)
+	}
+
+	got := map[string]int{}
+	for _, r := range readTestManifest(t, manifest)[1] {
+		got[string(r.Key().Key()[0])]++
+	}
+
+	// cleared key000 leaves no record, key002 keeps tombstone and CLEAR
+	// version for level 2
+	if fmt.Sprint(got) != "map[key001:2 key002:2 key003:1]" {
+		t.Errorf("records at level 1 %v", got)
+	}
+}
@@ -1,6 +1,12 @@
 package pdb
 
 import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"../collection"
 	"../util"
 )
 
@@ -10,11 +16,383 @@ type IPdb interface {
 	ConsensusID() util.IConsensusID // Consensus ID
 	Domain() string                 // Domain Name
 	// operations
-	Get(table string, key util.IData, group string) util.IRecord
-	Set(table string, record util.IRecord) error
-	Groups(table string, key, scheme util.IData) util.IData
-	Keys(table string, key, scheme util.IData) util.IData
+	Get(table string, key util.IKey, group string) (util.IRecord, error) // get record with specified key and attribute group
+	Set(table string, time util.IConsensusTime, record util.IRecord) error
+	TestSet(table string, time util.IConsensusTime, record util.IRecord, test_millis uint32) error // set record if test passes
+	Write(time util.IConsensusTime, batch *WriteBatch) error                                       // set records of tables atomically
+	Checkpoint(dir string) error                                                                   // consistent copy of pdb into dir
+	Groups(table string, key util.IKey) ([]string, error)
+	Keys(table string, key util.IKey) ([]util.IKey, error)
+	// reads as of consensus time
+	GetAsOf(table string, key util.IKey, group string, time util.IConsensusTime) (util.IRecord, error)
+	KeysAsOf(table string, key util.IKey, time util.IConsensusTime) ([]util.IKey, error)
+	// Close the resource
+	Close() error
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// Implementation V1
+//
+// PdbV1 is a local key value store of a consensus ID and domain, with one
+// journal shared by all tables.  Set goes through the Flusher - appended to
+// the journal, applied to the memtable of the table, and flushed to level 0
+// SSTables in background.  Write of a WriteBatch sets records of any tables
+// as one journal entry, all or nothing.  Flushed tables are compacted by a
+// background goroutine.  Checkpoint copies the pdb into a directory while
+// open, which opens as a PdbV1 with all records committed before the
+// checkpoint.
+//
+// Reads go through the Tablet of the table - Get consults memtables newest
+// first, then SSTables newest first - level 0 files from newest to oldest,
+// then the file holding the key at each deeper level.  The first record found
+// wins, and a CLEAR record hides older ones.  Records and keys returned are
+// copies, and remain valid after SSTables are compacted away.
+
 type PdbV1 struct {
+	// basic attributes
+	dir          string
+	consensus_id util.IConsensusID
+	domain       string
+	flusher      *Flusher
+	// epochs or terms of history retained, 0 if history is disabled
+	history_window uint32
+	// version of SSTables written
+	sstable_version uint32
+	// writes of a table, exclusive for TestSet
+	locks_mutex sync.Mutex
+	locks       map[string]*sync.RWMutex
+	// background compaction, guarded by mutex
+	mutex      sync.Mutex
+	compactors map[string]*Compactor
+	pending    map[string]bool // tables to compact
+	compact_ch chan struct{}
+	done       chan struct{}
+	closed     bool
+}
+
+// options of a pdb, fixed once the pdb is opened
+type PdbOptions struct {
+	HistoryWindow  uint32 // epochs or terms of history retained for reads as of time, 0 to disable history
+	SSTableVersion uint32 // version of SSTables written by flush and compaction, files of any version are read
+}
+
+func DefaultPdbOptions() *PdbOptions {
+	return &PdbOptions{HistoryWindow: MVCC_HISTORY_WINDOW, SSTableVersion: SSTABLE_VERSION}
+}
+
+// open pdb with default options
+func OpenPdbV1(dir string, consensus_id util.IConsensusID, domain string) (*PdbV1, error) {
+	return OpenPdbV1WithOptions(dir, consensus_id, domain, DefaultPdbOptions())
+}
+
+func OpenPdbV1WithOptions(dir string, consensus_id util.IConsensusID, domain string, options *PdbOptions) (*PdbV1, error) {
+
+	if collection.IsNil(consensus_id) {
+		return nil, fmt.Errorf("OpenPdbV1 - consensus id is nil")
+	}
+	if options == nil {
+		return nil, fmt.Errorf("OpenPdbV1 - options is nil")
+	}
+	if options.SSTableVersion != 1 && options.SSTableVersion != 2 {
+		return nil, fmt.Errorf("OpenPdbV1 - unsupported SSTable version %d", options.SSTableVersion)
+	}
+
+	flusher, err := openFlusher(dir, consensus_id, domain, options)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PdbV1{
+		dir:             dir,
+		consensus_id:    consensus_id,
+		domain:          domain,
+		flusher:         flusher,
+		locks:           map[string]*sync.RWMutex{},
+		compactors:      map[string]*Compactor{},
+		pending:         map[string]bool{},
+		compact_ch:      make(chan struct{}, 1),
+		done:            make(chan struct{}),
+		history_window:  options.HistoryWindow,
+		sstable_version: options.SSTableVersion,
+	}
+
+	flusher.OnFlush(p.schedule)
+
+	go p.compactor()
+
+	// tables may need compaction left from last run
+	for _, table := range flusher.Tables() {
+		p.schedule(table)
+	}
+
+	return p, nil
+}
+
+// open pdb under the data dir of consensus ID and domain on node
+func OpenNodePdbV1(node_id string, consensus_id util.IConsensusID, domain string) (*PdbV1, error) {
+
+	if collection.IsNil(consensus_id) {
+		return nil, fmt.Errorf("OpenNodePdbV1 - consensus id is nil")
+	}
+
+	return OpenPdbV1(util.LCGetConsensusDir(node_id, domain, consensus_id), consensus_id, domain)
+}
+
+func (p *PdbV1) Version() uint32 {
+	return 1
+}
+
+func (p *PdbV1) ConsensusID() util.IConsensusID {
+	return p.consensus_id
+}
+
+func (p *PdbV1) Domain() string {
+	return p.domain
+}
+
+func (p *PdbV1) Dir() string {
+	return p.dir
+}
+
+// tablet of a table
+func (p *PdbV1) Tablet(table string) (*Tablet, error) {
+
+	if err := flush_check_table(table); err != nil {
+		return nil, fmt.Errorf("PdbV1::Tablet - %s", err)
+	}
+
+	return &Tablet{pdb: p, table: table}, nil
+}
+
+// set record of a table at consensus time, returns after record is durable in journal
+func (p *PdbV1) Set(table string, time util.IConsensusTime, record util.IRecord) error {
+
+	t, err := p.Tablet(table)
+	if err != nil {
+		return err
+	}
+
+	return t.Set(time, record)
+}
+
+// set record of a table at consensus time if it passes the test against the
+// current record, returns *TestConflictError if the test fails
+func (p *PdbV1) TestSet(table string, time util.IConsensusTime, record util.IRecord, test_millis uint32) error {
+
+	t, err := p.Tablet(table)
+	if err != nil {
+		return err
+	}
+
+	return t.TestSet(time, record, test_millis)
+}
+
+// set records of all tables of a batch atomically at consensus time, returns
+// after records are durable in journal
+func (p *PdbV1) Write(time util.IConsensusTime, batch *WriteBatch) error {
+
+	if collection.IsNil(time) {
+		return fmt.Errorf("PdbV1::Write - time is nil")
+	}
+	if batch == nil {
+		return fmt.Errorf("PdbV1::Write - batch is nil")
+	}
+
+	tables := batch.Tables()
+	for _, table := range tables {
+		if err := flush_check_table(table); err != nil {
+			return fmt.Errorf("PdbV1::Write - %s", err)
+		}
+	}
+
+	// no TestSet of any table in between, locks taken in order of table
+	sort.Strings(tables)
+	for _, table := range tables {
+		lock := p.lock(table)
+		lock.RLock()
+		defer lock.RUnlock()
+	}
+
+	return p.flusher.WriteBatch(time, batch)
+}
+
+// get record with specified key and group, return nil if not found
+func (p *PdbV1) Get(table string, key util.IKey, group string) (util.IRecord, error) {
+
+	t, err := p.Tablet(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Get(key, group)
+}
+
+// list of groups under specified key, maximum MAX_ATTR_GROUPS groups
+func (p *PdbV1) Groups(table string, key util.IKey) ([]string, error) {
+
+	t, err := p.Tablet(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Groups(key)
+}
+
+// list of child keys with specified key as prefix
+func (p *PdbV1) Keys(table string, key util.IKey) ([]util.IKey, error) {
+
+	t, err := p.Tablet(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Keys(key)
+}
+
+// get record with specified key and group as of consensus time
+func (p *PdbV1) GetAsOf(table string, key util.IKey, group string, time util.IConsensusTime) (util.IRecord, error) {
+
+	t, err := p.Tablet(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.GetAsOf(key, group, time)
+}
+
+// list of child keys with specified key as prefix, as of consensus time
+func (p *PdbV1) KeysAsOf(table string, key util.IKey, time util.IConsensusTime) ([]util.IKey, error) {
+
+	t, err := p.Tablet(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.KeysAsOf(key, time)
+}
+
+// write lock of a table
+func (p *PdbV1) lock(table string) *sync.RWMutex {
+
+	p.locks_mutex.Lock()
+	defer p.locks_mutex.Unlock()
+
+	lock, ok := p.locks[table]
+	if !ok {
+		lock = &sync.RWMutex{}
+		p.locks[table] = lock
+	}
+
+	return lock
+}
+
+// flush all memtables to SSTables
+func (p *PdbV1) Flush() error {
+	return p.flusher.Flush()
+}
+
+// stop background compaction, and close journal - records not flushed are
+// recovered from journal on next open
+func (p *PdbV1) Close() error {
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.compact_ch)
+	p.mutex.Unlock()
+
+	<-p.done
+
+	return p.flusher.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Background compaction
+
+// schedule compaction of a table
+func (p *PdbV1) schedule(table string) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	p.pending[table] = true
+
+	select {
+	case p.compact_ch <- struct{}{}:
+	default:
+	}
+}
+
+func (p *PdbV1) compactor() {
+
+	defer close(p.done)
+
+	for range p.compact_ch {
+		for {
+			p.mutex.Lock()
+			if p.closed || len(p.pending) == 0 {
+				p.mutex.Unlock()
+				break
+			}
+			var table string
+			for table = range p.pending {
+				break
+			}
+			delete(p.pending, table)
+			p.mutex.Unlock()
+
+			if err := p.compact(table); err != nil {
+				log.Printf("PdbV1::compactor - table [%s] - %s", table, err)
+			}
+		}
+	}
+}
+
+// run compactions of a table until no level needs compaction, or pdb closed
+func (p *PdbV1) compact(table string) error {
+
+	manifest := p.flusher.Manifest(table)
+	if manifest == nil {
+		return nil
+	}
+
+	c := p.tableCompactor(table, manifest)
+
+	for {
+		p.mutex.Lock()
+		closed := p.closed
+		p.mutex.Unlock()
+		if closed {
+			return nil
+		}
+
+		compacted, err := c.Compact()
+		if err != nil || !compacted {
+			return err
+		}
+	}
+}
+
+// compactor of a table, created if not exist
+func (p *PdbV1) tableCompactor(table string, manifest *ManifestV1) *Compactor {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	c, ok := p.compactors[table]
+	if !ok {
+		c = NewCompactor(manifest)
+		c.history_window = p.history_window
+		c.sstable_version = p.sstable_version
+		p.compactors[table] = c
+	}
+
+	return c
 }
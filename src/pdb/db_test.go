@@ -0,0 +1,318 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// test utilities
+
+func setTestRecord(t testing.TB, p IPdb, table string, r util.IRecord) {
+	if err := p.Set(table, util.NewLedgerTime(1), r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// value of a record in pdb, "<nil>" if not found
+func getTestValue(t testing.TB, p IPdb, table, key, group string) string {
+	r, err := p.Get(table, newTestKey(key), group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil {
+		return "<nil>"
+	}
+	return string(r.Value().Value())
+}
+
+// wait for background compaction of level 0
+func waitTestCompaction(t testing.TB, manifest *ManifestV1) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		level0 := 0
+		for _, file := range manifest.Files() {
+			if file.Level() == 0 {
+				level0++
+			}
+		}
+		if level0 < COMPACTION_L0_TRIGGER {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("level 0 not compacted: %d files", level0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testKeyStrings(keys []util.IKey) string {
+	result := []string{}
+	for _, k := range keys {
+		result = append(result, testKeyString(k))
+	}
+	return fmt.Sprint(result)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestPdbV1(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	p, err := OpenPdbV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setTestRecord(t, p, "table1", newTestRecord("a", "a1"))
+	setTestRecord(t, p, "table1", newTestGroupRecord("a", "x/y", "a-xy"))
+	setTestRecord(t, p, "table1", newTestGroupRecord("a/b", "", "ab1"))
+	setTestRecord(t, p, "table1", newTestGroupRecord("a/c", "", "ac1"))
+	setTestRecord(t, p, "table2", newTestRecord("a", "table2"))
+
+	if v := getTestValue(t, p, "table1", "a", ""); v != "a1" {
+		t.Errorf("memtable value %s; want a1", v)
+	}
+
+	// SSTable is consulted after memtable
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	setTestRecord(t, p, "table1", newTestGroupRecord("a/b", "", "ab2"))
+
+	checks := [][]string{
+		{"table1", "a", "", "a1"},
+		{"table1", "a", "x/y", "a-xy"},
+		{"table1", "a/b", "", "ab2"},
+		{"table1", "a/c", "", "ac1"},
+		{"table1", "a/d", "", "<nil>"},
+		{"table2", "a", "", "table2"},
+		{"table3", "a", "", "<nil>"},
+	}
+	check := func(p IPdb) {
+		for _, c := range checks {
+			if v := getTestValue(t, p, c[0], c[1], c[2]); v != c[3] {
+				t.Errorf("%s [%s] [%s] value %s; want %s", c[0], c[1], c[2], v, c[3])
+			}
+		}
+	}
+	check(p)
+
+	groups, err := p.Groups("table1", newTestKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[ x/y]" {
+		t.Errorf("groups %q; want [ x/y]", groups)
+	}
+
+	keys, err := p.Keys("table1", newTestKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testKeyStrings(keys) != "[a/b a/c]" {
+		t.Errorf("keys %s; want [a/b a/c]", testKeyStrings(keys))
+	}
+
+	if _, err := p.Get("../table", newTestKey("a"), ""); err == nil {
+		t.Errorf("invalid table name should fail")
+	}
+
+	// records not flushed are recovered from journal
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err = OpenPdbV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	check(p)
+}
+
+func TestPdbV1Clear(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	setTestRecord(t, p, "table", newTestRecord("a", "a1"))
+	setTestRecord(t, p, "table", newTestGroupRecord("a/b", "", "ab1"))
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// tombstones in memtable hide records in SSTable
+	setTestRecord(t, p, "table", newTestClearRecord("a", time.Now().UnixNano()))
+	setTestRecord(t, p, "table", newTestClearRecord("a/b", time.Now().UnixNano()))
+
+	if v := getTestValue(t, p, "table", "a", ""); v != "<nil>" {
+		t.Errorf("cleared value %s", v)
+	}
+
+	groups, err := p.Groups("table", newTestKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 0 {
+		t.Errorf("cleared groups %q", groups)
+	}
+
+	keys, err := p.Keys("table", newTestKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("cleared keys %s", testKeyStrings(keys))
+	}
+}
+
+func TestPdbV1SSTableVersion(t *testing.T) {
+
+	// SSTableV1 by default, SSTableV2 opt in
+	for _, version := range []uint32{0, 2} {
+
+		dir := newTestDir(t)
+		defer os.RemoveAll(dir)
+
+		options := DefaultPdbOptions()
+		if version != 0 {
+			options.SSTableVersion = version
+		}
+		p, err := OpenPdbV1WithOptions(dir, newTestConsensusID(), "test.domain", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setTestRecord(t, p, "table", newTestRecord("key", "value"))
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		manifest := p.flusher.Manifest("table")
+		table, err := LoadSSTable(manifest.FilePath(manifest.Files()[0].Num()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Version() != options.SSTableVersion {
+			t.Errorf("SSTable version %d; want %d", table.Version(), options.SSTableVersion)
+		}
+		table.Close()
+		p.Close()
+	}
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	options := DefaultPdbOptions()
+	options.SSTableVersion = 3
+	if _, err := OpenPdbV1WithOptions(dir, newTestConsensusID(), "test.domain", options); err == nil {
+		t.Errorf("unsupported SSTable version should fail")
+	}
+}
+
+func TestPdbV1Compaction(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// each flush writes a level 0 file, newer values overwrite older
+	for i := 0; i < COMPACTION_L0_TRIGGER+1; i++ {
+		for k := 0; k < 10; k++ {
+			setTestRecord(t, p, "table", newTestRecord(fmt.Sprintf("key%03d", k), fmt.Sprintf("value%d", i)))
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitTestCompaction(t, p.flusher.Manifest("table"))
+
+	want := fmt.Sprintf("value%d", COMPACTION_L0_TRIGGER)
+	for k := 0; k < 10; k++ {
+		if v := getTestValue(t, p, "table", fmt.Sprintf("key%03d", k), ""); v != want {
+			t.Errorf("key%03d value %s; want %s", k, v, want)
+		}
+	}
+}
+
+func TestPdbV1ClearCompaction(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// tombstone applied later masks the record, even with an earlier timestamp
+	setTestRecord(t, p, "table", newTestTimestampRecord("a", "a1", time.Now().Add(time.Hour).UnixNano()))
+	setTestRecord(t, p, "table", newTestGroupRecord("b", "x", "bx1"))
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	setTestRecord(t, p, "table", newTestClearRecord("a", 1))
+	setTestRecord(t, p, "table", newTestClearRecord("b", 1))
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < COMPACTION_L0_TRIGGER; i++ {
+		setTestRecord(t, p, "table", newTestRecord(fmt.Sprintf("key%03d", i), "v"))
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest := p.flusher.Manifest("table")
+	waitTestCompaction(t, manifest)
+
+	if v := getTestValue(t, p, "table", "a", ""); v != "<nil>" {
+		t.Errorf("cleared value %s after compaction", v)
+	}
+	if v := getTestValue(t, p, "table", "b", "x"); v != "bx1" {
+		t.Errorf("value of group not cleared %s; want bx1", v)
+	}
+	groups, err := p.Groups("table", newTestKey("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[x]" {
+		t.Errorf("groups %q; want [x]", groups)
+	}
+
+	// no deeper level holds the keys, tombstones are collected
+	version := manifest.Current()
+	defer version.Release()
+	levels, err := compaction_load(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, files := range levels {
+		for _, f := range files {
+			if f.file.HasClear() {
+				t.Errorf("tombstone left in level %d", f.file.Level())
+			}
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package pdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"../collection"
+	"../util"
+)
+
+const (
+	JOURNAL_DIR = "journal"
+	TABLES_DIR  = "tables"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Flusher
+//
+// Flusher is the write path of a pdb directory:
+//
+//   pdb log ---> active memtables ---> immutable memtables ---> level 0 SSTables
+//
+// Records are appended to the journal first, and applied to the active
+// memtable of their table by the journal commit hook, in order of journal seq,
+// each with its history record for MVCC reads unless history is disabled.
+// Records of all tables of a WriteBatch are applied together, and never split
+// by a rotation.  When the active memtables together exceed the size
+// threshold, they are rotated as one set and queued for flush.  A background
+// goroutine writes each non empty memtable of the oldest set to a level 0
+// SSTable, records the file in the manifest of its table, and only then
+// purges journal segments with entries all flushed.
+//
+// Directory layout:
+//
+//   <dir>/journal/           - journal segments
+//   <dir>/tables/<table>/    - manifest and SSTable files of a table
+
+type Flusher struct {
+	// basic attributes
+	dir          string
+	consensus_id util.IConsensusID
+	domain       string
+	journal      *JournalV1
+	max_size     uint64 // rotate when active memtables exceed this size
+	max_records  uint32 // max records of a memtable, and of an entry of a table
+	history      bool   // whether history records are written
+	version      uint32 // version of SSTables written
+	// memtables and manifests, guarded by mutex
+	mutex     sync.Mutex
+	cond      *sync.Cond // signaled when a memtable set is flushed, or on error
+	manifests map[string]*ManifestV1
+	active    *flush_memtables
+	immutable []*flush_memtables // oldest first
+	err       error              // flush error, flusher fails permanently once set
+	closed    bool
+	// background flush
+	flush_ch chan struct{}
+	done     chan struct{}
+	on_flush func(table string)
+}
+
+// memtables of all tables, rotated together
+type flush_memtables struct {
+	tables    map[string]*MemTableV1
+	start_seq uint64 // journal seq of the first entry
+	end_seq   uint64 // journal seq after the last entry
+}
+
+// open flusher with default options of a pdb
+func OpenFlusher(dir string, consensus_id util.IConsensusID, domain string) (*Flusher, error) {
+	return openFlusher(dir, consensus_id, domain, DefaultPdbOptions())
+}
+
+func openFlusher(dir string, consensus_id util.IConsensusID, domain string, options *PdbOptions) (*Flusher, error) {
+
+	f := &Flusher{
+		dir:          dir,
+		consensus_id: consensus_id,
+		domain:       domain,
+		max_size:     MEMTABLE_MAX_SIZE,
+		max_records:  SSTABLE_MAX_RECORDS,
+		history:      options.HistoryWindow > 0,
+		version:      options.SSTableVersion,
+		manifests:    map[string]*ManifestV1{},
+		flush_ch:     make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	f.cond = sync.NewCond(&f.mutex)
+
+	// load manifests of existing tables
+	entries, err := ioutil.ReadDir(filepath.Join(dir, TABLES_DIR))
+	if err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			manifest, err := OpenManifestV1(table_dir(dir, entry.Name()))
+			if err != nil {
+				f.closeManifests()
+				return nil, err
+			}
+			f.manifests[entry.Name()] = manifest
+		}
+	}
+
+	f.journal, err = OpenJournalV1(filepath.Join(dir, JOURNAL_DIR), consensus_id, domain)
+	if err != nil {
+		f.closeManifests()
+		return nil, err
+	}
+
+	// replay records not yet flushed
+	f.active = &flush_memtables{tables: map[string]*MemTableV1{}, start_seq: 1, end_seq: 1}
+	err = f.journal.ReplayBatch(0, func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error {
+		// tables of a batch are flushed independently
+		unflushed := NewWriteBatch()
+		for _, table := range batch.Tables() {
+			if manifest, ok := f.manifests[table]; ok && seq < manifest.FlushedSeq() {
+				continue
+			}
+			for _, r := range batch.Records(table) {
+				unflushed.Set(table, r)
+			}
+		}
+		if unflushed.Count() == 0 {
+			return nil
+		}
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		return f.apply(seq, time, unflushed)
+	})
+	if err != nil {
+		f.journal.Close()
+		f.closeManifests()
+		return nil, err
+	}
+
+	// continue from the next seq
+	f.active.end_seq = f.journal.NextSeq()
+	if len(f.active.tables) == 0 {
+		f.active.start_seq = f.active.end_seq
+	}
+
+	// the entry is durable but not in memtables if apply fails, later writes
+	// fail as memtables no longer follow the journal
+	f.journal.OnCommitBatch(func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		err := f.apply(seq, time, batch)
+		if err != nil && f.err == nil {
+			f.err = fmt.Errorf("Flusher - entry %d not applied - %s", seq, err)
+			f.cond.Broadcast()
+		}
+		return err
+	})
+
+	go f.flusher()
+
+	return f, nil
+}
+
+// write records of a table, returns after records are durable in journal and applied to memtable
+func (f *Flusher) Write(table string, time util.IConsensusTime, records []util.IRecord) error {
+
+	batch := NewWriteBatch()
+	for _, r := range records {
+		batch.Set(table, r)
+	}
+
+	return f.WriteBatch(time, batch)
+}
+
+// write records of all tables of a batch atomically as one journal entry,
+// returns after records are durable in journal and applied to memtables
+func (f *Flusher) WriteBatch(time util.IConsensusTime, batch *WriteBatch) error {
+
+	if batch == nil {
+		return fmt.Errorf("Flusher::WriteBatch - batch is nil")
+	}
+
+	for _, table := range batch.Tables() {
+		if err := flush_check_table(table); err != nil {
+			return err
+		}
+		for _, r := range batch.Records(table) {
+			if collection.IsNil(r) || collection.IsNil(r.Key()) {
+				return fmt.Errorf("Flusher::WriteBatch - record or key is nil")
+			}
+			if group, err := RecordGroup(r); err != nil {
+				return fmt.Errorf("Flusher::WriteBatch - %s", err)
+			} else if group_is_history(group) {
+				return fmt.Errorf("Flusher::WriteBatch - group [%x] is reserved for history", group)
+			}
+		}
+		// records of an entry, with their history records, fit in one memtable
+		if count := f.entryRecords(len(batch.Records(table))); count > uint64(f.max_records) {
+			return fmt.Errorf("Flusher::WriteBatch - table [%s] - %d records exceeding %d", table, count, f.max_records)
+		}
+	}
+
+	f.mutex.Lock()
+	err := f.err
+	f.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return f.journal.AppendBatch(time, batch)
+}
+
+// set hook called after a memtable of a table is flushed to a level 0 SSTable,
+// must be set before writes
+func (f *Flusher) OnFlush(fn func(table string)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.on_flush = fn
+}
+
+// tables with SSTables
+func (f *Flusher) Tables() []string {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	result := []string{}
+	for table := range f.manifests {
+		result = append(result, table)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// memtables of a table, newest first
+func (f *Flusher) Memtables(table string) []*MemTableV1 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.memtables(table)
+}
+
+// memtables of a table newest first, and journal seq of the next entry - the
+// active memtable is not rotated, entries from the seq on are applied to it
+// after the call
+func (f *Flusher) Pin(table string) ([]*MemTableV1, uint64, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return nil, 0, fmt.Errorf("Flusher::Pin - flusher closed")
+	}
+	if f.err != nil {
+		return nil, 0, f.err
+	}
+
+	return f.memtables(table), f.active.end_seq, nil
+}
+
+// manifest of a table, nil if the table has no SSTable yet
+func (f *Flusher) Manifest(table string) *ManifestV1 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.manifests[table]
+}
+
+// rotate active memtables, and wait for all memtables to be flushed
+func (f *Flusher) Flush() error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return fmt.Errorf("Flusher::Flush - flusher closed")
+	}
+
+	f.rotate()
+
+	for len(f.immutable) > 0 && f.err == nil {
+		f.cond.Wait()
+	}
+
+	return f.err
+}
+
+// close journal and stop background flush, memtables not flushed are recovered from journal on next open
+func (f *Flusher) Close() error {
+
+	// journal waits for pending commit hooks
+	err := f.journal.Close()
+
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.flush_ch)
+	f.mutex.Unlock()
+
+	<-f.done
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if e := f.closeManifests(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Write path
+
+// apply an entry to the active memtables of its tables, mutex must be held -
+// records and history records of all tables are prepared before any memtable
+// is changed, so an entry is applied all or nothing
+func (f *Flusher) apply(seq uint64, time util.IConsensusTime, batch *WriteBatch) error {
+
+	if collection.IsNil(time) {
+		return fmt.Errorf("Flusher::apply - time is nil")
+	}
+
+	// latest record, and history record of the version
+	prepared := map[string][]memtable_record{}
+	for _, table := range batch.Tables() {
+
+		if m, ok := f.active.tables[table]; ok {
+			if err := m.checkTime(time); err != nil {
+				return fmt.Errorf("Flusher::apply - %s", err)
+			}
+		}
+
+		for _, r := range batch.Records(table) {
+			records := []util.IRecord{r}
+			if f.history {
+				h, err := NewHistoryRecord(r, time, seq)
+				if err != nil {
+					return fmt.Errorf("Flusher::apply - %s", err)
+				}
+				records = append(records, h)
+			}
+			for _, record := range records {
+				p, err := memtable_prepare(record)
+				if err != nil {
+					return fmt.Errorf("Flusher::apply - %s", err)
+				}
+				prepared[table] = append(prepared[table], p)
+			}
+		}
+	}
+
+	// entry is never split, active memtables are rotated first if the entry
+	// may exceed max records of a memtable
+	for table, records := range prepared {
+		if m, ok := f.active.tables[table]; ok && uint64(m.Count())+uint64(len(records)) > uint64(f.max_records) {
+			f.rotate()
+			break
+		}
+	}
+
+	// active memtables are not frozen, and take prepared records and time
+	for _, table := range batch.Tables() {
+
+		m, ok := f.active.tables[table]
+		if !ok {
+			m = NewMemTableV1(f.consensus_id, f.domain, table)
+			m.max_records = f.max_records
+			f.active.tables[table] = m
+		}
+
+		for _, p := range prepared[table] {
+			if err := m.put(p); err != nil {
+				return fmt.Errorf("Flusher::apply - %s", err)
+			}
+		}
+
+		if err := m.UpdateTime(time); err != nil {
+			return fmt.Errorf("Flusher::apply - %s", err)
+		}
+	}
+
+	// rotate only after all tables of the entry are applied
+	f.active.end_seq = seq + 1
+
+	if f.active.isFull(f.max_size) {
+		f.rotate()
+	}
+
+	return nil
+}
+
+// records applied to a memtable for an entry of count records of a table
+func (f *Flusher) entryRecords(count int) uint64 {
+	if f.history {
+		return 2 * uint64(count)
+	}
+	return uint64(count)
+}
+
+// memtables of a table, newest first, mutex must be held
+func (f *Flusher) memtables(table string) []*MemTableV1 {
+
+	result := []*MemTableV1{}
+	if m, ok := f.active.tables[table]; ok {
+		result = append(result, m)
+	}
+	for i := len(f.immutable) - 1; i >= 0; i-- {
+		if m, ok := f.immutable[i].tables[table]; ok {
+			result = append(result, m)
+		}
+	}
+
+	return result
+}
+
+// freeze active memtables and queue them for flush, mutex must be held
+func (f *Flusher) rotate() {
+
+	if len(f.active.tables) == 0 || f.closed {
+		return
+	}
+
+	for _, m := range f.active.tables {
+		m.Freeze()
+	}
+
+	f.immutable = append(f.immutable, f.active)
+	f.active = &flush_memtables{tables: map[string]*MemTableV1{}, start_seq: f.active.end_seq, end_seq: f.active.end_seq}
+
+	select {
+	case f.flush_ch <- struct{}{}:
+	default:
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Background flush
+
+func (f *Flusher) flusher() {
+
+	defer close(f.done)
+
+	for range f.flush_ch {
+		for {
+			f.mutex.Lock()
+			if len(f.immutable) == 0 || f.err != nil {
+				f.mutex.Unlock()
+				break
+			}
+			batch := f.immutable[0]
+			f.mutex.Unlock()
+
+			err := f.flush(batch)
+
+			f.mutex.Lock()
+			if err != nil {
+				f.err = err
+			} else {
+				f.immutable = f.immutable[1:]
+			}
+			f.cond.Broadcast()
+			on_flush := f.on_flush
+			f.mutex.Unlock()
+
+			if err != nil {
+				log.Printf("Flusher::flusher - %s", err)
+				break
+			}
+
+			if on_flush != nil {
+				for table, m := range batch.tables {
+					if m.Count() > 0 {
+						on_flush(table)
+					}
+				}
+			}
+
+			// journal entries before end seq are all flushed
+			if err := f.journal.Purge(batch.end_seq); err != nil {
+				log.Printf("Flusher::flusher - %s", err)
+			}
+		}
+	}
+}
+
+// write each memtable of a set to a level 0 SSTable, and record it in manifest
+func (f *Flusher) flush(batch *flush_memtables) error {
+
+	tables := []string{}
+	for table := range batch.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+
+		m := batch.tables[table]
+		if m.Count() == 0 {
+			continue
+		}
+
+		manifest, err := f.manifest(table)
+		if err != nil {
+			return err
+		}
+
+		num := manifest.NewFileNum()
+		sstable, err := m.Flush(f.version, manifest.FilePath(num), 0, m.StartTime(), m.EndTime())
+		if err != nil {
+			return fmt.Errorf("Flusher::flush - table [%s] - %s", table, err)
+		}
+		var file ManifestFile
+		info, err := os.Stat(manifest.FilePath(num))
+		if err == nil {
+			file, err = NewManifestTableFile(0, num, sstable, uint64(info.Size()))
+		}
+		sstable.Close()
+		if err != nil {
+			return fmt.Errorf("Flusher::flush - table [%s] - %s", table, err)
+		}
+
+		if err := manifest.Apply([]ManifestFile{file}, nil, batch.end_seq); err != nil {
+			return fmt.Errorf("Flusher::flush - table [%s] - %s", table, err)
+		}
+	}
+
+	return nil
+}
+
+// manifest of a table, created if not exist
+func (f *Flusher) manifest(table string) (*ManifestV1, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if manifest, ok := f.manifests[table]; ok {
+		return manifest, nil
+	}
+
+	manifest, err := OpenManifestV1(table_dir(f.dir, table))
+	if err != nil {
+		return nil, err
+	}
+	f.manifests[table] = manifest
+
+	return manifest, nil
+}
+
+func (f *Flusher) closeManifests() error {
+	var err error
+	for _, manifest := range f.manifests {
+		if e := manifest.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// whether memtables exceed size threshold, or any memtable is full
+func (s *flush_memtables) isFull(max_size uint64) bool {
+
+	size := uint64(0)
+	for _, m := range s.tables {
+		if m.IsFull() {
+			return true
+		}
+		size += m.Size()
+	}
+
+	return size >= max_size
+}
+
+// table name is used as directory name
+func flush_check_table(table string) error {
+
+	if table == "" || table == "." || table == ".." || strings.ContainsAny(table, "/\\\x00") {
+		return fmt.Errorf("invalid table name [%s]", table)
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// test utilities
+
+func writeTestRecords(t testing.TB, f *Flusher, table string, epoch uint32, start, end int) {
+	for i := start; i < end; i++ {
+		r := newTestRecord(fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i))
+		if err := f.Write(table, util.NewLedgerTime(epoch), []util.IRecord{r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// count records not history
+func countTestLatest(t testing.TB, iter ISSTableIterator) int {
+	count := 0
+	for iter.HasNext() {
+		v, err := record_history(iter.Next())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// count records of a table in memtables and SSTables
+func countTestRecords(t testing.TB, f *Flusher, table string) (int, int) {
+
+	memtable_count := 0
+	for _, m := range f.Memtables(table) {
+		memtable_count += countTestLatest(t, m.Iterator())
+	}
+
+	sstable_count := 0
+	if manifest := f.Manifest(table); manifest != nil {
+		for _, file := range manifest.Files() {
+			sstable, err := LoadSSTable(manifest.FilePath(file.Num()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.Level() != 0 {
+				t.Errorf("file [%d] level not match: %d", file.Num(), file.Level())
+			}
+			sstable_count += countTestLatest(t, sstable.Iterator())
+			sstable.Close()
+		}
+	}
+
+	return memtable_count, sstable_count
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestFlusher(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	f, err := OpenFlusher(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.max_size = 4 * 1024
+	f.journal.max_segment_size = 4 * 1024
+
+	writeTestRecords(t, f, "table1", 1, 0, 500)
+	writeTestRecords(t, f, "table2", 2, 0, 100)
+
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, s := countTestRecords(t, f, "table1"); m != 0 || s != 500 {
+		t.Errorf("table1 count not match: %d, %d", m, s)
+	}
+	if m, s := countTestRecords(t, f, "table2"); m != 0 || s != 100 {
+		t.Errorf("table2 count not match: %d, %d", m, s)
+	}
+
+	// start and end time of level 0 SSTables
+	manifest := f.Manifest("table2")
+	files := manifest.Files()
+	sstable, err := LoadSSTable(manifest.FilePath(files[len(files)-1].Num()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq, _ := sstable.StartTime().EQ(util.NewLedgerTime(2)); !eq {
+		t.Errorf("start time not match: %x", sstable.StartTime().Buf())
+	}
+	if !sstable.EndKey().Equal(util.NewStringKey("key000099")) {
+		t.Errorf("end key not match: %v", sstable.EndKey().Key())
+	}
+	sstable.Close()
+
+	// journal segments before the flushed seq are purged
+	segments, err := f.journal.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) > 2 {
+		t.Errorf("journal not purged: %d segments", len(segments))
+	}
+}
+
+func TestFlusherRecovery(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	f, err := OpenFlusher(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestRecords(t, f, "table1", 1, 0, 100)
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestRecords(t, f, "table1", 2, 100, 150)
+	writeTestRecords(t, f, "table2", 2, 0, 10)
+	f.Close()
+
+	if err := f.Write("table1", util.NewLedgerTime(2), []util.IRecord{newTestRecord("key", "value")}); err == nil {
+		t.Errorf("write after close should fail")
+	}
+
+	// records not flushed are replayed into memtables
+	f, err = OpenFlusher(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m, s := countTestRecords(t, f, "table1"); m != 50 || s != 100 {
+		t.Errorf("table1 count not match: %d, %d", m, s)
+	}
+	if m, s := countTestRecords(t, f, "table2"); m != 10 || s != 0 {
+		t.Errorf("table2 count not match: %d, %d", m, s)
+	}
+
+	writeTestRecords(t, f, "table2", 3, 10, 20)
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// nothing is replayed after flush
+	f, err = OpenFlusher(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if m, s := countTestRecords(t, f, "table1"); m != 0 || s != 150 {
+		t.Errorf("table1 count not match after flush: %d, %d", m, s)
+	}
+	if m, s := countTestRecords(t, f, "table2"); m != 0 || s != 20 {
+		t.Errorf("table2 count not match after flush: %d, %d", m, s)
+	}
+
+	if err := f.Write("../table", util.NewLedgerTime(3), []util.IRecord{newTestRecord("key", "value")}); err == nil {
+		t.Errorf("write with invalid table name should fail")
+	}
+}
+
+func TestFlusherApplyError(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	f, err := OpenFlusher(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	writeTestRecords(t, f, "table1", 1, 0, 10)
+
+	// raft time does not compare with ledger time of the memtable of table1,
+	// and no record of the batch is applied
+	batch := NewWriteBatch()
+	batch.Set("table0", newTestRecord("key", "value"))
+	batch.Set("table1", newTestRecord("key", "value"))
+	if err := f.WriteBatch(util.NewRaftTime(1, 1, 1), batch); err == nil {
+		t.Fatalf("write not applied to memtable should fail")
+	}
+	if m := f.Memtables("table0"); len(m) != 0 {
+		t.Errorf("table0 has %d memtables after failed write", len(m))
+	}
+	for _, m := range f.Memtables("table1") {
+		if r, err := m.Get(newTestKey("key"), ""); err != nil || r != nil {
+			t.Errorf("record of failed write applied: %v %v", r, err)
+		}
+	}
+
+	// memtables no longer follow the journal
+	if err := f.Write("table1", util.NewLedgerTime(1), []util.IRecord{newTestRecord("key", "value")}); err == nil {
+		t.Errorf("write after apply error should fail")
+	}
+}
+
+func TestFlusherMaxRecords(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	f, err := OpenFlusher(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.max_records = 6
+
+	// entry of more records than a memtable holds, with history records
+	records := []util.IRecord{}
+	for i := 0; i < 4; i++ {
+		records = append(records, newTestRecord(fmt.Sprintf("key%06d", i), "v"))
+	}
+	if err := f.Write("table1", util.NewLedgerTime(1), records); err == nil {
+		t.Errorf("write exceeding max records should fail")
+	}
+
+	// an entry that does not fit in the active memtable goes to a new one
+	if err := f.Write("table1", util.NewLedgerTime(1), records[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write("table1", util.NewLedgerTime(1), records[2:]); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range f.Memtables("table1") {
+		if m.Count() != 4 {
+			t.Errorf("memtable count %d; want 4", m.Count())
+		}
+	}
+
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if m, s := countTestRecords(t, f, "table1"); m != 0 || s != 4 {
+		t.Errorf("table1 count not match after flush: %d, %d", m, s)
+	}
+	if n := len(f.Manifest("table1").Files()); n != 2 {
+		t.Errorf("%d files; want 2", n)
+	}
+}
@@ -0,0 +1,69 @@
+package pdb
+
+import (
+	"fmt"
+	"strings"
+
+	"../collection"
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Attribute Group (Bucket)
+//
+// Consensus ID, Domain and Tablet are not stored in the Record when stored in
+// pdb.  The Scheme field of a Record carries only the Buckets, encoded as a
+// util.Scheme.  The group name of a Record is the Buckets joined by '/', and
+// the default group has empty name.
+
+const GROUP_SEPARATOR = "/"
+
+// create a record scheme for specified group, nil for default group
+func NewGroupScheme(group string) (util.IValue, error) {
+
+	if group == "" {
+		return nil, nil
+	}
+
+	scheme := util.NewScheme()
+	for _, bucket := range strings.Split(group, GROUP_SEPARATOR) {
+		if bucket == "" {
+			return nil, fmt.Errorf("NewGroupScheme - invalid group [%s]", group)
+		}
+		scheme.AddBucket([]byte(bucket))
+	}
+
+	if err := scheme.Encode(nil); err != nil {
+		return nil, fmt.Errorf("NewGroupScheme - %s", err)
+	}
+
+	return util.NewPrimitive(scheme.Buf()), nil
+}
+
+// group name of a record, default group has empty name
+func RecordGroup(r util.IRecord) (string, error) {
+	return schemeGroup(r.Scheme())
+}
+
+func schemeGroup(scheme util.IValue) (string, error) {
+
+	if collection.IsNil(scheme) || scheme.IsNil() {
+		return "", nil
+	}
+
+	if !scheme.IsPrimitive() {
+		return "", fmt.Errorf("RecordGroup - scheme is not primitive")
+	}
+
+	mapped, _, err := util.NewMappedScheme(scheme.Value())
+	if err != nil {
+		return "", fmt.Errorf("RecordGroup - %s", err)
+	}
+
+	buckets := []string{}
+	for _, bucket := range mapped.Buckets() {
+		buckets = append(buckets, string(bucket))
+	}
+
+	return strings.Join(buckets, GROUP_SEPARATOR), nil
+}
@@ -0,0 +1,179 @@
+package pdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Ingestion
+//
+// SSTables built offline are added to a table directly, without going through
+// the journal and memtables.  Ingested files must carry the consensus ID,
+// domain and table of the tablet in their headers, and hold at least one
+// record.  Files are hard linked into the table directory under new file
+// numbers, or copied if on another file system - the source files are left
+// in place.
+//
+// Ingested records are newer than all records of the table written before.
+// Memtables of the table are flushed first if they hold records, and each
+// file is placed at the deepest level with no overlapping file at or above
+// it, or at level 0 as the newest file if it overlaps level 0.  A later file
+// of the same ingestion is newer than an earlier one.  All files are added to
+// the manifest in one edit, so either all or none are visible.
+//
+// Writes of the table and compactions of the table wait until ingestion is
+// done, so the key ranges checked stay valid until the files are added.
+
+type ingest_file struct {
+	path  string
+	table ISSTable
+	size  uint64
+}
+
+// add SSTable files to the tablet atomically, files are validated against
+// the tablet and left in place
+func (t *Tablet) IngestSSTables(paths []string) error {
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	files := []*ingest_file{}
+	defer func() {
+		for _, f := range files {
+			f.table.Close()
+		}
+	}()
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("Tablet::IngestSSTables - %s", err)
+		}
+		table, err := LoadSSTable(path)
+		if err != nil {
+			return fmt.Errorf("Tablet::IngestSSTables - [%s] - %s", path, err)
+		}
+		files = append(files, &ingest_file{path: path, table: table, size: uint64(info.Size())})
+
+		if !bytes.Equal(table.ConsensusID().Buf(), t.ConsensusID().Buf()) {
+			return fmt.Errorf("Tablet::IngestSSTables - [%s] - consensus id %x not match %x", path, table.ConsensusID().Buf(), t.ConsensusID().Buf())
+		}
+		if table.Domain() != t.Domain() {
+			return fmt.Errorf("Tablet::IngestSSTables - [%s] - domain [%s] not match [%s]", path, table.Domain(), t.Domain())
+		}
+		if table.Table() != t.Table() {
+			return fmt.Errorf("Tablet::IngestSSTables - [%s] - table [%s] not match [%s]", path, table.Table(), t.Table())
+		}
+		if table.Count() == 0 {
+			return fmt.Errorf("Tablet::IngestSSTables - [%s] - no record", path)
+		}
+	}
+
+	// no write of the table until files are added
+	lock := t.pdb.lock(t.table)
+	lock.Lock()
+	defer lock.Unlock()
+
+	t.pdb.mutex.Lock()
+	closed := t.pdb.closed
+	t.pdb.mutex.Unlock()
+	if closed {
+		return fmt.Errorf("Tablet::IngestSSTables - pdb closed")
+	}
+
+	// records written before are flushed to SSTables, ingested files are newer
+	for _, m := range t.pdb.flusher.Memtables(t.table) {
+		if m.Count() > 0 {
+			if err := t.pdb.flusher.Flush(); err != nil {
+				return fmt.Errorf("Tablet::IngestSSTables - %s", err)
+			}
+			break
+		}
+	}
+
+	manifest, err := t.pdb.flusher.manifest(t.table)
+	if err != nil {
+		return fmt.Errorf("Tablet::IngestSSTables - %s", err)
+	}
+
+	if err := t.pdb.tableCompactor(t.table, manifest).ingest(files); err != nil {
+		return fmt.Errorf("Tablet::IngestSSTables - %s", err)
+	}
+
+	// ingested files may need compaction
+	t.pdb.schedule(t.table)
+
+	return nil
+}
+
+// link files into the manifest directory, and add them in one edit - no
+// compaction runs meanwhile
+func (c *Compactor) ingest(files []*ingest_file) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	version := c.manifest.Current()
+	defer version.Release()
+
+	levels, err := compaction_load(version)
+	if err != nil {
+		return err
+	}
+
+	added := []ManifestFile{}
+	abort := func() {
+		for _, file := range added {
+			os.Remove(c.manifest.FilePath(file.num))
+		}
+	}
+
+	for _, f := range files {
+
+		level := ingest_level(levels, f.table)
+		num := c.manifest.NewFileNum()
+		file, err := NewManifestTableFile(level, num, f.table, f.size)
+		if err != nil {
+			abort()
+			return fmt.Errorf("[%s] - %s", f.path, err)
+		}
+		if err := linkFile(f.path, c.manifest.FilePath(num)); err != nil {
+			abort()
+			return fmt.Errorf("[%s] - %s", f.path, err)
+		}
+		added = append(added, file)
+
+		// later files are placed against earlier ones
+		levels[level] = append(levels[level], &compaction_file{file: file})
+	}
+
+	if err := c.manifest.Apply(added, nil, 0); err != nil {
+		abort()
+		return err
+	}
+
+	return nil
+}
+
+// deepest level with no file overlapping the table at or above it, level 0
+// if level 0 overlaps
+func ingest_level(levels [][]*compaction_file, table ISSTable) uint32 {
+
+	start, end := table.StartKey(), table.EndKey()
+	if len(compaction_overlaps(levels[0], start, end)) > 0 {
+		return 0
+	}
+
+	level := 0
+	for l := 1; l < len(levels); l++ {
+		if len(compaction_overlaps(levels[l], start, end)) > 0 {
+			break
+		}
+		level = l
+	}
+
+	return uint32(level)
+}
@@ -0,0 +1,135 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../util"
+)
+
+func buildTestIngestSSTable(t testing.TB, path string, consensus_id util.IConsensusID, table string, keys []string, value string) {
+	b, err := NewSSTableBuilder(SSTABLE_VERSION, path, consensus_id, "test.domain", table, 0, util.NewLedgerTime(1), util.NewLedgerTime(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := b.Add(newTestRecord(key, value)); err != nil {
+			b.Abort()
+			t.Fatal(err)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTabletIngestSSTables(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	p, err := OpenPdbV1(filepath.Join(dir, "pdb"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tablet, err := p.Tablet("test.table")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k := 0; k < 10; k++ {
+		if err := tablet.Set(util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%03d", k), "old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// in memtable, older than ingested files
+	if err := tablet.Set(util.NewLedgerTime(1), newTestRecord("key005", "memtable")); err != nil {
+		t.Fatal(err)
+	}
+
+	// overlapping level 0, not overlapping, and newer than the first
+	paths := []string{filepath.Join(dir, "ingest1.sst"), filepath.Join(dir, "ingest2.sst"), filepath.Join(dir, "ingest3.sst")}
+	buildTestIngestSSTable(t, paths[0], consensus_id, "test.table", []string{"key005", "key006", "key007"}, "ingest1")
+	buildTestIngestSSTable(t, paths[1], consensus_id, "test.table", []string{"key100", "key101"}, "ingest2")
+	buildTestIngestSSTable(t, paths[2], consensus_id, "test.table", []string{"key007", "key008"}, "ingest3")
+
+	// invalid files, nothing ingested
+	invalid := filepath.Join(dir, "invalid.sst")
+	buildTestIngestSSTable(t, invalid, newTestConsensusID(), "test.table", []string{"key200"}, "invalid")
+	if err := tablet.IngestSSTables(append(paths, invalid)); err == nil {
+		t.Errorf("ingest of other consensus id should fail")
+	}
+	os.Remove(invalid)
+	buildTestIngestSSTable(t, invalid, consensus_id, "other.table", []string{"key200"}, "invalid")
+	if err := tablet.IngestSSTables([]string{invalid}); err == nil {
+		t.Errorf("ingest of other table should fail")
+	}
+	os.Remove(invalid)
+	buildTestIngestSSTable(t, invalid, consensus_id, "test.table", []string{}, "invalid")
+	if err := tablet.IngestSSTables([]string{invalid}); err == nil {
+		t.Errorf("ingest of empty file should fail")
+	}
+	if files := p.flusher.Manifest("test.table").Files(); len(files) != 1 {
+		t.Fatalf("files added by failed ingestion: %v", files)
+	}
+
+	if err := tablet.IngestSSTables(paths); err != nil {
+		t.Fatal(err)
+	}
+
+	levels := []uint32{}
+	for _, file := range p.flusher.Manifest("test.table").Files() {
+		levels = append(levels, file.Level())
+	}
+	if fmt.Sprint(levels) != fmt.Sprintf("[0 0 0 %d 0]", COMPACTION_MAX_LEVELS-1) {
+		t.Errorf("levels %v", levels)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("source file removed: %s", err)
+		}
+	}
+
+	check := func(p IPdb) {
+		for _, tt := range []struct{ key, want string }{
+			{"key000", "old"},
+			{"key005", "ingest1"},
+			{"key006", "ingest1"},
+			{"key007", "ingest3"},
+			{"key008", "ingest3"},
+			{"key009", "old"},
+			{"key101", "ingest2"},
+		} {
+			if v := getTestValue(t, p, "test.table", tt.key, ""); v != tt.want {
+				t.Errorf("%s = %s; want %s", tt.key, v, tt.want)
+			}
+		}
+	}
+	check(p)
+
+	// written after ingestion
+	if err := tablet.Set(util.NewLedgerTime(2), newTestRecord("key101", "new")); err != nil {
+		t.Fatal(err)
+	}
+	if v := getTestValue(t, p, "test.table", "key101", ""); v != "new" {
+		t.Errorf("key101 = %s; want new", v)
+	}
+	if err := tablet.Set(util.NewLedgerTime(2), newTestRecord("key101", "ingest2")); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Close()
+	p, err = OpenPdbV1(filepath.Join(dir, "pdb"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	check(p)
+}
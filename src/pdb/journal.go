@@ -1,18 +1,911 @@
 package pdb
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../collection"
 	"../util"
 )
 
+const (
+	JOURNAL_MAX_SEGMENT_SIZE = uint32(64 * 1024 * 1024) // segment rolls over when exceeding this size
+	JOURNAL_MAX_ENTRY_SIZE   = uint32(16 * 1024 * 1024) // max size of records appended in one entry
+	JOURNAL_MAX_BATCH        = 1024                     // max entries committed with one fsync
+	JOURNAL_SEGMENT_SUFFIX   = ".journal"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Interface
+
 type IJournal interface {
 	// each pdb has one journal
 	Version() uint32                // Version
 	ConsensusID() util.IConsensusID // Consensus ID
 	Domain() string                 // Domain Name
 	// operations
-	Append(r []util.IRecord) error     // append a list of records
-	AppendRecord(r util.IRecord) error // append a record
+	Append(table string, time util.IConsensusTime, r []util.IRecord) error     // append a list of records
+	AppendRecord(table string, time util.IConsensusTime, r util.IRecord) error // append a record
+	AppendBatch(time util.IConsensusTime, batch *WriteBatch) error             // append records of tables as one entry
+	// Close the resource
+	Close() error
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// Implementation V1
+//
+// JournalV1 is a segmented append-only log under a directory.  Each segment is
+// a file named <segment number in hex> + JOURNAL_SEGMENT_SUFFIX:
+//
+//   - header     : version, consensus id, domain, start seq, header crc32
+//   - entries    : length, seq, table, consensus time, records, entry crc32
+//
+// Each Append is written as one entry, and the entry crc32 covers the whole
+// entry.  Entry seq starts from 1 and increases by 1 across segments.  A
+// WriteBatch of more than one table is written as one entry with an empty
+// table, followed by consensus time, and table, record count and records of
+// each table - an entry is recovered or truncated as a whole, so a batch is
+// replayed all or nothing.
+//
+// Appends are queued to a single writer, which writes all pending entries and
+// commits them with one fsync (group commit).  Append returns only after the
+// entry is durable, and after the commit hook, if any, is called with the
+// entry - an error of the hook is returned to the Append of the entry.  The
+// commit hook is called from the writer in order of seq.  A new segment is
+// started when the current segment would exceed JOURNAL_MAX_SEGMENT_SIZE.
+//
+// On open, a torn tail of the last segment (a partial entry running to the end
+// of the segment, left by a crash) is truncated, and appends continue in the
+// last segment.  Any other corruption is an error, as entries after it were
+// committed.
+
 type JournalV1 struct {
+	// basic attributes
+	dir          string
+	consensus_id util.IConsensusID
+	domain       string
+	// current segment
+	segment          *os.File
+	segment_num      uint64
+	segment_size     uint32
+	max_segment_size uint32
+	next_seq         uint64
+	// writer
+	mutex       sync.Mutex   // guards current segment, next seq and err
+	close_mutex sync.RWMutex // guards closed and requests
+	purge_mutex sync.Mutex   // held by Purge, and by checkpoint to keep segments
+	requests    chan *journal_request
+	done        chan struct{}
+	err         error // write error, journal fails permanently once set
+	closed      bool
+	// called with each committed entry, in order of seq
+	on_commit func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error
+}
+
+type journal_request struct {
+	time  util.IConsensusTime
+	batch *WriteBatch
+	buf   []byte // encoded entry payload
+	done  chan error
+}
+
+type journal_segment struct {
+	num  uint64
+	path string
+}
+
+func OpenJournalV1(dir string, consensus_id util.IConsensusID, domain string) (*JournalV1, error) {
+
+	if collection.IsNil(consensus_id) {
+		return nil, fmt.Errorf("OpenJournalV1 - consensus id is nil")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &JournalV1{
+		dir:              dir,
+		consensus_id:     consensus_id,
+		domain:           domain,
+		max_segment_size: JOURNAL_MAX_SEGMENT_SIZE,
+		next_seq:         1,
+	}
+
+	// recover existing segments
+	segments, err := j.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	size := 0
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		next_seq, valid_size, err := j.recover(segment, last)
+		if err != nil {
+			return nil, err
+		}
+		if next_seq != 0 {
+			j.next_seq = next_seq
+			size = valid_size
+		} else {
+			size = 0
+		}
+		j.segment_num = segment.num + 1
+	}
+
+	// append to the recovered last segment, or start a new segment
+	if size != 0 {
+		if err := j.reopen(segments[len(segments)-1], size); err != nil {
+			return nil, err
+		}
+	} else if err := j.rollover(); err != nil {
+		return nil, err
+	}
+
+	j.requests = make(chan *journal_request, JOURNAL_MAX_BATCH)
+	j.done = make(chan struct{})
+	go j.writer()
+
+	return j, nil
+}
+
+func (j *JournalV1) Version() uint32 {
+	return 1
+}
+
+func (j *JournalV1) ConsensusID() util.IConsensusID {
+	return j.consensus_id
+}
+
+func (j *JournalV1) Domain() string {
+	return j.domain
+}
+
+// seq of the next entry to be appended
+func (j *JournalV1) NextSeq() uint64 {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.next_seq
+}
+
+// set the commit hook, called for each table of an entry, must be called
+// before any Append - an error of the hook is returned by the Append of the
+// entry
+func (j *JournalV1) OnCommit(fn func(seq uint64, table string, time util.IConsensusTime, records []util.IRecord) error) {
+	j.OnCommitBatch(func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error {
+		for _, table := range batch.Tables() {
+			if err := fn(seq, table, time, batch.Records(table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// set the commit hook, called once for each entry with all its tables, must
+// be called before any Append - an error of the hook is returned by the
+// Append of the entry
+func (j *JournalV1) OnCommitBatch(fn func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error) {
+	j.on_commit = fn
+}
+
+func (j *JournalV1) AppendRecord(table string, time util.IConsensusTime, r util.IRecord) error {
+	return j.Append(table, time, []util.IRecord{r})
+}
+
+// append a list of records as one entry, returns after the entry is synced to disk
+func (j *JournalV1) Append(table string, time util.IConsensusTime, r []util.IRecord) error {
+
+	batch := NewWriteBatch()
+	for _, record := range r {
+		batch.Set(table, record)
+	}
+
+	if err := j.append(time, batch); err != nil {
+		return fmt.Errorf("JournalV1::Append - %s", err)
+	}
+
+	return nil
+}
+
+// append records of all tables of a batch as one entry, returns after the
+// entry is synced to disk
+func (j *JournalV1) AppendBatch(time util.IConsensusTime, batch *WriteBatch) error {
+
+	if batch == nil {
+		return fmt.Errorf("JournalV1::AppendBatch - batch is nil")
+	}
+
+	if err := j.append(time, batch); err != nil {
+		return fmt.Errorf("JournalV1::AppendBatch - %s", err)
+	}
+
+	return nil
+}
+
+func (j *JournalV1) append(time util.IConsensusTime, batch *WriteBatch) error {
+
+	if batch.Count() == 0 {
+		return nil
+	}
+
+	if collection.IsNil(time) {
+		return fmt.Errorf("consensus time is nil")
+	}
+
+	buf, err := journal_encode_payload(time, batch)
+	if err != nil {
+		return err
+	}
+
+	if uint32(len(buf)) > JOURNAL_MAX_ENTRY_SIZE {
+		return fmt.Errorf("entry size %d larger than %d", len(buf), JOURNAL_MAX_ENTRY_SIZE)
+	}
+
+	req := &journal_request{time: time, batch: batch, buf: buf, done: make(chan error, 1)}
+
+	j.close_mutex.RLock()
+	if j.closed {
+		j.close_mutex.RUnlock()
+		return fmt.Errorf("journal closed")
+	}
+	j.requests <- req
+	j.close_mutex.RUnlock()
+
+	return <-req.done
+}
+
+func (j *JournalV1) Close() error {
+
+	j.close_mutex.Lock()
+	if j.closed {
+		j.close_mutex.Unlock()
+		return nil
+	}
+	j.closed = true
+	close(j.requests)
+	j.close_mutex.Unlock()
+
+	// wait for pending entries to be committed
+	<-j.done
+
+	return j.segment.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Replay
+
+// replay all entries in order of seq, starting from specified seq - fn is
+// called for each table of an entry
+func (j *JournalV1) Replay(from_seq uint64, fn func(seq uint64, table string, time util.IConsensusTime, records []util.IRecord) error) error {
+	return j.ReplayBatch(from_seq, func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error {
+		for _, table := range batch.Tables() {
+			if err := fn(seq, table, time, batch.Records(table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// replay all entries in order of seq, starting from specified seq - fn is
+// called once for each entry with all its tables
+func (j *JournalV1) ReplayBatch(from_seq uint64, fn func(seq uint64, time util.IConsensusTime, batch *WriteBatch) error) error {
+
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+
+		buf, err := ioutil.ReadFile(segment.path)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = j.scan(buf, func(seq uint64, payload []byte) error {
+			if seq < from_seq {
+				return nil
+			}
+			time, batch, err := journal_decode_entry(payload)
+			if err != nil {
+				return err
+			}
+			return fn(seq, time, batch)
+		})
+		if err != nil {
+			return fmt.Errorf("JournalV1::Replay - segment [%s] - %s", segment.path, err)
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Writer
+
+func (j *JournalV1) writer() {
+
+	defer close(j.done)
+
+	for req := range j.requests {
+
+		// collect all pending requests
+		batch := []*journal_request{req}
+	collect:
+		for len(batch) < JOURNAL_MAX_BATCH {
+			select {
+			case r, ok := <-j.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, r)
+			default:
+				break collect
+			}
+		}
+
+		seq, err := j.commit(batch)
+		for _, r := range batch {
+			result := err
+			if result == nil && j.on_commit != nil {
+				result = j.on_commit(seq, r.time, r.batch)
+			}
+			seq++
+			r.done <- result
+		}
+	}
+}
+
+// write and sync a batch of entries, returns seq of the first entry
+func (j *JournalV1) commit(batch []*journal_request) (uint64, error) {
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.err != nil {
+		return 0, j.err
+	}
+
+	start_seq := j.next_seq
+
+	buf := []byte{}
+	for _, req := range batch {
+
+		entry := journal_encode_entry(j.next_seq, req.buf)
+
+		// roll over to a new segment
+		if j.segment_size+uint32(len(buf)+len(entry)) > j.max_segment_size && j.segment_size+uint32(len(buf)) > journal_header_size(j.consensus_id, j.domain) {
+			if j.err = j.write(buf); j.err != nil {
+				return 0, j.err
+			}
+			buf = buf[:0]
+			if j.err = j.rollover(); j.err != nil {
+				return 0, j.err
+			}
+		}
+
+		buf = append(buf, entry...)
+		j.next_seq++
+	}
+
+	j.err = j.write(buf)
+
+	return start_seq, j.err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Purge
+
+// remove segments with all entries before specified seq, current segment is never removed
+func (j *JournalV1) Purge(before_seq uint64) error {
+
+	j.purge_mutex.Lock()
+	defer j.purge_mutex.Unlock()
+
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	current := j.segment_num - 1
+	j.mutex.Unlock()
+
+	for i := 0; i+1 < len(segments) && segments[i].num < current; i++ {
+
+		// entries of a segment are before start seq of the next segment
+		next_start_seq, err := j.startSeq(segments[i+1])
+		if err != nil {
+			return err
+		}
+		if next_start_seq > before_seq {
+			break
+		}
+
+		if err := os.Remove(segments[i].path); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(j.dir)
+}
+
+// start seq from segment header
+func (j *JournalV1) startSeq(segment journal_segment) (uint64, error) {
+
+	f, err := os.Open(segment.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, journal_header_size(j.consensus_id, j.domain))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return 0, fmt.Errorf("JournalV1::startSeq - segment [%s] - %s", segment.path, err)
+	}
+
+	_, start_seq, err := j.decodeHeader(buf)
+	if err != nil {
+		return 0, fmt.Errorf("JournalV1::startSeq - segment [%s] - %s", segment.path, err)
+	}
+
+	return start_seq, nil
+}
+
+func (j *JournalV1) write(buf []byte) error {
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if _, err := j.segment.Write(buf); err != nil {
+		return err
+	}
+	j.segment_size += uint32(len(buf))
+
+	return j.segment.Sync()
+}
+
+// continue appending to a recovered segment with valid entries up to size
+func (j *JournalV1) reopen(segment journal_segment, size int) error {
+
+	f, err := os.OpenFile(segment.path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(int64(size), io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.segment = f
+	j.segment_num = segment.num + 1
+	j.segment_size = uint32(size)
+
+	return nil
+}
+
+// close current segment, and start a new segment
+func (j *JournalV1) rollover() error {
+
+	path := filepath.Join(j.dir, journal_segment_name(j.segment_num))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	header, err := journal_encode_header(j.consensus_id, j.domain, j.next_seq)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := syncDir(j.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	if j.segment != nil {
+		j.segment.Close()
+	}
+
+	j.segment = f
+	j.segment_num += 1
+	j.segment_size = uint32(len(header))
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Recovery
+
+// list of segments in order
+func (j *JournalV1) segments() ([]journal_segment, error) {
+
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []journal_segment{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, JOURNAL_SEGMENT_SUFFIX) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, JOURNAL_SEGMENT_SUFFIX), 16, 64)
+		if err != nil {
+			continue
+		}
+		result = append(result, journal_segment{num: num, path: filepath.Join(j.dir, name)})
+	}
+
+	sort.Slice(result, func(a, b int) bool { return result[a].num < result[b].num })
+
+	return result, nil
+}
+
+// verify a segment, truncate torn tail if it is the last segment - returns
+// next seq after the segment and size of its valid entries including header,
+// or 0 if the last segment has a torn header and is removed
+func (j *JournalV1) recover(segment journal_segment, last bool) (uint64, int, error) {
+
+	buf, err := ioutil.ReadFile(segment.path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, start_seq, err := j.decodeHeader(buf)
+	if err != nil {
+		if !last || uint32(len(buf)) >= journal_header_size(j.consensus_id, j.domain) {
+			return 0, 0, fmt.Errorf("JournalV1::recover - segment [%s] - %s", segment.path, err)
+		}
+		// crashed while creating the segment
+		return 0, 0, os.Remove(segment.path)
+	}
+
+	if start_seq != j.next_seq && j.next_seq != 1 {
+		return 0, 0, fmt.Errorf("JournalV1::recover - segment [%s] start seq %d, expected %d", segment.path, start_seq, j.next_seq)
+	}
+
+	valid_size, next_seq, err := j.scan(buf, nil)
+	if err == nil {
+		return next_seq, valid_size, nil
+	}
+
+	// only the tail of the last segment may be torn by a crash, entries
+	// after a corrupted entry were committed and must not be dropped
+	if !last || !journal_is_torn(buf[valid_size:]) {
+		return 0, 0, fmt.Errorf("JournalV1::recover - segment [%s] - %s", segment.path, err)
+	}
+
+	f, err := os.OpenFile(segment.path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(int64(valid_size)); err != nil {
+		return 0, 0, err
+	}
+
+	return next_seq, valid_size, f.Sync()
+}
+
+// scan entries of a segment - returns size of valid entries including header,
+// and the seq after the last valid entry
+func (j *JournalV1) scan(buf []byte, fn func(seq uint64, payload []byte) error) (int, uint64, error) {
+
+	pos, seq, err := j.decodeHeader(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for pos < len(buf) {
+
+		if len(buf) < pos+4+8 {
+			return pos, seq, fmt.Errorf("JournalV1::scan - partial entry header at %d", pos)
+		}
+
+		length := binary.BigEndian.Uint32(buf[pos : pos+4])
+		if length > JOURNAL_MAX_ENTRY_SIZE {
+			return pos, seq, fmt.Errorf("JournalV1::scan - entry size %d larger than %d at %d", length, JOURNAL_MAX_ENTRY_SIZE, pos)
+		}
+
+		end := pos + 4 + 8 + int(length)
+		if len(buf) < end+4 {
+			return pos, seq, fmt.Errorf("JournalV1::scan - partial entry at %d", pos)
+		}
+
+		computed_crc32 := crc32.ChecksumIEEE(buf[pos:end])
+		entry_crc32 := binary.BigEndian.Uint32(buf[end : end+4])
+		if computed_crc32 != entry_crc32 {
+			return pos, seq, fmt.Errorf("JournalV1::scan - entry crc32 checksum failed at %d - computed %d vs entry %d", pos, computed_crc32, entry_crc32)
+		}
+
+		entry_seq := binary.BigEndian.Uint64(buf[pos+4 : pos+4+8])
+		if entry_seq != seq {
+			return pos, seq, fmt.Errorf("JournalV1::scan - entry seq %d, expected %d at %d", entry_seq, seq, pos)
+		}
+
+		if fn != nil {
+			if err := fn(entry_seq, buf[pos+4+8:end]); err != nil {
+				return pos, seq, err
+			}
+		}
+
+		pos = end + 4
+		seq++
+	}
+
+	return pos, seq, nil
+}
+
+// decode and verify segment header - returns header size and start seq
+func (j *JournalV1) decodeHeader(buf []byte) (int, uint64, error) {
+
+	pos := 0
+
+	// version
+	if len(buf) < pos+4 {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - no version")
+	}
+	version := binary.BigEndian.Uint32(buf[pos : pos+4])
+	if version != 1 {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - unsupported version - %d", version)
+	}
+	pos += 4
+
+	// consensus id
+	consensus_id, err := util.NewMappedConsensusID(buf[pos:])
+	if err != nil {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - %s", err)
+	}
+	if !collection.EqualByteSlice(consensus_id.Buf(), j.consensus_id.Buf()) {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - consensus id not match")
+	}
+	pos += len(consensus_id.Buf())
+
+	// domain
+	domain, _, err := util.NewStandardMappedValue(buf[pos:])
+	if err != nil {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - %s", err)
+	}
+	if string(domain.Value()) != j.domain {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - domain [%s] not match [%s]", domain.Value(), j.domain)
+	}
+	pos += len(domain.Buf())
+
+	// start seq
+	if len(buf) < pos+8 {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - no start seq")
+	}
+	start_seq := binary.BigEndian.Uint64(buf[pos : pos+8])
+	pos += 8
+
+	// header crc32
+	if len(buf) < pos+4 {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - no header crc32")
+	}
+	computed_crc32 := crc32.ChecksumIEEE(buf[:pos])
+	header_crc32 := binary.BigEndian.Uint32(buf[pos : pos+4])
+	if computed_crc32 != header_crc32 {
+		return 0, 0, fmt.Errorf("JournalV1::decodeHeader - header crc32 checksum failed - computed %d vs header %d", computed_crc32, header_crc32)
+	}
+	pos += 4
+
+	return pos, start_seq, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+func journal_segment_name(num uint64) string {
+	return fmt.Sprintf("%016x%s", num, JOURNAL_SEGMENT_SUFFIX)
+}
+
+func journal_encode_header(consensus_id util.IConsensusID, domain string, start_seq uint64) ([]byte, error) {
+
+	header := appendUint32(nil, 1)
+	header = append(header, consensus_id.Buf()...)
+
+	value := util.NewPrimitive([]byte(domain))
+	if err := value.Encode(nil); err != nil {
+		return nil, fmt.Errorf("journal_encode_header - %s", err)
+	}
+	header = append(header, value.Buf()...)
+
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, start_seq)
+	header = append(header, seq...)
+
+	return appendUint32(header, crc32.ChecksumIEEE(header)), nil
+}
+
+func journal_header_size(consensus_id util.IConsensusID, domain string) uint32 {
+	header, err := journal_encode_header(consensus_id, domain, 0)
+	if err != nil {
+		return 0
+	}
+	return uint32(len(header))
+}
+
+// whether bytes after the last valid entry are a torn write - a partial entry
+// running to the end of the segment, or space allocated but never written
+func journal_is_torn(buf []byte) bool {
+
+	if len(buf) < 4+8 {
+		return true
+	}
+
+	length := binary.BigEndian.Uint32(buf[:4])
+	if length <= JOURNAL_MAX_ENTRY_SIZE && len(buf) <= 4+8+int(length)+4 {
+		return true
+	}
+
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// entry is composed as <length> + <seq> + <table> + <time> + <records> + <crc32>
+func journal_encode_entry(seq uint64, payload []byte) []byte {
+
+	entry := make([]byte, 4+8, 4+8+len(payload)+4)
+	binary.BigEndian.PutUint32(entry, uint32(len(payload)))
+	binary.BigEndian.PutUint64(entry[4:], seq)
+	entry = append(entry, payload...)
+
+	return appendUint32(entry, crc32.ChecksumIEEE(entry))
+}
+
+// payload of one table is composed as <table> + <time> + <records>, and of
+// more tables as <empty table> + <time> + (<table> + <count> + <records>)...
+func journal_encode_payload(time util.IConsensusTime, batch *WriteBatch) ([]byte, error) {
+
+	tables := batch.Tables()
+	for _, table := range tables {
+		if table == "" {
+			return nil, fmt.Errorf("table is empty")
+		}
+	}
+
+	var err error
+	buf := []byte{}
+
+	if len(tables) == 1 {
+		if buf, err = journal_append_table(buf, tables[0]); err != nil {
+			return nil, err
+		}
+		buf = append(buf, time.Buf()...)
+		return journal_append_records(buf, batch.Records(tables[0]))
+	}
+
+	if buf, err = journal_append_table(buf, ""); err != nil {
+		return nil, err
+	}
+	buf = append(buf, time.Buf()...)
+
+	for _, table := range tables {
+		if buf, err = journal_append_table(buf, table); err != nil {
+			return nil, err
+		}
+		buf = appendUint32(buf, uint32(len(batch.Records(table))))
+		if buf, err = journal_append_records(buf, batch.Records(table)); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+func journal_append_table(buf []byte, table string) ([]byte, error) {
+	value := util.NewPrimitive([]byte(table))
+	if err := value.Encode(nil); err != nil {
+		return nil, err
+	}
+	return append(buf, value.Buf()...), nil
+}
+
+func journal_append_records(buf []byte, records []util.IRecord) ([]byte, error) {
+	for _, record := range records {
+		if collection.IsNil(record) {
+			return nil, fmt.Errorf("record is nil")
+		}
+		if !record.IsEncoded() {
+			if err := record.Encode(nil); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, record.Buf()...)
+	}
+	return buf, nil
+}
+
+// decode time, and tables and records of an entry
+func journal_decode_entry(buf []byte) (util.IConsensusTime, *WriteBatch, error) {
+
+	table, length, err := util.NewStandardMappedValue(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	pos := length
+
+	time, err := util.NewConsensusTime(buf[pos:])
+	if err != nil {
+		return nil, nil, err
+	}
+	pos += len(time.Buf())
+
+	batch := NewWriteBatch()
+
+	// records of one table
+	if len(table.Value()) > 0 {
+		for pos < len(buf) {
+			r, length, err := util.NewMappedRecord(buf[pos:])
+			if err != nil {
+				return nil, nil, err
+			}
+			batch.Set(string(table.Value()), r)
+			pos += length
+		}
+		return time, batch, nil
+	}
+
+	// records of each table of a batch
+	for pos < len(buf) {
+
+		table, length, err := util.NewStandardMappedValue(buf[pos:])
+		if err != nil {
+			return nil, nil, err
+		}
+		pos += length
+
+		if len(table.Value()) == 0 || len(buf) < pos+4 {
+			return nil, nil, fmt.Errorf("journal_decode_entry - invalid table of batch")
+		}
+		count := binary.BigEndian.Uint32(buf[pos:])
+		pos += 4
+
+		for i := uint32(0); i < count; i++ {
+			if pos >= len(buf) {
+				return nil, nil, fmt.Errorf("journal_decode_entry - %d records of table [%s] missing", count-i, table.Value())
+			}
+			r, length, err := util.NewMappedRecord(buf[pos:])
+			if err != nil {
+				return nil, nil, err
+			}
+			batch.Set(string(table.Value()), r)
+			pos += length
+		}
+	}
+
+	return time, batch, nil
 }
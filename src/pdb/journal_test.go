@@ -0,0 +1,387 @@
+package pdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// test utilities
+
+func replayTestJournal(t testing.TB, j *JournalV1, from_seq uint64) ([]uint64, []string) {
+	seqs := []uint64{}
+	keys := []string{}
+	err := j.Replay(from_seq, func(seq uint64, table string, time util.IConsensusTime, records []util.IRecord) error {
+		if table != "test.table" {
+			t.Errorf("replay table not match: %s", table)
+		}
+		if eq, _ := time.EQ(util.NewLedgerTime(1)); !eq {
+			t.Errorf("replay time not match: %x", time.Buf())
+		}
+		for _, r := range records {
+			seqs = append(seqs, seq)
+			keys = append(keys, testKeyString(r.Key()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seqs, keys
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestJournalV1(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	j, err := OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord("key1", "value1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Append("test.table", util.NewLedgerTime(1), []util.IRecord{newTestRecord("key2", "value2"), newTestRecord("key3", "value3")}); err != nil {
+		t.Fatal(err)
+	}
+	if j.NextSeq() != 3 {
+		t.Errorf("next seq not match: %d", j.NextSeq())
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord("key4", "value4")); err == nil {
+		t.Errorf("append to closed journal should fail")
+	}
+
+	// reopen and continue
+	j, err = OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord("key4", "value4")); err != nil {
+		t.Fatal(err)
+	}
+
+	seqs, keys := replayTestJournal(t, j, 0)
+	if fmt.Sprint(seqs) != "[1 2 2 3]" || fmt.Sprint(keys) != "[key1 key2 key3 key4]" {
+		t.Errorf("replay not match: %v, %v", seqs, keys)
+	}
+
+	seqs, keys = replayTestJournal(t, j, 3)
+	if fmt.Sprint(seqs) != "[3]" || fmt.Sprint(keys) != "[key4]" {
+		t.Errorf("replay from seq not match: %v, %v", seqs, keys)
+	}
+
+	// consensus id and domain must match
+	if _, err := OpenJournalV1(dir, newTestConsensusID(), "test.domain"); err == nil {
+		t.Errorf("open with different consensus id should fail")
+	}
+	if _, err := OpenJournalV1(dir, consensus_id, "other.domain"); err == nil {
+		t.Errorf("open with different domain should fail")
+	}
+}
+
+func TestJournalV1TornTail(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	j, err := OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%d", i), "value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := j.segment.Name()
+	j.Close()
+
+	// tear the last entry
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.NextSeq() != 10 {
+		t.Errorf("next seq not match: %d", j.NextSeq())
+	}
+	if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord("key9", "value")); err != nil {
+		t.Fatal(err)
+	}
+
+	seqs, keys := replayTestJournal(t, j, 0)
+	if len(seqs) != 10 || seqs[9] != 10 || keys[9] != "key9" {
+		t.Errorf("replay not match: %v, %v", seqs, keys)
+	}
+	j.Close()
+
+	// appends continue in the recovered segment
+	segments, err := j.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].path != path {
+		t.Errorf("segments not match: %v", segments)
+	}
+
+	// corruption before committed entries is an error, not a torn tail
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)/2] ^= 0xff
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenJournalV1(dir, consensus_id, "test.domain"); err == nil {
+		t.Errorf("open with corrupted segment should fail")
+	}
+	buf[len(buf)/2] ^= 0xff
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// tail allocated but never written is torn
+	if err := ioutil.WriteFile(path, append(buf, make([]byte, 64)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err = OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.NextSeq() != 11 {
+		t.Errorf("next seq not match: %d", j.NextSeq())
+	}
+	j.Close()
+}
+
+func TestJournalV1Reopen(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	for i := 0; i < 5; i++ {
+		j, err := OpenJournalV1(dir, consensus_id, "test.domain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%d", i), "value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j, err := OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// restarts do not leave a segment each
+	segments, err := j.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("segments not reused: %d", len(segments))
+	}
+
+	seqs, keys := replayTestJournal(t, j, 0)
+	if fmt.Sprint(seqs) != "[1 2 3 4 5]" || fmt.Sprint(keys) != "[key0 key1 key2 key3 key4]" {
+		t.Errorf("replay not match: %v, %v", seqs, keys)
+	}
+}
+
+func TestJournalV1Rollover(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	j, err := OpenJournalV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	j.max_segment_size = 1024
+	for i := 0; i < 100; i++ {
+		if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%03d", i), "value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, err := j.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Errorf("segments not rolled over: %d", len(segments))
+	}
+	for _, segment := range segments {
+		info, err := os.Stat(segment.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("segment [%s] size %d exceeding limit", segment.path, info.Size())
+		}
+	}
+
+	seqs, keys := replayTestJournal(t, j, 0)
+	if len(keys) != 100 {
+		t.Fatalf("replay count not match: %d", len(keys))
+	}
+	for i := range keys {
+		if seqs[i] != uint64(i+1) || keys[i] != fmt.Sprintf("key%03d", i) {
+			t.Errorf("replay [%d] not match: %d, %s", i, seqs[i], keys[i])
+		}
+	}
+}
+
+func TestJournalV1Concurrent(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournalV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%d-%d", w, i), "value")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seqs, _ := replayTestJournal(t, j, 0)
+	if len(seqs) != 8*50 {
+		t.Errorf("replay count not match: %d", len(seqs))
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Errorf("replay seq [%d] not match: %d", i, seq)
+			break
+		}
+	}
+}
+
+func TestJournalV1Purge(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournalV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// commit hook is called in order of seq
+	committed := []uint64{}
+	j.OnCommit(func(seq uint64, table string, time util.IConsensusTime, records []util.IRecord) error {
+		committed = append(committed, seq)
+		return nil
+	})
+
+	j.max_segment_size = 512
+	for i := 0; i < 50; i++ {
+		if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%03d", i), "value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, seq := range committed {
+		if seq != uint64(i+1) {
+			t.Fatalf("commit hook seq [%d] not match: %d", i, seq)
+		}
+	}
+
+	before, _ := j.segments()
+	if err := j.Purge(30); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := j.segments()
+	if len(after) >= len(before) {
+		t.Errorf("segments not purged: %d, %d", len(before), len(after))
+	}
+
+	// entries from seq 30 are kept
+	seqs, _ := replayTestJournal(t, j, 0)
+	if len(seqs) == 0 || seqs[0] > 30 || seqs[len(seqs)-1] != 50 {
+		t.Errorf("replay after purge not match: %v", seqs)
+	}
+
+	// current segment is never purged
+	if err := j.Purge(1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.AppendRecord("test.table", util.NewLedgerTime(1), newTestRecord("key", "value")); err != nil {
+		t.Fatal(err)
+	}
+	if seqs, _ := replayTestJournal(t, j, 0); len(seqs) == 0 || seqs[len(seqs)-1] != 51 {
+		t.Errorf("replay after purge all not match: %v", seqs)
+	}
+}
+
+func BenchmarkJournalV1Append(b *testing.B) {
+
+	dir := newTestDir(b)
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournalV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer j.Close()
+
+	r := newTestRecord("key", "value")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := j.AppendRecord("test.table", util.NewLedgerTime(1), r); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,999 @@
+package pdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"../collection"
+	"../util"
+)
+
+const (
+	MANIFEST_FILENAME     = "MANIFEST"
+	MANIFEST_LOG_FILENAME = "MANIFEST.log"
+	MANIFEST_MAX_EDITS    = 1024 // write a snapshot when edit log has this many edits
+	SSTABLE_SUFFIX        = ".sst"
+	manifest_file_clear   = uint32(0x01) // flag of a file with CLEAR records
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Manifest V1
+//
+// ManifestV1 records the live SSTable files of a table directory, and the
+// journal seq up to which records of the table are flushed.  Changes are
+// appended to an edit log, and periodically folded into a snapshot:
+//
+//   MANIFEST      - snapshot, rewritten atomically
+//                     - version, edit seq, flushed seq, next file number, file count
+//                     - files      : level, file number, start key, end key,
+//                                    size, flags, start time, end time
+//                     - crc32
+//
+//   MANIFEST.log  - edit log, appended and synced on each change
+//                     - length, edit, crc32
+//                     - edit       : edit seq, flushed seq, next file number,
+//                                    added files, removed file numbers
+//
+// The key range of a file is kept with its level, so reads find the files
+// that may hold a key without opening every file - an empty key range is not
+// known, and the file may hold any key.  Size, time range and whether the
+// file has CLEAR records are kept too, so compaction picks its inputs without
+// opening files - empty times are not known, and the file is opened to learn
+// them.
+//
+// Edits with edit seq not after the snapshot are already in the snapshot, and
+// skipped on open, so a crash between writing a snapshot and truncating the
+// edit log is safe.  A torn edit at the tail of the log is truncated on open,
+// a corrupted edit anywhere else fails the open - edits after it were
+// committed, and the journal may be purged past them.
+//
+// Each change installs a new ManifestVersion.  Readers hold a reference to a
+// version while reading its files, and a file removed by compaction is only
+// deleted from disk when no live version holds it.
+//
+// SSTable files are named <file number in hex> + SSTABLE_SUFFIX.  Files not
+// recorded in the manifest are left over from a crash, and removed on open -
+// unless a torn tail was truncated, then they are kept, and new file numbers
+// start past them.
+// Readers open SSTables of a version through the TableCache of the manifest,
+// and a file is evicted from the table cache before it is deleted.
+
+type ManifestV1 struct {
+	dir           string
+	mutex         sync.Mutex
+	current       *ManifestVersion
+	edit_seq      uint64 // seq of the last edit
+	next_file_num uint64
+	log           *os.File
+	log_edits     int // edits in log since last snapshot
+	max_edits     int
+	file_refs     map[uint64]int // number of live versions holding each file
+	tables        *TableCache    // open SSTables
+	closed        bool
+}
+
+type ManifestFile struct {
+	level uint32
+	num   uint64
+	start util.IKey // smallest key, nil if not known
+	end   util.IKey // largest key, nil if not known
+	// stats, not known if times are nil
+	size       uint64 // file size
+	start_time util.IConsensusTime
+	end_time   util.IConsensusTime
+	clear      bool // whether any record is CLEAR
+}
+
+// immutable set of live files
+type ManifestVersion struct {
+	manifest    *ManifestV1
+	files       []ManifestFile
+	flushed_seq uint64 // records with journal seq before flushed seq are in SSTables
+	refs        int    // guarded by manifest mutex
+}
+
+type manifest_edit struct {
+	edit_seq      uint64
+	flushed_seq   uint64
+	next_file_num uint64
+	added         []ManifestFile
+	removed       []uint64
+}
+
+func OpenManifestV1(dir string) (*ManifestV1, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &ManifestV1{
+		dir:           dir,
+		next_file_num: 1,
+		max_edits:     MANIFEST_MAX_EDITS,
+		file_refs:     map[uint64]int{},
+		tables:        DefaultTableCache(),
+	}
+	v := &ManifestVersion{manifest: m, files: []ManifestFile{}}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, MANIFEST_FILENAME))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if v, err = m.decodeSnapshot(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	torn := false
+	if v, torn, err = m.recover(v); err != nil {
+		return nil, err
+	}
+
+	m.install(v)
+
+	if err := m.removeOrphans(torn); err != nil {
+		m.log.Close()
+		return nil, err
+	}
+
+	if m.log_edits >= m.max_edits {
+		if err := m.snapshot(); err != nil {
+			m.log.Close()
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// manifest of a table, under the data dir of consensus ID and domain on node
+func OpenTableManifestV1(node_id string, consensus_id util.IConsensusID, domain, table string) (*ManifestV1, error) {
+
+	if err := flush_check_table(table); err != nil {
+		return nil, fmt.Errorf("OpenTableManifestV1 - %s", err)
+	}
+
+	return OpenManifestV1(table_dir(util.LCGetConsensusDir(node_id, domain, consensus_id), table))
+}
+
+func (m *ManifestV1) Dir() string {
+	return m.dir
+}
+
+// current version with a reference held, caller must Release it
+func (m *ManifestV1) Current() *ManifestVersion {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.current.refs++
+	return m.current
+}
+
+func (m *ManifestV1) FlushedSeq() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.current.flushed_seq
+}
+
+// live files of current version, in order of being added - files may be
+// deleted by compaction unless read through a referenced version
+func (m *ManifestV1) Files() []ManifestFile {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]ManifestFile{}, m.current.files...)
+}
+
+// allocate a new file number
+func (m *ManifestV1) NewFileNum() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	num := m.next_file_num
+	m.next_file_num++
+	return num
+}
+
+func (m *ManifestV1) FilePath(num uint64) string {
+	return filepath.Join(m.dir, fmt.Sprintf("%016x%s", num, SSTABLE_SUFFIX))
+}
+
+// record a new file, and advance flushed seq
+func (m *ManifestV1) AddFile(level uint32, num uint64, flushed_seq uint64) error {
+	return m.Apply([]ManifestFile{NewManifestFile(level, num)}, nil, flushed_seq)
+}
+
+// add and remove files atomically, and advance flushed seq - removed files are
+// deleted from disk once no version holds them
+func (m *ManifestV1) Apply(added []ManifestFile, removed []ManifestFile, flushed_seq uint64) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return fmt.Errorf("ManifestV1::Apply - manifest closed")
+	}
+
+	if flushed_seq < m.current.flushed_seq {
+		flushed_seq = m.current.flushed_seq
+	}
+
+	edit := &manifest_edit{
+		edit_seq:      m.edit_seq + 1,
+		flushed_seq:   flushed_seq,
+		next_file_num: m.next_file_num,
+		added:         added,
+		removed:       []uint64{},
+	}
+	for _, file := range removed {
+		edit.removed = append(edit.removed, file.num)
+	}
+
+	v, err := m.current.apply(edit)
+	if err != nil {
+		return fmt.Errorf("ManifestV1::Apply - %s", err)
+	}
+
+	if err := m.append(edit); err != nil {
+		return err
+	}
+
+	m.edit_seq = edit.edit_seq
+	m.install(v)
+
+	// edit is durable in log, snapshot is retried on next edit if failed
+	if m.log_edits >= m.max_edits {
+		if err := m.snapshot(); err != nil {
+			log.Printf("ManifestV1::Apply - snapshot - %s", err)
+		}
+	}
+
+	return nil
+}
+
+// table cache of SSTables of the manifest
+func (m *ManifestV1) TableCache() *TableCache {
+	return m.tables
+}
+
+// set table cache, before any version is read
+func (m *ManifestV1) SetTableCache(tables *TableCache) {
+	m.tables = tables
+}
+
+// close edit log, versions still referenced remain readable
+func (m *ManifestV1) Close() error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	// tables of versions still referenced are closed when released
+	for _, file := range m.current.files {
+		m.tables.Evict(m.FilePath(file.num))
+	}
+
+	return m.log.Close()
+}
+
+// install a new current version, mutex must be held
+func (m *ManifestV1) install(v *ManifestVersion) {
+
+	v.refs = 1
+	for _, file := range v.files {
+		m.file_refs[file.num]++
+	}
+
+	old := m.current
+	m.current = v
+	if old != nil {
+		m.release(old)
+	}
+}
+
+// drop a reference of version, and delete files no longer held, mutex must be held
+func (m *ManifestV1) release(v *ManifestVersion) {
+
+	v.refs--
+	if v.refs > 0 {
+		return
+	}
+	if v.refs < 0 {
+		panic("ManifestV1::release - version released more than referenced")
+	}
+
+	for _, file := range v.files {
+		m.file_refs[file.num]--
+		if m.file_refs[file.num] == 0 {
+			delete(m.file_refs, file.num)
+			m.tables.Evict(m.FilePath(file.num))
+			os.Remove(m.FilePath(file.num))
+		}
+	}
+}
+
+// file with key range not known
+func NewManifestFile(level uint32, num uint64) ManifestFile {
+	return ManifestFile{level: level, num: num}
+}
+
+// file with key range [start, end], keys are copied
+func NewManifestFileRange(level uint32, num uint64, start, end util.IKey) (ManifestFile, error) {
+
+	file := ManifestFile{level: level, num: num}
+	if collection.IsNil(start) || collection.IsNil(end) {
+		return file, nil
+	}
+
+	var err error
+	if file.start, err = manifest_copy_key(start); err != nil {
+		return file, fmt.Errorf("NewManifestFileRange - %s", err)
+	}
+	if file.end, err = manifest_copy_key(end); err != nil {
+		return file, fmt.Errorf("NewManifestFileRange - %s", err)
+	}
+
+	return file, nil
+}
+
+// file with key range and stats of an SSTable of size
+func NewManifestTableFile(level uint32, num uint64, table ISSTable, size uint64) (ManifestFile, error) {
+
+	file := NewManifestFile(level, num)
+	if table.Count() > 0 {
+		var err error
+		if file, err = NewManifestFileRange(level, num, table.StartKey(), table.EndKey()); err != nil {
+			return file, err
+		}
+	}
+
+	return file.withStats(size, table.StartTime(), table.EndTime(), table.HasClear())
+}
+
+func (f ManifestFile) Level() uint32 {
+	return f.level
+}
+
+func (f ManifestFile) Num() uint64 {
+	return f.num
+}
+
+// smallest key of file, nil if not known
+func (f ManifestFile) StartKey() util.IKey {
+	return f.start
+}
+
+// largest key of file, nil if not known
+func (f ManifestFile) EndKey() util.IKey {
+	return f.end
+}
+
+// whether key range of file is known
+func (f ManifestFile) HasRange() bool {
+	return f.start != nil && f.end != nil
+}
+
+// file size, 0 if not known
+func (f ManifestFile) Size() uint64 {
+	return f.size
+}
+
+// earliest time of records, nil if not known
+func (f ManifestFile) StartTime() util.IConsensusTime {
+	return f.start_time
+}
+
+// latest time of records, nil if not known
+func (f ManifestFile) EndTime() util.IConsensusTime {
+	return f.end_time
+}
+
+// whether any record is CLEAR, false if not known
+func (f ManifestFile) HasClear() bool {
+	return f.clear
+}
+
+// whether size, time range and CLEAR of file are known
+func (f ManifestFile) HasStats() bool {
+	return f.start_time != nil && f.end_time != nil
+}
+
+// the same file with stats, times are copied
+func (f ManifestFile) withStats(size uint64, start_time, end_time util.IConsensusTime, clear bool) (ManifestFile, error) {
+
+	if collection.IsNil(start_time) || collection.IsNil(end_time) {
+		return f, fmt.Errorf("ManifestFile::withStats - start time or end time is nil")
+	}
+
+	var err error
+	if f.start_time, err = util.NewConsensusTime(start_time.Buf()); err != nil {
+		return f, fmt.Errorf("ManifestFile::withStats - %s", err)
+	}
+	if f.end_time, err = util.NewConsensusTime(end_time.Buf()); err != nil {
+		return f, fmt.Errorf("ManifestFile::withStats - %s", err)
+	}
+	f.size = size
+	f.clear = clear
+
+	return f, nil
+}
+
+// the same file at another level
+func (f ManifestFile) atLevel(level uint32) ManifestFile {
+	f.level = level
+	return f
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ManifestVersion
+
+func (v *ManifestVersion) Files() []ManifestFile {
+	return append([]ManifestFile{}, v.files...)
+}
+
+func (v *ManifestVersion) FlushedSeq() uint64 {
+	return v.flushed_seq
+}
+
+func (v *ManifestVersion) FilePath(num uint64) string {
+	return v.manifest.FilePath(num)
+}
+
+// release reference to version, files removed since are deleted once no version holds them
+func (v *ManifestVersion) Release() {
+	v.manifest.mutex.Lock()
+	defer v.manifest.mutex.Unlock()
+	v.manifest.release(v)
+}
+
+// new version with edit applied
+func (v *ManifestVersion) apply(edit *manifest_edit) (*ManifestVersion, error) {
+
+	files := []ManifestFile{}
+	for _, file := range v.files {
+		if !manifest_contains_num(edit.removed, file.num) {
+			files = append(files, file)
+		}
+	}
+	if len(files)+len(edit.removed) != len(v.files) {
+		return nil, fmt.Errorf("removed files not found in manifest")
+	}
+	for _, file := range edit.added {
+		if manifest_contains(files, file.num) {
+			return nil, fmt.Errorf("file %d already exists", file.num)
+		}
+		files = append(files, file)
+	}
+
+	return &ManifestVersion{manifest: v.manifest, files: files, flushed_seq: edit.flushed_seq}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// persistence
+
+// append an edit to log and sync, mutex must be held
+func (m *ManifestV1) append(edit *manifest_edit) error {
+
+	payload := edit.encode()
+	buf := appendUint32(nil, uint32(len(payload)))
+	buf = append(buf, payload...)
+	buf = appendUint32(buf, crc32.ChecksumIEEE(payload))
+
+	if _, err := m.log.Write(buf); err != nil {
+		return err
+	}
+	if err := m.log.Sync(); err != nil {
+		return err
+	}
+
+	m.log_edits++
+
+	return nil
+}
+
+// write current version to snapshot, and truncate edit log, mutex must be held
+func (m *ManifestV1) snapshot() error {
+
+	buf := m.encodeSnapshot(m.current)
+	if err := writeFileAtomic(filepath.Join(m.dir, MANIFEST_FILENAME), buf); err != nil {
+		return err
+	}
+
+	// edits in log are now in snapshot
+	if err := m.log.Truncate(0); err != nil {
+		return err
+	}
+	if err := m.log.Sync(); err != nil {
+		return err
+	}
+
+	m.log_edits = 0
+
+	return nil
+}
+
+// snapshot of a version as of last edit, mutex must be held
+func (m *ManifestV1) encodeSnapshot(v *ManifestVersion) []byte {
+
+	buf := appendUint32(nil, 1)
+	buf = appendUint64(buf, m.edit_seq)
+	buf = appendUint64(buf, v.flushed_seq)
+	buf = appendUint64(buf, m.next_file_num)
+	buf = appendUint32(buf, uint32(len(v.files)))
+	for _, file := range v.files {
+		buf = manifest_append_file(buf, file)
+	}
+	buf = appendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	return buf
+}
+
+func (m *ManifestV1) decodeSnapshot(buf []byte) (*ManifestVersion, error) {
+
+	if len(buf) < 4+8+8+8+4+4 {
+		return nil, fmt.Errorf("ManifestV1::decodeSnapshot - manifest too short")
+	}
+
+	computed_crc32 := crc32.ChecksumIEEE(buf[:len(buf)-4])
+	manifest_crc32 := binary.BigEndian.Uint32(buf[len(buf)-4:])
+	if computed_crc32 != manifest_crc32 {
+		return nil, fmt.Errorf("ManifestV1::decodeSnapshot - crc32 checksum failed - computed %d vs manifest %d", computed_crc32, manifest_crc32)
+	}
+
+	version := binary.BigEndian.Uint32(buf)
+	if version != 1 {
+		return nil, fmt.Errorf("ManifestV1::decodeSnapshot - unsupported version - %d", version)
+	}
+
+	m.edit_seq = binary.BigEndian.Uint64(buf[4:])
+	v := &ManifestVersion{manifest: m, flushed_seq: binary.BigEndian.Uint64(buf[12:]), files: []ManifestFile{}}
+	m.next_file_num = binary.BigEndian.Uint64(buf[20:])
+	count := int(binary.BigEndian.Uint32(buf[28:]))
+
+	pos := 32
+	for i := 0; i < count; i++ {
+		file, length, err := manifest_decode_file(buf[pos : len(buf)-4])
+		if err != nil {
+			return nil, fmt.Errorf("ManifestV1::decodeSnapshot - file %d of %d - %s", i, count, err)
+		}
+		v.files = append(v.files, file)
+		pos += length
+	}
+	if pos != len(buf)-4 {
+		return nil, fmt.Errorf("ManifestV1::decodeSnapshot - file count %d not match manifest size %d", count, len(buf))
+	}
+
+	return v, nil
+}
+
+// open edit log, and apply edits after snapshot to version - returns whether
+// a torn tail is truncated
+func (m *ManifestV1) recover(v *ManifestVersion) (*ManifestVersion, bool, error) {
+
+	path := filepath.Join(m.dir, MANIFEST_LOG_FILENAME)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	pos := 0
+	for pos+4 <= len(buf) {
+
+		length := int(binary.BigEndian.Uint32(buf[pos:]))
+		if length > len(buf)-pos-4-4 {
+			break
+		}
+		payload := buf[pos+4 : pos+4+length]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[pos+4+length:]) {
+			break
+		}
+
+		edit, err := manifest_decode_edit(payload)
+		if err != nil {
+			return nil, false, fmt.Errorf("ManifestV1::recover - %s", err)
+		}
+		pos += 4 + length + 4
+		m.log_edits++
+
+		// already in snapshot
+		if edit.edit_seq <= m.edit_seq {
+			continue
+		}
+
+		if v, err = v.apply(edit); err != nil {
+			return nil, false, fmt.Errorf("ManifestV1::recover - edit %d - %s", edit.edit_seq, err)
+		}
+		m.edit_seq = edit.edit_seq
+		if edit.next_file_num > m.next_file_num {
+			m.next_file_num = edit.next_file_num
+		}
+	}
+
+	// only a partial edit at the tail may be torn by a crash, edits after a
+	// corrupted edit were committed and must not be dropped
+	if pos < len(buf) && !manifest_is_torn(buf[pos:]) {
+		return nil, false, fmt.Errorf("ManifestV1::recover - corrupted edit at offset %d of %d", pos, len(buf))
+	}
+
+	m.log, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// truncate torn tail
+	if pos < len(buf) {
+		if err := m.log.Truncate(int64(pos)); err != nil {
+			m.log.Close()
+			return nil, false, err
+		}
+		if err := m.log.Sync(); err != nil {
+			m.log.Close()
+			return nil, false, err
+		}
+	}
+
+	return v, pos < len(buf), nil
+}
+
+// remove SSTable files and temporary files not recorded in manifest - if
+// keep, SSTable files are kept, and new file numbers start past them
+func (m *ManifestV1) removeOrphans(keep bool) error {
+
+	live := map[string]bool{}
+	for _, file := range m.current.files {
+		live[m.FilePath(file.num)] = true
+	}
+
+	entries, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(m.dir, entry.Name())
+		if entry.IsDir() || live[path] {
+			continue
+		}
+		if keep && strings.HasSuffix(entry.Name(), SSTABLE_SUFFIX) {
+			var num uint64
+			if _, err := fmt.Sscanf(entry.Name(), "%016x"+SSTABLE_SUFFIX, &num); err == nil && num >= m.next_file_num {
+				m.next_file_num = num + 1
+			}
+			log.Printf("ManifestV1::removeOrphans - [%s] not in manifest, kept after torn tail", path)
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), SSTABLE_SUFFIX) || strings.HasSuffix(entry.Name(), ".tmp") {
+			m.tables.Evict(path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// whether bytes after the last valid edit are a torn write - a partial edit
+// running to the end of the log, or space allocated but never written
+func manifest_is_torn(buf []byte) bool {
+
+	if len(buf) < 4 {
+		return true
+	}
+
+	length := binary.BigEndian.Uint32(buf[:4])
+	if uint64(len(buf)) <= 4+uint64(length)+4 {
+		return true
+	}
+
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *manifest_edit) encode() []byte {
+
+	buf := appendUint64(nil, e.edit_seq)
+	buf = appendUint64(buf, e.flushed_seq)
+	buf = appendUint64(buf, e.next_file_num)
+	buf = appendUint32(buf, uint32(len(e.added)))
+	for _, file := range e.added {
+		buf = manifest_append_file(buf, file)
+	}
+	buf = appendUint32(buf, uint32(len(e.removed)))
+	for _, num := range e.removed {
+		buf = appendUint64(buf, num)
+	}
+
+	return buf
+}
+
+func manifest_decode_edit(buf []byte) (*manifest_edit, error) {
+
+	if len(buf) < 8+8+8+4 {
+		return nil, fmt.Errorf("edit too short")
+	}
+
+	e := &manifest_edit{
+		edit_seq:      binary.BigEndian.Uint64(buf),
+		flushed_seq:   binary.BigEndian.Uint64(buf[8:]),
+		next_file_num: binary.BigEndian.Uint64(buf[16:]),
+		added:         []ManifestFile{},
+		removed:       []uint64{},
+	}
+
+	pos := 24
+	added := int(binary.BigEndian.Uint32(buf[pos:]))
+	pos += 4
+	for i := 0; i < added; i++ {
+		file, length, err := manifest_decode_file(buf[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("edit %d - added file %d of %d - %s", e.edit_seq, i, added, err)
+		}
+		e.added = append(e.added, file)
+		pos += length
+	}
+
+	if len(buf) < pos+4 {
+		return nil, fmt.Errorf("edit %d - no removed count", e.edit_seq)
+	}
+	removed := int(binary.BigEndian.Uint32(buf[pos:]))
+	pos += 4
+	if len(buf) != pos+removed*8 {
+		return nil, fmt.Errorf("edit %d - removed count %d not match edit size %d", e.edit_seq, removed, len(buf))
+	}
+	for i := 0; i < removed; i++ {
+		e.removed = append(e.removed, binary.BigEndian.Uint64(buf[pos:]))
+		pos += 8
+	}
+
+	return e, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// directory of a table under pdb directory
+func table_dir(dir, table string) string {
+	return filepath.Join(dir, TABLES_DIR, table)
+}
+
+func manifest_contains(files []ManifestFile, num uint64) bool {
+	for _, file := range files {
+		if file.num == num {
+			return true
+		}
+	}
+	return false
+}
+
+func manifest_contains_num(nums []uint64, num uint64) bool {
+	for _, n := range nums {
+		if n == num {
+			return true
+		}
+	}
+	return false
+}
+
+// file is composed as <level> + <file number> + <start key length> + <start key> + <end key length> + <end key>
+func manifest_append_file(buf []byte, file ManifestFile) []byte {
+
+	buf = appendUint32(buf, file.level)
+	buf = appendUint64(buf, file.num)
+	for _, key := range []util.IKey{file.start, file.end} {
+		if !file.HasRange() {
+			buf = appendUint32(buf, 0)
+			continue
+		}
+		buf = appendUint32(buf, uint32(len(key.Buf())))
+		buf = append(buf, key.Buf()...)
+	}
+
+	buf = appendUint64(buf, file.size)
+	flags := uint32(0)
+	if file.clear {
+		flags |= manifest_file_clear
+	}
+	buf = appendUint32(buf, flags)
+	for _, t := range []util.IConsensusTime{file.start_time, file.end_time} {
+		if !file.HasStats() {
+			buf = appendUint32(buf, 0)
+			continue
+		}
+		buf = appendUint32(buf, uint32(len(t.Buf())))
+		buf = append(buf, t.Buf()...)
+	}
+
+	return buf
+}
+
+// decode a file, returns the file and its encoded length
+func manifest_decode_file(buf []byte) (ManifestFile, int, error) {
+
+	if len(buf) < 4+8 {
+		return ManifestFile{}, 0, fmt.Errorf("file too short")
+	}
+
+	file := ManifestFile{level: binary.BigEndian.Uint32(buf), num: binary.BigEndian.Uint64(buf[4:])}
+	pos := 4 + 8
+
+	keys := [2]util.IKey{}
+	for i := range keys {
+		if len(buf) < pos+4 {
+			return file, 0, fmt.Errorf("file %d - no key length", file.num)
+		}
+		length := int(binary.BigEndian.Uint32(buf[pos:]))
+		pos += 4
+		if length == 0 {
+			continue
+		}
+		if len(buf) < pos+length {
+			return file, 0, fmt.Errorf("file %d - key length %d exceeding size %d", file.num, length, len(buf))
+		}
+		key, _, err := util.NewMappedKey(append([]byte{}, buf[pos:pos+length]...))
+		if err != nil {
+			return file, 0, fmt.Errorf("file %d - %s", file.num, err)
+		}
+		keys[i] = key
+		pos += length
+	}
+
+	if keys[0] != nil && keys[1] != nil {
+		file.start, file.end = keys[0], keys[1]
+	}
+
+	if len(buf) < pos+8+4 {
+		return file, 0, fmt.Errorf("file %d - no size or flags", file.num)
+	}
+	file.size = binary.BigEndian.Uint64(buf[pos:])
+	flags := binary.BigEndian.Uint32(buf[pos+8:])
+	if flags&^manifest_file_clear != 0 {
+		return file, 0, fmt.Errorf("file %d - unsupported flags %x", file.num, flags)
+	}
+	file.clear = flags&manifest_file_clear != 0
+	pos += 8 + 4
+
+	times := [2]util.IConsensusTime{}
+	for i := range times {
+		if len(buf) < pos+4 {
+			return file, 0, fmt.Errorf("file %d - no time length", file.num)
+		}
+		length := int(binary.BigEndian.Uint32(buf[pos:]))
+		pos += 4
+		if length == 0 {
+			continue
+		}
+		if len(buf) < pos+length {
+			return file, 0, fmt.Errorf("file %d - time length %d exceeding size %d", file.num, length, len(buf))
+		}
+		t, err := util.NewConsensusTime(buf[pos : pos+length])
+		if err != nil {
+			return file, 0, fmt.Errorf("file %d - %s", file.num, err)
+		}
+		times[i] = t
+		pos += length
+	}
+
+	if times[0] != nil && times[1] != nil {
+		file.start_time, file.end_time = times[0], times[1]
+	}
+
+	return file, pos, nil
+}
+
+// copy of a key, remains valid after the SSTable holding it is closed
+func manifest_copy_key(key util.IKey) (util.IKey, error) {
+
+	if !key.IsEncoded() {
+		if err := key.Encode(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	copied, _, err := util.NewMappedKey(append([]byte{}, key.Buf()...))
+	if err != nil {
+		return nil, err
+	}
+
+	return copied, nil
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return append(buf, b...)
+}
+
+// write to a temporary file, sync, and rename to the path
+func writeFileAtomic(path string, buf []byte) (err error) {
+
+	tmp_path := path + ".tmp"
+	f, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp_path)
+		}
+	}()
+
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp_path, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// hard link an immutable file, or copy if link is not possible
+func linkFile(src, dst string) error {
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	return copyFile(src, dst, -1)
+}
+
+// copy up to limit bytes of a file and sync, the whole file if limit is negative
+func copyFile(src, dst string, limit int64) (err error) {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	var r io.Reader = in
+	if limit >= 0 {
+		r = io.LimitReader(in, limit)
+	}
+
+	n, err := io.Copy(out, r)
+	if err != nil {
+		return err
+	}
+	if limit >= 0 && n != limit {
+		return fmt.Errorf("copied %d of %d bytes", n, limit)
+	}
+
+	return out.Sync()
+}
@@ -0,0 +1,383 @@
+package pdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// test utilities
+
+// create an empty file for a file number
+func touchTestFile(t testing.TB, m *ManifestV1, num uint64) {
+	if err := ioutil.WriteFile(m.FilePath(num), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFileExists(m *ManifestV1, num uint64) bool {
+	_, err := os.Stat(m.FilePath(num))
+	return err == nil
+}
+
+func testManifestFiles(files []ManifestFile) string {
+	result := []string{}
+	for _, file := range files {
+		result = append(result, fmt.Sprintf("%d:%d", file.Level(), file.Num()))
+	}
+	return fmt.Sprint(result)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestManifestV1(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nums := []uint64{}
+	for i := 0; i < 3; i++ {
+		num := m.NewFileNum()
+		touchTestFile(t, m, num)
+		if err := m.AddFile(0, num, uint64(10*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+		nums = append(nums, num)
+	}
+
+	// compact first two files, and move the third
+	merged := m.NewFileNum()
+	touchTestFile(t, m, merged)
+	err = m.Apply(
+		[]ManifestFile{NewManifestFile(1, merged), NewManifestFile(1, nums[2])},
+		[]ManifestFile{NewManifestFile(0, nums[0]), NewManifestFile(0, nums[1]), NewManifestFile(0, nums[2])},
+		0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Apply(nil, []ManifestFile{NewManifestFile(0, nums[0])}, 0); err == nil {
+		t.Errorf("removing missing file should fail")
+	}
+	if err := m.AddFile(1, merged, 0); err == nil {
+		t.Errorf("adding existing file should fail")
+	}
+
+	want := "[1:4 1:3]"
+	if got := testManifestFiles(m.Files()); got != want {
+		t.Errorf("files %s; want %s", got, want)
+	}
+	if m.FlushedSeq() != 30 {
+		t.Errorf("flushed seq %d; want 30", m.FlushedSeq())
+	}
+	if testFileExists(m, nums[0]) || testFileExists(m, nums[1]) || !testFileExists(m, nums[2]) {
+		t.Errorf("removed files not deleted, or moved file deleted")
+	}
+
+	// orphan file is removed on open
+	orphan := m.NewFileNum()
+	touchTestFile(t, m, orphan)
+	m.Close()
+
+	m, err = OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if got := testManifestFiles(m.Files()); got != want {
+		t.Errorf("reopened files %s; want %s", got, want)
+	}
+	if m.FlushedSeq() != 30 {
+		t.Errorf("reopened flushed seq %d; want 30", m.FlushedSeq())
+	}
+	if testFileExists(m, orphan) {
+		t.Errorf("orphan file not removed")
+	}
+	if num := m.NewFileNum(); num <= merged {
+		t.Errorf("file number %d reused", num)
+	}
+}
+
+func TestManifestV1Snapshot(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.max_edits = 4
+
+	for i := 0; i < 10; i++ {
+		num := m.NewFileNum()
+		touchTestFile(t, m, num)
+		if err := m.AddFile(0, num, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// log is truncated after snapshot
+	if m.log_edits != 2 {
+		t.Errorf("log edits %d; want 2", m.log_edits)
+	}
+
+	// keep a copy of log, as if crashed before truncate after the next snapshot
+	num := m.NewFileNum()
+	touchTestFile(t, m, num)
+	if err := m.AddFile(0, num, 11); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := ioutil.ReadFile(filepath.Join(dir, MANIFEST_LOG_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	num = m.NewFileNum()
+	touchTestFile(t, m, num)
+	if err := m.AddFile(0, num, 12); err != nil {
+		t.Fatal(err)
+	}
+	if m.log_edits != 0 {
+		t.Errorf("log edits %d; want 0", m.log_edits)
+	}
+	want := testManifestFiles(m.Files())
+	m.Close()
+
+	// edits in stale log are already in snapshot
+	if err := ioutil.WriteFile(filepath.Join(dir, MANIFEST_LOG_FILENAME), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if got := testManifestFiles(m.Files()); got != want {
+		t.Errorf("files %s; want %s", got, want)
+	}
+	if m.FlushedSeq() != 12 {
+		t.Errorf("flushed seq %d; want 12", m.FlushedSeq())
+	}
+}
+
+func TestManifestV1KeyRange(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.max_edits = 2
+
+	// files with key range, and one without
+	for i := 0; i < 3; i++ {
+		num := m.NewFileNum()
+		touchTestFile(t, m, num)
+		file := NewManifestFile(1, num)
+		if i > 0 {
+			start, end := newTestKey(fmt.Sprintf("key%03d", 10*i)), newTestKey(fmt.Sprintf("key%03d", 10*i+9))
+			if file, err = NewManifestFileRange(1, num, start, end); err != nil {
+				t.Fatal(err)
+			}
+			if file, err = file.withStats(uint64(100*i), util.NewLedgerTime(uint32(i)), util.NewLedgerTime(uint32(i+1)), i == 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.Apply([]ManifestFile{file}, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+
+	// first two files are in snapshot, the last in edit log
+	m, err = OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	files := m.Files()
+	if len(files) != 3 {
+		t.Fatalf("files %s; want 3 files", testManifestFiles(files))
+	}
+	if files[0].HasRange() || files[0].HasStats() {
+		t.Errorf("file %d has key range or stats; want none", files[0].Num())
+	}
+	for i, file := range files[1:] {
+		start, end := newTestKey(fmt.Sprintf("key%03d", 10*(i+1))), newTestKey(fmt.Sprintf("key%03d", 10*(i+1)+9))
+		if !file.HasRange() || !file.StartKey().Equal(start) || !file.EndKey().Equal(end) {
+			t.Errorf("file %d key range %v - %v; want %v - %v", file.Num(), file.StartKey(), file.EndKey(), start.Key(), end.Key())
+		}
+		if !file.HasStats() || file.Size() != uint64(100*(i+1)) || file.HasClear() != (i == 1) {
+			t.Errorf("file %d stats %v size %d clear %v", file.Num(), file.HasStats(), file.Size(), file.HasClear())
+		} else if eq, err := file.EndTime().EQ(util.NewLedgerTime(uint32(i + 2))); err != nil || !eq {
+			t.Errorf("file %d end time %x", file.Num(), file.EndTime().Buf())
+		}
+	}
+}
+
+func TestManifestV1TornTail(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		num := m.NewFileNum()
+		touchTestFile(t, m, num)
+		if err := m.AddFile(0, num, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+
+	// cut the last edit in half
+	path := filepath.Join(dir, MANIFEST_LOG_FILENAME)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testManifestFiles(m.Files()); got != "[0:1 0:2]" {
+		t.Errorf("files %s; want [0:1 0:2]", got)
+	}
+	if !testFileExists(m, 3) {
+		t.Errorf("file of torn edit removed")
+	}
+
+	// log continues after truncated tail, with file numbers past kept files
+	num := m.NewFileNum()
+	if num != 4 {
+		t.Errorf("file num %d after torn tail; want 4", num)
+	}
+	touchTestFile(t, m, num)
+	if err := m.AddFile(0, num, 4); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	m, err = OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if got := testManifestFiles(m.Files()); got != "[0:1 0:2 0:4]" {
+		t.Errorf("files %s; want [0:1 0:2 0:4]", got)
+	}
+	if testFileExists(m, 3) {
+		t.Errorf("orphan file not removed on clean open")
+	}
+}
+
+func TestManifestV1CorruptedEdit(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		num := m.NewFileNum()
+		touchTestFile(t, m, num)
+		if err := m.AddFile(0, num, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+
+	// flip a byte of the first edit, later edits are intact
+	path := filepath.Join(dir, MANIFEST_LOG_FILENAME)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[4+8] ^= 0xff
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := OpenManifestV1(dir); err == nil {
+		m.Close()
+		t.Fatalf("open with corrupted edit should fail")
+	}
+	for num := uint64(1); num <= 3; num++ {
+		if !testFileExists(m, num) {
+			t.Errorf("file %d removed after corrupted edit", num)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(buf)) {
+		t.Errorf("edit log truncated after corrupted edit: %v", err)
+	}
+}
+
+func TestManifestV1Version(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	old := m.NewFileNum()
+	touchTestFile(t, m, old)
+	if err := m.AddFile(0, old, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// reader holds the version with the old file
+	v := m.Current()
+
+	merged := m.NewFileNum()
+	touchTestFile(t, m, merged)
+	if err := m.Apply([]ManifestFile{NewManifestFile(1, merged)}, []ManifestFile{NewManifestFile(0, old)}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testManifestFiles(v.Files()); got != "[0:1]" {
+		t.Errorf("version files %s; want [0:1]", got)
+	}
+	if !testFileExists(m, old) {
+		t.Errorf("file deleted while version referenced")
+	}
+
+	v.Release()
+	if testFileExists(m, old) {
+		t.Errorf("file not deleted after version released")
+	}
+	if !testFileExists(m, merged) {
+		t.Errorf("live file deleted")
+	}
+}
@@ -1,18 +1,466 @@
 package pdb
 
 import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"../collection"
 	"../util"
 )
 
+const (
+	MEMTABLE_MAX_SIZE = uint64(64 * 1024 * 1024) // memtable is full and should be frozen when exceeding this size
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Interface
+
 type IMemTable interface {
 	// SSTable Level Attributes
 	Version() uint32                // Version
 	ConsensusID() util.IConsensusID // Consensus ID
 	Domain() string                 // Domain Name
 	Table() string                  // Table Name
+	StartTime() util.IConsensusTime // Start Time, nil if no time recorded
+	EndTime() util.IConsensusTime   // End Time, nil if no time recorded
+	Count() uint32                  // Record Count
+	Size() uint64                   // Approximate Encoded Size
 	// operations
-	Get(key, scheme util.IData) util.IRecord
+	Get(key util.IKey, group string) (util.IRecord, error) // get record with specified key and attribute group
 	Set(record util.IRecord) error
-	Groups(key, scheme util.IData) []string
-	Keys(key, scheme util.IData) []util.IData
+	UpdateTime(time util.IConsensusTime) error // extend start time and end time to include specified time
+	Groups(key util.IKey) ([]string, error)
+	Keys(key util.IKey) ([]util.IKey, error)
+	// Iterators
+	Iterator() ISSTableIterator                          // iterate all records in sorted order
+	RangeIterator(start, end util.IKey) ISSTableIterator // iterate records within given range, start inclusive, end not inclusive
+	PrefixIterator(prefix util.IKey) ISSTableIterator    // iterate records with specified key as prefix
+	// Freeze and Flush
+	IsFull() bool   // whether memtable crossed the size threshold
+	Freeze()        // freeze the memtable, no more Set is allowed
+	IsFrozen() bool // whether memtable is frozen
+	Flush(version uint32, filepath string, level uint32, start_time, end_time util.IConsensusTime) (ISSTable, error)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Implementation V1
+//
+// MemTableV1 keeps records in a collection.SkipList sorted the same way as
+// SSTables, by <key> + 0x00 + <group>.  Get, Groups, Keys and iterators are
+// lock free and may run concurrently with Set, while Set calls are serialized
+// by a mutex.  Once frozen, a memtable is read only and can be flushed to a
+// SSTable file.  A memtable holds at most SSTABLE_MAX_RECORDS records, so it
+// always fits in one SSTable - Set of a new key fails once it is reached.
+
+type MemTableV1 struct {
+	// basic attributes
+	consensus_id util.IConsensusID
+	domain       string
+	table        string
+	max_size     uint64
+	max_records  uint32 // Set of a new key fails when reached
+	start_time   util.IConsensusTime
+	end_time     util.IConsensusTime
+	// records
+	list  *collection.SkipList
+	size  uint64 // approximate encoded size, accessed atomically
+	count uint32 // number of records, accessed atomically
+	// writer
+	mutex  sync.Mutex
+	frozen int32 // accessed atomically
+}
+
+// key of the skip list, composed of record key and group
+type memtable_key struct {
+	key   util.IKey
+	group string
+}
+
+// record checked and encoded for a memtable, with its group
+type memtable_record struct {
+	record util.IRecord
+	group  string
+}
+
+func NewMemTableV1(consensus_id util.IConsensusID, domain, table string) *MemTableV1 {
+	return &MemTableV1{
+		consensus_id: consensus_id,
+		domain:       domain,
+		table:        table,
+		max_size:     MEMTABLE_MAX_SIZE,
+		max_records:  SSTABLE_MAX_RECORDS,
+		list:         collection.NewSkipList(),
+	}
+}
+
+func (m *MemTableV1) Version() uint32 {
+	return 1
+}
+
+func (m *MemTableV1) ConsensusID() util.IConsensusID {
+	return m.consensus_id
+}
+
+func (m *MemTableV1) Domain() string {
+	return m.domain
+}
+
+func (m *MemTableV1) Table() string {
+	return m.table
+}
+
+func (m *MemTableV1) StartTime() util.IConsensusTime {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.start_time
+}
+
+func (m *MemTableV1) EndTime() util.IConsensusTime {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.end_time
+}
+
+func (m *MemTableV1) Count() uint32 {
+	return atomic.LoadUint32(&m.count)
+}
+
+func (m *MemTableV1) Size() uint64 {
+	return atomic.LoadUint64(&m.size)
+}
+
+// get record with specified key and group, return nil if not found - a CLEAR
+// record is returned as is, and masks the key and group in older tables
+func (m *MemTableV1) Get(key util.IKey, group string) (util.IRecord, error) {
+
+	if collection.IsNil(key) {
+		return nil, fmt.Errorf("MemTableV1::Get - key is nil")
+	}
+
+	value := m.list.Get(&memtable_key{key: key, group: group})
+	if value == nil {
+		return nil, nil
+	}
+
+	return value.(util.IRecord), nil
+}
+
+// set a record, replaces existing record with the same key and group
+func (m *MemTableV1) Set(record util.IRecord) error {
+
+	r, err := memtable_prepare(record)
+	if err != nil {
+		return fmt.Errorf("MemTableV1::Set - %s", err)
+	}
+
+	return m.put(r)
+}
+
+// check and encode a record, so putting it fails only if memtable is frozen
+func memtable_prepare(record util.IRecord) (memtable_record, error) {
+
+	if collection.IsNil(record) || collection.IsNil(record.Key()) {
+		return memtable_record{}, fmt.Errorf("record or key is nil")
+	}
+
+	if !record.IsEncoded() {
+		if err := record.Encode(nil); err != nil {
+			return memtable_record{}, err
+		}
+	}
+
+	group, err := RecordGroup(record)
+	if err != nil {
+		return memtable_record{}, err
+	}
+
+	return memtable_record{record: record, group: group}, nil
+}
+
+// put a prepared record
+func (m *MemTableV1) put(r memtable_record) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.IsFrozen() {
+		return fmt.Errorf("MemTableV1::Set - memtable frozen")
+	}
+
+	record := r.record
+	key := &memtable_key{key: record.Key(), group: r.group}
+	if m.Count() >= m.max_records && m.list.Get(key) == nil {
+		return fmt.Errorf("MemTableV1::Set - memtable full with %d records", m.max_records)
+	}
+
+	old := m.list.Put(key, record)
+	if old != nil {
+		atomic.AddUint64(&m.size, ^uint64(memtable_record_size(old.(util.IRecord))-1))
+	} else {
+		atomic.AddUint32(&m.count, 1)
+	}
+	atomic.AddUint64(&m.size, memtable_record_size(record))
+
+	return nil
+}
+
+// extend start time and end time to include specified time
+func (m *MemTableV1) UpdateTime(time util.IConsensusTime) error {
+
+	if collection.IsNil(time) {
+		return fmt.Errorf("MemTableV1::UpdateTime - time is nil")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.IsFrozen() {
+		return fmt.Errorf("MemTableV1::UpdateTime - memtable frozen")
+	}
+
+	start, end, err := m.extendTime(time)
+	if err != nil {
+		return fmt.Errorf("MemTableV1::UpdateTime - %s", err)
+	}
+	m.start_time, m.end_time = start, end
+
+	return nil
+}
+
+// whether start time and end time can be extended to include time
+func (m *MemTableV1) checkTime(time util.IConsensusTime) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, _, err := m.extendTime(time)
+
+	return err
+}
+
+// start time and end time extended to include time, mutex must be held
+func (m *MemTableV1) extendTime(time util.IConsensusTime) (util.IConsensusTime, util.IConsensusTime, error) {
+
+	if collection.IsNil(time) {
+		return nil, nil, fmt.Errorf("time is nil")
+	}
+
+	start, end := m.start_time, m.end_time
+	if start == nil {
+		return time, time, nil
+	}
+
+	if lt, err := time.LT(start); err != nil {
+		return nil, nil, err
+	} else if lt {
+		start = time
+	}
+
+	if gt, err := time.GT(end); err != nil {
+		return nil, nil, err
+	} else if gt {
+		end = time
+	}
+
+	return start, end, nil
+}
+
+// list of groups under specified key, maximum MAX_ATTR_GROUPS groups
+func (m *MemTableV1) Groups(key util.IKey) ([]string, error) {
+
+	if collection.IsNil(key) {
+		return nil, fmt.Errorf("MemTableV1::Groups - key is nil")
+	}
+
+	result := []string{}
+
+	iter := m.list.RangeIterator(&memtable_key{key: key}, nil)
+	for iter.HasNext() && len(result) < util.MAX_ATTR_GROUPS {
+		k, v := iter.Next()
+		if !k.(*memtable_key).key.Equal(key) {
+			break
+		}
+		// skip cleared groups, and history
+		group := k.(*memtable_key).group
+		if record_is_clear(v.(util.IRecord)) || group_is_history(group) {
+			continue
+		}
+		result = append(result, group)
+	}
+
+	return result, nil
+}
+
+// list of child keys with specified key as prefix
+func (m *MemTableV1) Keys(key util.IKey) ([]util.IKey, error) {
+
+	result := []util.IKey{}
+
+	iter := m.PrefixIterator(key)
+	for iter.HasNext() {
+		r := iter.Next()
+		// skip the key itself
+		if !collection.IsNil(key) && len(r.Key().Key()) <= len(key.Key()) {
+			continue
+		}
+		// skip cleared groups, and history
+		if live, err := record_is_live(r); err != nil {
+			return nil, fmt.Errorf("MemTableV1::Keys - %s", err)
+		} else if !live {
+			continue
+		}
+		// skip other groups of the same key
+		if len(result) > 0 && result[len(result)-1].Equal(r.Key()) {
+			continue
+		}
+		result = append(result, r.Key())
+	}
+
+	return result, nil
+}
+
+// whether memtable crossed the size threshold, or would not fit in one SSTable
+func (m *MemTableV1) IsFull() bool {
+	return m.Size() >= m.max_size || m.Count() >= m.max_records
+}
+
+func (m *MemTableV1) Freeze() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	atomic.StoreInt32(&m.frozen, 1)
+}
+
+func (m *MemTableV1) IsFrozen() bool {
+	return atomic.LoadInt32(&m.frozen) != 0
+}
+
+// write all records of a frozen memtable to a SSTable file of version, and load it
+func (m *MemTableV1) Flush(version uint32, filepath string, level uint32, start_time, end_time util.IConsensusTime) (ISSTable, error) {
+
+	if !m.IsFrozen() {
+		return nil, fmt.Errorf("MemTableV1::Flush - memtable not frozen")
+	}
+
+	b, err := NewSSTableBuilder(version, filepath, m.consensus_id, m.domain, m.table, level, start_time, end_time)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := m.Iterator()
+	for iter.HasNext() {
+		if err := b.Add(iter.Next()); err != nil {
+			b.Abort()
+			return nil, err
+		}
+	}
+
+	if err := b.Finish(); err != nil {
+		return nil, err
+	}
+
+	return LoadSSTable(filepath)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Iterators
+
+type MemTableV1Iterator struct {
+	iter   collection.ISortedMapIterator
+	prefix util.IKey // key prefix, nil for no prefix
+	done   bool
+}
+
+// iterator of all records
+func (m *MemTableV1) Iterator() ISSTableIterator {
+	return &MemTableV1Iterator{iter: m.list.Iterator()}
+}
+
+// iterator of records with key in [start, end), nil start or end means unbounded
+func (m *MemTableV1) RangeIterator(start, end util.IKey) ISSTableIterator {
+
+	if !collection.IsNil(start) && !collection.IsNil(end) && start.Compare(end) > 0 {
+		panic(fmt.Sprintf("MemTableV1::RangeIterator - start [%v] is larger than end [%v]", start.Key(), end.Key()))
+	}
+
+	var start_key, end_key collection.IComparable
+	if !collection.IsNil(start) {
+		start_key = &memtable_key{key: start}
+	}
+	if !collection.IsNil(end) {
+		end_key = &memtable_key{key: end}
+	}
+
+	return &MemTableV1Iterator{iter: m.list.RangeIterator(start_key, end_key)}
+}
+
+// iterator of records with key having specified prefix, empty prefix iterates all records
+func (m *MemTableV1) PrefixIterator(prefix util.IKey) ISSTableIterator {
+
+	if collection.IsNil(prefix) || prefix.IsEmpty() {
+		return m.Iterator()
+	}
+
+	return &MemTableV1Iterator{iter: m.list.RangeIterator(&memtable_key{key: prefix}, nil), prefix: prefix}
+}
+
+func (i *MemTableV1Iterator) Next() util.IRecord {
+	if !i.HasNext() {
+		return nil
+	}
+	_, value := i.iter.Next()
+	return value.(util.IRecord)
+}
+
+func (i *MemTableV1Iterator) HasNext() bool {
+	if i.done || !i.iter.HasNext() {
+		return false
+	}
+	if i.prefix != nil {
+		k, _ := i.iter.Peek()
+		if !keyHasPrefix(k.(*memtable_key).key, i.prefix) {
+			i.done = true // no more left
+			return false
+		}
+	}
+	return true
+}
+
+func (i *MemTableV1Iterator) Peek() util.IRecord {
+	if !i.HasNext() {
+		return nil
+	}
+	_, value := i.iter.Peek()
+	return value.(util.IRecord)
+}
+
+func (i *MemTableV1Iterator) Error() error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// memtable_key
+
+func (k *memtable_key) Equal(o collection.IObject) bool {
+	if collection.IsNil(o) {
+		return false
+	}
+	return k.Compare(o.(collection.IComparable)) == 0
+}
+
+func (k *memtable_key) Compare(c collection.IComparable) int {
+	t, ok := c.(*memtable_key)
+	if !ok {
+		panic(fmt.Sprintf("memtable_key::Compare - target is not memtable_key [%v]", reflect.TypeOf(c)))
+	}
+	return sstable_compare(k.key, k.group, t.key, t.group)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// approximate memory used by a record
+func memtable_record_size(r util.IRecord) uint64 {
+	return uint64(r.EstBufSize())
 }
@@ -0,0 +1,240 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"../util"
+)
+
+func TestMemTableV1(t *testing.T) {
+
+	m := NewMemTableV1(newTestConsensusID(), "test.domain", "test.table")
+
+	records := []util.IRecord{
+		newTestGroupRecord("a/d", "attr", "a/d/attr"),
+		newTestGroupRecord("a", "attr/sub", "a/attr/sub"),
+		newTestGroupRecord("e", "", "e"),
+		newTestGroupRecord("a/b", "attr", "a/b/attr"),
+		newTestGroupRecord("a", "", "a"),
+		newTestGroupRecord("a/b/c", "", "a/b/c"),
+		newTestGroupRecord("a/d", "", "a/d"),
+		newTestGroupRecord("a", "attr", "a/attr"),
+	}
+	size := uint64(0)
+	for _, r := range records {
+		if err := m.Set(r); err != nil {
+			t.Fatal(err)
+		}
+		size += uint64(r.EstBufSize())
+	}
+	if m.Count() != uint32(len(records)) || m.Size() != size {
+		t.Errorf("count or size not match: %d, %d", m.Count(), m.Size())
+	}
+
+	// get
+	for _, r := range records {
+		group, _ := RecordGroup(r)
+		found, err := m.Get(r.Key(), group)
+		if err != nil || found == nil {
+			t.Errorf("get [%s] [%s] not found: %s", testKeyString(r.Key()), group, err)
+		}
+	}
+	if r, _ := m.Get(newTestKey("a/b"), ""); r != nil {
+		t.Errorf("get [a/b] default group should not be found")
+	}
+
+	// replace
+	replace := newTestGroupRecord("a", "", "replaced")
+	if err := m.Set(replace); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := m.Get(newTestKey("a"), ""); r == nil || string(r.Value().Value()) != "replaced" {
+		t.Errorf("get [a] not replaced")
+	}
+	size = size - uint64(records[4].EstBufSize()) + uint64(replace.EstBufSize())
+	if m.Count() != uint32(len(records)) || m.Size() != size {
+		t.Errorf("count or size not match after replace: %d, %d", m.Count(), m.Size())
+	}
+
+	// groups
+	groups, err := m.Groups(newTestKey("a"))
+	if err != nil || fmt.Sprint(groups) != fmt.Sprint([]string{"", "attr", "attr/sub"}) {
+		t.Errorf("groups [a]: got %q, %v", groups, err)
+	}
+
+	// keys
+	keys, err := m.Keys(newTestKey("a"))
+	got := []string{}
+	for _, key := range keys {
+		got = append(got, testKeyString(key))
+	}
+	if err != nil || fmt.Sprint(got) != "[a/b a/b/c a/d]" {
+		t.Errorf("keys [a]: got %q, %v", got, err)
+	}
+
+	// iterators
+	got = []string{}
+	iter := m.RangeIterator(newTestKey("a/b"), newTestKey("a/d"))
+	for iter.HasNext() {
+		got = append(got, testKeyString(iter.Next().Key()))
+	}
+	if fmt.Sprint(got) != "[a/b a/b/c]" {
+		t.Errorf("range iterator: got %q", got)
+	}
+}
+
+func TestMemTableV1Clear(t *testing.T) {
+
+	m := newTestMemTable([]util.IRecord{
+		newTestGroupRecord("a", "", "a"),
+		newTestGroupRecord("a", "x", "ax"),
+		newTestGroupRecord("a/b", "", "ab"),
+		newTestGroupRecord("a/c", "", "ac"),
+	})
+	for _, r := range []util.IRecord{newTestClearRecord("a", 1), newTestClearRecord("a/b", 1)} {
+		if err := m.Set(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tombstone is returned by Get, and skipped by Groups and Keys
+	if r, err := m.Get(newTestKey("a"), ""); err != nil || r == nil || !record_is_clear(r) {
+		t.Errorf("get of cleared key %v %v; want tombstone", r, err)
+	}
+
+	groups, err := m.Groups(newTestKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[x]" {
+		t.Errorf("groups %q; want [x]", groups)
+	}
+
+	keys, err := m.Keys(newTestKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testKeyStrings(keys) != "[a/c]" {
+		t.Errorf("keys %s; want [a/c]", testKeyStrings(keys))
+	}
+}
+
+func TestMemTableV1MaxRecords(t *testing.T) {
+
+	m := NewMemTableV1(newTestConsensusID(), "test.domain", "test.table")
+	m.max_records = 2
+	for _, key := range []string{"a", "b"} {
+		if err := m.Set(newTestRecord(key, "v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !m.IsFull() {
+		t.Errorf("memtable with max records not full")
+	}
+
+	// a new key does not fit, an existing key is replaced
+	if err := m.Set(newTestRecord("c", "v1")); err == nil {
+		t.Errorf("set of a new key in full memtable should fail")
+	}
+	if err := m.Set(newTestRecord("a", "v2")); err != nil {
+		t.Errorf("set of an existing key in full memtable: %s", err)
+	}
+	if m.Count() != 2 {
+		t.Errorf("count %d; want 2", m.Count())
+	}
+}
+
+func TestMemTableV1Flush(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m := NewMemTableV1(newTestConsensusID(), "test.domain", "test.table")
+	m.max_size = 10 * 1024
+
+	for i := 999; !m.IsFull(); i-- {
+		if err := m.Set(newTestRecord(fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := m.Flush(SSTABLE_VERSION, dir+"/test.sst", 0, util.NewLedgerTime(1), util.NewLedgerTime(2)); err == nil {
+		t.Errorf("flush before freeze should fail")
+	}
+
+	m.Freeze()
+	if err := m.Set(newTestRecord("key", "value")); err == nil {
+		t.Errorf("set after freeze should fail")
+	}
+
+	table, err := m.Flush(SSTABLE_VERSION, dir+"/test.sst", 0, util.NewLedgerTime(1), util.NewLedgerTime(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if table.Count() != m.Count() {
+		t.Errorf("count not match: %d, %d", table.Count(), m.Count())
+	}
+
+	mem_iter := m.Iterator()
+	table_iter := table.Iterator()
+	for mem_iter.HasNext() && table_iter.HasNext() {
+		r1 := mem_iter.Next()
+		r2 := table_iter.Next()
+		if !r1.Key().Equal(r2.Key()) || string(r1.Value().Value()) != string(r2.Value().Value()) {
+			t.Errorf("record not match: %s, %s", testKeyString(r1.Key()), testKeyString(r2.Key()))
+		}
+	}
+	if mem_iter.HasNext() || table_iter.HasNext() {
+		t.Errorf("record count not match")
+	}
+}
+
+func TestMemTableV1Concurrent(t *testing.T) {
+
+	m := NewMemTableV1(newTestConsensusID(), "test.domain", "test.table")
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var last util.IKey
+				iter := m.Iterator()
+				for iter.HasNext() {
+					key := iter.Next().Key()
+					if last != nil && last.Compare(key) >= 0 {
+						t.Errorf("iterator out of order: %s after %s", testKeyString(key), testKeyString(last))
+						return
+					}
+					last = key
+				}
+				m.Get(newTestKey("key000500"), "")
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		if err := m.Set(newTestRecord(fmt.Sprintf("key%06d", (i*7919)%1000), "value")); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if m.Count() != 1000 {
+		t.Errorf("count not match: %d", m.Count())
+	}
+}
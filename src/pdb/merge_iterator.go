@@ -0,0 +1,188 @@
+package pdb
+
+import (
+	"container/heap"
+
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Merge Iterator
+//
+// MergeIterator merges sorted record iterators into one sorted iterator, with
+// one record for each <key> + <group>.  Inputs are ordered newest first - in
+// the order records are applied by consensus.  When more than one input has
+// the same key and group, the record from the newer input wins, regardless of
+// record timestamps, the same as reads of a Tablet.  A CLEAR record winning
+// masks older records, and is returned as is for the caller to skip.
+
+type MergeIterator struct {
+	inputs []ISSTableIterator
+	heap   merge_heap
+	next   util.IRecord
+	err    error
+}
+
+type merge_item struct {
+	record util.IRecord
+	group  string
+	input  int // index of input, smaller is newer
+}
+
+type merge_heap []*merge_item
+
+func NewMergeIterator(inputs []ISSTableIterator) *MergeIterator {
+
+	i := &MergeIterator{inputs: inputs, heap: merge_heap{}}
+	for idx := range inputs {
+		i.push(idx)
+	}
+	heap.Init(&i.heap)
+
+	return i
+}
+
+func (i *MergeIterator) Next() util.IRecord {
+	i.advance()
+	r := i.next
+	i.next = nil
+	return r
+}
+
+func (i *MergeIterator) HasNext() bool {
+	i.advance()
+	return i.next != nil
+}
+
+func (i *MergeIterator) Peek() util.IRecord {
+	i.advance()
+	return i.next
+}
+
+func (i *MergeIterator) Error() error {
+	return i.err
+}
+
+func (i *MergeIterator) advance() {
+
+	if i.next != nil || i.err != nil || len(i.heap) == 0 {
+		return
+	}
+
+	// pop the smallest, and all the others with the same key and group
+	winner := heap.Pop(&i.heap).(*merge_item)
+	i.pushNext(winner.input)
+
+	for len(i.heap) > 0 && sstable_compare(i.heap[0].record.Key(), i.heap[0].group, winner.record.Key(), winner.group) == 0 {
+		item := heap.Pop(&i.heap).(*merge_item)
+		i.pushNext(item.input)
+		if item.input < winner.input {
+			winner = item
+		}
+	}
+
+	if i.err != nil {
+		return
+	}
+
+	i.next = winner.record
+}
+
+// push the next record of an input, before heap is initialized
+func (i *MergeIterator) push(idx int) {
+	if item := i.read(idx); item != nil {
+		i.heap = append(i.heap, item)
+	}
+}
+
+// push the next record of an input to heap
+func (i *MergeIterator) pushNext(idx int) {
+	if item := i.read(idx); item != nil {
+		heap.Push(&i.heap, item)
+	}
+}
+
+func (i *MergeIterator) read(idx int) *merge_item {
+
+	input := i.inputs[idx]
+	if !input.HasNext() {
+		if input.Error() != nil && i.err == nil {
+			i.err = input.Error()
+		}
+		return nil
+	}
+
+	r := input.Next()
+	group, err := RecordGroup(r)
+	if err != nil {
+		if i.err == nil {
+			i.err = err
+		}
+		return nil
+	}
+
+	return &merge_item{record: r, group: group, input: idx}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// merge_heap
+
+func (h merge_heap) Len() int {
+	return len(h)
+}
+
+func (h merge_heap) Less(a, b int) bool {
+	if r := sstable_compare(h[a].record.Key(), h[a].group, h[b].record.Key(), h[b].group); r != 0 {
+		return r < 0
+	}
+	return h[a].input < h[b].input
+}
+
+func (h merge_heap) Swap(a, b int) {
+	h[a], h[b] = h[b], h[a]
+}
+
+func (h *merge_heap) Push(x interface{}) {
+	*h = append(*h, x.(*merge_item))
+}
+
+func (h *merge_heap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// whether record is a tombstone, with CLEAR bit set in record magic, or CLEAR
+// flag set on a record not yet encoded
+func record_is_clear(r util.IRecord) bool {
+
+	if !r.IsEncoded() {
+		if record, ok := r.(*util.Record); ok {
+			return record.IsClear()
+		}
+		return false
+	}
+
+	magic := r.RecordMagic()
+
+	return magic != 0xff && magic&(0x01<<3) != 0
+}
+
+// whether record is a latest record not CLEAR
+func record_is_live(r util.IRecord) (bool, error) {
+
+	if record_is_clear(r) {
+		return false, nil
+	}
+
+	group, err := RecordGroup(r)
+	if err != nil {
+		return false, err
+	}
+
+	return !group_is_history(group), nil
+}
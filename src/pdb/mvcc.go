@@ -0,0 +1,300 @@
+package pdb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"../collection"
+	"../util"
+)
+
+const (
+	HISTORY_BUCKET       = "\xff" // first bucket of history groups, reserved
+	HISTORY_CLEAR_SUFFIX = ".c"   // suffix of time bucket for CLEAR versions
+	MVCC_HISTORY_WINDOW  = 256    // default ledger epochs or raft terms of history retained
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// MVCC
+//
+// Each record written at a consensus time is kept twice - as the latest
+// record of its <key> + <group>, and as a history record of the same key with
+// a version group:
+//
+//   <HISTORY_BUCKET> / <group buckets> / <hex of consensus time>.<hex of journal seq>[.c]
+//
+// A history record keeps the key, value, timestamp and signature of the
+// original record, and the original group is restored on read.  A CLEAR
+// version has HISTORY_CLEAR_SUFFIX, and is not a tombstone itself.  The
+// journal seq tells apart versions written at the same consensus time - a
+// ledger time carries the epoch only - and orders them.  Hex of consensus
+// time sorts in time order for the same time type, and history groups sort
+// after regular groups of a key, so history is stored and merged as ordinary
+// records.
+//
+// Reads "as of" a consensus time pick, for each group, the newest version at
+// or before the time.  Compaction drops versions older than the newest
+// version at or before the history horizon - the history window, by default
+// MVCC_HISTORY_WINDOW epochs or terms, before the latest time of the table -
+// so reads as of a time within the window remain exact, and reads before the
+// window may miss versions.
+// A CLEAR version left as the newest version is dropped as well, once no
+// deeper level may hold the key, so deleted keys leave no history behind.
+// A history window of 0 disables history - no history record is written, and
+// reads as of a time are not served.
+
+type history_version struct {
+	group string
+	time  util.IConsensusTime
+	seq   uint64 // journal seq of the write
+	clear bool
+}
+
+// history record of r, set at consensus time by journal entry seq
+func NewHistoryRecord(r util.IRecord, time util.IConsensusTime, seq uint64) (util.IRecord, error) {
+
+	if collection.IsNil(r) || collection.IsNil(time) {
+		return nil, fmt.Errorf("NewHistoryRecord - record or time is nil")
+	}
+
+	group, err := RecordGroup(r)
+	if err != nil {
+		return nil, fmt.Errorf("NewHistoryRecord - %s", err)
+	}
+
+	scheme, err := NewGroupScheme(history_group(group, time, seq, record_is_clear(r)))
+	if err != nil {
+		return nil, fmt.Errorf("NewHistoryRecord - %s", err)
+	}
+
+	h, err := history_copy(r)
+	if err != nil {
+		return nil, fmt.Errorf("NewHistoryRecord - %s", err)
+	}
+	h.SetScheme(scheme)
+	if err := h.Encode(nil); err != nil {
+		return nil, fmt.Errorf("NewHistoryRecord - %s", err)
+	}
+
+	return h, nil
+}
+
+// version group of a record at consensus time and journal seq
+func history_group(group string, time util.IConsensusTime, seq uint64, clear bool) string {
+
+	buckets := []string{HISTORY_BUCKET}
+	if group != "" {
+		buckets = append(buckets, group)
+	}
+
+	version := fmt.Sprintf("%s.%016x", hex.EncodeToString(time.Buf()), seq)
+	if clear {
+		version += HISTORY_CLEAR_SUFFIX
+	}
+
+	return strings.Join(append(buckets, version), GROUP_SEPARATOR)
+}
+
+// whether group is a version group
+func group_is_history(group string) bool {
+	return group == HISTORY_BUCKET || strings.HasPrefix(group, HISTORY_BUCKET+GROUP_SEPARATOR)
+}
+
+// version of a history record, nil if record is not a history record
+func record_history(r util.IRecord) (*history_version, error) {
+
+	group, err := RecordGroup(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !group_is_history(group) {
+		return nil, nil
+	}
+
+	buckets := strings.Split(group, GROUP_SEPARATOR)
+	if len(buckets) < 2 {
+		return nil, fmt.Errorf("record_history - invalid version group [%x]", group)
+	}
+
+	version := buckets[len(buckets)-1]
+	v := &history_version{group: strings.Join(buckets[1:len(buckets)-1], GROUP_SEPARATOR)}
+	if strings.HasSuffix(version, HISTORY_CLEAR_SUFFIX) {
+		v.clear = true
+		version = strings.TrimSuffix(version, HISTORY_CLEAR_SUFFIX)
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("record_history - invalid version [%s]", version)
+	}
+
+	buf, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("record_history - invalid version [%s] - %s", version, err)
+	}
+
+	if v.seq, err = strconv.ParseUint(parts[1], 16, 64); err != nil {
+		return nil, fmt.Errorf("record_history - invalid version [%s] - %s", version, err)
+	}
+
+	if v.time, err = util.NewConsensusTime(buf); err != nil {
+		return nil, fmt.Errorf("record_history - %s", err)
+	}
+
+	return v, nil
+}
+
+// order of versions by consensus time, then by journal seq
+func (v *history_version) compare(o *history_version) (int, error) {
+
+	if lt, err := v.time.LT(o.time); err != nil {
+		return 0, err
+	} else if lt {
+		return -1, nil
+	}
+
+	if gt, err := v.time.GT(o.time); err != nil {
+		return 0, err
+	} else if gt {
+		return 1, nil
+	}
+
+	switch {
+	case v.seq < o.seq:
+		return -1, nil
+	case v.seq > o.seq:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// original record of a history record, nil if the version is CLEAR
+func history_original(h util.IRecord, v *history_version) (util.IRecord, error) {
+
+	if v.clear {
+		return nil, nil
+	}
+
+	r, err := history_copy(h)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, err := NewGroupScheme(v.group)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != nil {
+		r.SetScheme(scheme)
+	}
+
+	if err := r.Encode(nil); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// copy of key, value, timestamp and signature of a record
+func history_copy(r util.IRecord) (*util.Record, error) {
+
+	c := util.NewRecord().SetKey(r.Key())
+	if !collection.IsNil(r.Value()) {
+		// mapped value does not encode
+		value, err := r.Value().CopyConstruct()
+		if err != nil {
+			return nil, err
+		}
+		c.SetValue(value.(util.IValue))
+	}
+	if r.Timestamp() != nil {
+		c.SetTimestamp(r.Timestamp())
+	}
+	if R, S := r.Signature(); R != nil && S != nil {
+		c.SetSignature(R, S)
+	}
+
+	return c, nil
+}
+
+// consensus time window epochs or terms before latest, nil if no history
+// can be dropped
+func history_horizon(latest util.IConsensusTime, window uint32) util.IConsensusTime {
+
+	if collection.IsNil(latest) {
+		return nil
+	}
+
+	// first 4 bytes after magic are ledger epoch or raft term
+	buf := latest.Buf()
+	if len(buf) < 1+4 {
+		return nil
+	}
+	t := binary.BigEndian.Uint32(buf[1:])
+	if t < window {
+		return nil
+	}
+
+	switch buf[0] {
+	case util.CONSENSUS_TIME_LEDGER:
+		return util.NewLedgerTime(t - window)
+	case util.CONSENSUS_TIME_RAFT:
+		return util.NewRaftTime(t-window, 0, 0)
+	default:
+		return nil
+	}
+}
+
+// newest version of each group at or before time, from records of one key
+type history_versions struct {
+	time     util.IConsensusTime
+	versions map[string]*history_version
+	records  map[string]util.IRecord
+}
+
+func new_history_versions(time util.IConsensusTime) *history_versions {
+	return &history_versions{time: time, versions: map[string]*history_version{}, records: map[string]util.IRecord{}}
+}
+
+// consider a record, returns whether it is a history record
+func (s *history_versions) add(r util.IRecord) (bool, error) {
+
+	v, err := record_history(r)
+	if err != nil || v == nil {
+		return false, err
+	}
+
+	if le, err := v.time.LE(s.time); err != nil {
+		return true, err
+	} else if !le {
+		return true, nil
+	}
+
+	if prev, ok := s.versions[v.group]; ok {
+		if c, err := v.compare(prev); err != nil {
+			return true, err
+		} else if c <= 0 {
+			return true, nil
+		}
+	}
+
+	s.versions[v.group] = v
+	s.records[v.group] = r
+
+	return true, nil
+}
+
+// whether any group has a version not CLEAR
+func (s *history_versions) exists() bool {
+	for _, v := range s.versions {
+		if !v.clear {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"../util"
+)
+
+func TestPdbV1AsOf(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	set := func(epoch uint32, r util.IRecord) {
+		if err := p.Set("table", util.NewLedgerTime(epoch), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set(10, newTestGroupRecord("a/b", "", "v10"))
+	set(10, newTestGroupRecord("a/b", "x", "x10"))
+	set(10, newTestGroupRecord("a/c", "", "c10"))
+	set(20, newTestGroupRecord("a/b", "", "v20"))
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set(30, newTestClearRecord("a/b", 30))
+	set(30, newTestClearRecord("a/c", 30))
+	set(40, newTestGroupRecord("a/b", "", "v40"))
+
+	asOf := func(key, group string, epoch uint32) string {
+		r, err := p.GetAsOf("table", newTestKey(key), group, util.NewLedgerTime(epoch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil {
+			return "<nil>"
+		}
+		if g, err := RecordGroup(r); err != nil || g != group {
+			t.Errorf("group [%s] of record as of %d; want [%s]", g, epoch, group)
+		}
+		return string(r.Value().Value())
+	}
+
+	checks := []struct {
+		key, group string
+		epoch      uint32
+		want       string
+	}{
+		{"a/b", "", 5, "<nil>"},
+		{"a/b", "", 10, "v10"},
+		{"a/b", "", 15, "v10"},
+		{"a/b", "", 20, "v20"},
+		{"a/b", "", 30, "<nil>"},
+		{"a/b", "", 40, "v40"},
+		{"a/b", "x", 40, "x10"},
+		{"a/c", "", 20, "c10"},
+		{"a/c", "", 40, "<nil>"},
+	}
+	for _, c := range checks {
+		if v := asOf(c.key, c.group, c.epoch); v != c.want {
+			t.Errorf("[%s] [%s] as of %d: %s; want %s", c.key, c.group, c.epoch, v, c.want)
+		}
+	}
+
+	keysAsOf := func(epoch uint32) string {
+		keys, err := p.KeysAsOf("table", newTestKey("a"), util.NewLedgerTime(epoch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testKeyStrings(keys)
+	}
+	if keys := keysAsOf(5); keys != "[]" {
+		t.Errorf("keys as of 5: %s", keys)
+	}
+	if keys := keysAsOf(20); keys != "[a/b a/c]" {
+		t.Errorf("keys as of 20: %s; want [a/b a/c]", keys)
+	}
+	// group x of a/b is not cleared
+	if keys := keysAsOf(30); keys != "[a/b]" {
+		t.Errorf("keys as of 30: %s; want [a/b]", keys)
+	}
+
+	// latest reads do not see history
+	if v := getTestValue(t, p, "table", "a/b", ""); v != "v40" {
+		t.Errorf("latest value %s; want v40", v)
+	}
+	groups, err := p.Groups("table", newTestKey("a/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(groups) != "[ x]" {
+		t.Errorf("groups %q; want [ x]", groups)
+	}
+	keys, err := p.Keys("table", newTestKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testKeyStrings(keys) != "[a/b]" {
+		t.Errorf("keys %s; want [a/b]", testKeyStrings(keys))
+	}
+
+	if err := p.Set("table", util.NewLedgerTime(50), newTestGroupRecord("a", HISTORY_BUCKET+"/x", "v")); err == nil {
+		t.Errorf("history group should be reserved")
+	}
+}
+
+func TestCompactorHistory(t *testing.T) {
+
+	records := []util.IRecord{newTestRecord("a", "v5")}
+	for _, epoch := range []uint32{1, 2, 3, 5} {
+		h, err := NewHistoryRecord(newTestRecord("a", fmt.Sprintf("v%d", epoch)), util.NewLedgerTime(epoch), uint64(epoch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, h)
+	}
+
+	// versions before the newest at or before horizon are dropped
+	pruned, err := compaction_prune_history(records, util.NewLedgerTime(4), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, r := range pruned {
+		got = append(got, string(r.Value().Value()))
+	}
+	if fmt.Sprint(got) != "[v5 v3 v5]" {
+		t.Errorf("pruned %v; want [v5 v3 v5]", got)
+	}
+
+	// horizon of window
+	if h := history_horizon(util.NewLedgerTime(300), 256); h == nil || fmt.Sprintf("%x", h.Buf()) != "010000002c" {
+		t.Errorf("ledger horizon %v", h)
+	}
+	if h := history_horizon(util.NewRaftTime(300, 10, 10), 256); h == nil || fmt.Sprintf("%x", h.Buf()) != "020000002c0000000000000000" {
+		t.Errorf("raft horizon %v", h)
+	}
+	if h := history_horizon(util.NewLedgerTime(100), 256); h != nil {
+		t.Errorf("horizon before first epoch %v", h)
+	}
+}
+
+func TestPdbV1HistoryVersions(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// writes in the same epoch are distinct versions, the last one wins
+	for i := 0; i < 3; i++ {
+		if err := p.Set("table", util.NewLedgerTime(10), newTestRecord("a", fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := 0
+	manifest := p.flusher.Manifest("table")
+	for _, file := range manifest.Files() {
+		sstable, err := LoadSSTable(manifest.FilePath(file.Num()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for iter := sstable.Iterator(); iter.HasNext(); {
+			if v, err := record_history(iter.Next()); err != nil {
+				t.Fatal(err)
+			} else if v != nil {
+				versions++
+			}
+		}
+		sstable.Close()
+	}
+	if versions != 3 {
+		t.Errorf("history versions %d; want 3", versions)
+	}
+
+	r, err := p.GetAsOf("table", newTestKey("a"), "", util.NewLedgerTime(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || string(r.Value().Value()) != "v2" {
+		t.Errorf("value as of 10 %v; want v2", r)
+	}
+}
+
+func TestPdbV1HistoryDisabled(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	options := DefaultPdbOptions()
+	options.HistoryWindow = 0
+	p, err := OpenPdbV1WithOptions(dir, newTestConsensusID(), "test.domain", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.Set("table", util.NewLedgerTime(10), newTestRecord("a", "v10")); err != nil {
+		t.Fatal(err)
+	}
+
+	// latest record only
+	for _, m := range p.flusher.Memtables("table") {
+		if m.Count() != 1 {
+			t.Errorf("memtable records %d; want 1", m.Count())
+		}
+	}
+	if v := getTestValue(t, p, "table", "a", ""); v != "v10" {
+		t.Errorf("latest value %s; want v10", v)
+	}
+
+	if _, err := p.GetAsOf("table", newTestKey("a"), "", util.NewLedgerTime(10)); err == nil {
+		t.Errorf("read as of time without history should fail")
+	}
+}
@@ -0,0 +1,352 @@
+package pdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"../collection"
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Shard Split and Merge
+//
+// A pdb holds the records of the shard in the shard start and end of its
+// consensus ID, see util.ShardHash for the location of a record on the hash
+// ring.  When ring membership changes, the records of a tablet are moved to
+// the tablets of new shards:
+//
+//   - SplitTablet copies records of a shard into the tablets of the lower and
+//     upper shards split at a boundary
+//   - MergeTablets copies records of two adjacent shards into the tablet of
+//     the merged shard
+//
+// Records of the source tablet - memtables and SSTables, with history and
+// CLEAR records - are filtered by their location, written to new SSTables
+// with the consensus ID of the target, and ingested into the target tablet.
+// A record is copied only if its location is in both the source and the
+// target shards.  The source tablet is left unchanged, and records written
+// to it after the copy started may not be copied - writes of the source shard
+// are expected to be stopped while its data moves.
+//
+// SSTables of all targets are written before any is ingested, so a failure
+// to read or write records leaves the targets unchanged.  MergeTablets
+// ingests into its one target atomically.  SplitTablet ingests into the lower
+// tablet first - if ingestion into the upper tablet then fails, the lower
+// tablet holds its half of the split, and the split must be retried into
+// fresh tablets.
+
+// copy records of tablet into tablets of the lower shard [start, boundary) and
+// the upper shard [boundary, end)
+func SplitTablet(src *Tablet, boundary []byte, lower, upper *Tablet) error {
+
+	if src == nil || lower == nil || upper == nil {
+		return fmt.Errorf("SplitTablet - tablet is nil")
+	}
+	if len(boundary) != util.SHARD_HASH_SIZE {
+		return fmt.Errorf("SplitTablet - boundary must be %d bytes", util.SHARD_HASH_SIZE)
+	}
+	if err := shard_check_tablets(src, lower, upper); err != nil {
+		return fmt.Errorf("SplitTablet - %s", err)
+	}
+
+	start, end, err := shard_range(src)
+	if err != nil {
+		return fmt.Errorf("SplitTablet - %s", err)
+	}
+	if bytes.Equal(boundary, start) || !util.ShardContains(start, end, boundary) {
+		return fmt.Errorf("SplitTablet - boundary %x not within shard %x - %x", boundary, start, end)
+	}
+
+	for _, target := range []struct {
+		tablet     *Tablet
+		start, end []byte
+	}{
+		{lower, start, boundary},
+		{upper, boundary, end},
+	} {
+		if err := shard_check_range(target.tablet, target.start, target.end); err != nil {
+			return fmt.Errorf("SplitTablet - %s", err)
+		}
+	}
+
+	lower_out, err := shard_write(src, lower)
+	if err != nil {
+		return fmt.Errorf("SplitTablet - %s", err)
+	}
+	defer lower_out.remove()
+	upper_out, err := shard_write(src, upper)
+	if err != nil {
+		return fmt.Errorf("SplitTablet - %s", err)
+	}
+	defer upper_out.remove()
+
+	if err := lower.IngestSSTables(lower_out.paths); err != nil {
+		return fmt.Errorf("SplitTablet - %s", err)
+	}
+	if err := upper.IngestSSTables(upper_out.paths); err != nil {
+		return fmt.Errorf("SplitTablet - lower tablet copied, upper tablet failed - %s", err)
+	}
+
+	return nil
+}
+
+// copy records of tablets of the lower shard [start, boundary) and the upper
+// shard [boundary, end) into the tablet of the merged shard [start, end)
+func MergeTablets(lower, upper, merged *Tablet) error {
+
+	if lower == nil || upper == nil || merged == nil {
+		return fmt.Errorf("MergeTablets - tablet is nil")
+	}
+	if err := shard_check_tablets(merged, lower, upper); err != nil {
+		return fmt.Errorf("MergeTablets - %s", err)
+	}
+
+	lower_start, lower_end, err := shard_range(lower)
+	if err != nil {
+		return fmt.Errorf("MergeTablets - %s", err)
+	}
+	upper_start, upper_end, err := shard_range(upper)
+	if err != nil {
+		return fmt.Errorf("MergeTablets - %s", err)
+	}
+	if bytes.Equal(lower_start, lower_end) || bytes.Equal(upper_start, upper_end) {
+		return fmt.Errorf("MergeTablets - shard covers the whole ring")
+	}
+	if !bytes.Equal(lower_end, upper_start) {
+		return fmt.Errorf("MergeTablets - lower shard end %x not match upper shard start %x", lower_end, upper_start)
+	}
+	if err := shard_check_range(merged, lower_start, upper_end); err != nil {
+		return fmt.Errorf("MergeTablets - %s", err)
+	}
+
+	lower_out, err := shard_write(lower, merged)
+	if err != nil {
+		return fmt.Errorf("MergeTablets - %s", err)
+	}
+	defer lower_out.remove()
+	upper_out, err := shard_write(upper, merged)
+	if err != nil {
+		return fmt.Errorf("MergeTablets - %s", err)
+	}
+	defer upper_out.remove()
+
+	// records of the two shards are at different locations, so no key is in
+	// files of both
+	if err := merged.IngestSSTables(append(lower_out.paths, upper_out.paths...)); err != nil {
+		return fmt.Errorf("MergeTablets - %s", err)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// SSTables written for a target tablet, in a temporary directory
+type shard_output struct {
+	dir   string // empty if no SSTable
+	paths []string
+}
+
+// remove the temporary directory and its SSTables
+func (o *shard_output) remove() {
+	if o.dir != "" {
+		os.RemoveAll(o.dir)
+	}
+}
+
+// write records of src located in both shards to SSTables for dst, output
+// must be removed after ingested
+func shard_write(src, dst *Tablet) (*shard_output, error) {
+
+	src_start, src_end, err := shard_range(src)
+	if err != nil {
+		return nil, err
+	}
+	dst_start, dst_end, err := shard_range(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := src.view()
+	if err != nil {
+		return nil, err
+	}
+	defer view.release()
+
+	out := &shard_output{paths: []string{}}
+	start_time, end_time, err := shard_time_range(view)
+	if err != nil {
+		return nil, err
+	} else if collection.IsNil(start_time) {
+		return out, nil
+	}
+
+	if out.dir, err = ioutil.TempDir(dst.pdb.dir, "shard"); err != nil {
+		return nil, err
+	}
+	written := false
+	defer func() {
+		if !written {
+			out.remove()
+		}
+	}()
+
+	w := new_sstable_writer(new_sstable_limits(), func() (ISSTableBuilder, error) {
+		path := filepath.Join(out.dir, fmt.Sprintf("%016x%s", len(out.paths), SSTABLE_SUFFIX))
+		b, err := NewSSTableBuilder(dst.pdb.sstable_version, path, dst.ConsensusID(), dst.Domain(), dst.Table(), 0, start_time, end_time)
+		if err != nil {
+			return nil, err
+		}
+		out.paths = append(out.paths, path)
+		return b, nil
+	})
+	defer w.abort()
+
+	var key util.IKey
+	copied := false
+	iter, release, err := view.prefixIterator(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	for iter.HasNext() {
+		r := iter.Next()
+
+		if key == nil || !key.Equal(r.Key()) {
+			key = r.Key()
+			location, err := util.ShardHash(src.ConsensusID(), src.Domain(), src.Table(), key)
+			if err != nil {
+				return nil, err
+			}
+			copied = util.ShardContains(src_start, src_end, location) && util.ShardContains(dst_start, dst_end, location)
+		}
+
+		if !copied {
+			continue
+		}
+
+		if err := w.add(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+
+	written = true
+	return out, nil
+}
+
+// shard start and end of the consensus ID of tablet, the whole ring if the
+// consensus ID has no shard
+func shard_range(t *Tablet) ([]byte, []byte, error) {
+
+	start, end, err := util.ConsensusShard(t.ConsensusID())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if start == nil {
+		start = make([]byte, util.SHARD_HASH_SIZE)
+		end = make([]byte, util.SHARD_HASH_SIZE)
+	}
+
+	return start, end, nil
+}
+
+// tablet covers shard [start, end), any equal start and end for the whole ring
+func shard_check_range(t *Tablet, start, end []byte) error {
+
+	t_start, t_end, err := shard_range(t)
+	if err != nil {
+		return err
+	}
+
+	whole := bytes.Equal(start, end)
+	if whole && bytes.Equal(t_start, t_end) {
+		return nil
+	}
+	if whole || !bytes.Equal(t_start, start) || !bytes.Equal(t_end, end) {
+		return fmt.Errorf("shard %x - %x of [%x] not match %x - %x", t_start, t_end, t.ConsensusID().Buf(), start, end)
+	}
+
+	return nil
+}
+
+// tablets of the same domain and table, each of a different pdb
+func shard_check_tablets(tablets ...*Tablet) error {
+
+	for i, t := range tablets {
+		if t.Domain() != tablets[0].Domain() || t.Table() != tablets[0].Table() {
+			return fmt.Errorf("tablet [%s] [%s] not match [%s] [%s]", t.Domain(), t.Table(), tablets[0].Domain(), tablets[0].Table())
+		}
+		for _, other := range tablets[:i] {
+			if t.pdb == other.pdb {
+				return fmt.Errorf("tablets of the same pdb [%s]", t.pdb.dir)
+			}
+		}
+	}
+
+	return nil
+}
+
+// earliest start time and latest end time of memtables and SSTables of view,
+// nil if view has no record
+func shard_time_range(view *tablet_view) (util.IConsensusTime, util.IConsensusTime, error) {
+
+	var start, end util.IConsensusTime
+	update := func(s, e util.IConsensusTime) error {
+		if collection.IsNil(s) || collection.IsNil(e) {
+			return nil
+		}
+		if collection.IsNil(start) {
+			start, end = s, e
+			return nil
+		}
+		if lt, err := s.LT(start); err != nil {
+			return err
+		} else if lt {
+			start = s
+		}
+		if gt, err := e.GT(end); err != nil {
+			return err
+		} else if gt {
+			end = e
+		}
+		return nil
+	}
+
+	for _, m := range view.memtables {
+		if m.Count() == 0 {
+			continue
+		}
+		if err := update(m.StartTime(), m.EndTime()); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, files := range view.levels {
+		for _, file := range files {
+			handle, err := view.acquire(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = update(handle.Table().StartTime(), handle.Table().EndTime())
+			handle.Release()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return start, end, nil
+}
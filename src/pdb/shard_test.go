@@ -0,0 +1,171 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../util"
+)
+
+func openTestShardTablet(t testing.TB, dir string, consensus_id util.IConsensusID) (*PdbV1, *Tablet) {
+	p, err := OpenPdbV1(dir, consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tablet, err := p.Tablet("test.table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, tablet
+}
+
+func TestSplitMergeTablet(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	cluster := newTestConsensusID()
+	zero := make([]byte, util.SHARD_HASH_SIZE)
+	boundary := make([]byte, util.SHARD_HASH_SIZE)
+	boundary[0] = 0x80
+	lower_id, err := util.NewShardConsensusID(cluster, zero, boundary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper_id, err := util.NewShardConsensusID(cluster, boundary, zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// whole ring, records flushed and in memtable
+	src_pdb, src := openTestShardTablet(t, filepath.Join(dir, "src"), cluster)
+	defer src_pdb.Close()
+	for k := 0; k < 100; k++ {
+		if err := src.Set(util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%03d", k), fmt.Sprintf("value%d", k))); err != nil {
+			t.Fatal(err)
+		}
+		if k == 59 {
+			if err := src_pdb.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := src.Set(util.NewLedgerTime(2), newTestClearRecord("key000", 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a hot key with more versions than a key has headroom for in a file
+	versions := util.MAX_ATTR_GROUPS + 10
+	for epoch := 3; epoch < 3+versions; epoch++ {
+		if err := src.Set(util.NewLedgerTime(uint32(epoch)), newTestRecord("hot", fmt.Sprintf("h%d", epoch))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lower_pdb, lower := openTestShardTablet(t, filepath.Join(dir, "lower"), lower_id)
+	defer lower_pdb.Close()
+	upper_pdb, upper := openTestShardTablet(t, filepath.Join(dir, "upper"), upper_id)
+	defer upper_pdb.Close()
+
+	if err := SplitTablet(src, boundary, upper, lower); err == nil {
+		t.Errorf("split into swapped shards should fail")
+	}
+	if err := SplitTablet(src, zero, lower, upper); err == nil {
+		t.Errorf("split at shard start should fail")
+	}
+	if err := SplitTablet(src, boundary, lower, lower); err == nil {
+		t.Errorf("split into the same tablet should fail")
+	}
+
+	if err := SplitTablet(src, boundary, lower, upper); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for k := 0; k < 100; k++ {
+		key := fmt.Sprintf("key%03d", k)
+		location, err := util.ShardHash(cluster, "test.domain", "test.table", newTestKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		in_lower := util.ShardContains(zero, boundary, location)
+		want_lower, want_upper := "<nil>", fmt.Sprintf("value%d", k)
+		if in_lower {
+			want_lower, want_upper = want_upper, want_lower
+		}
+		if k == 0 {
+			want_lower, want_upper = "<nil>", "<nil>"
+		}
+		if v := getTestValue(t, lower_pdb, "test.table", key, ""); v != want_lower {
+			t.Errorf("lower %s = %s; want %s", key, v, want_lower)
+		}
+		if v := getTestValue(t, upper_pdb, "test.table", key, ""); v != want_upper {
+			t.Errorf("upper %s = %s; want %s", key, v, want_upper)
+		}
+		if in_lower {
+			counts["lower"]++
+		} else {
+			counts["upper"]++
+		}
+	}
+	if counts["lower"] == 0 || counts["upper"] == 0 {
+		t.Errorf("records not split: %v", counts)
+	}
+
+	// history is copied
+	history := 0
+	for _, tablet := range []*Tablet{lower, upper} {
+		r, err := tablet.GetAsOf(newTestKey("key000"), "", util.NewLedgerTime(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != nil && string(r.Value().Value()) == "value0" {
+			history++
+		}
+	}
+	if history != 1 {
+		t.Errorf("history of key000 found in %d tablets", history)
+	}
+	history = 0
+	for _, tablet := range []*Tablet{lower, upper} {
+		r, err := tablet.GetAsOf(newTestKey("hot"), "", util.NewLedgerTime(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != nil && string(r.Value().Value()) == "h3" {
+			history++
+		}
+	}
+	if history != 1 {
+		t.Errorf("history of hot key found in %d tablets", history)
+	}
+
+	// merge back into the whole ring
+	merged_pdb, merged := openTestShardTablet(t, filepath.Join(dir, "merged"), cluster)
+	defer merged_pdb.Close()
+
+	if err := MergeTablets(lower, src, merged); err == nil {
+		t.Errorf("merge of whole ring shard should fail")
+	}
+	if err := MergeTablets(lower, upper, lower); err == nil {
+		t.Errorf("merge into the same tablet should fail")
+	}
+
+	if err := MergeTablets(lower, upper, merged); err != nil {
+		t.Fatal(err)
+	}
+	for k := 1; k < 100; k++ {
+		key := fmt.Sprintf("key%03d", k)
+		if v := getTestValue(t, merged_pdb, "test.table", key, ""); v != fmt.Sprintf("value%d", k) {
+			t.Errorf("merged %s = %s", key, v)
+		}
+	}
+	if v := getTestValue(t, merged_pdb, "test.table", "key000", ""); v != "<nil>" {
+		t.Errorf("merged key000 = %s", v)
+	}
+	if v := getTestValue(t, merged_pdb, "test.table", "hot", ""); v != fmt.Sprintf("h%d", 2+versions) {
+		t.Errorf("merged hot = %s", v)
+	}
+}
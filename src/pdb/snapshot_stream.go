@@ -0,0 +1,631 @@
+package pdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"../util"
+)
+
+const (
+	SNAPSHOT_CHUNK_SIZE     = 1024 * 1024 // max data bytes of a chunk
+	SNAPSHOT_HEADER_FILE    = "SNAPSHOT"
+	snapshot_chunk_header   = byte(1)
+	snapshot_chunk_data     = byte(2)
+	snapshot_chunk_end      = byte(3)
+	snapshot_chunk_overhead = 4 + 1 + 8 + 4 // length, type, data offset, crc32
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Snapshot Stream
+//
+// A snapshot stream ships the SSTables of a tablet to a Raft learner, which
+// then catches up with change logs from the journal position of the snapshot.
+// SnapshotProducer holds a manifest version of the tablet, so its files stay
+// on disk until Release, and streams them as chunks:
+//
+//   chunk       : length, type, payload, crc32 of type and payload
+//   header      : version, consensus id, domain, table, journal seq,
+//                 file count, files (level, size)
+//   data        : offset in stream, bytes of one file
+//   end         : total size of files
+//
+// Files are streamed in order of file number, back to back, and data offset
+// is the offset of the bytes in the concatenation of all files.  Records of
+// the tablet with journal seq before journal seq are in the files - records
+// after are in memtables or not yet flushed, and are caught up from logs.
+//
+// SnapshotConsumer writes the header and received files into a staging
+// directory, and syncs each chunk.  A broken stream is resumed by streaming
+// again from the Offset of the consumer, which survives restarts - if the
+// header of the new stream differs, the snapshot changed on the producer, and
+// the consumer starts over from offset 0.  Install replaces all SSTables of a
+// tablet with the received files in one manifest edit.
+
+type SnapshotProducer struct {
+	version    *ManifestVersion // nil if table has no SSTable
+	header     []byte
+	files      []snapshot_file
+	total      uint64
+	chunk_size int
+}
+
+type SnapshotConsumer struct {
+	dir    string // staging directory
+	header *snapshot_header
+	raw    []byte // encoded header
+	offset uint64 // bytes received
+	done   bool
+}
+
+type snapshot_header struct {
+	consensus_id util.IConsensusID
+	domain       string
+	table        string
+	journal_seq  uint64
+	files        []snapshot_file
+	total        uint64
+}
+
+type snapshot_file struct {
+	level uint32
+	num   uint64 // file number on producer
+	size  uint64
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SnapshotProducer
+
+// snapshot of current SSTables of a tablet, must be released after use
+func NewSnapshotProducer(t *Tablet) (*SnapshotProducer, error) {
+
+	s := &SnapshotProducer{files: []snapshot_file{}, chunk_size: SNAPSHOT_CHUNK_SIZE}
+
+	header := &snapshot_header{consensus_id: t.ConsensusID(), domain: t.Domain(), table: t.Table()}
+
+	if manifest := t.pdb.flusher.Manifest(t.table); manifest != nil {
+		s.version = manifest.Current()
+		header.journal_seq = s.version.FlushedSeq()
+		for _, file := range s.version.Files() {
+			info, err := os.Stat(s.version.FilePath(file.num))
+			if err != nil {
+				s.Release()
+				return nil, fmt.Errorf("NewSnapshotProducer - %s", err)
+			}
+			s.files = append(s.files, snapshot_file{level: file.level, num: file.num, size: uint64(info.Size())})
+		}
+	}
+
+	// order of file number keeps level 0 files newest last
+	sort.Slice(s.files, func(a, b int) bool { return s.files[a].num < s.files[b].num })
+	for _, file := range s.files {
+		s.total += file.size
+	}
+	header.files = s.files
+	header.total = s.total
+
+	buf, err := header.encode()
+	if err != nil {
+		s.Release()
+		return nil, fmt.Errorf("NewSnapshotProducer - %s", err)
+	}
+	s.header = buf
+
+	return s, nil
+}
+
+// records with journal seq before are in the snapshot
+func (s *SnapshotProducer) JournalSeq() uint64 {
+	if s.version == nil {
+		return 0
+	}
+	return s.version.FlushedSeq()
+}
+
+// total size of files
+func (s *SnapshotProducer) Size() uint64 {
+	return s.total
+}
+
+// write header, files from offset, and end to w - offset is the Offset of
+// the consumer, 0 to start over
+func (s *SnapshotProducer) Stream(w io.Writer, offset uint64) error {
+
+	if offset > s.total {
+		return fmt.Errorf("SnapshotProducer::Stream - offset %d exceeding size %d", offset, s.total)
+	}
+
+	if err := snapshot_write_chunk(w, snapshot_chunk_header, s.header); err != nil {
+		return err
+	}
+
+	start := uint64(0)
+	for _, file := range s.files {
+		if start+file.size > offset {
+			if err := s.streamFile(w, file, offset-start, start); err != nil {
+				return err
+			}
+			offset = start + file.size
+		}
+		start += file.size
+	}
+
+	return snapshot_write_chunk(w, snapshot_chunk_end, appendUint64(nil, s.total))
+}
+
+// release files of the snapshot
+func (s *SnapshotProducer) Release() {
+	if s.version != nil {
+		s.version.Release()
+		s.version = nil
+	}
+}
+
+// write data chunks of a file from pos, start is the offset of the file in stream
+func (s *SnapshotProducer) streamFile(w io.Writer, file snapshot_file, pos, start uint64) error {
+
+	if s.version == nil {
+		return fmt.Errorf("SnapshotProducer::Stream - snapshot released")
+	}
+
+	f, err := os.Open(s.version.FilePath(file.num))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(int64(pos), io.SeekStart); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8+s.chunk_size)
+	for pos < file.size {
+		n := uint64(s.chunk_size)
+		if file.size-pos < n {
+			n = file.size - pos
+		}
+		binary.BigEndian.PutUint64(buf, start+pos)
+		if _, err := io.ReadFull(f, buf[8:8+n]); err != nil {
+			return fmt.Errorf("SnapshotProducer::Stream - file %d - %s", file.num, err)
+		}
+		if err := snapshot_write_chunk(w, snapshot_chunk_data, buf[:8+n]); err != nil {
+			return err
+		}
+		pos += n
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SnapshotConsumer
+
+// consumer receiving into staging dir, resumes from files already received
+func OpenSnapshotConsumer(dir string) (*SnapshotConsumer, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &SnapshotConsumer{dir: dir}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, SNAPSHOT_HEADER_FILE))
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	header, err := snapshot_decode_header(raw)
+	if err != nil {
+		return nil, fmt.Errorf("OpenSnapshotConsumer - %s", err)
+	}
+	c.header = header
+	c.raw = raw
+
+	// files are received in order, offset ends at the first partial file
+	for i, file := range header.files {
+		info, err := os.Stat(c.filePath(i))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if uint64(info.Size()) > file.size {
+			return nil, fmt.Errorf("OpenSnapshotConsumer - file %d size %d exceeding %d", i, info.Size(), file.size)
+		}
+		c.offset += uint64(info.Size())
+		if uint64(info.Size()) < file.size {
+			break
+		}
+	}
+	c.done = c.offset == header.total
+
+	return c, nil
+}
+
+// bytes received, the offset to resume streaming from
+func (c *SnapshotConsumer) Offset() uint64 {
+	return c.offset
+}
+
+// whether the whole snapshot is received
+func (c *SnapshotConsumer) Done() bool {
+	return c.done
+}
+
+// records with journal seq before are in the snapshot, 0 if no header received
+// - a seq of the producer journal, logs from there on are caught up by Raft
+func (c *SnapshotConsumer) JournalSeq() uint64 {
+	if c.header == nil {
+		return 0
+	}
+	return c.header.journal_seq
+}
+
+// receive chunks from r until end of snapshot - data received is kept if the
+// stream breaks, and receiving resumes from Offset
+func (c *SnapshotConsumer) Receive(r io.Reader) error {
+
+	var out *os.File
+	out_index := -1
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+
+	for first := true; ; first = false {
+
+		typ, payload, err := snapshot_read_chunk(r)
+		if err != nil {
+			return fmt.Errorf("SnapshotConsumer::Receive - %s", err)
+		}
+
+		if first != (typ == snapshot_chunk_header) {
+			return fmt.Errorf("SnapshotConsumer::Receive - stream must start with one header")
+		}
+
+		switch typ {
+
+		case snapshot_chunk_header:
+			if err := c.receiveHeader(payload); err != nil {
+				return fmt.Errorf("SnapshotConsumer::Receive - %s", err)
+			}
+
+		case snapshot_chunk_data:
+			if len(payload) < 8 {
+				return fmt.Errorf("SnapshotConsumer::Receive - data chunk too short")
+			}
+			offset := binary.BigEndian.Uint64(payload)
+			data := payload[8:]
+			if offset != c.offset {
+				return fmt.Errorf("SnapshotConsumer::Receive - data offset %d not match %d", offset, c.offset)
+			}
+			index, pos := c.locate(offset)
+			if index < 0 || pos+uint64(len(data)) > c.header.files[index].size {
+				return fmt.Errorf("SnapshotConsumer::Receive - data at offset %d exceeding file", offset)
+			}
+			if index != out_index {
+				if out != nil {
+					out.Close()
+				}
+				out, err = os.OpenFile(c.filePath(index), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+				if err != nil {
+					out = nil
+					return err
+				}
+				out_index = index
+			}
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+			if err := out.Sync(); err != nil {
+				return err
+			}
+			c.offset += uint64(len(data))
+
+		case snapshot_chunk_end:
+			if len(payload) != 8 || binary.BigEndian.Uint64(payload) != c.header.total {
+				return fmt.Errorf("SnapshotConsumer::Receive - end chunk not match size %d", c.header.total)
+			}
+			if c.offset != c.header.total {
+				return fmt.Errorf("SnapshotConsumer::Receive - received %d of %d bytes", c.offset, c.header.total)
+			}
+			c.done = true
+			return syncDir(c.dir)
+
+		default:
+			return fmt.Errorf("SnapshotConsumer::Receive - unknown chunk type %d", typ)
+		}
+	}
+}
+
+// replace all SSTables of tablet with the snapshot in one manifest edit, and
+// remove the staging dir - records in memtables of the tablet are flushed and
+// replaced too.  Journal seq of the snapshot is a position in the journal of
+// the producer, and is not recorded - the tablet keeps the flushed seq of its
+// own journal.
+func (c *SnapshotConsumer) Install(t *Tablet) error {
+
+	if !c.done {
+		return fmt.Errorf("SnapshotConsumer::Install - snapshot not fully received")
+	}
+
+	h := c.header
+	if !bytes.Equal(h.consensus_id.Buf(), t.ConsensusID().Buf()) || h.domain != t.Domain() || h.table != t.Table() {
+		return fmt.Errorf("SnapshotConsumer::Install - snapshot of [%x] [%s] [%s] not match tablet", h.consensus_id.Buf(), h.domain, h.table)
+	}
+
+	files := []*ingest_file{}
+	levels := []uint32{}
+	defer func() {
+		for _, f := range files {
+			f.table.Close()
+		}
+	}()
+	for i, file := range h.files {
+		table, err := LoadSSTable(c.filePath(i))
+		if err != nil {
+			return fmt.Errorf("SnapshotConsumer::Install - file %d - %s", i, err)
+		}
+		files = append(files, &ingest_file{path: c.filePath(i), table: table, size: file.size})
+		levels = append(levels, file.level)
+		if !bytes.Equal(table.ConsensusID().Buf(), t.ConsensusID().Buf()) || table.Table() != t.Table() || table.Domain() != t.Domain() {
+			return fmt.Errorf("SnapshotConsumer::Install - file %d of table [%x] [%s] [%s]", i, table.ConsensusID().Buf(), table.Domain(), table.Table())
+		}
+	}
+
+	// no write of the table until files are installed
+	lock := t.pdb.lock(t.table)
+	lock.Lock()
+	defer lock.Unlock()
+
+	t.pdb.mutex.Lock()
+	closed := t.pdb.closed
+	t.pdb.mutex.Unlock()
+	if closed {
+		return fmt.Errorf("SnapshotConsumer::Install - pdb closed")
+	}
+
+	for _, m := range t.pdb.flusher.Memtables(t.table) {
+		if m.Count() > 0 {
+			if err := t.pdb.flusher.Flush(); err != nil {
+				return fmt.Errorf("SnapshotConsumer::Install - %s", err)
+			}
+			break
+		}
+	}
+
+	manifest, err := t.pdb.flusher.manifest(t.table)
+	if err != nil {
+		return fmt.Errorf("SnapshotConsumer::Install - %s", err)
+	}
+
+	if err := t.pdb.tableCompactor(t.table, manifest).install(files, levels); err != nil {
+		return fmt.Errorf("SnapshotConsumer::Install - %s", err)
+	}
+
+	t.pdb.schedule(t.table)
+
+	return c.Abort()
+}
+
+// remove the staging dir and all data received
+func (c *SnapshotConsumer) Abort() error {
+	c.header = nil
+	c.raw = nil
+	c.offset = 0
+	c.done = false
+	return os.RemoveAll(c.dir)
+}
+
+// adopt header of a stream, start over if snapshot changed
+func (c *SnapshotConsumer) receiveHeader(raw []byte) error {
+
+	if c.raw != nil && bytes.Equal(c.raw, raw) {
+		return nil
+	}
+
+	header, err := snapshot_decode_header(raw)
+	if err != nil {
+		return err
+	}
+
+	restart := c.offset > 0
+	if err := c.Abort(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(c.dir, SNAPSHOT_HEADER_FILE), raw); err != nil {
+		return err
+	}
+	c.header = header
+	c.raw = raw
+
+	if restart {
+		return fmt.Errorf("snapshot changed, resume from offset 0")
+	}
+
+	return nil
+}
+
+// file index and position in file of a stream offset, -1 if past the end
+func (c *SnapshotConsumer) locate(offset uint64) (int, uint64) {
+	start := uint64(0)
+	for i, file := range c.header.files {
+		if offset < start+file.size {
+			return i, offset - start
+		}
+		start += file.size
+	}
+	return -1, 0
+}
+
+func (c *SnapshotConsumer) filePath(index int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%016x%s", index, SSTABLE_SUFFIX))
+}
+
+// link files into the manifest directory at their levels, and replace all
+// current files in one edit - no compaction runs meanwhile
+func (c *Compactor) install(files []*ingest_file, levels []uint32) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	removed := c.manifest.Files()
+
+	added := []ManifestFile{}
+	abort := func() {
+		for _, file := range added {
+			os.Remove(c.manifest.FilePath(file.num))
+		}
+	}
+
+	for i, f := range files {
+		if levels[i] >= COMPACTION_MAX_LEVELS {
+			abort()
+			return fmt.Errorf("file %d level %d exceeding %d", i, levels[i], COMPACTION_MAX_LEVELS)
+		}
+		num := c.manifest.NewFileNum()
+		file, err := NewManifestTableFile(levels[i], num, f.table, f.size)
+		if err != nil {
+			abort()
+			return err
+		}
+		if err := linkFile(f.path, c.manifest.FilePath(num)); err != nil {
+			abort()
+			return err
+		}
+		added = append(added, file)
+	}
+
+	if err := c.manifest.Apply(added, removed, 0); err != nil {
+		abort()
+		return err
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+func (h *snapshot_header) encode() ([]byte, error) {
+
+	buf := appendUint32(nil, 1)
+	buf = append(buf, h.consensus_id.Buf()...)
+
+	var err error
+	if buf, err = journal_append_table(buf, h.domain); err != nil {
+		return nil, err
+	}
+	if buf, err = journal_append_table(buf, h.table); err != nil {
+		return nil, err
+	}
+
+	buf = appendUint64(buf, h.journal_seq)
+	buf = appendUint32(buf, uint32(len(h.files)))
+	for _, file := range h.files {
+		buf = appendUint32(buf, file.level)
+		buf = appendUint64(buf, file.size)
+	}
+
+	return buf, nil
+}
+
+func snapshot_decode_header(buf []byte) (*snapshot_header, error) {
+
+	if len(buf) < 4 || binary.BigEndian.Uint32(buf) != 1 {
+		return nil, fmt.Errorf("snapshot header - unsupported version")
+	}
+	pos := 4
+
+	consensus_id, err := util.NewMappedConsensusID(buf[pos:])
+	if err != nil {
+		return nil, fmt.Errorf("snapshot header - %s", err)
+	}
+	pos += len(consensus_id.Buf())
+
+	names := []string{}
+	for i := 0; i < 2; i++ {
+		value, length, err := util.NewStandardMappedValue(buf[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("snapshot header - %s", err)
+		}
+		if !value.IsPrimitive() {
+			return nil, fmt.Errorf("snapshot header - domain or table not primitive")
+		}
+		names = append(names, string(value.Value()))
+		pos += int(length)
+	}
+
+	if len(buf) < pos+8+4 {
+		return nil, fmt.Errorf("snapshot header too short")
+	}
+	h := &snapshot_header{consensus_id: consensus_id, domain: names[0], table: names[1], files: []snapshot_file{}}
+	h.journal_seq = binary.BigEndian.Uint64(buf[pos:])
+	count := int(binary.BigEndian.Uint32(buf[pos+8:]))
+	pos += 8 + 4
+
+	if len(buf) != pos+count*(4+8) {
+		return nil, fmt.Errorf("snapshot header - file count %d not match header size %d", count, len(buf))
+	}
+	for i := 0; i < count; i++ {
+		file := snapshot_file{level: binary.BigEndian.Uint32(buf[pos:]), size: binary.BigEndian.Uint64(buf[pos+4:])}
+		h.files = append(h.files, file)
+		h.total += file.size
+		pos += 4 + 8
+	}
+
+	return h, nil
+}
+
+func snapshot_write_chunk(w io.Writer, typ byte, payload []byte) error {
+
+	buf := make([]byte, 0, 4+1+len(payload)+4)
+	buf = appendUint32(buf, uint32(len(payload)))
+	buf = append(buf, typ)
+	buf = append(buf, payload...)
+	buf = appendUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+func snapshot_read_chunk(r io.Reader) (byte, []byte, error) {
+
+	head := make([]byte, 4+1)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(head)
+	if length > SNAPSHOT_CHUNK_SIZE+snapshot_chunk_overhead {
+		return 0, nil, fmt.Errorf("chunk length %d exceeding %d", length, SNAPSHOT_CHUNK_SIZE)
+	}
+
+	buf := make([]byte, 1+length+4)
+	buf[0] = head[4]
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return 0, nil, err
+	}
+
+	computed_crc32 := crc32.ChecksumIEEE(buf[:1+length])
+	chunk_crc32 := binary.BigEndian.Uint32(buf[1+length:])
+	if computed_crc32 != chunk_crc32 {
+		return 0, nil, fmt.Errorf("crc32 checksum failed - computed %d vs chunk %d", computed_crc32, chunk_crc32)
+	}
+
+	return head[4], buf[1 : 1+length], nil
+}
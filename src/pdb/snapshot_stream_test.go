@@ -0,0 +1,229 @@
+package pdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../util"
+)
+
+func TestSnapshotStream(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	p, err := OpenPdbV1(filepath.Join(dir, "leader"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	tablet, err := p.Tablet("test.table")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// level 0 and level 1 files, and a record not flushed
+	write := func(value string, flushes int) {
+		for i := 0; i < flushes; i++ {
+			for k := i; k < 100; k += flushes {
+				if err := tablet.Set(util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%03d", k), value)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write("v1", COMPACTION_L0_TRIGGER)
+	waitTestCompaction(t, p.flusher.Manifest("test.table"))
+	write("v2", 2)
+	if err := tablet.Set(util.NewLedgerTime(1), newTestRecord("unflushed", "v")); err != nil {
+		t.Fatal(err)
+	}
+
+	producer, err := NewSnapshotProducer(tablet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Release()
+	producer.chunk_size = 1024
+	if producer.JournalSeq() != p.flusher.Manifest("test.table").FlushedSeq() || len(producer.files) < 2 {
+		t.Errorf("journal seq %d, %d files", producer.JournalSeq(), len(producer.files))
+	}
+
+	// files of the snapshot are kept while compacted away
+	write("v3", COMPACTION_L0_TRIGGER)
+	waitTestCompaction(t, p.flusher.Manifest("test.table"))
+
+	var full bytes.Buffer
+	if err := producer.Stream(&full, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// broken stream, resumed after restart
+	staging := filepath.Join(dir, "staging")
+	c, err := OpenSnapshotConsumer(staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Receive(bytes.NewReader(full.Bytes()[:full.Len()/2])); err == nil {
+		t.Errorf("broken stream should fail")
+	}
+	offset := c.Offset()
+	if offset == 0 || offset >= producer.Size() || c.Done() {
+		t.Fatalf("offset %d of %d after broken stream", offset, producer.Size())
+	}
+	c, err = OpenSnapshotConsumer(staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Offset() != offset {
+		t.Errorf("offset %d after restart; want %d", c.Offset(), offset)
+	}
+
+	// corrupted chunk
+	var resumed bytes.Buffer
+	if err := producer.Stream(&resumed, c.Offset()); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte{}, resumed.Bytes()...)
+	corrupted[len(producer.header)+4+1+4+1+8+10] ^= 0xff
+	if err := c.Receive(bytes.NewReader(corrupted)); err == nil {
+		t.Errorf("corrupted stream should fail")
+	}
+	if c.Offset() != offset {
+		t.Errorf("offset %d after corrupted chunk; want %d", c.Offset(), offset)
+	}
+
+	if err := c.Receive(bytes.NewReader(resumed.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Done() || c.Offset() != producer.Size() || c.JournalSeq() != producer.JournalSeq() {
+		t.Errorf("done %v offset %d journal seq %d", c.Done(), c.Offset(), c.JournalSeq())
+	}
+
+	// learner with records of its own
+	l, err := OpenPdbV1(filepath.Join(dir, "learner"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	learner, err := l.Tablet("test.table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := learner.Set(util.NewLedgerTime(1), newTestRecord("stale", "flushed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := learner.Set(util.NewLedgerTime(1), newTestRecord("key000", "memtable")); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := l.Tablet("other.table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Install(other); err == nil {
+		t.Errorf("install into other table should fail")
+	}
+
+	// file of another consensus id
+	path := c.filePath(0)
+	if err := os.Rename(path, path+".orig"); err != nil {
+		t.Fatal(err)
+	}
+	buildTestIngestSSTable(t, path, newTestConsensusID(), "test.table", []string{"key000"}, "foreign")
+	if err := c.Install(learner); err == nil {
+		t.Errorf("install of file of another consensus id should fail")
+	}
+	if err := os.Rename(path+".orig", path); err != nil {
+		t.Fatal(err)
+	}
+
+	// journal seq of the snapshot is ahead of the learner journal, and is
+	// not taken as flushed seq of the learner
+	journal_seq := c.JournalSeq()
+	if journal_seq <= l.flusher.journal.next_seq {
+		t.Fatalf("journal seq %d of snapshot not past learner journal %d", journal_seq, l.flusher.journal.next_seq)
+	}
+	if err := c.Install(learner); err != nil {
+		t.Fatal(err)
+	}
+	if seq := l.flusher.Manifest("test.table").FlushedSeq(); seq >= journal_seq {
+		t.Errorf("flushed seq %d after install; want learner seq before %d", seq, journal_seq)
+	}
+	for k := 0; k < 100; k++ {
+		if v := getTestValue(t, l, "test.table", fmt.Sprintf("key%03d", k), ""); v != "v2" {
+			t.Errorf("key%03d = %s; want v2", k, v)
+		}
+	}
+	for _, key := range []string{"stale", "unflushed"} {
+		if v := getTestValue(t, l, "test.table", key, ""); v != "<nil>" {
+			t.Errorf("%s = %s", key, v)
+		}
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Errorf("staging dir not removed: %v", err)
+	}
+
+	// snapshot changed on producer, consumer starts over
+	c, err = OpenSnapshotConsumer(staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Receive(bytes.NewReader(full.Bytes()[:full.Len()/2])); err == nil {
+		t.Errorf("broken stream should fail")
+	}
+	changed, err := NewSnapshotProducer(tablet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer changed.Release()
+	var stream bytes.Buffer
+	if err := changed.Stream(&stream, c.Offset()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Receive(bytes.NewReader(stream.Bytes())); err == nil || c.Offset() != 0 {
+		t.Errorf("changed snapshot should start over: %v, offset %d", err, c.Offset())
+	}
+	stream.Reset()
+	if err := changed.Stream(&stream, c.Offset()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Receive(&stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Install(learner); err != nil {
+		t.Fatal(err)
+	}
+	if v := getTestValue(t, l, "test.table", "key050", ""); v != "v3" {
+		t.Errorf("key050 = %s; want v3", v)
+	}
+
+	// writes after install not flushed are recovered from journal
+	if err := learner.Set(util.NewLedgerTime(1), newTestRecord("key050", "after")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = OpenPdbV1(filepath.Join(dir, "learner"), consensus_id, "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if v := getTestValue(t, l, "test.table", "key050", ""); v != "after" {
+		t.Errorf("key050 = %s after reopen; want after", v)
+	}
+	if v := getTestValue(t, l, "test.table", "key051", ""); v != "v3" {
+		t.Errorf("key051 = %s after reopen; want v3", v)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	//"golang.org/x/exp/mmap" - not good, interface requires memory copy
+	"../collection"
 	"../util"
 	"github.com/edsrzf/mmap-go"
 )
@@ -15,6 +16,13 @@ const (
 	SSTABLE_MAX_BLOCK_SIZE = uint32(4 * 1024 * 1024)        // this is a soft limit, it helps keep operation relatively small
 	SSTABLE_MAX_FILE_SIZE  = uint32(1 * 1024 * 1024 * 1024) // max file keeps total file small
 	SSTABLE_MAX_RECORDS    = uint32(1024 * 1024)
+	// level field of header holds level in lower 16 bits, and flags in upper 16 bits
+	SSTABLE_LEVEL_MASK = uint32(0xffff)
+	SSTABLE_FLAG_BLOOM = uint32(0x01 << 16) // sstable has bloom section
+	SSTABLE_FLAG_CLEAR = uint32(0x02 << 16) // sstable has CLEAR records
+	// default version of SSTables written by flush and compaction, SSTableV2
+	// is opt in with PdbOptions
+	SSTABLE_VERSION = uint32(1)
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -28,15 +36,20 @@ type ISSTable interface {
 	Table() string                  // Table Name
 	StartTime() util.IConsensusTime // Start Time
 	EndTime() util.IConsensusTime   // End Time
-	StartKey() util.IData           // Start Key
-	EndKey() util.IData             // End Key
+	StartKey() util.IKey            // Start Key
+	EndKey() util.IKey              // End Key
 	Level() uint32                  // Level
 	Count() uint32                  // Record Count
+	HasClear() bool                 // whether any record is CLEAR
 	// Record Operations
-	Get(key, group *util.IData) (util.IRecord, error) // get record with specified key and attribute group
-	Groups(key, scheme util.IData) ([]string, error)
-	Keys(key, scheme util.IData) ([]util.IData, error)
+	Get(key util.IKey, group string) (util.IRecord, error) // get record with specified key and attribute group
+	Groups(key util.IKey) ([]string, error)
+	Keys(key util.IKey) ([]util.IKey, error)
 	Read(pos, suggest_offset uint32) ([]util.IRecord, uint32, error) // Batch scan and read operation, return a list of IRecord, bytes read, or error
+	// Iterators
+	Iterator() ISSTableIterator                          // iterate all records in sorted order
+	RangeIterator(start, end util.IKey) ISSTableIterator // iterate records within given range, start inclusive, end not inclusive
+	PrefixIterator(prefix util.IKey) ISSTableIterator    // iterate records with specified key as prefix
 	// Close the resource
 	Close() error
 }
@@ -49,21 +62,24 @@ type SSTableV1 struct {
 	filepath     string
 	version      uint32
 	consensus_id util.IConsensusID
-	domain       util.IData
-	table        util.IData
+	domain       util.IValue
+	table        util.IValue
 	start_time   util.IConsensusTime
 	end_time     util.IConsensusTime
-	start_key    util.IData
-	end_key      util.IData
+	start_key    util.IKey
+	end_key      util.IKey
 	level        uint32
 	count        uint32 // number of records
+	has_clear    bool   // whether any record is CLEAR
 	// lookup table
+	bloom         *util.BloomFilter // nil if sstable has no bloom section
 	mph_table     *util.MPHTable
 	record_offset []uint32 // record offset table
 	// file as mmap
 	mmap_data *mmap.MMap
-	// record start
+	// record start and end
 	record_start_pos uint32 // start of record position
+	record_end_pos   uint32 // end of record position, followed by records crc32
 }
 
 func LoadSSTableV1(filepath string) (t *SSTableV1, err error) {
@@ -72,6 +88,8 @@ func LoadSSTableV1(filepath string) (t *SSTableV1, err error) {
 	if err != nil {
 		return
 	}
+	// mapping stays valid after the file is closed
+	defer f.Close()
 
 	mmap_data, err := mmap.Map(f, mmap.RDONLY, 0)
 	if err != nil {
@@ -87,105 +105,30 @@ func LoadSSTableV1(filepath string) (t *SSTableV1, err error) {
 		}
 	}()
 
-	// pos tracking
-	pos := 0
-
 	////////////////////////////////////////
 	// parse header
 
-	// parse version
-	if len(mmap_data) < pos+4 {
-		err = fmt.Errorf("NewSSTableV1 - no version")
-		return
-	}
-	t.version = binary.BigEndian.Uint32(mmap_data[pos : pos+4])
-	if t.version != 1 {
-		err = fmt.Errorf("NewSSTableV1 - unsupported version - %d", t.version)
-		return
-	}
-	pos += 4
-
-	// parse consensus_id
-	t.consensus_id, err = util.NewMappedConsensusID(mmap_data[pos:])
+	h, pos, err := sstable_decode_header(mmap_data)
 	if err != nil {
+		err = fmt.Errorf("NewSSTableV1 - %s", err)
 		return
 	}
-	pos += len(t.consensus_id.Buf())
-
-	// parse domain
-	t.domain, err = util.NewStandardMappedData(mmap_data[pos:])
-	if err != nil {
+	if h.version != 1 {
+		err = fmt.Errorf("NewSSTableV1 - unsupported version - %d", h.version)
 		return
 	}
-	pos += len(t.domain.Buf())
-
-	// parse domain
-	t.table, err = util.NewStandardMappedData(mmap_data[pos:])
-	if err != nil {
-		return
-	}
-	pos += len(t.table.Buf())
-
-	// parse start time
-	t.start_time, err = util.NewConsensusTime(mmap_data[pos:])
-	if err != nil {
-		return
-	}
-	pos += len(t.start_time.Buf())
-
-	// parse end time
-	t.end_time, err = util.NewConsensusTime(mmap_data[pos:])
-	if err != nil {
-		return
-	}
-	pos += len(t.end_time.Buf())
-
-	// parse start key
-	t.start_key, err = util.NewStandardMappedData(mmap_data[pos:])
-	if err != nil {
-		return
-	}
-	pos += len(t.start_key.Buf())
-
-	// parse end key
-	t.end_key, err = util.NewStandardMappedData(mmap_data[pos:])
-	if err != nil {
-		return
-	}
-	pos += len(t.end_key.Buf())
-
-	// parse level
-	if len(mmap_data) < pos+4 {
-		err = fmt.Errorf("NewSSTableV1 - no level")
-		return
-	}
-	t.level = binary.BigEndian.Uint32(mmap_data[pos : pos+4])
-	pos += 4
-
-	// parse count
-	if len(mmap_data) < pos+4 {
-		err = fmt.Errorf("NewSSTableV1 - no count")
-		return
-	}
-	t.count = binary.BigEndian.Uint32(mmap_data[pos : pos+4])
-	if t.count > SSTABLE_MAX_RECORDS {
-		err = fmt.Errorf("NewSSTableV1 - unsupported count - %d", t.count)
-		return
-	}
-	pos += 4
-
-	// parse header crc32
-	computed_header_crc32 := crc32.ChecksumIEEE(mmap_data[:pos])
-	if len(mmap_data) < pos+4 {
-		err = fmt.Errorf("NewSSTableV1 - no header crc32")
-		return
-	}
-	header_crc32 := binary.BigEndian.Uint32(mmap_data[pos : pos+4])
-	if computed_header_crc32 != header_crc32 {
-		err = fmt.Errorf("NewSSTableV1 - header crc32 checksum failed - computed %d vs header %d", computed_header_crc32, header_crc32)
-		return
-	}
-	pos += 4
+	t.version = h.version
+	t.consensus_id = h.consensus_id
+	t.domain = h.domain
+	t.table = h.table
+	t.start_time = h.start_time
+	t.end_time = h.end_time
+	t.start_key = h.start_key
+	t.end_key = h.end_key
+	t.level = h.level
+	t.count = h.count
+	t.has_clear = h.flags&SSTABLE_FLAG_CLEAR != 0
+	flags := h.flags
 
 	////////////////////////////////////////
 	// mph hash and offset table
@@ -214,6 +157,7 @@ func LoadSSTableV1(filepath string) (t *SSTableV1, err error) {
 	// parse each record offset data
 	if len(mmap_data) < pos+4*int(record_offset_size) {
 		err = fmt.Errorf("NewSSTableV1 - no record offset data")
+		return
 	}
 	t.record_offset = make([]uint32, int(record_offset_size))
 	for i := 0; i < int(record_offset_size); i++ {
@@ -234,11 +178,46 @@ func LoadSSTableV1(filepath string) (t *SSTableV1, err error) {
 	}
 	pos += 4
 
+	////////////////////////////////////////
+	// optional bloom filter
+
+	if flags&SSTABLE_FLAG_BLOOM != 0 {
+
+		// parse bloom
+		bloom_pos := pos
+		bloom_length := 0
+		t.bloom, bloom_length, err = util.NewBloomFilter(mmap_data[pos:])
+		if err != nil {
+			return
+		}
+		pos += bloom_length
+
+		// parse bloom crc32
+		computed_bloom_crc32 := crc32.ChecksumIEEE(mmap_data[bloom_pos:pos])
+		if len(mmap_data) < pos+4 {
+			err = fmt.Errorf("NewSSTableV1 - no bloom crc32")
+			return
+		}
+		bloom_crc32 := binary.BigEndian.Uint32(mmap_data[pos : pos+4])
+		if computed_bloom_crc32 != bloom_crc32 {
+			err = fmt.Errorf("NewSSTableV1 - bloom crc32 checksum failed - computed %d vs bloom %d", computed_bloom_crc32, bloom_crc32)
+			return
+		}
+		pos += 4
+	}
+
 	////////////////////////////////////////
 	// start of record
 
 	t.record_start_pos = uint32(pos)
 
+	// records are followed by records crc32
+	if len(mmap_data) < pos+4 {
+		err = fmt.Errorf("NewSSTableV1 - no records crc32")
+		return
+	}
+	t.record_end_pos = uint32(len(mmap_data) - 4)
+
 	////////////////////////////////////////
 	// return parsed SSTableV1
 
@@ -253,12 +232,12 @@ func (t *SSTableV1) ConsensusID() util.IConsensusID {
 	return t.consensus_id
 }
 
-func (t *SSTableV1) Domain() []byte {
-	return t.domain.Data()
+func (t *SSTableV1) Domain() string {
+	return string(t.domain.Value())
 }
 
-func (t *SSTableV1) Table() []byte {
-	return t.table.Data()
+func (t *SSTableV1) Table() string {
+	return string(t.table.Value())
 }
 
 func (t *SSTableV1) StartTime() util.IConsensusTime {
@@ -269,11 +248,11 @@ func (t *SSTableV1) EndTime() util.IConsensusTime {
 	return t.end_time
 }
 
-func (t *SSTableV1) StartKey() util.IData {
+func (t *SSTableV1) StartKey() util.IKey {
 	return t.start_key
 }
 
-func (t *SSTableV1) EndKey() util.IData {
+func (t *SSTableV1) EndKey() util.IKey {
 	return t.end_key
 }
 
@@ -281,20 +260,162 @@ func (t *SSTableV1) Level() uint32 {
 	return t.level
 }
 
-func (t *SSTableV1) Get(key, group *util.IData) (util.IRecord, error) {
-	return nil, fmt.Errorf("TODO")
+func (t *SSTableV1) Count() uint32 {
+	return t.count
 }
 
-func (t *SSTableV1) Groups(key *util.IData) ([]util.IData, error) {
-	return nil, fmt.Errorf("TODO")
+func (t *SSTableV1) HasClear() bool {
+	return t.has_clear
 }
 
-func (t *SSTableV1) Keys(key *util.IData) ([]util.IData, error) {
-	return nil, fmt.Errorf("TODO")
+// get record with specified key and group, return nil if not found - a CLEAR
+// record is returned as is, and masks the key and group in older tables
+func (t *SSTableV1) Get(key util.IKey, group string) (util.IRecord, error) {
+
+	if t.mmap_data == nil {
+		return nil, fmt.Errorf("SSTableV1::Get - sstable closed")
+	}
+
+	if t.count == 0 {
+		return nil, nil
+	}
+
+	hash_key, err := sstable_hash_key(key, group)
+	if err != nil {
+		return nil, fmt.Errorf("SSTableV1::Get - %s", err)
+	}
+
+	// bloom filter rules out most absent keys without reading mph or records
+	if t.bloom != nil && !t.bloom.MayContain(hash_key) {
+		return nil, nil
+	}
+
+	// mph verify by hash is only a bloom filter check
+	n, ok := t.mph_table.Lookup(hash_key)
+	if !ok {
+		return nil, nil
+	}
+
+	r, err := t.recordAt(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// verify actual key and group
+	if !r.Key().Equal(key) {
+		return nil, nil
+	}
+
+	r_group, err := RecordGroup(r)
+	if err != nil {
+		return nil, fmt.Errorf("SSTableV1::Get - %s", err)
+	} else if r_group != group {
+		return nil, nil
+	}
+
+	return r, nil
 }
 
-func (t *SSTableV1) Read(pos, suggest_offset uint32) ([]util.IRecord, uint32, error) {
-	return nil, 0, fmt.Errorf("TODO")
+// list of groups under specified key, maximum MAX_ATTR_GROUPS groups
+func (t *SSTableV1) Groups(key util.IKey) ([]string, error) {
+
+	if t.mmap_data == nil {
+		return nil, fmt.Errorf("SSTableV1::Groups - sstable closed")
+	}
+
+	result := []string{}
+
+	// records of the same key are sorted by group
+	n, err := t.seek(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; n < uint32(len(t.record_offset)) && len(result) < util.MAX_ATTR_GROUPS; n++ {
+		r, err := t.recordAt(n)
+		if err != nil {
+			return nil, err
+		}
+		if !r.Key().Equal(key) {
+			break
+		}
+		group, err := RecordGroup(r)
+		if err != nil {
+			return nil, fmt.Errorf("SSTableV1::Groups - %s", err)
+		}
+		// skip cleared groups, and history
+		if record_is_clear(r) || group_is_history(group) {
+			continue
+		}
+		result = append(result, group)
+	}
+
+	return result, nil
+}
+
+// list of child keys with specified key as prefix
+func (t *SSTableV1) Keys(key util.IKey) ([]util.IKey, error) {
+
+	if t.mmap_data == nil {
+		return nil, fmt.Errorf("SSTableV1::Keys - sstable closed")
+	}
+
+	result := []util.IKey{}
+
+	iter := t.PrefixIterator(key)
+	for iter.HasNext() {
+		r := iter.Next()
+		// skip the key itself
+		if !collection.IsNil(key) && len(r.Key().Key()) <= len(key.Key()) {
+			continue
+		}
+		// skip cleared groups, and history
+		if live, err := record_is_live(r); err != nil {
+			return nil, fmt.Errorf("SSTableV1::Keys - %s", err)
+		} else if !live {
+			continue
+		}
+		// skip other groups of the same key
+		if len(result) > 0 && result[len(result)-1].Equal(r.Key()) {
+			continue
+		}
+		result = append(result, r.Key())
+	}
+
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+
+	return result, nil
+}
+
+// decode n-th record in place from mmap data
+func (t *SSTableV1) recordAt(n uint32) (*util.MappedRecord, error) {
+
+	if int(n) >= len(t.record_offset) {
+		return nil, fmt.Errorf("SSTableV1::recordAt - index %d out of range %d", n, len(t.record_offset))
+	}
+
+	start := t.record_start_pos + t.record_offset[n]
+	end := t.record_end_pos
+	if int(n)+1 < len(t.record_offset) {
+		end = t.record_start_pos + t.record_offset[n+1]
+	}
+
+	if start >= end || end > t.record_end_pos {
+		return nil, fmt.Errorf("SSTableV1::recordAt - invalid record offset [%d] %d - %d", n, start, end)
+	}
+
+	r, _, err := util.NewMappedRecord((*t.mmap_data)[start:end])
+	if err != nil {
+		return nil, fmt.Errorf("SSTableV1::recordAt - record [%d] error [%v]", n, err)
+	}
+
+	if collection.IsNil(r.Key()) {
+		return nil, fmt.Errorf("SSTableV1::recordAt - record [%d] has no key", n)
+	}
+
+	return r, nil
 }
 
 func (t *SSTableV1) Close() error {
@@ -309,3 +430,122 @@ func (t *SSTableV1) Close() error {
 	}
 	return nil
 }
+
+////////////////////////////////////////////////////////////////////////////////
+// Header
+//
+// Header is shared by all SSTable versions:
+//
+//   version, consensus id, domain, table, start time, end time, start key,
+//   end key, level and flags, count, header crc32
+
+type sstable_header struct {
+	version      uint32
+	consensus_id util.IConsensusID
+	domain       util.IValue
+	table        util.IValue
+	start_time   util.IConsensusTime
+	end_time     util.IConsensusTime
+	start_key    util.IKey
+	end_key      util.IKey
+	level        uint32
+	flags        uint32
+	count        uint32
+}
+
+// parse header in place from buf, return header and header length
+func sstable_decode_header(buf []byte) (h *sstable_header, pos int, err error) {
+
+	h = &sstable_header{}
+
+	// parse version
+	if len(buf) < pos+4 {
+		return nil, pos, fmt.Errorf("sstable_decode_header - no version")
+	}
+	h.version = binary.BigEndian.Uint32(buf[pos : pos+4])
+	pos += 4
+
+	// parse consensus_id
+	h.consensus_id, err = util.NewMappedConsensusID(buf[pos:])
+	if err != nil {
+		return nil, pos, err
+	}
+	pos += len(h.consensus_id.Buf())
+
+	// parse domain
+	h.domain, _, err = util.NewStandardMappedValue(buf[pos:])
+	if err != nil {
+		return nil, pos, err
+	}
+	pos += len(h.domain.Buf())
+
+	// parse table
+	h.table, _, err = util.NewStandardMappedValue(buf[pos:])
+	if err != nil {
+		return nil, pos, err
+	}
+	pos += len(h.table.Buf())
+
+	// parse start time
+	h.start_time, err = util.NewConsensusTime(buf[pos:])
+	if err != nil {
+		return nil, pos, err
+	}
+	pos += len(h.start_time.Buf())
+
+	// parse end time
+	h.end_time, err = util.NewConsensusTime(buf[pos:])
+	if err != nil {
+		return nil, pos, err
+	}
+	pos += len(h.end_time.Buf())
+
+	// parse start key
+	h.start_key, _, err = util.NewMappedKey(buf[pos:])
+	if err != nil {
+		return nil, pos, err
+	}
+	pos += len(h.start_key.Buf())
+
+	// parse end key
+	h.end_key, _, err = util.NewMappedKey(buf[pos:])
+	if err != nil {
+		return nil, pos, err
+	}
+	pos += len(h.end_key.Buf())
+
+	// parse level and flags
+	if len(buf) < pos+4 {
+		return nil, pos, fmt.Errorf("sstable_decode_header - no level")
+	}
+	level := binary.BigEndian.Uint32(buf[pos : pos+4])
+	h.level = level & SSTABLE_LEVEL_MASK
+	h.flags = level &^ SSTABLE_LEVEL_MASK
+	if h.flags&^(SSTABLE_FLAG_BLOOM|SSTABLE_FLAG_CLEAR) != 0 {
+		return nil, pos, fmt.Errorf("sstable_decode_header - unsupported flags - %x", h.flags)
+	}
+	pos += 4
+
+	// parse count
+	if len(buf) < pos+4 {
+		return nil, pos, fmt.Errorf("sstable_decode_header - no count")
+	}
+	h.count = binary.BigEndian.Uint32(buf[pos : pos+4])
+	if h.count > SSTABLE_MAX_RECORDS {
+		return nil, pos, fmt.Errorf("sstable_decode_header - unsupported count - %d", h.count)
+	}
+	pos += 4
+
+	// parse header crc32
+	computed_header_crc32 := crc32.ChecksumIEEE(buf[:pos])
+	if len(buf) < pos+4 {
+		return nil, pos, fmt.Errorf("sstable_decode_header - no header crc32")
+	}
+	header_crc32 := binary.BigEndian.Uint32(buf[pos : pos+4])
+	if computed_header_crc32 != header_crc32 {
+		return nil, pos, fmt.Errorf("sstable_decode_header - header crc32 checksum failed - computed %d vs header %d", computed_header_crc32, header_crc32)
+	}
+	pos += 4
+
+	return h, pos, nil
+}
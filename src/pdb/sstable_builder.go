@@ -0,0 +1,473 @@
+package pdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"../collection"
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Interface
+
+type ISSTableBuilder interface {
+	Count() uint32               // records added so far
+	EstFileSize() uint64         // estimated file size with all records added so far
+	Fits(r util.IRecord) bool    // whether record can be added within limits
+	Add(r util.IRecord) error    // add a record, in sorted order
+	SetBloomBitsPerKey(bits int) // bloom filter bits per key, 0 for no bloom section
+	Finish() error               // write SSTable file and publish atomically
+	Abort()                      // discard the builder
+}
+
+// builder of SSTable version, SSTABLE_VERSION for the default version
+func NewSSTableBuilder(version uint32, filepath string, consensus_id util.IConsensusID, domain, table string, level uint32, start_time, end_time util.IConsensusTime) (ISSTableBuilder, error) {
+
+	var b ISSTableBuilder
+	var err error
+
+	switch version {
+	case 1:
+		b, err = NewSSTableV1Builder(filepath, consensus_id, domain, table, level, start_time, end_time)
+	case 2:
+		b, err = NewSSTableV2Builder(filepath, consensus_id, domain, table, level, start_time, end_time)
+	default:
+		return nil, fmt.Errorf("NewSSTableBuilder - unsupported version %d", version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SSTable V1 Builder
+//
+// SSTableV1Builder writes a V1 SSTable file as parsed by LoadSSTableV1:
+//
+//   - header     : version, consensus id, domain, table, start time, end time,
+//                  start key, end key, level and flags, count, header crc32 -
+//                  SSTABLE_FLAG_CLEAR is set if any record is CLEAR
+//   - mph        : mph table, record offset size, record offsets, mph crc32
+//   - bloom      : optional, bloom filter of mph hash keys, bloom crc32 -
+//                  present if SSTABLE_FLAG_BLOOM is set in header
+//   - records    : sorted records, followed by records crc32
+//
+// Record offsets are relative to the start of the records section.  Records
+// must be added in sorted order of <key> + 0x00 + <group>.  Records are
+// streamed to a temporary data file while the builder is open, and the final
+// SSTable file is published atomically by Finish.
+
+type SSTableV1Builder struct {
+	// basic attributes
+	filepath     string
+	consensus_id util.IConsensusID
+	domain       string
+	table        string
+	start_time   util.IConsensusTime
+	end_time     util.IConsensusTime
+	level        uint32
+	header_size  uint64 // upper bound of header size
+	bloom_bits   int    // bloom filter bits per key, 0 for no bloom section
+	// records
+	hash_keys     []util.IKey // mph hash keys, in sorted order
+	record_offset []uint32    // record offset table
+	record_size   uint32      // total size of records
+	record_crc32  uint32      // running crc32 of records
+	start_key     util.IKey
+	end_key       util.IKey
+	last_key      util.IKey
+	last_group    string
+	has_clear     bool // whether any record is CLEAR
+	// temporary data file
+	data_file *os.File
+	closed    bool
+}
+
+func NewSSTableV1Builder(filepath string, consensus_id util.IConsensusID, domain, table string, level uint32, start_time, end_time util.IConsensusTime) (*SSTableV1Builder, error) {
+
+	if collection.IsNil(consensus_id) {
+		return nil, fmt.Errorf("NewSSTableV1Builder - consensus id is nil")
+	}
+
+	if collection.IsNil(start_time) || collection.IsNil(end_time) {
+		return nil, fmt.Errorf("NewSSTableV1Builder - start time or end time is nil")
+	}
+
+	if level > SSTABLE_LEVEL_MASK {
+		return nil, fmt.Errorf("NewSSTableV1Builder - unsupported level %d", level)
+	}
+
+	data_file, err := os.OpenFile(filepath+".data.tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &SSTableV1Builder{
+		filepath:      filepath,
+		consensus_id:  consensus_id,
+		domain:        domain,
+		table:         table,
+		start_time:    start_time,
+		end_time:      end_time,
+		level:         level,
+		header_size:   sstable_v1_est_header_size(consensus_id, domain, table, start_time, end_time),
+		bloom_bits:    util.BLOOM_BITS_PER_KEY,
+		hash_keys:     []util.IKey{},
+		record_offset: []uint32{},
+		data_file:     data_file,
+	}
+
+	return b, nil
+}
+
+func (b *SSTableV1Builder) Count() uint32 {
+	return uint32(len(b.record_offset))
+}
+
+// set bloom filter bits per key, 0 to write no bloom section
+func (b *SSTableV1Builder) SetBloomBitsPerKey(bits int) {
+	b.bloom_bits = bits
+}
+
+// estimated file size with all the records added so far
+func (b *SSTableV1Builder) EstFileSize() uint64 {
+	return sstable_v1_est_file_size(b.header_size, len(b.record_offset), uint64(b.record_size), b.bloom_bits)
+}
+
+// whether record can be added without exceeding SSTABLE_MAX_RECORDS or SSTABLE_MAX_FILE_SIZE
+func (b *SSTableV1Builder) Fits(r util.IRecord) bool {
+
+	if uint32(len(b.record_offset))+1 > SSTABLE_MAX_RECORDS {
+		return false
+	}
+
+	est_size := sstable_v1_est_file_size(b.header_size, len(b.record_offset)+1, uint64(b.record_size)+uint64(r.EstBufSize()), b.bloom_bits)
+
+	return est_size <= uint64(SSTABLE_MAX_FILE_SIZE)
+}
+
+// add a record - records must be added in sorted order
+func (b *SSTableV1Builder) Add(r util.IRecord) error {
+
+	if b.closed {
+		return fmt.Errorf("SSTableV1Builder::Add - builder closed")
+	}
+
+	if collection.IsNil(r) || collection.IsNil(r.Key()) {
+		return fmt.Errorf("SSTableV1Builder::Add - record or key is nil")
+	}
+
+	if !r.IsEncoded() {
+		err := r.Encode(nil)
+		if err != nil {
+			return fmt.Errorf("SSTableV1Builder::Add - %s", err)
+		}
+	}
+
+	key := r.Key()
+	group, err := RecordGroup(r)
+	if err != nil {
+		return fmt.Errorf("SSTableV1Builder::Add - %s", err)
+	}
+
+	// check sort order
+	if b.last_key != nil {
+		if sstable_compare(b.last_key, b.last_group, key, group) >= 0 {
+			return fmt.Errorf("SSTableV1Builder::Add - record not in sorted order [%v] [%s]", key.Key(), group)
+		}
+	}
+
+	// check limits
+	if !b.Fits(r) {
+		return fmt.Errorf("SSTableV1Builder::Add - exceeding limit, count %d, size %d", len(b.record_offset), b.record_size)
+	}
+
+	hash_key, err := sstable_hash_key(key, group)
+	if err != nil {
+		return fmt.Errorf("SSTableV1Builder::Add - %s", err)
+	}
+
+	// append record to data file
+	buf := r.Buf()
+	_, err = b.data_file.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	b.hash_keys = append(b.hash_keys, hash_key)
+	b.record_offset = append(b.record_offset, b.record_size)
+	b.record_size += uint32(len(buf))
+	b.record_crc32 = crc32.Update(b.record_crc32, crc32.IEEETable, buf)
+	if record_is_clear(r) {
+		b.has_clear = true
+	}
+
+	if b.start_key == nil {
+		b.start_key = key
+	}
+	b.end_key = key
+	b.last_key = key
+	b.last_group = group
+
+	return nil
+}
+
+// write SSTable file and publish atomically
+func (b *SSTableV1Builder) Finish() (err error) {
+
+	if b.closed {
+		return fmt.Errorf("SSTableV1Builder::Finish - builder closed")
+	}
+
+	defer b.Abort()
+
+	tmp_path := b.filepath + ".tmp"
+	f, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			os.Remove(tmp_path)
+		}
+	}()
+
+	////////////////////////////////////////
+	// header
+
+	header, err := b.encodeHeader()
+	if err != nil {
+		return err
+	}
+
+	////////////////////////////////////////
+	// mph hash and offset table
+
+	mph_table := util.MPHBuild(b.hash_keys, false)
+	mph, err := mph_table.Encode()
+	if err != nil {
+		return fmt.Errorf("SSTableV1Builder::Finish - %s", err)
+	}
+
+	offset_buf := make([]byte, 4+4*len(b.record_offset))
+	binary.BigEndian.PutUint32(offset_buf, uint32(len(b.record_offset)))
+	for i, offset := range b.record_offset {
+		binary.BigEndian.PutUint32(offset_buf[4+4*i:], offset)
+	}
+	mph = append(mph, offset_buf...)
+	mph = appendUint32(mph, crc32.ChecksumIEEE(mph))
+
+	////////////////////////////////////////
+	// bloom filter of mph hash keys
+
+	bloom := []byte{}
+	if b.bloom_bits > 0 {
+		bloom, err = util.BloomBuild(b.hash_keys, b.bloom_bits).Encode()
+		if err != nil {
+			return fmt.Errorf("SSTableV1Builder::Finish - %s", err)
+		}
+		bloom = appendUint32(bloom, crc32.ChecksumIEEE(bloom))
+	}
+
+	// check file size
+	file_size := uint64(len(header)) + uint64(len(mph)) + uint64(len(bloom)) + uint64(b.record_size) + 4
+	if file_size > uint64(SSTABLE_MAX_FILE_SIZE) {
+		return fmt.Errorf("SSTableV1Builder::Finish - file size %d exceeding %d", file_size, SSTABLE_MAX_FILE_SIZE)
+	}
+
+	if _, err = f.Write(header); err != nil {
+		return err
+	}
+
+	if _, err = f.Write(mph); err != nil {
+		return err
+	}
+
+	if _, err = f.Write(bloom); err != nil {
+		return err
+	}
+
+	////////////////////////////////////////
+	// records
+
+	if _, err = b.data_file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err = io.CopyN(f, b.data_file, int64(b.record_size)); err != nil {
+		return err
+	}
+
+	if _, err = f.Write(appendUint32(nil, b.record_crc32)); err != nil {
+		return err
+	}
+
+	////////////////////////////////////////
+	// sync and publish
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		f = nil
+		return err
+	}
+	f = nil
+
+	if err = os.Rename(tmp_path, b.filepath); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(b.filepath))
+}
+
+// discard the builder and remove the temporary data file
+func (b *SSTableV1Builder) Abort() {
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	b.data_file.Close()
+	os.Remove(b.data_file.Name())
+}
+
+func (b *SSTableV1Builder) encodeHeader() ([]byte, error) {
+
+	flags := uint32(0)
+	if b.bloom_bits > 0 {
+		flags |= SSTABLE_FLAG_BLOOM
+	}
+	if b.has_clear {
+		flags |= SSTABLE_FLAG_CLEAR
+	}
+
+	header, err := sstable_encode_header(1, b.consensus_id, b.domain, b.table, b.start_time, b.end_time, b.start_key, b.end_key, b.level|flags, uint32(len(b.record_offset)))
+	if err != nil {
+		return nil, fmt.Errorf("SSTableV1Builder::encodeHeader - %s", err)
+	}
+
+	return header, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// encode header shared by all SSTable versions, level holds level and flags
+func sstable_encode_header(version uint32, consensus_id util.IConsensusID, domain, table string, start_time, end_time util.IConsensusTime, start_key, end_key util.IKey, level, count uint32) ([]byte, error) {
+
+	header := appendUint32(nil, version)
+
+	// consensus id
+	header = append(header, consensus_id.Buf()...)
+
+	// domain and table
+	for _, name := range []string{domain, table} {
+		value := util.NewPrimitive([]byte(name))
+		if err := value.Encode(nil); err != nil {
+			return nil, err
+		}
+		header = append(header, value.Buf()...)
+	}
+
+	// start time and end time
+	header = append(header, start_time.Buf()...)
+	header = append(header, end_time.Buf()...)
+
+	// start key and end key
+	for _, key := range []util.IKey{start_key, end_key} {
+		if key == nil {
+			key = util.NewEmptyKey()
+		}
+		if !key.IsEncoded() {
+			if err := key.Encode(nil); err != nil {
+				return nil, err
+			}
+		}
+		header = append(header, key.Buf()...)
+	}
+
+	// level and flags, and count
+	header = appendUint32(header, level)
+	header = appendUint32(header, count)
+
+	// header crc32
+	header = appendUint32(header, crc32.ChecksumIEEE(header))
+
+	return header, nil
+}
+
+// compare records by <key> + 0x00 + <group>
+func sstable_compare(k1 util.IKey, g1 string, k2 util.IKey, g2 string) int {
+
+	if r := k1.Compare(k2); r != 0 {
+		return r
+	}
+
+	return collection.CompareByteSlice([]byte(g1), []byte(g2))
+}
+
+// mph hash key is composed as <key_bytes> + 0x00 + <group_bytes>
+func sstable_hash_key(key util.IKey, group string) (util.IKey, error) {
+
+	if !key.IsEncoded() {
+		if err := key.Encode(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, 0, len(key.Buf())+1+len(group))
+	buf = append(buf, key.Buf()...)
+	buf = append(buf, 0x00)
+	buf = append(buf, group...)
+
+	return util.NewSimpleKey(buf), nil
+}
+
+// upper bound of V1 header size - start key and end key are bounded by MAX_KEY_LENGTH
+func sstable_v1_est_header_size(consensus_id util.IConsensusID, domain, table string, start_time, end_time util.IConsensusTime) uint64 {
+	return uint64(4 + len(consensus_id.Buf()) + 3 + len(domain) + 3 + len(table) + len(start_time.Buf()) + len(end_time.Buf()) + 2*util.MAX_KEY_LENGTH + 4 + 4 + 4)
+}
+
+// conservative estimate of V1 file size
+func sstable_v1_est_file_size(header_size uint64, count int, record_size uint64, bloom_bits int) uint64 {
+
+	mph_size := uint64(64 + 4*(count/2+1) + 4*2*count + 4*count) // level 0, level 1, and verify hash
+	offset_size := uint64(4 + 4*count + 4)                       // offset size, offsets, and mph crc32
+
+	bloom_size := uint64(0)
+	if bloom_bits > 0 {
+		bloom_size = uint64(util.BloomEstSize(count, bloom_bits) + 4) // bloom, and bloom crc32
+	}
+
+	return header_size + mph_size + offset_size + bloom_size + record_size + 4
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return append(buf, b...)
+}
+
+func syncDir(dir string) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,384 @@
+package pdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"../collection"
+	"../util"
+)
+
+const (
+	SSTABLE_DUMP_TEXT    = "text"    // one line per record
+	SSTABLE_DUMP_VERBOSE = "verbose" // keys printed by their Print, one field per line
+	SSTABLE_DUMP_JSON    = "json"    // a json object of header, stats and records
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Dump
+//
+// DumpSSTable writes the content of an SSTable file for inspection - the
+// header, lookup statistics (mph of V1, sparse index of V2, and bloom filter
+// if any), and records in sorted order.  Text formats print a key as its sub
+// keys separated by '/', and verbose format prints a key by its Print.  Sub
+// keys and primitive values are printed as text if printable, or as hex with
+// 0x prefix otherwise.
+//
+// JSON output is a single object, with records streamed as they are read:
+//
+//   {"header": {...}, "mph": {...}, "index": {...}, "bloom": {...},
+//    "records": [{"key": [...], "group": ..., "value": ..., ...}, ...]}
+//
+// mph is present for V1, index for V2, and bloom if the SSTable has one.
+
+type sstable_dump_header struct {
+	Path        string   `json:"path"`
+	Version     uint32   `json:"version"`
+	ConsensusID string   `json:"consensus_id"`
+	Domain      string   `json:"domain"`
+	Table       string   `json:"table"`
+	StartTime   string   `json:"start_time"`
+	EndTime     string   `json:"end_time"`
+	StartKey    []string `json:"start_key"`
+	EndKey      []string `json:"end_key"`
+	Level       uint32   `json:"level"`
+	Count       uint32   `json:"count"`
+	FileSize    int64    `json:"file_size"`
+}
+
+type sstable_dump_mph struct {
+	Keys        int     `json:"keys"`
+	Level0      int     `json:"level0"`
+	Level1      int     `json:"level1"`
+	Load        float64 `json:"load"`
+	VerifyByKey bool    `json:"verify_by_key"`
+}
+
+type sstable_dump_index struct {
+	Blocks   int    `json:"blocks"`
+	DataSize uint32 `json:"data_size"`
+	AvgBlock uint32 `json:"avg_block"`
+}
+
+type sstable_dump_bloom struct {
+	Size       int     `json:"size"`
+	Hashes     int     `json:"hashes"`
+	BitsPerKey float64 `json:"bits_per_key"`
+}
+
+type sstable_dump_record struct {
+	Key       []string    `json:"key"`
+	Group     string      `json:"group"`
+	Value     interface{} `json:"value"`
+	Timestamp string      `json:"timestamp,omitempty"`
+	Clear     bool        `json:"clear,omitempty"`
+	Size      int         `json:"size"`
+}
+
+// dump SSTable file to w in format, with up to limit records - all records if
+// limit is negative, and header and statistics only if limit is 0
+func DumpSSTable(filepath string, w io.Writer, format string, limit int) error {
+
+	if format != SSTABLE_DUMP_TEXT && format != SSTABLE_DUMP_VERBOSE && format != SSTABLE_DUMP_JSON {
+		return fmt.Errorf("DumpSSTable - unsupported format %s", format)
+	}
+
+	info, err := os.Stat(filepath)
+	if err != nil {
+		return err
+	}
+
+	table, err := LoadSSTable(filepath)
+	if err != nil {
+		return fmt.Errorf("DumpSSTable - %s", err)
+	}
+	defer table.Close()
+
+	header := &sstable_dump_header{
+		Path:        filepath,
+		Version:     table.Version(),
+		ConsensusID: fmt.Sprintf("%x", table.ConsensusID().Buf()),
+		Domain:      table.Domain(),
+		Table:       table.Table(),
+		StartTime:   fmt.Sprintf("%x", table.StartTime().Buf()),
+		EndTime:     fmt.Sprintf("%x", table.EndTime().Buf()),
+		StartKey:    sstable_dump_key(table.StartKey()),
+		EndKey:      sstable_dump_key(table.EndKey()),
+		Level:       table.Level(),
+		Count:       table.Count(),
+		FileSize:    info.Size(),
+	}
+
+	var mph *sstable_dump_mph
+	var index *sstable_dump_index
+	var bloom *util.BloomFilter
+	switch t := table.(type) {
+	case *SSTableV1:
+		mph = &sstable_dump_mph{
+			Keys:        len(t.record_offset),
+			Level0:      t.mph_table.Level0Size(),
+			Level1:      t.mph_table.Level1Size(),
+			VerifyByKey: t.mph_table.VerifyByKey(),
+		}
+		if mph.Level1 > 0 {
+			mph.Load = float64(mph.Keys) / float64(mph.Level1)
+		}
+		bloom = t.bloom
+	case *SSTableV2:
+		index = &sstable_dump_index{Blocks: len(t.index), DataSize: t.data_size}
+		if len(t.index) > 0 {
+			index.AvgBlock = t.data_size / uint32(len(t.index))
+		}
+		bloom = t.bloom
+	}
+
+	var bloom_stats *sstable_dump_bloom
+	if bloom != nil {
+		bloom_stats = &sstable_dump_bloom{Size: bloom.Size(), Hashes: bloom.Hashes()}
+		if table.Count() > 0 {
+			bloom_stats.BitsPerKey = float64(8*bloom.Size()) / float64(table.Count())
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	if format == SSTABLE_DUMP_JSON {
+		err = sstable_dump_json(out, table, header, mph, index, bloom_stats, limit)
+	} else {
+		err = sstable_dump_text(out, table, header, mph, index, bloom_stats, limit, format == SSTABLE_DUMP_VERBOSE)
+	}
+	if err != nil {
+		return err
+	}
+
+	return out.Flush()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+func sstable_dump_text(w *bufio.Writer, table ISSTable, header *sstable_dump_header, mph *sstable_dump_mph, index *sstable_dump_index, bloom *sstable_dump_bloom, limit int, verbose bool) error {
+
+	fmt.Fprintf(w, "SSTable %s\n", header.Path)
+	fmt.Fprintf(w, "  version      : %d\n", header.Version)
+	fmt.Fprintf(w, "  consensus id : %s\n", header.ConsensusID)
+	fmt.Fprintf(w, "  domain       : %s\n", header.Domain)
+	fmt.Fprintf(w, "  table        : %s\n", header.Table)
+	fmt.Fprintf(w, "  start time   : %s\n", header.StartTime)
+	fmt.Fprintf(w, "  end time     : %s\n", header.EndTime)
+	fmt.Fprintf(w, "  start key    : %s\n", strings.Join(header.StartKey, "/"))
+	fmt.Fprintf(w, "  end key      : %s\n", strings.Join(header.EndKey, "/"))
+	fmt.Fprintf(w, "  level        : %d\n", header.Level)
+	fmt.Fprintf(w, "  count        : %d\n", header.Count)
+	fmt.Fprintf(w, "  file size    : %d\n", header.FileSize)
+
+	if mph != nil {
+		fmt.Fprintf(w, "MPH\n")
+		fmt.Fprintf(w, "  keys         : %d\n", mph.Keys)
+		fmt.Fprintf(w, "  level 0      : %d\n", mph.Level0)
+		fmt.Fprintf(w, "  level 1      : %d\n", mph.Level1)
+		fmt.Fprintf(w, "  load         : %.3f\n", mph.Load)
+		fmt.Fprintf(w, "  verify by    : %s\n", map[bool]string{true: "key", false: "hash"}[mph.VerifyByKey])
+	}
+	if index != nil {
+		fmt.Fprintf(w, "Index\n")
+		fmt.Fprintf(w, "  blocks       : %d\n", index.Blocks)
+		fmt.Fprintf(w, "  data size    : %d\n", index.DataSize)
+		fmt.Fprintf(w, "  avg block    : %d\n", index.AvgBlock)
+	}
+	if bloom != nil {
+		fmt.Fprintf(w, "Bloom\n")
+		fmt.Fprintf(w, "  size         : %d\n", bloom.Size)
+		fmt.Fprintf(w, "  hashes       : %d\n", bloom.Hashes)
+		fmt.Fprintf(w, "  bits per key : %.2f\n", bloom.BitsPerKey)
+	}
+
+	if limit == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "Records\n")
+	n := 0
+	iter := table.Iterator()
+	for iter.HasNext() && (limit < 0 || n < limit) {
+		r := iter.Next()
+		d, err := sstable_dump_record_of(r)
+		if err != nil {
+			return fmt.Errorf("DumpSSTable - record [%d] - %s", n, err)
+		}
+		value, _ := json.Marshal(d.Value)
+		if !verbose {
+			fmt.Fprintf(w, "  [%d] %s [%s] = %s", n, strings.Join(d.Key, "/"), d.Group, value)
+			if d.Timestamp != "" {
+				fmt.Fprintf(w, " @%s", d.Timestamp)
+			}
+			if d.Clear {
+				fmt.Fprintf(w, " CLEAR")
+			}
+			fmt.Fprintf(w, "\n")
+		} else {
+			fmt.Fprintf(w, "  record [%d]\n", n)
+			r.Key().Print(w, 4)
+			fmt.Fprintf(w, "    group     : %s\n", d.Group)
+			fmt.Fprintf(w, "    value     : %s\n", value)
+			fmt.Fprintf(w, "    timestamp : %s\n", d.Timestamp)
+			fmt.Fprintf(w, "    clear     : %v\n", d.Clear)
+			fmt.Fprintf(w, "    size      : %d\n", d.Size)
+		}
+		n += 1
+	}
+
+	return iter.Error()
+}
+
+func sstable_dump_json(w *bufio.Writer, table ISSTable, header *sstable_dump_header, mph *sstable_dump_mph, index *sstable_dump_index, bloom *sstable_dump_bloom, limit int) error {
+
+	sections := []struct {
+		name  string
+		value interface{}
+	}{
+		{"header", header},
+		{"mph", mph},
+		{"index", index},
+		{"bloom", bloom},
+	}
+
+	w.WriteString("{")
+	for i, section := range sections {
+		if collection.IsNil(section.value) {
+			continue
+		}
+		buf, err := json.Marshal(section.value)
+		if err != nil {
+			return fmt.Errorf("DumpSSTable - %s", err)
+		}
+		if i > 0 {
+			w.WriteString(",")
+		}
+		fmt.Fprintf(w, "\n  %q: %s", section.name, buf)
+	}
+
+	w.WriteString(",\n  \"records\": [")
+	n := 0
+	iter := table.Iterator()
+	for limit != 0 && iter.HasNext() && (limit < 0 || n < limit) {
+		d, err := sstable_dump_record_of(iter.Next())
+		if err != nil {
+			return fmt.Errorf("DumpSSTable - record [%d] - %s", n, err)
+		}
+		buf, err := json.Marshal(d)
+		if err != nil {
+			return fmt.Errorf("DumpSSTable - record [%d] - %s", n, err)
+		}
+		if n > 0 {
+			w.WriteString(",")
+		}
+		fmt.Fprintf(w, "\n    %s", buf)
+		n += 1
+	}
+	if iter.Error() != nil {
+		return iter.Error()
+	}
+	w.WriteString("\n  ]\n}\n")
+
+	return nil
+}
+
+func sstable_dump_record_of(r util.IRecord) (*sstable_dump_record, error) {
+
+	group, err := RecordGroup(r)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := sstable_dump_value(r.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	d := &sstable_dump_record{
+		Key:   sstable_dump_key(r.Key()),
+		Group: sstable_dump_bytes([]byte(group)),
+		Value: value,
+		Clear: record_is_clear(r),
+		Size:  len(r.Buf()),
+	}
+	if ts := r.Timestamp(); ts != nil {
+		d.Timestamp = ts.UTC().Format(time.RFC3339Nano)
+	}
+
+	return d, nil
+}
+
+func sstable_dump_key(key util.IKey) []string {
+	result := []string{}
+	if collection.IsNil(key) {
+		return result
+	}
+	for _, sub_key := range key.Key() {
+		result = append(result, sstable_dump_bytes(sub_key))
+	}
+	return result
+}
+
+// primitive as text or hex, value array as list, record list as list of records
+func sstable_dump_value(v util.IValue) (interface{}, error) {
+
+	if collection.IsNil(v) || v.IsNil() {
+		return nil, nil
+	}
+
+	if v.IsPrimitive() {
+		return sstable_dump_bytes(v.Value()), nil
+	}
+
+	result := []interface{}{}
+	for i := uint16(0); i < v.Size(); i++ {
+		if v.IsValueArray() {
+			e, err := v.ValueAt(i)
+			if err != nil {
+				return nil, err
+			}
+			d, err := sstable_dump_value(e)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, d)
+		} else if v.IsRecordList() {
+			r, err := v.RecordAt(i)
+			if err != nil {
+				return nil, err
+			}
+			d, err := sstable_dump_record_of(r)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, d)
+		}
+	}
+
+	return result, nil
+}
+
+// bytes as text if printable, otherwise hex with 0x prefix
+func sstable_dump_bytes(buf []byte) string {
+
+	if !utf8.Valid(buf) || strings.HasPrefix(string(buf), "0x") {
+		return "0x" + hex.EncodeToString(buf)
+	}
+
+	for _, c := range string(buf) {
+		if !unicode.IsPrint(c) {
+			return "0x" + hex.EncodeToString(buf)
+		}
+	}
+
+	return string(buf)
+}
@@ -0,0 +1,97 @@
+package pdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+func TestDumpSSTable(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ts := time.Unix(1000, 0)
+	records := []util.IRecord{
+		newTestGroupRecord("a/1", "", "value a1"),
+		newTestGroupRecord("a/1", "g1", "value a1 g1"),
+		newTestClearRecord("a/2", ts.UnixNano()),
+		newTestGroupRecord("a/3", "", "\x00\x01"),
+	}
+	buildTestSSTable(t, dir+"/v1.sst", newTestConsensusID(), records)
+	buildTestSSTableV2(t, dir+"/v2.sst", records, 512)
+
+	for _, path := range []string{dir + "/v1.sst", dir + "/v2.sst"} {
+
+		// json
+		var buf bytes.Buffer
+		if err := DumpSSTable(path, &buf, SSTABLE_DUMP_JSON, -1); err != nil {
+			t.Fatal(err)
+		}
+		var dump struct {
+			Header  sstable_dump_header   `json:"header"`
+			MPH     *sstable_dump_mph     `json:"mph"`
+			Index   *sstable_dump_index   `json:"index"`
+			Bloom   *sstable_dump_bloom   `json:"bloom"`
+			Records []sstable_dump_record `json:"records"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+			t.Fatalf("%s: %s\n%s", path, err, buf.String())
+		}
+		if dump.Header.Count != 4 || dump.Header.Domain != "test.domain" || strings.Join(dump.Header.EndKey, "/") != "a/3" {
+			t.Errorf("%s: header %+v", path, dump.Header)
+		}
+		if (dump.MPH != nil) != (dump.Header.Version == 1) || (dump.Index != nil) != (dump.Header.Version == 2) || dump.Bloom == nil {
+			t.Errorf("%s: version %d mph %v index %v bloom %v", path, dump.Header.Version, dump.MPH, dump.Index, dump.Bloom)
+		}
+		if len(dump.Records) != 4 {
+			t.Fatalf("%s: %d records", path, len(dump.Records))
+		}
+		r := dump.Records[1]
+		if strings.Join(r.Key, "/") != "a/1" || r.Group != "g1" || r.Value != "value a1 g1" || r.Clear {
+			t.Errorf("%s: record %+v", path, r)
+		}
+		if r := dump.Records[2]; !r.Clear || r.Timestamp != "1970-01-01T00:16:40Z" {
+			t.Errorf("%s: clear record %+v", path, r)
+		}
+		if r := dump.Records[3]; r.Value != "0x0001" {
+			t.Errorf("%s: binary value %v", path, r.Value)
+		}
+
+		// text, header only
+		buf.Reset()
+		if err := DumpSSTable(path, &buf, SSTABLE_DUMP_TEXT, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "count        : 4\n") || strings.Contains(buf.String(), "Records") {
+			t.Errorf("%s: text header\n%s", path, buf.String())
+		}
+
+		// text, limited records
+		buf.Reset()
+		if err := DumpSSTable(path, &buf, SSTABLE_DUMP_TEXT, 2); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "  [1] a/1 [g1] = \"value a1 g1\"\n") || strings.Contains(buf.String(), "[2]") {
+			t.Errorf("%s: text records\n%s", path, buf.String())
+		}
+
+		// verbose
+		buf.Reset()
+		if err := DumpSSTable(path, &buf, SSTABLE_DUMP_VERBOSE, -1); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(buf.String(), "subKey[1]") != 4 {
+			t.Errorf("%s: verbose records\n%s", path, buf.String())
+		}
+	}
+
+	if err := DumpSSTable(dir+"/v1.sst", &bytes.Buffer{}, "xml", -1); err == nil {
+		t.Errorf("unsupported format should fail")
+	}
+}
@@ -0,0 +1,332 @@
+package pdb
+
+import (
+	"fmt"
+	"sort"
+
+	"../collection"
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Interface
+
+type ISSTableIterator interface {
+	Next() util.IRecord // return the next record
+	HasNext() bool      // whether next record exist
+	Peek() util.IRecord // peek the next record
+	Error() error       // error encountered during iteration, iteration stops on error
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SSTableV1 Iterator
+//
+// Iterates records of a SSTableV1 in sorted order, decoding each record in
+// place from the mmap data.  A range iterator returns records with key within
+// [start, end) - start inclusive, end not inclusive, same as ITrie.RangeIterator.
+// A prefix iterator returns records with key having the specified key as prefix.
+
+type SSTableV1Iterator struct {
+	table  *SSTableV1
+	pos    uint32       // index of next record
+	end    util.IKey    // end key (exclusive), nil for no end
+	prefix util.IKey    // key prefix, nil for no prefix
+	next   util.IRecord // decoded next record
+	err    error
+}
+
+// iterator of all records
+func (t *SSTableV1) Iterator() ISSTableIterator {
+	return &SSTableV1Iterator{table: t, pos: 0}
+}
+
+// iterator of records with key in [start, end), nil start or end means unbounded
+func (t *SSTableV1) RangeIterator(start, end util.IKey) ISSTableIterator {
+
+	if !collection.IsNil(start) && !collection.IsNil(end) && start.Compare(end) > 0 {
+		panic(fmt.Sprintf("SSTableV1::RangeIterator - start [%v] is larger than end [%v]", start.Key(), end.Key()))
+	}
+
+	iter := &SSTableV1Iterator{table: t}
+	if !collection.IsNil(end) {
+		iter.end = end
+	}
+	iter.pos, iter.err = t.seek(start)
+
+	return iter
+}
+
+// iterator of records with key having specified prefix, empty prefix iterates all records
+func (t *SSTableV1) PrefixIterator(prefix util.IKey) ISSTableIterator {
+
+	if collection.IsNil(prefix) || prefix.IsEmpty() {
+		return t.Iterator()
+	}
+
+	iter := &SSTableV1Iterator{table: t, prefix: prefix}
+	iter.pos, iter.err = t.seek(prefix)
+
+	return iter
+}
+
+func (i *SSTableV1Iterator) Next() util.IRecord {
+	i.advance()
+	r := i.next
+	i.next = nil
+	return r
+}
+
+func (i *SSTableV1Iterator) HasNext() bool {
+	i.advance()
+	return i.next != nil
+}
+
+func (i *SSTableV1Iterator) Peek() util.IRecord {
+	i.advance()
+	return i.next
+}
+
+func (i *SSTableV1Iterator) Error() error {
+	return i.err
+}
+
+func (i *SSTableV1Iterator) advance() {
+
+	if i.next != nil || i.err != nil || i.pos >= uint32(len(i.table.record_offset)) {
+		return
+	}
+
+	if i.table.mmap_data == nil {
+		i.err = fmt.Errorf("SSTableV1Iterator::advance - sstable closed")
+		return
+	}
+
+	r, err := i.table.recordAt(i.pos)
+	if err != nil {
+		i.err = err
+		return
+	}
+
+	if i.end != nil && r.Key().Compare(i.end) >= 0 {
+		i.pos = uint32(len(i.table.record_offset)) // no more left
+		return
+	}
+
+	if i.prefix != nil && !keyHasPrefix(r.Key(), i.prefix) {
+		i.pos = uint32(len(i.table.record_offset)) // no more left
+		return
+	}
+
+	i.next = r
+	i.pos += 1
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SSTableV2 Iterator
+//
+// Iterates records of a SSTableV2 in sorted order, reading one block at a
+// time.  Range and prefix iterators are the same as SSTableV1, and seek by
+// the sparse index to the block that may hold the first record.
+
+type SSTableV2Iterator struct {
+	table   *SSTableV2
+	block   int                 // index of current block
+	records *sstable_v2_records // records of current block, nil if not read
+	pos     int                 // index of next record in current block
+	end     util.IKey           // end key (exclusive), nil for no end
+	prefix  util.IKey           // key prefix, nil for no prefix
+	next    util.IRecord        // decoded next record
+	err     error
+}
+
+// iterator of all records
+func (t *SSTableV2) Iterator() ISSTableIterator {
+	return &SSTableV2Iterator{table: t}
+}
+
+// iterator of records with key in [start, end), nil start or end means unbounded
+func (t *SSTableV2) RangeIterator(start, end util.IKey) ISSTableIterator {
+
+	if !collection.IsNil(start) && !collection.IsNil(end) && start.Compare(end) > 0 {
+		panic(fmt.Sprintf("SSTableV2::RangeIterator - start [%v] is larger than end [%v]", start.Key(), end.Key()))
+	}
+
+	iter := &SSTableV2Iterator{table: t}
+	if !collection.IsNil(end) {
+		iter.end = end
+	}
+	iter.seek(start)
+
+	return iter
+}
+
+// iterator of records with key having specified prefix, empty prefix iterates all records
+func (t *SSTableV2) PrefixIterator(prefix util.IKey) ISSTableIterator {
+
+	if collection.IsNil(prefix) || prefix.IsEmpty() {
+		return t.Iterator()
+	}
+
+	iter := &SSTableV2Iterator{table: t, prefix: prefix}
+	iter.seek(prefix)
+
+	return iter
+}
+
+func (i *SSTableV2Iterator) Next() util.IRecord {
+	i.advance()
+	r := i.next
+	i.next = nil
+	return r
+}
+
+func (i *SSTableV2Iterator) HasNext() bool {
+	i.advance()
+	return i.next != nil
+}
+
+func (i *SSTableV2Iterator) Peek() util.IRecord {
+	i.advance()
+	return i.next
+}
+
+func (i *SSTableV2Iterator) Error() error {
+	return i.err
+}
+
+// position at the first record with key no less than specified key
+func (i *SSTableV2Iterator) seek(key util.IKey) {
+
+	if collection.IsNil(key) || key.IsEmpty() {
+		return
+	}
+
+	// first block starting at or after key, records before it may be in the previous block
+	index := i.table.index
+	b := sort.Search(len(index), func(n int) bool { return index[n].key.Compare(key) >= 0 })
+	if b == 0 {
+		return
+	}
+
+	i.block = b - 1
+	if i.records, i.err = i.readBlock(i.block); i.err != nil {
+		return
+	}
+	i.pos, i.err = i.records.seek(key)
+}
+
+// read a block - an iterator may be abandoned without closing, so the block
+// is not pinned in cache while records are iterated
+func (i *SSTableV2Iterator) readBlock(b int) (*sstable_v2_records, error) {
+	records, handle, err := i.table.readBlock(b)
+	handle.Release()
+	return records, err
+}
+
+func (i *SSTableV2Iterator) advance() {
+
+	for i.next == nil && i.err == nil && i.block < len(i.table.index) {
+
+		if i.records == nil {
+			if i.records, i.err = i.readBlock(i.block); i.err != nil {
+				return
+			}
+			i.pos = 0
+		}
+
+		// move to next block
+		if i.pos >= len(i.records.offsets) {
+			i.block += 1
+			i.records = nil
+			continue
+		}
+
+		r, err := i.records.recordAt(i.pos)
+		if err != nil {
+			i.err = err
+			return
+		}
+
+		if (i.end != nil && r.Key().Compare(i.end) >= 0) || (i.prefix != nil && !keyHasPrefix(r.Key(), i.prefix)) {
+			i.block = len(i.table.index) // no more left
+			i.records = nil
+			return
+		}
+
+		i.next = r
+		i.pos += 1
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Batch Read
+
+// read records starting at byte position pos of the records section, until
+// at least suggest_offset bytes are read - return records, and bytes read
+func (t *SSTableV1) Read(pos, suggest_offset uint32) ([]util.IRecord, uint32, error) {
+
+	if t.mmap_data == nil {
+		return nil, 0, fmt.Errorf("SSTableV1::Read - sstable closed")
+	}
+
+	// locate the record starting at pos
+	n := sort.Search(len(t.record_offset), func(i int) bool { return t.record_offset[i] >= pos })
+	if n < len(t.record_offset) && t.record_offset[n] != pos {
+		return nil, 0, fmt.Errorf("SSTableV1::Read - pos %d is not at record boundary", pos)
+	}
+
+	result := []util.IRecord{}
+	read := uint32(0)
+	for ; n < len(t.record_offset) && (read < suggest_offset || len(result) == 0); n++ {
+		r, err := t.recordAt(uint32(n))
+		if err != nil {
+			return result, read, err
+		}
+		result = append(result, r)
+		read += uint32(len(r.Buf()))
+	}
+
+	return result, read, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// index of first record with key no less than specified key
+func (t *SSTableV1) seek(key util.IKey) (uint32, error) {
+
+	if collection.IsNil(key) || key.IsEmpty() {
+		return 0, nil
+	}
+
+	var err error
+	n := sort.Search(len(t.record_offset), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		r, e := t.recordAt(uint32(i))
+		if e != nil {
+			err = e
+			return true
+		}
+		return r.Key().Compare(key) >= 0
+	})
+
+	return uint32(n), err
+}
+
+// whether key has specified prefix, on sub key boundary
+func keyHasPrefix(key, prefix util.IKey) bool {
+
+	if len(key.Key()) < len(prefix.Key()) {
+		return false
+	}
+
+	for idx, subKey := range prefix.Key() {
+		if !collection.EqualByteSlice(subKey, key.SubKeyAt(idx)) {
+			return false
+		}
+	}
+
+	return true
+}
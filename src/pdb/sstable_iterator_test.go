@@ -0,0 +1,143 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"../util"
+)
+
+func TestSSTableV1RangeIterator(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := []util.IRecord{}
+	for i := 0; i < 100; i++ {
+		records = append(records, newTestRecord(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)))
+	}
+
+	path := dir + "/test.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), records)
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	var rangeTestCases = []struct {
+		start util.IKey
+		end   util.IKey
+		first int
+		last  int // exclusive
+	}{
+		{nil, nil, 0, 100},
+		{util.NewStringKey("key0010"), util.NewStringKey("key0020"), 10, 20},
+		{util.NewStringKey("key0010"), nil, 10, 100},
+		{nil, util.NewStringKey("key0020"), 0, 20},
+		{util.NewStringKey("key00105"), util.NewStringKey("key00205"), 11, 21},
+		{util.NewStringKey("key0020"), util.NewStringKey("key0020"), 20, 20},
+		{util.NewStringKey("zzz"), nil, 100, 100},
+	}
+
+	for _, tt := range rangeTestCases {
+		i := tt.first
+		for iter := table.RangeIterator(tt.start, tt.end); iter.HasNext(); i++ {
+			r := iter.Next()
+			if i >= tt.last || !r.Key().Equal(records[i].Key()) {
+				t.Errorf("range [%d, %d): unexpected record %v", tt.first, tt.last, r.Key().Key())
+				break
+			}
+		}
+		if i != tt.last {
+			t.Errorf("range [%d, %d): got %d", tt.first, tt.last, i)
+		}
+	}
+}
+
+func TestSSTableV1PrefixIterator(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := []util.IRecord{}
+	for _, a := range []string{"a", "b", "c"} {
+		records = append(records, util.NewRecord().SetKey(util.NewKey().Add([]byte(a))).SetV([]byte(a)))
+		for i := 0; i < 10; i++ {
+			key := util.NewKey().Add([]byte(a)).Add([]byte(fmt.Sprintf("%02d", i)))
+			records = append(records, util.NewRecord().SetKey(key).SetV([]byte(a)))
+		}
+	}
+
+	path := dir + "/test.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), records)
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	count := 0
+	for iter := table.PrefixIterator(util.NewStringKey("b")); iter.HasNext(); count++ {
+		r := iter.Next()
+		if string(r.Key().SubKeyAt(0)) != "b" {
+			t.Errorf("unexpected key %v", r.Key().Key())
+		}
+	}
+	if count != 11 {
+		t.Errorf("prefix b: got %d; want 11", count)
+	}
+
+	iter := table.PrefixIterator(util.NewKey().Add([]byte("c")).Add([]byte("05")))
+	if !iter.HasNext() || !iter.Next().Key().Equal(records[2*11-1+7].Key()) || iter.HasNext() {
+		t.Errorf("prefix c/05 not match")
+	}
+
+	if table.PrefixIterator(util.NewStringKey("d")).HasNext() {
+		t.Errorf("prefix d should be empty")
+	}
+}
+
+func TestSSTableV1Read(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := []util.IRecord{}
+	for i := 0; i < 100; i++ {
+		records = append(records, newTestRecord(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)))
+	}
+
+	path := dir + "/test.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), records)
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	count := 0
+	for pos := uint32(0); ; {
+		result, read, err := table.Read(pos, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) == 0 {
+			break
+		}
+		for _, r := range result {
+			if !r.Key().Equal(records[count].Key()) {
+				t.Errorf("read [%d] not match %v", count, r.Key().Key())
+			}
+			count++
+		}
+		pos += read
+	}
+	if count != len(records) {
+		t.Errorf("read count: got %d; want %d", count, len(records))
+	}
+}
@@ -0,0 +1,443 @@
+package pdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// test utilities
+
+func newTestConsensusID() util.IConsensusID {
+	buf := make([]byte, 1+32)
+	buf[0] = 0x01 << 6 // cluster bit
+	for i := 1; i < len(buf); i++ {
+		buf[i] = util.RandUint8()
+	}
+	consensus_id, err := util.NewMappedConsensusID(buf)
+	if err != nil {
+		panic(err)
+	}
+	return consensus_id
+}
+
+func newTestRecord(key, value string) util.IRecord {
+	r := util.NewRecord().SetK([]byte(key)).SetV([]byte(value))
+	if err := r.Encode(nil); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// key with sub keys separated by '/'
+func newTestKey(key string) util.IKey {
+	k := util.NewKey()
+	for _, subKey := range strings.Split(key, "/") {
+		k.Add([]byte(subKey))
+	}
+	return k
+}
+
+func testKeyString(key util.IKey) string {
+	subKeys := []string{}
+	for _, subKey := range key.Key() {
+		subKeys = append(subKeys, string(subKey))
+	}
+	return strings.Join(subKeys, "/")
+}
+
+func newTestGroupRecord(key, group, value string) util.IRecord {
+	r := util.NewRecord().SetKey(newTestKey(key)).SetV([]byte(value))
+	scheme, err := NewGroupScheme(group)
+	if err != nil {
+		panic(err)
+	}
+	if scheme != nil {
+		r.SetScheme(scheme)
+	}
+	if err := r.Encode(nil); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func newTestDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "pdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func buildTestSSTable(t testing.TB, path string, consensus_id util.IConsensusID, records []util.IRecord) {
+	b, err := NewSSTableV1Builder(path, consensus_id, "test.domain", "test.table", 0, util.NewLedgerTime(1), util.NewLedgerTime(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if err := b.Add(r); err != nil {
+			b.Abort()
+			t.Fatal(err)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestSSTableV1Builder(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	consensus_id := newTestConsensusID()
+	records := []util.IRecord{}
+	for i := 0; i < 1000; i++ {
+		records = append(records, newTestRecord(fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)))
+	}
+
+	path := dir + "/test.sst"
+	buildTestSSTable(t, path, consensus_id, records)
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file not removed")
+	}
+	if _, err := os.Stat(path + ".data.tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary data file not removed")
+	}
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if table.Domain() != "test.domain" || table.Table() != "test.table" {
+		t.Errorf("domain or table not match: %s, %s", table.Domain(), table.Table())
+	}
+	if table.Count() != uint32(len(records)) || len(table.record_offset) != len(records) {
+		t.Errorf("count not match: %d, %d", table.Count(), len(table.record_offset))
+	}
+	if eq, _ := table.StartTime().EQ(util.NewLedgerTime(1)); !eq {
+		t.Errorf("start time not match")
+	}
+	if eq, _ := table.EndTime().EQ(util.NewLedgerTime(2)); !eq {
+		t.Errorf("end time not match")
+	}
+	if !table.StartKey().Equal(records[0].Key()) || !table.EndKey().Equal(records[len(records)-1].Key()) {
+		t.Errorf("start key or end key not match: %v, %v", table.StartKey().Key(), table.EndKey().Key())
+	}
+
+	// every record is reachable through mph and record offset
+	data := *table.mmap_data
+	for i, r := range records {
+		hash_key, _ := sstable_hash_key(r.Key(), "")
+		n, ok := table.mph_table.Lookup(hash_key)
+		if !ok || int(n) != i {
+			t.Errorf("mph lookup failed [%d]: %d, %v", i, n, ok)
+			continue
+		}
+		mapped, _, err := util.NewMappedRecord(data[table.record_start_pos+table.record_offset[n]:])
+		if err != nil {
+			t.Errorf("record decode failed [%d]: %s", i, err)
+			continue
+		}
+		if !mapped.Key().Equal(r.Key()) {
+			t.Errorf("record key not match [%d]: %v", i, mapped.Key().Key())
+		}
+	}
+}
+
+func TestSSTableV1BuilderSortOrder(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewSSTableV1Builder(dir+"/test.sst", newTestConsensusID(), "test.domain", "test.table", 0, util.NewLedgerTime(1), util.NewLedgerTime(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Abort()
+
+	if err := b.Add(newTestRecord("key2", "value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(newTestRecord("key1", "value")); err == nil {
+		t.Errorf("out of order record should fail")
+	}
+	if err := b.Add(newTestRecord("key2", "value")); err == nil {
+		t.Errorf("duplicate record should fail")
+	}
+}
+
+func TestSSTableV1BuilderEmpty(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	path := dir + "/test.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), nil)
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if table.Count() != 0 || !table.StartKey().IsEmpty() {
+		t.Errorf("empty table not match: %d", table.Count())
+	}
+}
+
+func TestSSTableHasClear(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, clear := range []bool{false, true} {
+		records := []util.IRecord{newTestTimestampRecord("a", "v", 1)}
+		if clear {
+			records = append(records, newTestClearRecord("b", 1))
+		}
+		v1, v2 := fmt.Sprintf("%s/v1-%v.sst", dir, clear), fmt.Sprintf("%s/v2-%v.sst", dir, clear)
+		buildTestSSTable(t, v1, newTestConsensusID(), records)
+		buildTestSSTableV2(t, v2, records, SSTABLE_V2_BLOCK_SIZE)
+		for _, path := range []string{v1, v2} {
+			table, err := LoadSSTable(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if table.HasClear() != clear {
+				t.Errorf("[%s] has clear %v; want %v", path, table.HasClear(), clear)
+			}
+			table.Close()
+		}
+	}
+}
+
+func TestSSTableV1Get(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := []util.IRecord{}
+	for i := 0; i < 1000; i += 2 {
+		records = append(records, newTestRecord(fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)))
+	}
+
+	path := dir + "/test.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), records)
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := util.NewStringKey(fmt.Sprintf("key%06d", i))
+		r, err := table.Get(key, "")
+		if err != nil {
+			t.Errorf("get failed [%d]: %s", i, err)
+			continue
+		}
+		if i%2 == 1 {
+			if r != nil {
+				t.Errorf("get [%d] should not be found", i)
+			}
+			continue
+		}
+		if r == nil {
+			t.Errorf("get [%d] not found", i)
+			continue
+		}
+		if !r.Key().Equal(key) || string(r.Value().Value()) != fmt.Sprintf("value%d", i) {
+			t.Errorf("get [%d] not match: %v, %s", i, r.Key().Key(), r.Value().Value())
+		}
+		// record is decoded in place from mmap data
+		if &r.Buf()[0] != &(*table.mmap_data)[table.record_start_pos+table.record_offset[i/2]] {
+			t.Errorf("get [%d] record is copied", i)
+		}
+	}
+
+	// non default group
+	r, err := table.Get(util.NewStringKey("key000000"), "group")
+	if err != nil || r != nil {
+		t.Errorf("get with group should not be found: %v, %s", r, err)
+	}
+}
+
+func TestSSTableV1Bloom(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := []util.IRecord{}
+	for i := 0; i < 1000; i += 2 {
+		records = append(records, newTestRecord(fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)))
+	}
+
+	// with and without bloom section
+	for _, bits := range []int{util.BLOOM_BITS_PER_KEY, 0} {
+		path := fmt.Sprintf("%s/test%d.sst", dir, bits)
+		b, err := NewSSTableV1Builder(path, newTestConsensusID(), "test.domain", "test.table", 3, util.NewLedgerTime(1), util.NewLedgerTime(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetBloomBitsPerKey(bits)
+		for _, r := range records {
+			if err := b.Add(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Finish(); err != nil {
+			t.Fatal(err)
+		}
+
+		table, err := LoadSSTableV1(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Level() != 3 {
+			t.Errorf("level %d; want 3", table.Level())
+		}
+		if (table.bloom != nil) != (bits > 0) {
+			t.Errorf("bloom section %v with %d bits per key", table.bloom != nil, bits)
+		}
+
+		absent := 0
+		for i := 0; i < 1000; i++ {
+			key := util.NewStringKey(fmt.Sprintf("key%06d", i))
+			r, err := table.Get(key, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (r != nil) != (i%2 == 0) {
+				t.Errorf("get [%d] found %v", i, r != nil)
+			}
+			hash_key, _ := sstable_hash_key(key, "")
+			if table.bloom != nil && !table.bloom.MayContain(hash_key) {
+				absent++
+			}
+		}
+		if bits > 0 && absent < 450 {
+			t.Errorf("bloom rules out %d of 500 absent keys", absent)
+		}
+
+		// corrupted bloom fails crc32 check
+		if bits > 0 {
+			pos := table.record_start_pos - 5
+			table.Close()
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[pos] ^= 0xff
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadSSTableV1(path); err == nil {
+				t.Errorf("corrupted bloom should fail")
+			}
+		} else {
+			table.Close()
+		}
+	}
+}
+
+func TestSSTableV1Groups(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := []util.IRecord{
+		newTestGroupRecord("a", "", "a"),
+		newTestGroupRecord("a", "attr", "a/attr"),
+		newTestGroupRecord("a", "attr/sub", "a/attr/sub"),
+		newTestGroupRecord("a/b", "attr", "a/b/attr"),
+		newTestGroupRecord("a/b/c", "", "a/b/c"),
+		newTestGroupRecord("a/d", "", "a/d"),
+		newTestGroupRecord("a/d", "attr", "a/d/attr"),
+		newTestGroupRecord("e", "", "e"),
+	}
+
+	path := dir + "/test.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), records)
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	// groups
+	groupTestCases := []struct {
+		key  string
+		want []string
+	}{
+		{"a", []string{"", "attr", "attr/sub"}},
+		{"a/b", []string{"attr"}},
+		{"a/d", []string{"", "attr"}},
+		{"a/c", []string{}},
+		{"f", []string{}},
+	}
+	for _, tt := range groupTestCases {
+		groups, err := table.Groups(newTestKey(tt.key))
+		if err != nil {
+			t.Errorf("groups [%s] failed: %s", tt.key, err)
+			continue
+		}
+		if fmt.Sprint(groups) != fmt.Sprint(tt.want) {
+			t.Errorf("groups [%s]: got %q; want %q", tt.key, groups, tt.want)
+		}
+	}
+
+	// get with group
+	for _, r := range records {
+		group, _ := RecordGroup(r)
+		found, err := table.Get(r.Key(), group)
+		if err != nil || found == nil {
+			t.Errorf("get [%s] [%s] not found: %s", testKeyString(r.Key()), group, err)
+			continue
+		}
+		if string(found.Value().Value()) != string(r.Value().Value()) {
+			t.Errorf("get [%s] [%s] not match: %s", testKeyString(r.Key()), group, found.Value().Value())
+		}
+	}
+	if r, _ := table.Get(newTestKey("a/b"), ""); r != nil {
+		t.Errorf("get [a/b] default group should not be found")
+	}
+
+	// keys
+	keyTestCases := []struct {
+		key  util.IKey
+		want []string
+	}{
+		{newTestKey("a"), []string{"a/b", "a/b/c", "a/d"}},
+		{newTestKey("a/b"), []string{"a/b/c"}},
+		{newTestKey("e"), []string{}},
+		{util.NewEmptyKey(), []string{"a", "a/b", "a/b/c", "a/d", "e"}},
+	}
+	for _, tt := range keyTestCases {
+		keys, err := table.Keys(tt.key)
+		if err != nil {
+			t.Errorf("keys [%v] failed: %s", tt.key.Key(), err)
+			continue
+		}
+		got := []string{}
+		for _, key := range keys {
+			got = append(got, testKeyString(key))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("keys [%v]: got %q; want %q", tt.key.Key(), got, tt.want)
+		}
+	}
+}
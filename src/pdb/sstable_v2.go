@@ -0,0 +1,625 @@
+package pdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"../collection"
+	"../util"
+	"github.com/golang/snappy"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Implementation V2
+//
+// SSTableV2 reads a block structured SSTable written by SSTableV2Builder.
+// The header, sparse index, and bloom filter are loaded when the file is
+// opened, and blocks are read from file and decompressed on demand - a Get
+// consults the bloom filter, locates the block by binary search of the first
+// key and group of each block in the index, and then the record by binary
+// search within the block.  Records are decoded in place from the block
+// buffer, and remain valid after the SSTable is closed.
+//
+// Decoded blocks are kept in a BlockCache, DefaultBlockCache unless set with
+// SetBlockCache, keyed by a file id unique to the opened SSTable.  A block is
+// pinned in cache while Get or Read decodes records from it, and blocks of a
+// closed SSTable age out of cache.
+
+type SSTableV2 struct {
+	// basic attributes
+	filepath     string
+	version      uint32
+	consensus_id util.IConsensusID
+	domain       util.IValue
+	table        util.IValue
+	start_time   util.IConsensusTime
+	end_time     util.IConsensusTime
+	start_key    util.IKey
+	end_key      util.IKey
+	level        uint32
+	count        uint32 // number of records
+	has_clear    bool   // whether any record is CLEAR
+	// lookup table
+	bloom *util.BloomFilter   // nil if sstable has no bloom section
+	index []*sstable_v2_block // sparse index, first key and group of each block
+	// file
+	file      *os.File
+	data_pos  uint32 // start of data section
+	data_size uint32 // size of data section
+	// block cache
+	cache   *BlockCache // nil if blocks are not cached
+	file_id uint64      // block cache file id
+}
+
+// index entry of a block
+type sstable_v2_block struct {
+	key   util.IKey // key of the first record
+	group string    // group of the first record
+	pos   uint32    // position in data section
+	size  uint32    // size in data section, including compression type and crc32
+}
+
+// decoded block content
+type sstable_v2_records struct {
+	buf     []byte   // records
+	offsets []uint32 // record offsets in buf
+}
+
+// load SSTable of any version, by version field in header
+func LoadSSTable(filepath string) (ISSTable, error) {
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4)
+	_, err = f.ReadAt(buf, 0)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("LoadSSTable - no version - %s", err)
+	}
+
+	var t ISSTable
+	switch version := binary.BigEndian.Uint32(buf); version {
+	case 1:
+		t, err = LoadSSTableV1(filepath)
+	case 2:
+		t, err = LoadSSTableV2(filepath)
+	default:
+		return nil, fmt.Errorf("LoadSSTable - unsupported version - %d", version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func LoadSSTableV2(filepath string) (t *SSTableV2, err error) {
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	t = &SSTableV2{
+		filepath: filepath,
+		file:     f,
+		cache:    DefaultBlockCache(),
+		file_id:  NewBlockCacheFileID(),
+	}
+	defer func() {
+		if err != nil && t != nil {
+			t.Close()
+			t = nil
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size := info.Size()
+
+	////////////////////////////////////////
+	// parse footer
+
+	if size < SSTABLE_V2_FOOTER_SIZE {
+		err = fmt.Errorf("NewSSTableV2 - no footer")
+		return
+	}
+	footer := make([]byte, SSTABLE_V2_FOOTER_SIZE)
+	if _, err = f.ReadAt(footer, size-SSTABLE_V2_FOOTER_SIZE); err != nil {
+		return
+	}
+	computed_footer_crc32 := crc32.ChecksumIEEE(footer[:SSTABLE_V2_FOOTER_SIZE-4])
+	footer_crc32 := binary.BigEndian.Uint32(footer[SSTABLE_V2_FOOTER_SIZE-4:])
+	if computed_footer_crc32 != footer_crc32 {
+		err = fmt.Errorf("NewSSTableV2 - footer crc32 checksum failed - computed %d vs footer %d", computed_footer_crc32, footer_crc32)
+		return
+	}
+	t.data_pos = binary.BigEndian.Uint32(footer[0:])
+	index_pos := binary.BigEndian.Uint32(footer[4:])
+	index_size := binary.BigEndian.Uint32(footer[8:])
+	bloom_pos := binary.BigEndian.Uint32(footer[12:])
+	bloom_size := binary.BigEndian.Uint32(footer[16:])
+
+	// sections are in order, and within file
+	sections_end := int64(index_pos) + int64(index_size) + 4
+	if bloom_pos != 0 {
+		sections_end = int64(bloom_pos) + int64(bloom_size) + 4
+	}
+	if t.data_pos > index_pos || (bloom_pos != 0 && bloom_pos != index_pos+index_size+4) || sections_end != size-SSTABLE_V2_FOOTER_SIZE {
+		err = fmt.Errorf("NewSSTableV2 - invalid footer - data %d, index %d %d, bloom %d %d", t.data_pos, index_pos, index_size, bloom_pos, bloom_size)
+		return
+	}
+	t.data_size = index_pos - t.data_pos
+
+	////////////////////////////////////////
+	// parse header
+
+	header := make([]byte, t.data_pos)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return
+	}
+	h, pos, err := sstable_decode_header(header)
+	if err != nil {
+		err = fmt.Errorf("NewSSTableV2 - %s", err)
+		return
+	}
+	if h.version != 2 {
+		err = fmt.Errorf("NewSSTableV2 - unsupported version - %d", h.version)
+		return
+	}
+	if pos != len(header) {
+		err = fmt.Errorf("NewSSTableV2 - header size %d vs data position %d", pos, t.data_pos)
+		return
+	}
+	t.version = h.version
+	t.consensus_id = h.consensus_id
+	t.domain = h.domain
+	t.table = h.table
+	t.start_time = h.start_time
+	t.end_time = h.end_time
+	t.start_key = h.start_key
+	t.end_key = h.end_key
+	t.level = h.level
+	t.count = h.count
+	t.has_clear = h.flags&SSTABLE_FLAG_CLEAR != 0
+
+	if (h.flags&SSTABLE_FLAG_BLOOM != 0) != (bloom_pos != 0) {
+		err = fmt.Errorf("NewSSTableV2 - bloom flag does not match bloom position %d", bloom_pos)
+		return
+	}
+
+	////////////////////////////////////////
+	// parse index
+
+	index, err := t.readSection(index_pos, index_size)
+	if err != nil {
+		err = fmt.Errorf("NewSSTableV2 - index - %s", err)
+		return
+	}
+	if t.index, err = sstable_v2_decode_index(index); err != nil {
+		err = fmt.Errorf("NewSSTableV2 - %s", err)
+		return
+	}
+	end := uint32(0)
+	for i, block := range t.index {
+		if block.pos != end || block.size < 1+4 || block.pos+block.size > t.data_size {
+			err = fmt.Errorf("NewSSTableV2 - invalid block [%d] position %d size %d", i, block.pos, block.size)
+			return
+		}
+		end = block.pos + block.size
+	}
+	if end != t.data_size {
+		err = fmt.Errorf("NewSSTableV2 - blocks size %d vs data size %d", end, t.data_size)
+		return
+	}
+
+	////////////////////////////////////////
+	// parse optional bloom filter
+
+	if bloom_pos != 0 {
+		bloom, e := t.readSection(bloom_pos, bloom_size)
+		if e != nil {
+			err = fmt.Errorf("NewSSTableV2 - bloom - %s", e)
+			return
+		}
+		if t.bloom, _, err = util.NewBloomFilter(bloom); err != nil {
+			return
+		}
+	}
+
+	return t, nil
+}
+
+func (t *SSTableV2) Version() uint32 {
+	return 2
+}
+
+func (t *SSTableV2) ConsensusID() util.IConsensusID {
+	return t.consensus_id
+}
+
+func (t *SSTableV2) Domain() string {
+	return string(t.domain.Value())
+}
+
+func (t *SSTableV2) Table() string {
+	return string(t.table.Value())
+}
+
+func (t *SSTableV2) StartTime() util.IConsensusTime {
+	return t.start_time
+}
+
+func (t *SSTableV2) EndTime() util.IConsensusTime {
+	return t.end_time
+}
+
+func (t *SSTableV2) StartKey() util.IKey {
+	return t.start_key
+}
+
+func (t *SSTableV2) EndKey() util.IKey {
+	return t.end_key
+}
+
+func (t *SSTableV2) Level() uint32 {
+	return t.level
+}
+
+func (t *SSTableV2) Count() uint32 {
+	return t.count
+}
+
+func (t *SSTableV2) HasClear() bool {
+	return t.has_clear
+}
+
+// get record with specified key and group, return nil if not found - a CLEAR
+// record is returned as is, and masks the key and group in older tables
+func (t *SSTableV2) Get(key util.IKey, group string) (util.IRecord, error) {
+
+	if t.file == nil {
+		return nil, fmt.Errorf("SSTableV2::Get - sstable closed")
+	}
+
+	if collection.IsNil(key) {
+		return nil, fmt.Errorf("SSTableV2::Get - key is nil")
+	}
+
+	if t.bloom != nil {
+		hash_key, err := sstable_hash_key(key, group)
+		if err != nil {
+			return nil, fmt.Errorf("SSTableV2::Get - %s", err)
+		}
+		if !t.bloom.MayContain(hash_key) {
+			return nil, nil
+		}
+	}
+
+	// last block with first record no larger than key and group
+	b := sort.Search(len(t.index), func(i int) bool {
+		return sstable_compare(t.index[i].key, t.index[i].group, key, group) > 0
+	}) - 1
+	if b < 0 {
+		return nil, nil
+	}
+
+	records, handle, err := t.readBlock(b)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Release()
+
+	var r util.IRecord
+	n := sort.Search(len(records.offsets), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var r_group string
+		r, err = records.recordAt(i)
+		if err == nil {
+			r_group, err = RecordGroup(r)
+		}
+		return err != nil || sstable_compare(r.Key(), r_group, key, group) >= 0
+	})
+	if err != nil {
+		return nil, fmt.Errorf("SSTableV2::Get - %s", err)
+	}
+	if n >= len(records.offsets) {
+		return nil, nil
+	}
+
+	if r, err = records.recordAt(n); err != nil {
+		return nil, fmt.Errorf("SSTableV2::Get - %s", err)
+	}
+	if !r.Key().Equal(key) {
+		return nil, nil
+	}
+	if r_group, err := RecordGroup(r); err != nil {
+		return nil, fmt.Errorf("SSTableV2::Get - %s", err)
+	} else if r_group != group {
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// list of groups under specified key, maximum MAX_ATTR_GROUPS groups
+func (t *SSTableV2) Groups(key util.IKey) ([]string, error) {
+
+	if t.file == nil {
+		return nil, fmt.Errorf("SSTableV2::Groups - sstable closed")
+	}
+
+	result := []string{}
+
+	// records of the same key are sorted by group
+	iter := t.RangeIterator(key, nil)
+	for iter.HasNext() && len(result) < util.MAX_ATTR_GROUPS {
+		r := iter.Next()
+		if !r.Key().Equal(key) {
+			break
+		}
+		group, err := RecordGroup(r)
+		if err != nil {
+			return nil, fmt.Errorf("SSTableV2::Groups - %s", err)
+		}
+		// skip cleared groups, and history
+		if record_is_clear(r) || group_is_history(group) {
+			continue
+		}
+		result = append(result, group)
+	}
+
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+
+	return result, nil
+}
+
+// list of child keys with specified key as prefix
+func (t *SSTableV2) Keys(key util.IKey) ([]util.IKey, error) {
+
+	if t.file == nil {
+		return nil, fmt.Errorf("SSTableV2::Keys - sstable closed")
+	}
+
+	result := []util.IKey{}
+
+	iter := t.PrefixIterator(key)
+	for iter.HasNext() {
+		r := iter.Next()
+		// skip the key itself
+		if !collection.IsNil(key) && len(r.Key().Key()) <= len(key.Key()) {
+			continue
+		}
+		// skip cleared groups, and history
+		if live, err := record_is_live(r); err != nil {
+			return nil, fmt.Errorf("SSTableV2::Keys - %s", err)
+		} else if !live {
+			continue
+		}
+		// skip other groups of the same key
+		if len(result) > 0 && result[len(result)-1].Equal(r.Key()) {
+			continue
+		}
+		result = append(result, r.Key())
+	}
+
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+
+	return result, nil
+}
+
+// read records of blocks starting at byte position pos of the data section,
+// until at least suggest_offset bytes are read - return records, and bytes read
+func (t *SSTableV2) Read(pos, suggest_offset uint32) ([]util.IRecord, uint32, error) {
+
+	if t.file == nil {
+		return nil, 0, fmt.Errorf("SSTableV2::Read - sstable closed")
+	}
+
+	// locate the block starting at pos
+	b := sort.Search(len(t.index), func(i int) bool { return t.index[i].pos >= pos })
+	if b < len(t.index) && t.index[b].pos != pos {
+		return nil, 0, fmt.Errorf("SSTableV2::Read - pos %d is not at block boundary", pos)
+	}
+
+	result := []util.IRecord{}
+	read := uint32(0)
+	for ; b < len(t.index) && (read < suggest_offset || len(result) == 0); b++ {
+		records, handle, err := t.readBlock(b)
+		if err != nil {
+			return result, read, err
+		}
+		for i := range records.offsets {
+			r, err := records.recordAt(i)
+			if err != nil {
+				handle.Release()
+				return result, read, err
+			}
+			result = append(result, r)
+		}
+		handle.Release()
+		read += t.index[b].size
+	}
+
+	return result, read, nil
+}
+
+// set block cache of the SSTable, nil to read blocks without cache
+func (t *SSTableV2) SetBlockCache(cache *BlockCache) {
+	t.cache = cache
+}
+
+func (t *SSTableV2) Close() error {
+	if t.file != nil {
+		err := t.file.Close()
+		t.file = nil
+		return err
+	}
+	return nil
+}
+
+// read a block from cache, or read and decompress a block from file and
+// verify block crc32 - the returned handle pins the block in cache until
+// released, and is nil if the block is not cached
+func (t *SSTableV2) readBlock(b int) (*sstable_v2_records, *BlockCacheHandle, error) {
+
+	if t.file == nil {
+		return nil, nil, fmt.Errorf("SSTableV2::readBlock - sstable closed")
+	}
+
+	block := t.index[b]
+	if t.cache != nil {
+		if handle := t.cache.Lookup(t.file_id, block.pos); handle != nil {
+			return handle.Value().(*sstable_v2_records), handle, nil
+		}
+	}
+
+	buf := make([]byte, block.size)
+	if _, err := t.file.ReadAt(buf, int64(t.data_pos)+int64(block.pos)); err != nil {
+		return nil, nil, fmt.Errorf("SSTableV2::readBlock - block [%d] - %s", b, err)
+	}
+
+	content, err := sstable_v2_decode_block(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SSTableV2::readBlock - block [%d] - %s", b, err)
+	}
+
+	if t.cache != nil {
+		return content, t.cache.Insert(t.file_id, block.pos, content, content.size()), nil
+	}
+
+	return content, nil, nil
+}
+
+// read a section followed by crc32, and verify crc32
+func (t *SSTableV2) readSection(pos, size uint32) ([]byte, error) {
+
+	buf := make([]byte, size+4)
+	if _, err := t.file.ReadAt(buf, int64(pos)); err != nil {
+		return nil, err
+	}
+
+	computed_crc32 := crc32.ChecksumIEEE(buf[:size])
+	section_crc32 := binary.BigEndian.Uint32(buf[size:])
+	if computed_crc32 != section_crc32 {
+		return nil, fmt.Errorf("crc32 checksum failed - computed %d vs section %d", computed_crc32, section_crc32)
+	}
+
+	return buf[:size], nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// sstable_v2_records
+
+// approximate memory size of decoded block
+func (b *sstable_v2_records) size() uint64 {
+	return uint64(len(b.buf)) + 4*uint64(len(b.offsets)) + 64
+}
+
+// decode n-th record of block in place
+func (b *sstable_v2_records) recordAt(n int) (*util.MappedRecord, error) {
+
+	start := b.offsets[n]
+	end := uint32(len(b.buf))
+	if n+1 < len(b.offsets) {
+		end = b.offsets[n+1]
+	}
+
+	if start >= end || end > uint32(len(b.buf)) {
+		return nil, fmt.Errorf("sstable_v2_records::recordAt - invalid record offset [%d] %d - %d", n, start, end)
+	}
+
+	r, _, err := util.NewMappedRecord(b.buf[start:end])
+	if err != nil {
+		return nil, fmt.Errorf("sstable_v2_records::recordAt - record [%d] error [%v]", n, err)
+	}
+
+	if collection.IsNil(r.Key()) {
+		return nil, fmt.Errorf("sstable_v2_records::recordAt - record [%d] has no key", n)
+	}
+
+	return r, nil
+}
+
+// index of first record with key no less than specified key
+func (b *sstable_v2_records) seek(key util.IKey) (int, error) {
+
+	var err error
+	n := sort.Search(len(b.offsets), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		r, e := b.recordAt(i)
+		if e != nil {
+			err = e
+			return true
+		}
+		return r.Key().Compare(key) >= 0
+	})
+
+	return n, err
+}
+
+// verify crc32, decompress, and parse record offsets of a block
+func sstable_v2_decode_block(buf []byte) (*sstable_v2_records, error) {
+
+	if len(buf) < 1+4 {
+		return nil, fmt.Errorf("sstable_v2_decode_block - block too short %d", len(buf))
+	}
+
+	computed_crc32 := crc32.ChecksumIEEE(buf[:len(buf)-4])
+	block_crc32 := binary.BigEndian.Uint32(buf[len(buf)-4:])
+	if computed_crc32 != block_crc32 {
+		return nil, fmt.Errorf("sstable_v2_decode_block - block crc32 checksum failed - computed %d vs block %d", computed_crc32, block_crc32)
+	}
+
+	content := buf[1 : len(buf)-4]
+	switch buf[0] {
+	case SSTABLE_V2_NO_COMPRESS:
+	case SSTABLE_V2_SNAPPY:
+		n, err := snappy.DecodedLen(content)
+		if err != nil {
+			return nil, fmt.Errorf("sstable_v2_decode_block - %s", err)
+		}
+		if n > int(SSTABLE_MAX_FILE_SIZE) {
+			return nil, fmt.Errorf("sstable_v2_decode_block - decoded size %d too large", n)
+		}
+		if content, err = snappy.Decode(nil, content); err != nil {
+			return nil, fmt.Errorf("sstable_v2_decode_block - %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("sstable_v2_decode_block - unsupported compression %d", buf[0])
+	}
+
+	if len(content) < SSTABLE_V2_BLOCK_HEADER {
+		return nil, fmt.Errorf("sstable_v2_decode_block - no record count")
+	}
+	count := binary.BigEndian.Uint32(content)
+	if count > SSTABLE_MAX_RECORDS || len(content) < SSTABLE_V2_BLOCK_HEADER+4*int(count) {
+		return nil, fmt.Errorf("sstable_v2_decode_block - invalid record count %d", count)
+	}
+
+	records := &sstable_v2_records{offsets: make([]uint32, count)}
+	pos := SSTABLE_V2_BLOCK_HEADER
+	for i := range records.offsets {
+		records.offsets[i] = binary.BigEndian.Uint32(content[pos:])
+		pos += 4
+	}
+	records.buf = content[pos:]
+
+	return records, nil
+}
@@ -0,0 +1,478 @@
+package pdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"../collection"
+	"../util"
+	"github.com/golang/snappy"
+)
+
+const (
+	SSTABLE_V2_BLOCK_SIZE   = uint32(64 * 1024) // target uncompressed block size
+	SSTABLE_V2_FOOTER_SIZE  = 4 * 6             // data, index and bloom positions, footer crc32
+	SSTABLE_V2_NO_COMPRESS  = byte(0)
+	SSTABLE_V2_SNAPPY       = byte(1)
+	SSTABLE_V2_BLOCK_HEADER = 4 // record count of block
+
+	// max target block size, decoded blocks fit a shard of the default block
+	// cache with room to spare
+	SSTABLE_V2_MAX_BLOCK_SIZE = uint32(BLOCK_CACHE_CAPACITY / BLOCK_CACHE_SHARDS / 4)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// SSTable V2 Builder
+//
+// SSTableV2Builder writes a V2 SSTable file as parsed by LoadSSTableV2:
+//
+//   - header     : same as V1, with version 2
+//   - data       : blocks of sorted records, each block is a compression type,
+//                  compressed block content, and block crc32 of both
+//   - index      : block count, and for each block the block position and
+//                  size in data section, key and group of the first record,
+//                  followed by index crc32
+//   - bloom      : optional, bloom filter of <key> + 0x00 + <group>, bloom
+//                  crc32 - present if SSTABLE_FLAG_BLOOM is set in header
+//   - footer     : data pos, index pos, index size, bloom pos, bloom size,
+//                  footer crc32
+//
+// Block content before compression is record count, record offsets relative
+// to the first record, and records.  A block is closed when its content
+// reaches block size (SSTABLE_V2_BLOCK_SIZE, up to SSTABLE_V2_MAX_BLOCK_SIZE),
+// and is stored uncompressed if snappy does not save at least 1/8 of it.
+// Index and bloom sizes exclude their crc32.
+
+type SSTableV2Builder struct {
+	// basic attributes
+	filepath     string
+	consensus_id util.IConsensusID
+	domain       string
+	table        string
+	start_time   util.IConsensusTime
+	end_time     util.IConsensusTime
+	level        uint32
+	header_size  uint64 // upper bound of header size
+	block_size   uint32 // target uncompressed block size
+	bloom_bits   int    // bloom filter bits per key, 0 for no bloom section
+	// records
+	hash_keys  []util.IKey // bloom hash keys
+	count      uint32
+	start_key  util.IKey
+	end_key    util.IKey
+	last_key   util.IKey
+	last_group string
+	has_clear  bool // whether any record is CLEAR
+	// blocks
+	block       []byte   // records of current block
+	block_index []uint32 // record offsets of current block
+	index       []byte   // encoded index entries
+	blocks      uint32   // number of blocks written
+	data_size   uint32   // size of blocks written
+	// temporary data file
+	data_file *os.File
+	closed    bool
+}
+
+func NewSSTableV2Builder(filepath string, consensus_id util.IConsensusID, domain, table string, level uint32, start_time, end_time util.IConsensusTime) (*SSTableV2Builder, error) {
+
+	if collection.IsNil(consensus_id) {
+		return nil, fmt.Errorf("NewSSTableV2Builder - consensus id is nil")
+	}
+
+	if collection.IsNil(start_time) || collection.IsNil(end_time) {
+		return nil, fmt.Errorf("NewSSTableV2Builder - start time or end time is nil")
+	}
+
+	if level > SSTABLE_LEVEL_MASK {
+		return nil, fmt.Errorf("NewSSTableV2Builder - unsupported level %d", level)
+	}
+
+	data_file, err := os.OpenFile(filepath+".data.tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &SSTableV2Builder{
+		filepath:     filepath,
+		consensus_id: consensus_id,
+		domain:       domain,
+		table:        table,
+		start_time:   start_time,
+		end_time:     end_time,
+		level:        level,
+		header_size:  sstable_v1_est_header_size(consensus_id, domain, table, start_time, end_time),
+		block_size:   SSTABLE_V2_BLOCK_SIZE,
+		bloom_bits:   util.BLOOM_BITS_PER_KEY,
+		hash_keys:    []util.IKey{},
+		data_file:    data_file,
+	}
+
+	return b, nil
+}
+
+func (b *SSTableV2Builder) Count() uint32 {
+	return b.count
+}
+
+// set bloom filter bits per key, 0 to write no bloom section
+func (b *SSTableV2Builder) SetBloomBitsPerKey(bits int) {
+	b.bloom_bits = bits
+}
+
+// set target uncompressed block size, up to SSTABLE_V2_MAX_BLOCK_SIZE - a
+// decoded block larger than a shard of the block cache is not cached
+func (b *SSTableV2Builder) SetBlockSize(size uint32) {
+	if size > SSTABLE_V2_MAX_BLOCK_SIZE {
+		size = SSTABLE_V2_MAX_BLOCK_SIZE
+	}
+	b.block_size = size
+}
+
+// estimated file size with all the records added so far, current block uncompressed
+func (b *SSTableV2Builder) EstFileSize() uint64 {
+	return b.estFileSize(b.count, uint64(len(b.block)+4*len(b.block_index)))
+}
+
+// whether record can be added without exceeding SSTABLE_MAX_RECORDS or SSTABLE_MAX_FILE_SIZE
+func (b *SSTableV2Builder) Fits(r util.IRecord) bool {
+
+	if b.count+1 > SSTABLE_MAX_RECORDS {
+		return false
+	}
+
+	est_size := b.estFileSize(b.count+1, uint64(len(b.block)+4*len(b.block_index)+4+r.EstBufSize()))
+
+	return est_size <= uint64(SSTABLE_MAX_FILE_SIZE)
+}
+
+// add a record - records must be added in sorted order
+func (b *SSTableV2Builder) Add(r util.IRecord) error {
+
+	if b.closed {
+		return fmt.Errorf("SSTableV2Builder::Add - builder closed")
+	}
+
+	if collection.IsNil(r) || collection.IsNil(r.Key()) {
+		return fmt.Errorf("SSTableV2Builder::Add - record or key is nil")
+	}
+
+	if b.count >= SSTABLE_MAX_RECORDS {
+		return fmt.Errorf("SSTableV2Builder::Add - exceeding max records %d", SSTABLE_MAX_RECORDS)
+	}
+
+	if !r.IsEncoded() {
+		if err := r.Encode(nil); err != nil {
+			return fmt.Errorf("SSTableV2Builder::Add - %s", err)
+		}
+	}
+
+	key := r.Key()
+	if !key.IsEncoded() {
+		if err := key.Encode(nil); err != nil {
+			return fmt.Errorf("SSTableV2Builder::Add - %s", err)
+		}
+	}
+
+	group, err := RecordGroup(r)
+	if err != nil {
+		return fmt.Errorf("SSTableV2Builder::Add - %s", err)
+	}
+
+	// records must be strictly increasing by <key> + 0x00 + <group>
+	if b.last_key != nil && sstable_compare(b.last_key, b.last_group, key, group) >= 0 {
+		return fmt.Errorf("SSTableV2Builder::Add - record not in sorted order")
+	}
+
+	hash_key, err := sstable_hash_key(key, group)
+	if err != nil {
+		return fmt.Errorf("SSTableV2Builder::Add - %s", err)
+	}
+
+	// index entry of a new block
+	if len(b.block_index) == 0 {
+		b.index, err = sstable_v2_encode_index_key(b.index, key, group)
+		if err != nil {
+			return fmt.Errorf("SSTableV2Builder::Add - %s", err)
+		}
+	}
+
+	b.block_index = append(b.block_index, uint32(len(b.block)))
+	b.block = append(b.block, r.Buf()...)
+	b.hash_keys = append(b.hash_keys, hash_key)
+	b.count += 1
+	if record_is_clear(r) {
+		b.has_clear = true
+	}
+
+	if b.start_key == nil {
+		b.start_key = key
+	}
+	b.end_key = key
+	b.last_key = key
+	b.last_group = group
+
+	if uint32(len(b.block)) >= b.block_size {
+		return b.flushBlock()
+	}
+
+	return nil
+}
+
+// write SSTable file and publish atomically
+func (b *SSTableV2Builder) Finish() (err error) {
+
+	if b.closed {
+		return fmt.Errorf("SSTableV2Builder::Finish - builder closed")
+	}
+
+	defer b.Abort()
+
+	if err = b.flushBlock(); err != nil {
+		return err
+	}
+
+	tmp_path := b.filepath + ".tmp"
+	f, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			os.Remove(tmp_path)
+		}
+	}()
+
+	////////////////////////////////////////
+	// header
+
+	flags := uint32(0)
+	if b.bloom_bits > 0 {
+		flags |= SSTABLE_FLAG_BLOOM
+	}
+	if b.has_clear {
+		flags |= SSTABLE_FLAG_CLEAR
+	}
+	header, err := sstable_encode_header(2, b.consensus_id, b.domain, b.table, b.start_time, b.end_time, b.start_key, b.end_key, b.level|flags, b.count)
+	if err != nil {
+		return fmt.Errorf("SSTableV2Builder::Finish - %s", err)
+	}
+
+	////////////////////////////////////////
+	// index, bloom and footer
+
+	index := appendUint32(nil, b.blocks)
+	index = append(index, b.index...)
+	index_size := uint32(len(index))
+	index = appendUint32(index, crc32.ChecksumIEEE(index))
+
+	bloom := []byte{}
+	if b.bloom_bits > 0 {
+		bloom, err = util.BloomBuild(b.hash_keys, b.bloom_bits).Encode()
+		if err != nil {
+			return fmt.Errorf("SSTableV2Builder::Finish - %s", err)
+		}
+	}
+	bloom_size := uint32(len(bloom))
+	if b.bloom_bits > 0 {
+		bloom = appendUint32(bloom, crc32.ChecksumIEEE(bloom))
+	}
+
+	data_pos := uint32(len(header))
+	index_pos := data_pos + b.data_size
+	bloom_pos := index_pos + uint32(len(index))
+	if b.bloom_bits == 0 {
+		bloom_pos = 0
+	}
+
+	footer := appendUint32(nil, data_pos)
+	footer = appendUint32(footer, index_pos)
+	footer = appendUint32(footer, index_size)
+	footer = appendUint32(footer, bloom_pos)
+	footer = appendUint32(footer, bloom_size)
+	footer = appendUint32(footer, crc32.ChecksumIEEE(footer))
+
+	// check file size
+	file_size := uint64(len(header)) + uint64(b.data_size) + uint64(len(index)) + uint64(len(bloom)) + uint64(len(footer))
+	if file_size > uint64(SSTABLE_MAX_FILE_SIZE) {
+		return fmt.Errorf("SSTableV2Builder::Finish - file size %d exceeding %d", file_size, SSTABLE_MAX_FILE_SIZE)
+	}
+
+	if _, err = f.Write(header); err != nil {
+		return err
+	}
+
+	////////////////////////////////////////
+	// data blocks
+
+	if _, err = b.data_file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err = io.CopyN(f, b.data_file, int64(b.data_size)); err != nil {
+		return err
+	}
+
+	for _, buf := range [][]byte{index, bloom, footer} {
+		if _, err = f.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	////////////////////////////////////////
+	// sync and publish
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		f = nil
+		return err
+	}
+	f = nil
+
+	if err = os.Rename(tmp_path, b.filepath); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(b.filepath))
+}
+
+// discard the builder and remove the temporary data file
+func (b *SSTableV2Builder) Abort() {
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	b.data_file.Close()
+	os.Remove(b.data_file.Name())
+}
+
+// compress and write current block to data file, and complete its index entry
+func (b *SSTableV2Builder) flushBlock() error {
+
+	if len(b.block_index) == 0 {
+		return nil
+	}
+
+	content := make([]byte, 0, SSTABLE_V2_BLOCK_HEADER+4*len(b.block_index)+len(b.block))
+	content = appendUint32(content, uint32(len(b.block_index)))
+	for _, offset := range b.block_index {
+		content = appendUint32(content, offset)
+	}
+	content = append(content, b.block...)
+
+	block := []byte{SSTABLE_V2_NO_COMPRESS}
+	if compressed := snappy.Encode(nil, content); len(compressed) < len(content)-len(content)/8 {
+		block = append([]byte{SSTABLE_V2_SNAPPY}, compressed...)
+	} else {
+		block = append(block, content...)
+	}
+	block = appendUint32(block, crc32.ChecksumIEEE(block))
+
+	if uint64(b.data_size)+uint64(len(block)) > uint64(SSTABLE_MAX_FILE_SIZE) {
+		return fmt.Errorf("SSTableV2Builder::flushBlock - data size exceeding %d", SSTABLE_MAX_FILE_SIZE)
+	}
+
+	if _, err := b.data_file.Write(block); err != nil {
+		return err
+	}
+
+	// block position and size follow the first key and group of the block
+	b.index = appendUint32(b.index, b.data_size)
+	b.index = appendUint32(b.index, uint32(len(block)))
+
+	b.data_size += uint32(len(block))
+	b.blocks += 1
+	b.block = b.block[:0]
+	b.block_index = b.block_index[:0]
+
+	return nil
+}
+
+// conservative estimate of file size with count records, and pending bytes of current block
+func (b *SSTableV2Builder) estFileSize(count uint32, pending uint64) uint64 {
+
+	size := b.header_size + uint64(b.data_size) + pending + 1 + 4 // block compression type and crc32
+	size += uint64(len(b.index)) + 4 + 2*util.MAX_KEY_LENGTH + 4  // index, and entry of current block
+	if b.bloom_bits > 0 {
+		size += uint64(util.BloomEstSize(int(count), b.bloom_bits) + 4)
+	}
+
+	return size + SSTABLE_V2_FOOTER_SIZE
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// append key and group of the first record of a block to index
+func sstable_v2_encode_index_key(buf []byte, key util.IKey, group string) ([]byte, error) {
+
+	buf = append(buf, key.Buf()...)
+
+	value := util.NewPrimitive([]byte(group))
+	if err := value.Encode(nil); err != nil {
+		return nil, err
+	}
+
+	return append(buf, value.Buf()...), nil
+}
+
+// parse index entries of V2 SSTable
+func sstable_v2_decode_index(buf []byte) ([]*sstable_v2_block, error) {
+
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("sstable_v2_decode_index - no block count")
+	}
+	count := binary.BigEndian.Uint32(buf)
+	pos := 4
+
+	if count > SSTABLE_MAX_RECORDS {
+		return nil, fmt.Errorf("sstable_v2_decode_index - unsupported block count %d", count)
+	}
+
+	index := make([]*sstable_v2_block, 0, count)
+	for i := uint32(0); i < count; i++ {
+
+		key, _, err := util.NewMappedKey(buf[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("sstable_v2_decode_index - block [%d] key - %s", i, err)
+		}
+		pos += len(key.Buf())
+
+		group, _, err := util.NewStandardMappedValue(buf[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("sstable_v2_decode_index - block [%d] group - %s", i, err)
+		}
+		pos += len(group.Buf())
+
+		if len(buf) < pos+8 {
+			return nil, fmt.Errorf("sstable_v2_decode_index - block [%d] no position", i)
+		}
+		block := &sstable_v2_block{
+			key:   key,
+			group: string(group.Value()),
+			pos:   binary.BigEndian.Uint32(buf[pos:]),
+			size:  binary.BigEndian.Uint32(buf[pos+4:]),
+		}
+		pos += 8
+
+		index = append(index, block)
+	}
+
+	if pos != len(buf) {
+		return nil, fmt.Errorf("sstable_v2_decode_index - %d trailing bytes", len(buf)-pos)
+	}
+
+	return index, nil
+}
@@ -0,0 +1,240 @@
+package pdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"../util"
+)
+
+// records of keys a/<i>/<j> with groups, sorted
+func newTestV2Records() []util.IRecord {
+	records := []util.IRecord{}
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j += 2 {
+			key := fmt.Sprintf("a/%03d/%03d", i, j)
+			for _, group := range []string{"", "g1", "g2"} {
+				records = append(records, newTestGroupRecord(key, group, fmt.Sprintf("value of %s [%s] repeated repeated repeated", key, group)))
+			}
+		}
+	}
+	return records
+}
+
+func buildTestSSTableV2(t testing.TB, path string, records []util.IRecord, block_size uint32) {
+	b, err := NewSSTableV2Builder(path, newTestConsensusID(), "test.domain", "test.table", 1, util.NewLedgerTime(1), util.NewLedgerTime(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetBlockSize(block_size)
+	for _, r := range records {
+		if err := b.Add(r); err != nil {
+			b.Abort()
+			t.Fatal(err)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRecordStrings(t testing.TB, iter ISSTableIterator) []string {
+	result := []string{}
+	for iter.HasNext() {
+		r := iter.Next()
+		group, err := RecordGroup(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, testKeyString(r.Key())+"["+group+"]="+string(r.Value().Value()))
+	}
+	if iter.Error() != nil {
+		t.Fatal(iter.Error())
+	}
+	return result
+}
+
+func TestSSTableV2(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := newTestV2Records()
+
+	// same records in V1 and V2 with small blocks
+	buildTestSSTable(t, dir+"/v1.sst", newTestConsensusID(), records)
+	buildTestSSTableV2(t, dir+"/v2.sst", records, 512)
+
+	v1, err := LoadSSTable(dir + "/v1.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1.Close()
+
+	loaded, err := LoadSSTable(dir + "/v2.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+
+	if v1.Version() != 1 || loaded.Version() != 2 {
+		t.Fatalf("versions %d, %d", v1.Version(), loaded.Version())
+	}
+	v2 := loaded.(*SSTableV2)
+
+	if v2.Count() != uint32(len(records)) || v2.Level() != 1 || v2.Domain() != "test.domain" || v2.Table() != "test.table" {
+		t.Errorf("header not match: count %d level %d %s %s", v2.Count(), v2.Level(), v2.Domain(), v2.Table())
+	}
+	if !v2.StartKey().Equal(records[0].Key()) || !v2.EndKey().Equal(records[len(records)-1].Key()) {
+		t.Errorf("start key or end key not match")
+	}
+	if len(v2.index) < 10 || v2.bloom == nil {
+		t.Errorf("blocks %d, bloom %v", len(v2.index), v2.bloom != nil)
+	}
+	if v2.data_size >= uint32(v1.(*SSTableV1).record_end_pos-v1.(*SSTableV1).record_start_pos) {
+		t.Errorf("blocks not compressed: %d", v2.data_size)
+	}
+
+	// iterators match V1
+	iterTestCases := []struct {
+		name   string
+		v1, v2 ISSTableIterator
+	}{
+		{"all", v1.Iterator(), v2.Iterator()},
+		{"range", v1.RangeIterator(newTestKey("a/005/003"), newTestKey("a/012")), v2.RangeIterator(newTestKey("a/005/003"), newTestKey("a/012"))},
+		{"range from block start", v1.RangeIterator(v2.index[3].key, nil), v2.RangeIterator(v2.index[3].key, nil)},
+		{"prefix", v1.PrefixIterator(newTestKey("a/007")), v2.PrefixIterator(newTestKey("a/007"))},
+		{"absent prefix", v1.PrefixIterator(newTestKey("b")), v2.PrefixIterator(newTestKey("b"))},
+	}
+	for _, tt := range iterTestCases {
+		want := fmt.Sprint(testRecordStrings(t, tt.v1))
+		if got := fmt.Sprint(testRecordStrings(t, tt.v2)); got != want {
+			t.Errorf("%s iterator:\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+
+	// get of every record, and absent keys and groups
+	for _, r := range records {
+		group, _ := RecordGroup(r)
+		got, err := v2.Get(r.Key(), group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || string(got.Value().Value()) != string(r.Value().Value()) {
+			t.Errorf("get [%s] [%s]: %v", testKeyString(r.Key()), group, got)
+		}
+	}
+	for _, key := range []string{"a", "a/000/001", "a/019/009", "b"} {
+		if got, err := v2.Get(newTestKey(key), ""); err != nil || got != nil {
+			t.Errorf("get of absent [%s]: %v %v", key, got, err)
+		}
+	}
+	if got, err := v2.Get(newTestKey("a/000/000"), "g3"); err != nil || got != nil {
+		t.Errorf("get of absent group: %v %v", got, err)
+	}
+
+	// groups and keys match V1
+	for _, key := range []string{"a/003/004", "a/003", "a", "b"} {
+		g1, err1 := v1.Groups(newTestKey(key))
+		g2, err2 := v2.Groups(newTestKey(key))
+		if err1 != nil || err2 != nil || fmt.Sprint(g1) != fmt.Sprint(g2) {
+			t.Errorf("groups [%s]: %q %v; want %q %v", key, g2, err2, g1, err1)
+		}
+		k1, err1 := v1.Keys(newTestKey(key))
+		k2, err2 := v2.Keys(newTestKey(key))
+		if err1 != nil || err2 != nil || testKeyStrings(k1) != testKeyStrings(k2) {
+			t.Errorf("keys [%s]: %s %v; want %s %v", key, testKeyStrings(k2), err2, testKeyStrings(k1), err1)
+		}
+	}
+
+	// batch read by block positions
+	read := 0
+	for pos := uint32(0); pos < v2.data_size; {
+		batch, n, err := v2.Read(pos, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 1024 && pos+n < v2.data_size {
+			t.Errorf("read %d bytes at %d", n, pos)
+		}
+		read += len(batch)
+		pos += n
+	}
+	if read != len(records) {
+		t.Errorf("read %d records; want %d", read, len(records))
+	}
+	if _, _, err := v2.Read(1, 1024); err == nil {
+		t.Errorf("read within block should fail")
+	}
+}
+
+func TestSSTableV2Corrupted(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := newTestV2Records()
+	path := dir + "/v2.sst"
+	buildTestSSTableV2(t, path, records, 512)
+
+	table, err := LoadSSTableV2(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := table.index[2]
+	block_pos := int(table.data_pos + block.pos)
+	table.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupted block fails reads of the block only
+	corrupted := append([]byte{}, data...)
+	corrupted[block_pos+int(block.size)/2] ^= 0xff
+	if err := ioutil.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	table, err = LoadSSTableV2(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Get(records[0].Key(), ""); err != nil {
+		t.Errorf("get of good block: %s", err)
+	}
+	if _, err := table.Get(block.key, block.group); err == nil {
+		t.Errorf("get of corrupted block should fail")
+	}
+	iter := table.Iterator()
+	for iter.HasNext() {
+		iter.Next()
+	}
+	if iter.Error() == nil {
+		t.Errorf("iterator over corrupted block should fail")
+	}
+	table.Close()
+
+	// corrupted header, index and footer fail load
+	for _, pos := range []int{10, len(data) - SSTABLE_V2_FOOTER_SIZE - 200, len(data) - 3} {
+		corrupted := append([]byte{}, data...)
+		corrupted[pos] ^= 0xff
+		if err := ioutil.WriteFile(path, corrupted, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if table, err := LoadSSTable(path); err == nil {
+			table.Close()
+			t.Errorf("load with byte %d of %d corrupted should fail", pos, len(data))
+		}
+	}
+
+	// truncated
+	if err := ioutil.WriteFile(path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSSTable(path); err == nil {
+		t.Errorf("load of truncated file should fail")
+	}
+}
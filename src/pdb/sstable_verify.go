@@ -0,0 +1,481 @@
+package pdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+
+	"../collection"
+	"../util"
+)
+
+const (
+	SSTABLE_VERIFY_MAX_PROBLEMS = 100 // problems listed in verify result, more are counted only
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Verify and Repair
+//
+// VerifySSTable checks an SSTable file beyond what loading it checks - load
+// verifies the header, lookup table and index, while verify walks every
+// record and checks:
+//
+//   - records crc32 of V1, and block crc32 of every V2 block
+//   - each record decodes as util.MappedRecord, with a key and a valid group
+//   - records are strictly increasing by <key> + 0x00 + <group>, and within
+//     StartKey and EndKey of the header, the first and last at StartKey and
+//     EndKey
+//   - each record is found by Get - the mph lookup of V1, or the index and
+//     bloom filter of V2 - and the first record of each V2 block matches its
+//     index entry
+//   - number of records matches the header
+//
+// RepairSSTable salvages the records that decode and are in order into a new
+// SSTable file of the same version and attributes.
+//
+// A V1 file that fails to load with an intact header, e.g. a corrupted mph or
+// record offset table, is walked record by record by the encoded length of
+// each record - from the record position found by the length of each
+// section, or failing that, the first position with a record at StartKey the
+// walk reaches the records crc32 from.  Such records cannot be looked up, and
+// the walk stops at the first record that does not decode.  A file with a
+// corrupted header, or a V2 file with a corrupted footer or index, is neither
+// verified nor repaired.
+
+type SSTableVerifyResult struct {
+	filepath string
+	version  uint32
+	count    uint32 // record count of header
+	records  uint32 // records walked
+	valid    uint32 // records passing all checks
+	problems []string
+	dropped  int // problems beyond SSTABLE_VERIFY_MAX_PROBLEMS
+	// records to salvage, copied
+	salvaged []util.IRecord
+	// attributes of repaired file
+	consensus_id util.IConsensusID
+	domain       string
+	table        string
+	level        uint32
+	start_time   util.IConsensusTime
+	end_time     util.IConsensusTime
+}
+
+// verify SSTable file, returns error if the file cannot be loaded
+func VerifySSTable(filepath string) (*SSTableVerifyResult, error) {
+	return sstable_verify(filepath, false)
+}
+
+// verify SSTable file, and write records that decode and are in order to
+// output file - the output file is written even if no problem is found
+func RepairSSTable(filepath, output string) (*SSTableVerifyResult, error) {
+
+	if filepath == output {
+		return nil, fmt.Errorf("RepairSSTable - output is the input file")
+	}
+
+	result, err := sstable_verify(filepath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := NewSSTableBuilder(result.version, output, result.consensus_id, result.domain, result.table, result.level, result.start_time, result.end_time)
+	if err != nil {
+		return nil, fmt.Errorf("RepairSSTable - %s", err)
+	}
+
+	for _, r := range result.salvaged {
+		if err := b.Add(r); err != nil {
+			b.Abort()
+			return nil, fmt.Errorf("RepairSSTable - %s", err)
+		}
+	}
+
+	if err := b.Finish(); err != nil {
+		return nil, fmt.Errorf("RepairSSTable - %s", err)
+	}
+
+	return result, nil
+}
+
+func (v *SSTableVerifyResult) Filepath() string {
+	return v.filepath
+}
+
+func (v *SSTableVerifyResult) Version() uint32 {
+	return v.version
+}
+
+// record count of header
+func (v *SSTableVerifyResult) Count() uint32 {
+	return v.count
+}
+
+// records found in file, including invalid ones
+func (v *SSTableVerifyResult) Records() uint32 {
+	return v.records
+}
+
+// records passing all checks
+func (v *SSTableVerifyResult) Valid() uint32 {
+	return v.valid
+}
+
+// records salvaged by repair
+func (v *SSTableVerifyResult) Salvaged() uint32 {
+	return uint32(len(v.salvaged))
+}
+
+// problems found, up to SSTABLE_VERIFY_MAX_PROBLEMS
+func (v *SSTableVerifyResult) Problems() []string {
+	return append([]string{}, v.problems...)
+}
+
+// number of problems found, including those not listed
+func (v *SSTableVerifyResult) ProblemCount() int {
+	return len(v.problems) + v.dropped
+}
+
+func (v *SSTableVerifyResult) OK() bool {
+	return v.ProblemCount() == 0
+}
+
+func (v *SSTableVerifyResult) problem(format string, args ...interface{}) {
+	if len(v.problems) >= SSTABLE_VERIFY_MAX_PROBLEMS {
+		v.dropped += 1
+		return
+	}
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// state of a record walk
+type sstable_verifier struct {
+	table      ISSTable // nil if records are walked by length
+	start_key  util.IKey
+	end_key    util.IKey
+	result     *SSTableVerifyResult
+	salvage    bool
+	last_key   util.IKey
+	last_group string
+}
+
+func sstable_verify(filepath string, salvage bool) (*SSTableVerifyResult, error) {
+
+	table, err := LoadSSTable(filepath)
+	if err != nil {
+		return sstable_verify_records(filepath, salvage, err)
+	}
+	defer table.Close()
+
+	// copy consensus id, V1 attributes are mapped
+	consensus_id, err := util.NewMappedConsensusID(append([]byte{}, table.ConsensusID().Buf()...))
+	if err != nil {
+		return nil, fmt.Errorf("VerifySSTable - %s", err)
+	}
+
+	v := &sstable_verifier{
+		table:     table,
+		start_key: table.StartKey(),
+		end_key:   table.EndKey(),
+		salvage:   salvage,
+		result: &SSTableVerifyResult{
+			filepath:     filepath,
+			version:      table.Version(),
+			count:        table.Count(),
+			problems:     []string{},
+			salvaged:     []util.IRecord{},
+			consensus_id: consensus_id,
+			domain:       table.Domain(),
+			table:        table.Table(),
+			level:        table.Level(),
+			start_time:   table.StartTime(),
+			end_time:     table.EndTime(),
+		},
+	}
+
+	switch t := table.(type) {
+	case *SSTableV1:
+		v.walkV1(t)
+	case *SSTableV2:
+		v.walkV2(t)
+	default:
+		return nil, fmt.Errorf("VerifySSTable - unsupported version %d", table.Version())
+	}
+
+	return v.finish(), nil
+}
+
+// verify V1 file that fails to load, by walking records by length - returns
+// load error if the header is not intact, or records are not found
+func sstable_verify_records(filepath string, salvage bool, load_err error) (*SSTableVerifyResult, error) {
+
+	// read into memory, header attributes and records are decoded in place
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("VerifySSTable - %s", load_err)
+	}
+
+	h, pos, err := sstable_decode_header(data)
+	if err != nil || h.version != 1 || len(data) < pos+4 {
+		return nil, fmt.Errorf("VerifySSTable - %s", load_err)
+	}
+
+	// records are followed by records crc32
+	end := len(data) - 4
+	start, err := sstable_v1_record_pos(data[:end], pos, h.flags)
+	if err != nil || !sstable_v1_walk_length(data[start:end], h.start_key) {
+		if start, err = sstable_v1_scan_records(data[:end], pos, h.start_key); err != nil {
+			return nil, fmt.Errorf("VerifySSTable - %s - %s", load_err, err)
+		}
+	}
+
+	v := &sstable_verifier{
+		start_key: h.start_key,
+		end_key:   h.end_key,
+		salvage:   salvage,
+		result: &SSTableVerifyResult{
+			filepath:     filepath,
+			version:      h.version,
+			count:        h.count,
+			problems:     []string{},
+			salvaged:     []util.IRecord{},
+			consensus_id: h.consensus_id,
+			domain:       string(h.domain.Value()),
+			table:        string(h.table.Value()),
+			level:        h.level,
+			start_time:   h.start_time,
+			end_time:     h.end_time,
+		},
+	}
+	v.result.problem("%s", load_err)
+
+	records := data[start:end]
+	computed_crc32 := crc32.ChecksumIEEE(records)
+	records_crc32 := binary.BigEndian.Uint32(data[end:])
+	if computed_crc32 != records_crc32 {
+		v.result.problem("records crc32 checksum failed - computed %d vs records %d", computed_crc32, records_crc32)
+	}
+
+	for pos := 0; pos < len(records); {
+		r, length, err := sstable_v1_record_length(records[pos:])
+		v.check(fmt.Sprintf("record at %d", start+pos), r, err)
+		if err != nil {
+			v.result.problem("walk stopped at %d", start+pos)
+			break
+		}
+		pos += length
+	}
+
+	return v.finish(), nil
+}
+
+// position of V1 records by the length of the mph, record offset and bloom
+// sections, without checking their content
+func sstable_v1_record_pos(buf []byte, pos int, flags uint32) (int, error) {
+
+	_, length, err := util.NewMPHTable(buf[pos:])
+	if err != nil {
+		return pos, err
+	}
+	pos += length
+
+	if len(buf) < pos+4 {
+		return pos, fmt.Errorf("no record offset size")
+	}
+	// record offsets and mph crc32
+	pos += 4 + 4*int(binary.BigEndian.Uint32(buf[pos:])) + 4
+	if len(buf) < pos {
+		return pos, fmt.Errorf("no record offset data")
+	}
+
+	if flags&SSTABLE_FLAG_BLOOM != 0 {
+		if _, length, err = util.NewBloomFilter(buf[pos:]); err != nil {
+			return pos, err
+		}
+		// bloom and bloom crc32
+		pos += length + 4
+		if len(buf) < pos {
+			return pos, fmt.Errorf("no bloom crc32")
+		}
+	}
+
+	return pos, nil
+}
+
+// first position from pos that records are walked to the end of buf
+func sstable_v1_scan_records(buf []byte, pos int, start_key util.IKey) (int, error) {
+
+	for ; pos < len(buf); pos++ {
+		if sstable_v1_walk_length(buf[pos:], start_key) {
+			return pos, nil
+		}
+	}
+
+	return pos, fmt.Errorf("no records found by length")
+}
+
+// whether records walked by length start at start key, and end at the end
+// of buf
+func sstable_v1_walk_length(buf []byte, start_key util.IKey) bool {
+
+	for pos := 0; pos < len(buf); {
+		r, length, err := sstable_v1_record_length(buf[pos:])
+		if err != nil {
+			return false
+		} else if pos == 0 && !collection.IsNil(start_key) && !r.Key().Equal(start_key) {
+			return false
+		}
+		pos += length
+	}
+
+	return true
+}
+
+// decode a record at the start of buf, and return its encoded length
+func sstable_v1_record_length(buf []byte) (*util.MappedRecord, int, error) {
+
+	r, length, err := util.NewMappedRecord(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if length <= 0 || length > len(buf) {
+		return nil, 0, fmt.Errorf("invalid record length %d", length)
+	}
+	if collection.IsNil(r.Key()) {
+		return nil, 0, fmt.Errorf("record has no key")
+	}
+
+	// record is decoded from its own bytes
+	if r, _, err = util.NewMappedRecord(buf[:length]); err != nil {
+		return nil, 0, err
+	}
+
+	return r, length, nil
+}
+
+// check record count and last key of a walk
+func (v *sstable_verifier) finish() *SSTableVerifyResult {
+
+	result := v.result
+	if result.records != result.count {
+		result.problem("%d records found, header count %d", result.records, result.count)
+	}
+	if v.last_key != nil && !collection.IsNil(v.end_key) && !v.last_key.Equal(v.end_key) {
+		result.problem("last key %s is not end key %s", v.last_key.ToString(), v.end_key.ToString())
+	}
+
+	return result
+}
+
+// walk records of V1, by record offset table
+func (v *sstable_verifier) walkV1(t *SSTableV1) {
+
+	records := (*t.mmap_data)[t.record_start_pos:t.record_end_pos]
+	computed_crc32 := crc32.ChecksumIEEE(records)
+	records_crc32 := binary.BigEndian.Uint32((*t.mmap_data)[t.record_end_pos:])
+	if computed_crc32 != records_crc32 {
+		v.result.problem("records crc32 checksum failed - computed %d vs records %d", computed_crc32, records_crc32)
+	}
+
+	if len(t.record_offset) != int(t.count) {
+		v.result.problem("record offset size %d, header count %d", len(t.record_offset), t.count)
+	}
+
+	for n := range t.record_offset {
+		r, err := t.recordAt(uint32(n))
+		v.check(fmt.Sprintf("record [%d]", n), r, err)
+	}
+}
+
+// walk records of V2, block by block
+func (v *sstable_verifier) walkV2(t *SSTableV2) {
+
+	// read blocks from file
+	t.SetBlockCache(nil)
+
+	for b, block := range t.index {
+
+		records, _, err := t.readBlock(b)
+		if err != nil {
+			v.result.problem("block [%d] - %s", b, err)
+			continue
+		}
+
+		for i := range records.offsets {
+			name := fmt.Sprintf("block [%d] record [%d]", b, i)
+			r, err := records.recordAt(i)
+			if err == nil && i == 0 {
+				if group, e := RecordGroup(r); e == nil && (!r.Key().Equal(block.key) || group != block.group) {
+					v.result.problem("%s - key %s [%s] is not index key %s [%s]", name, r.Key().ToString(), group, block.key.ToString(), block.group)
+				}
+			}
+			v.check(name, r, err)
+		}
+	}
+}
+
+// check a walked record, and salvage it if it decodes and is in order
+func (v *sstable_verifier) check(name string, r *util.MappedRecord, err error) {
+
+	result := v.result
+	result.records += 1
+
+	if err != nil {
+		result.problem("%s - %s", name, err)
+		return
+	}
+
+	group, err := RecordGroup(r)
+	if err != nil {
+		result.problem("%s - %s", name, err)
+		return
+	}
+
+	key := r.Key()
+	if v.last_key != nil && sstable_compare(v.last_key, v.last_group, key, group) >= 0 {
+		result.problem("%s - key %s [%s] not after %s [%s]", name, key.ToString(), group, v.last_key.ToString(), v.last_group)
+		return
+	}
+
+	valid := true
+	start_key, end_key := v.start_key, v.end_key
+	if v.last_key == nil && !collection.IsNil(start_key) && !key.Equal(start_key) {
+		result.problem("%s - first key %s is not start key %s", name, key.ToString(), start_key.ToString())
+		valid = false
+	} else if (!collection.IsNil(start_key) && key.Compare(start_key) < 0) || (!collection.IsNil(end_key) && key.Compare(end_key) > 0) {
+		result.problem("%s - key %s out of range", name, key.ToString())
+		valid = false
+	}
+
+	// records walked by length have no lookup table to check
+	if v.table != nil {
+		if found, err := v.table.Get(key, group); err != nil {
+			result.problem("%s - get %s [%s] - %s", name, key.ToString(), group, err)
+			valid = false
+		} else if found == nil || !bytes.Equal(found.Buf(), r.Buf()) {
+			result.problem("%s - get %s [%s] does not find the record", name, key.ToString(), group)
+			valid = false
+		}
+	}
+
+	if valid {
+		result.valid += 1
+	}
+
+	// copy salvaged record, V1 records are mapped
+	copied, _, err := util.NewMappedRecord(append([]byte{}, r.Buf()...))
+	if err != nil {
+		result.problem("%s - %s", name, err)
+		return
+	}
+	v.last_key = copied.Key()
+	v.last_group = group
+	if v.salvage {
+		result.salvaged = append(result.salvaged, copied)
+	}
+}
@@ -0,0 +1,221 @@
+package pdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"../util"
+)
+
+func TestVerifySSTable(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := newTestV2Records()
+	buildTestSSTable(t, dir+"/v1.sst", newTestConsensusID(), records)
+	buildTestSSTableV2(t, dir+"/v2.sst", records, 512)
+
+	for _, path := range []string{dir + "/v1.sst", dir + "/v2.sst"} {
+		result, err := VerifySSTable(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.OK() || result.Records() != uint32(len(records)) || result.Valid() != uint32(len(records)) {
+			t.Errorf("%s: records %d valid %d problems %v", path, result.Records(), result.Valid(), result.Problems())
+		}
+	}
+
+	if _, err := VerifySSTable(dir + "/missing.sst"); err == nil {
+		t.Errorf("verify of missing file should fail")
+	}
+}
+
+func TestRepairSSTableV1(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := newTestV2Records()
+	path := dir + "/v1.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), records)
+
+	table, err := LoadSSTableV1(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record_pos := int(table.record_start_pos + table.record_offset[5])
+	table.Close()
+
+	// record body of the 6th record is corrupted
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[record_pos] = 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// loads, but fails verify
+	if table, err := LoadSSTable(path); err != nil {
+		t.Fatal(err)
+	} else {
+		table.Close()
+	}
+	result, err := VerifySSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK() || result.Valid() != uint32(len(records)-1) || result.ProblemCount() != 2 {
+		t.Errorf("valid %d problems %v", result.Valid(), result.Problems())
+	}
+
+	// salvaged records only miss the corrupted one
+	repaired := dir + "/repaired.sst"
+	result, err = RepairSSTable(path, repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Salvaged() != uint32(len(records)-1) {
+		t.Errorf("salvaged %d; want %d", result.Salvaged(), len(records)-1)
+	}
+	result, err = VerifySSTable(repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() || result.Version() != 1 || result.Count() != uint32(len(records)-1) {
+		t.Errorf("repaired version %d count %d problems %v", result.Version(), result.Count(), result.Problems())
+	}
+
+	if _, err := RepairSSTable(path, path); err == nil {
+		t.Errorf("repair onto input file should fail")
+	}
+}
+
+func TestRepairSSTableV2(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := newTestV2Records()
+	path := dir + "/v2.sst"
+	buildTestSSTableV2(t, path, records, 512)
+
+	table, err := LoadSSTableV2(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := table.index[1]
+	block_pos := int(table.data_pos + block.pos)
+	table.Close()
+
+	// second block is corrupted
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[block_pos+int(block.size)/2] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifySSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK() || result.Records() >= uint32(len(records)) || result.Valid() != result.Records() {
+		t.Errorf("records %d valid %d problems %v", result.Records(), result.Valid(), result.Problems())
+	}
+
+	// records of other blocks are salvaged
+	repaired := dir + "/repaired.sst"
+	result, err = RepairSSTable(path, repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Salvaged() != result.Records() {
+		t.Errorf("salvaged %d of %d", result.Salvaged(), result.Records())
+	}
+	verified, err := VerifySSTable(repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.OK() || verified.Version() != 2 || verified.Count() != result.Salvaged() {
+		t.Errorf("repaired version %d count %d problems %v", verified.Version(), verified.Count(), verified.Problems())
+	}
+}
+
+func TestRepairSSTableV1Lookup(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	records := newTestV2Records()
+	path := dir + "/v1.sst"
+	buildTestSSTable(t, path, newTestConsensusID(), records)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, header_size, err := sstable_decode_header(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mph_size, err := util.NewMPHTable(data[header_size:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset_pos := header_size + mph_size
+
+	// corrupted record offset, records found by section length, and corrupted
+	// record offset size, records found by scan
+	for n, pos := range []int{offset_pos + 4 + 4*5, offset_pos} {
+
+		corrupted := append([]byte{}, data...)
+		corrupted[pos] ^= 0x7f
+		input := fmt.Sprintf("%s/corrupted-%d.sst", dir, n)
+		if err := ioutil.WriteFile(input, corrupted, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSSTable(input); err == nil {
+			t.Fatalf("[%d] load of corrupted file should fail", n)
+		}
+
+		result, err := VerifySSTable(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.OK() || result.Records() != uint32(len(records)) || result.Valid() != uint32(len(records)) {
+			t.Errorf("[%d] records %d valid %d problems %v", n, result.Records(), result.Valid(), result.Problems())
+		}
+
+		repaired := fmt.Sprintf("%s/repaired-%d.sst", dir, n)
+		result, err = RepairSSTable(input, repaired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Salvaged() != uint32(len(records)) {
+			t.Errorf("[%d] salvaged %d; want %d", n, result.Salvaged(), len(records))
+		}
+		result, err = VerifySSTable(repaired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.OK() || result.Count() != uint32(len(records)) {
+			t.Errorf("[%d] repaired count %d problems %v", n, result.Count(), result.Problems())
+		}
+	}
+
+	// a corrupted header is not repaired
+	data[header_size-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifySSTable(path); err == nil {
+		t.Errorf("verify of corrupted header should fail")
+	}
+}
@@ -0,0 +1,136 @@
+package pdb
+
+import (
+	"../util"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// SSTable Writer
+//
+// sstable_writer writes sorted records of a merge - compaction output, or
+// records copied between shards - into SSTables, and starts a new file when
+// the current one is full:
+//
+//   - between keys, once a file reaches the split size or split records, so
+//     records of a key are kept in one file when possible
+//   - within a key, before a record exceeds the max size or max records of a
+//     file
+//
+// A key may hold more records than the headroom between split and max limits
+// allows - MVCC keeps a history record for every write of a key within the
+// history window.  Such a key continues in the next file, and the adjacent
+// files share the key with different groups.  Reads consult every file whose
+// key range holds a key, and merge records by key and group.
+
+type sstable_limits struct {
+	split_size    uint64 // split between keys when exceeding this size
+	split_records uint32 // split between keys when exceeding this count
+	max_size      uint64 // split within a key before exceeding this size
+	max_records   uint32 // split within a key before exceeding this count
+}
+
+type sstable_writer struct {
+	limits  sstable_limits
+	create  func() (ISSTableBuilder, error) // builder of the next file
+	builder ISSTableBuilder
+	start   util.IKey        // key of the first record of the current file
+	key     util.IKey        // key of the last record added
+	clear   bool             // whether any record of the current file is CLEAR
+	outputs []sstable_output // finished files, in order of creation
+}
+
+type sstable_output struct {
+	start util.IKey
+	end   util.IKey
+	clear bool // whether any record is CLEAR
+}
+
+// limits of SSTable files, with headroom for keys of MAX_ATTR_GROUPS records
+func new_sstable_limits() sstable_limits {
+	return sstable_limits{
+		split_size:    uint64(SSTABLE_MAX_FILE_SIZE) - COMPACTION_KEY_HEADROOM,
+		split_records: SSTABLE_MAX_RECORDS - util.MAX_ATTR_GROUPS,
+		max_size:      uint64(SSTABLE_MAX_FILE_SIZE),
+		max_records:   SSTABLE_MAX_RECORDS,
+	}
+}
+
+func new_sstable_writer(limits sstable_limits, create func() (ISSTableBuilder, error)) *sstable_writer {
+	return &sstable_writer{limits: limits, create: create}
+}
+
+// add a record - records must be added in sorted order
+func (w *sstable_writer) add(r util.IRecord) error {
+
+	if w.builder != nil && w.full(r) {
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+
+	if w.builder == nil {
+		b, err := w.create()
+		if err != nil {
+			return err
+		}
+		w.builder = b
+	}
+
+	if err := w.builder.Add(r); err != nil {
+		return err
+	}
+	if w.start == nil {
+		w.start = r.Key()
+	}
+	w.key = r.Key()
+	if record_is_clear(r) {
+		w.clear = true
+	}
+
+	return nil
+}
+
+// finish the current file, if any
+func (w *sstable_writer) finish() error {
+
+	if w.builder == nil {
+		return nil
+	}
+
+	err := w.builder.Finish()
+	if err == nil {
+		w.outputs = append(w.outputs, sstable_output{start: w.start, end: w.key, clear: w.clear})
+	}
+	w.builder = nil
+	w.start = nil
+	w.key = nil
+	w.clear = false
+
+	return err
+}
+
+// discard the current file, if any - files already finished are kept
+func (w *sstable_writer) abort() {
+	if w.builder != nil {
+		w.builder.Abort()
+		w.builder = nil
+		w.start = nil
+		w.key = nil
+		w.clear = false
+	}
+}
+
+// whether r goes to a new file
+func (w *sstable_writer) full(r util.IRecord) bool {
+
+	b := w.builder
+	if b.Count() >= w.limits.max_records || b.EstFileSize()+uint64(4+r.EstBufSize()) > w.limits.max_size || !b.Fits(r) {
+		return true
+	}
+
+	if w.key != nil && w.key.Equal(r.Key()) {
+		return false
+	}
+
+	return b.EstFileSize() >= w.limits.split_size || b.Count() >= w.limits.split_records
+}
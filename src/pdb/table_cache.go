@@ -0,0 +1,234 @@
+package pdb
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TABLE_CACHE_CAPACITY = 1000 // default max number of idle open SSTables
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Table Cache
+//
+// TableCache keeps SSTables open across reads, so a read does not open and
+// map every file of a table.  SSTables are opened lazily on Acquire, keyed by
+// file path, and reference counted - a table in use is never closed, and idle
+// tables are closed least recently used first when more than capacity tables
+// are open.  More than capacity tables may be open while in use.
+//
+// SSTable files are immutable, and a path is only reused after the file is
+// deleted - whoever deletes an SSTable file must Evict it first.  An evicted
+// table in use is closed when its last handle is released.
+
+type TableCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*table_cache_entry
+	lru      *list.List // idle tables, most recently used first
+	open     int        // open tables, including evicted ones in use
+}
+
+// handle of an SSTable in use, must be released after use
+type TableCacheHandle struct {
+	cache    *TableCache
+	entry    *table_cache_entry
+	released int32
+}
+
+type table_cache_entry struct {
+	path     string
+	table    ISSTable
+	size     uint64        // file size
+	refs     int           // handles in use
+	in_cache bool          // whether entry is in cache map
+	elem     *list.Element // position in lru, nil if in use or not in cache
+}
+
+var default_table_cache = NewTableCache(TABLE_CACHE_CAPACITY)
+
+// table cache shared by all manifests by default
+func DefaultTableCache() *TableCache {
+	return default_table_cache
+}
+
+func NewTableCache(capacity int) *TableCache {
+	return &TableCache{
+		capacity: capacity,
+		entries:  map[string]*table_cache_entry{},
+		lru:      list.New(),
+	}
+}
+
+// SSTable of file path, opened if not in cache
+func (c *TableCache) Acquire(path string) (*TableCacheHandle, error) {
+
+	c.mutex.Lock()
+	if e, ok := c.entries[path]; ok {
+		c.pin(e)
+		c.mutex.Unlock()
+		return &TableCacheHandle{cache: c, entry: e}, nil
+	}
+	c.mutex.Unlock()
+
+	// open without holding mutex
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := LoadSSTable(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+
+	// opened by another reader meanwhile
+	if e, ok := c.entries[path]; ok {
+		c.pin(e)
+		c.mutex.Unlock()
+		table.Close()
+		return &TableCacheHandle{cache: c, entry: e}, nil
+	}
+
+	e := &table_cache_entry{path: path, table: table, size: uint64(info.Size()), refs: 1, in_cache: true}
+	c.entries[path] = e
+	c.open += 1
+	closing := c.evict()
+	c.mutex.Unlock()
+
+	c.close(closing)
+
+	return &TableCacheHandle{cache: c, entry: e}, nil
+}
+
+// drop SSTable of file path from cache, closed now if idle, or when released
+func (c *TableCache) Evict(path string) {
+
+	c.mutex.Lock()
+	closing := []*table_cache_entry{}
+	if e, ok := c.entries[path]; ok {
+		if c.remove(e) {
+			closing = append(closing, e)
+		}
+	}
+	c.mutex.Unlock()
+
+	c.close(closing)
+}
+
+// drop all SSTables from cache
+func (c *TableCache) EvictAll() {
+
+	c.mutex.Lock()
+	closing := []*table_cache_entry{}
+	for _, e := range c.entries {
+		if c.remove(e) {
+			closing = append(closing, e)
+		}
+	}
+	c.mutex.Unlock()
+
+	c.close(closing)
+}
+
+// number of open SSTables
+func (c *TableCache) Open() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.open
+}
+
+// number of SSTables in use
+func (c *TableCache) InUse() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.open - c.lru.Len()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// TableCacheHandle
+
+func (h *TableCacheHandle) Table() ISSTable {
+	return h.entry.table
+}
+
+// size of SSTable file
+func (h *TableCacheHandle) Size() uint64 {
+	return h.entry.size
+}
+
+// release the SSTable, the handle and table must not be used after release
+func (h *TableCacheHandle) Release() {
+
+	if h == nil || !atomic.CompareAndSwapInt32(&h.released, 0, 1) {
+		return
+	}
+
+	c := h.cache
+	c.mutex.Lock()
+
+	e := h.entry
+	e.refs -= 1
+	closing := []*table_cache_entry{}
+	if e.refs == 0 {
+		if e.in_cache {
+			e.elem = c.lru.PushFront(e)
+			closing = c.evict()
+		} else {
+			c.open -= 1
+			closing = append(closing, e)
+		}
+	}
+	c.mutex.Unlock()
+
+	c.close(closing)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities, mutex must be held unless noted
+
+func (c *TableCache) pin(e *table_cache_entry) {
+	if e.refs == 0 && e.elem != nil {
+		c.lru.Remove(e.elem)
+		e.elem = nil
+	}
+	e.refs += 1
+}
+
+// remove entry from cache, returns whether the entry is idle and to be closed
+func (c *TableCache) remove(e *table_cache_entry) bool {
+	delete(c.entries, e.path)
+	e.in_cache = false
+	if e.refs > 0 {
+		return false
+	}
+	if e.elem != nil {
+		c.lru.Remove(e.elem)
+		e.elem = nil
+	}
+	c.open -= 1
+	return true
+}
+
+// remove least recently used idle entries over capacity, returns entries to be closed
+func (c *TableCache) evict() []*table_cache_entry {
+	closing := []*table_cache_entry{}
+	for c.open > c.capacity && c.lru.Len() > 0 {
+		e := c.lru.Back().Value.(*table_cache_entry)
+		c.remove(e)
+		closing = append(closing, e)
+	}
+	return closing
+}
+
+// close tables of removed entries, without holding mutex
+func (c *TableCache) close(entries []*table_cache_entry) {
+	for _, e := range entries {
+		e.table.Close()
+	}
+}
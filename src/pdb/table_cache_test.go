@@ -0,0 +1,243 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"../util"
+)
+
+func TestTableCache(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	paths := []string{}
+	for i := 0; i < 4; i++ {
+		path := fmt.Sprintf("%s/%d.sst", dir, i)
+		buildTestSSTable(t, path, newTestConsensusID(), []util.IRecord{newTestRecord(fmt.Sprintf("key%d", i), "v")})
+		paths = append(paths, path)
+	}
+
+	c := NewTableCache(2)
+
+	// tables in use are kept open over capacity
+	handles := []*TableCacheHandle{}
+	for _, path := range paths {
+		h, err := c.Acquire(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, h)
+	}
+	if c.Open() != 4 || c.InUse() != 4 {
+		t.Errorf("open %d in use %d; want 4, 4", c.Open(), c.InUse())
+	}
+
+	// same table for the same path
+	h, err := c.Acquire(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Table() != handles[0].Table() || h.Size() == 0 {
+		t.Errorf("table of path not shared")
+	}
+	h.Release()
+	h.Release()
+
+	// idle tables over capacity closed, least recently used first
+	for _, h := range handles {
+		h.Release()
+	}
+	if c.Open() != 2 || c.InUse() != 0 {
+		t.Errorf("open %d in use %d; want 2, 0", c.Open(), c.InUse())
+	}
+	if _, err := handles[0].Table().Get(newTestKey("key0"), ""); err == nil {
+		t.Errorf("least recently used table not closed")
+	}
+	if r, err := handles[3].Table().Get(newTestKey("key3"), ""); err != nil || r == nil {
+		t.Errorf("recently used table closed: %v %v", r, err)
+	}
+
+	// evicted table in use is closed when released
+	h, err = c.Acquire(paths[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Evict(paths[3])
+	if r, err := h.Table().Get(newTestKey("key3"), ""); err != nil || r == nil {
+		t.Errorf("evicted table in use closed: %v %v", r, err)
+	}
+	if c.Open() != 2 {
+		t.Errorf("open %d; want 2", c.Open())
+	}
+	h.Release()
+	if _, err := h.Table().Get(newTestKey("key3"), ""); err == nil {
+		t.Errorf("evicted table not closed on release")
+	}
+	if c.Open() != 1 {
+		t.Errorf("open %d; want 1", c.Open())
+	}
+
+	// missing file
+	if _, err := c.Acquire(dir + "/missing.sst"); err == nil {
+		t.Errorf("acquire of missing file should fail")
+	}
+
+	c.EvictAll()
+	if c.Open() != 0 {
+		t.Errorf("open %d after evict all", c.Open())
+	}
+}
+
+func TestTableCacheConcurrent(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	paths := []string{}
+	for i := 0; i < 8; i++ {
+		path := fmt.Sprintf("%s/%d.sst", dir, i)
+		buildTestSSTable(t, path, newTestConsensusID(), []util.IRecord{newTestRecord(fmt.Sprintf("key%d", i), "v")})
+		paths = append(paths, path)
+	}
+
+	c := NewTableCache(3)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				n := (g + i) % len(paths)
+				h, err := c.Acquire(paths[n])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if r, err := h.Table().Get(newTestKey(fmt.Sprintf("key%d", n)), ""); err != nil || r == nil {
+					t.Errorf("get of table %d: %v %v", n, r, err)
+				}
+				h.Release()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if c.Open() > 3 || c.InUse() != 0 {
+		t.Errorf("open %d in use %d", c.Open(), c.InUse())
+	}
+}
+
+func TestTableCacheManifest(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTableCache(TABLE_CACHE_CAPACITY)
+	manifest.SetTableCache(c)
+
+	consensus_id := newTestConsensusID()
+	for i := 0; i < COMPACTION_L0_TRIGGER; i++ {
+		addTestSSTable(t, manifest, consensus_id, 0, []util.IRecord{newTestTimestampRecord(fmt.Sprintf("key%03d", i), "v", 1)})
+	}
+
+	// picking compaction inputs opens no table
+	version := manifest.Current()
+	levels, err := compaction_load(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version.Release()
+	if c.Open() != 0 {
+		t.Errorf("open %d after load; want 0", c.Open())
+	}
+
+	// tables stay open across reads
+	for i := 0; i < 2; i++ {
+		version := manifest.Current()
+		levels, err := compaction_load(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := compaction_acquire(manifest, levels); err != nil {
+			t.Fatal(err)
+		}
+		compaction_close(levels)
+		version.Release()
+	}
+	if c.Open() != COMPACTION_L0_TRIGGER || c.InUse() != 0 {
+		t.Errorf("open %d in use %d; want %d, 0", c.Open(), c.InUse(), COMPACTION_L0_TRIGGER)
+	}
+
+	// compacted files are evicted before deleted
+	if compacted, err := NewCompactor(manifest).Compact(); err != nil || !compacted {
+		t.Fatalf("compact: %v %v", compacted, err)
+	}
+	if c.Open() != 0 {
+		t.Errorf("open %d after compaction; want 0", c.Open())
+	}
+
+	// files of manifest evicted on close
+	version = manifest.Current()
+	levels, err = compaction_load(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compaction_acquire(manifest, levels); err != nil {
+		t.Fatal(err)
+	}
+	compaction_close(levels)
+	version.Release()
+	if c.Open() != len(manifest.Files()) {
+		t.Errorf("open %d; want %d", c.Open(), len(manifest.Files()))
+	}
+	manifest.Close()
+	if c.Open() != 0 {
+		t.Errorf("open %d after manifest close", c.Open())
+	}
+}
+
+func TestTableCacheCompactionInputs(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+	c := NewTableCache(TABLE_CACHE_CAPACITY)
+	manifest.SetTableCache(c)
+
+	// oldest level 1 file overlaps one level 2 file
+	consensus_id := newTestConsensusID()
+	for _, key := range []string{"b", "d", "f"} {
+		addTestSSTable(t, manifest, consensus_id, 1, []util.IRecord{newTestTimestampRecord(key, "v1", 1)})
+	}
+	for _, key := range []string{"a", "b", "e"} {
+		addTestSSTable(t, manifest, consensus_id, 2, []util.IRecord{newTestTimestampRecord(key, "v2", 1)})
+	}
+
+	compactor := NewCompactor(manifest)
+	compactor.level_base_size = 1
+	if compacted, err := compactor.Compact(); err != nil || !compacted {
+		t.Fatalf("compact: %v %v", compacted, err)
+	}
+
+	// inputs are evicted with their files, other files are never opened
+	if c.Open() != 0 || c.InUse() != 0 {
+		t.Errorf("open %d in use %d after compaction; want 0, 0", c.Open(), c.InUse())
+	}
+	if got := testManifestFiles(manifest.Files()); got != "[1:2 1:3 2:4 2:6 2:7]" {
+		t.Errorf("files %s; want [1:2 1:3 2:4 2:6 2:7]", got)
+	}
+}
@@ -1,6 +1,10 @@
 package pdb
 
 import (
+	"fmt"
+	"sort"
+
+	"../collection"
 	"../util"
 )
 
@@ -11,11 +15,761 @@ type ITablet interface {
 	Domain() string                 // Domain Name
 	Table() string                  // Table Name
 	// operations
-	Get(key, scheme util.IData) util.IRecord
-	Set(record util.IRecord) error
-	Groups(key, scheme util.IData) []string
-	Keys(key, scheme util.IData) []util.IData
+	Get(key util.IKey, group string) (util.IRecord, error) // get record with specified key and attribute group
+	Set(time util.IConsensusTime, record util.IRecord) error
+	TestSet(time util.IConsensusTime, record util.IRecord, test_millis uint32) error // set record if test passes
+	Groups(key util.IKey) ([]string, error)
+	Keys(key util.IKey) ([]util.IKey, error)
+	// reads as of consensus time
+	GetAsOf(key util.IKey, group string, time util.IConsensusTime) (util.IRecord, error)
+	KeysAsOf(key util.IKey, time util.IConsensusTime) ([]util.IKey, error)
+	// point in time view
+	Snapshot(time util.IConsensusTime) (*TabletSnapshot, error)
+	// bulk load
+	IngestSSTables(paths []string) error // add externally built SSTables atomically
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// Tablet
+//
+// Tablet is the view of one table of a pdb - the active memtable, immutable
+// memtables waiting for flush, and the leveled SSTables - read as one:
+//
+//   active memtable ---> immutable memtables ---> level 0 ---> level 1 ... n
+//       newest                                                    oldest
+//
+// Reads of a Tablet see the latest state, and may observe writes and
+// compactions in progress.  A view of the tablet finds SSTables by the level
+// and key range recorded in the manifest - a point lookup probes the level 0
+// files holding the key, and a binary search of each deeper level - and opens
+// only the files probed, through the table cache of the manifest.  A table is
+// acquired for one probe or one iteration, and released right after, so idle
+// tables may be evicted while a view or snapshot is held.
+//
+// A TabletSnapshot is pinned to a consensus time and a journal seq, and keeps
+// seeing the tablet as of the time - the SSTables are held by a manifest
+// version reference until Release, and the memtables are kept without rotating
+// the active one.  Snapshot reads are served from history versions at or
+// before the time, and versions written to memtables from the pinned seq on
+// are skipped, so the snapshot sees neither later writes, nor writes at or
+// before the time that arrive after the snapshot is taken.
+
 type Tablet struct {
+	pdb   *PdbV1
+	table string
+}
+
+// point in time view of a tablet, must be released after use
+type TabletSnapshot struct {
+	table string
+	time  util.IConsensusTime
+	view  *tablet_view
+}
+
+// memtables and SSTables read together
+type tablet_view struct {
+	memtables  []*MemTableV1    // newest first
+	before_seq uint64           // history of memtables from this journal seq on is skipped, 0 to see all
+	version    *ManifestVersion // nil if table has no SSTable
+	levels     [][]ManifestFile // level 0 newest first, other levels sorted by start key
+}
+
+func (t *Tablet) Version() uint32 {
+	return 1
+}
+
+func (t *Tablet) ConsensusID() util.IConsensusID {
+	return t.pdb.consensus_id
+}
+
+func (t *Tablet) Domain() string {
+	return t.pdb.domain
+}
+
+func (t *Tablet) Table() string {
+	return t.table
+}
+
+// set record at consensus time, returns after record is durable in journal
+func (t *Tablet) Set(time util.IConsensusTime, record util.IRecord) error {
+
+	if collection.IsNil(time) {
+		return fmt.Errorf("Tablet::Set - time is nil")
+	}
+
+	lock := t.pdb.lock(t.table)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return t.pdb.flusher.Write(t.table, time, []util.IRecord{record})
+}
+
+// set record at consensus time if it passes the test against the current
+// record, returns *TestConflictError if the test fails
+func (t *Tablet) TestSet(time util.IConsensusTime, record util.IRecord, test_millis uint32) error {
+
+	if collection.IsNil(time) {
+		return fmt.Errorf("Tablet::TestSet - time is nil")
+	}
+	if collection.IsNil(record) || collection.IsNil(record.Key()) {
+		return fmt.Errorf("Tablet::TestSet - record or key is nil")
+	}
+
+	group, err := RecordGroup(record)
+	if err != nil {
+		return fmt.Errorf("Tablet::TestSet - %s", err)
+	}
+
+	// no other write of the table between test and set
+	lock := t.pdb.lock(t.table)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, err := t.Get(record.Key(), group)
+	if err != nil {
+		return fmt.Errorf("Tablet::TestSet - %s", err)
+	}
+
+	write, err := test_record(t.table, group, current, record, test_millis)
+	if err != nil || !write {
+		return err
+	}
+
+	return t.pdb.flusher.Write(t.table, time, []util.IRecord{record})
+}
+
+// get record with specified key and group, return nil if not found
+func (t *Tablet) Get(key util.IKey, group string) (util.IRecord, error) {
+
+	view, err := t.view()
+	if err != nil {
+		return nil, fmt.Errorf("Tablet::Get - %s", err)
+	}
+	defer view.release()
+
+	return view.get(key, group)
+}
+
+// list of groups under specified key, maximum MAX_ATTR_GROUPS groups
+func (t *Tablet) Groups(key util.IKey) ([]string, error) {
+
+	view, err := t.view()
+	if err != nil {
+		return nil, fmt.Errorf("Tablet::Groups - %s", err)
+	}
+	defer view.release()
+
+	return view.groups(key)
+}
+
+// list of child keys with specified key as prefix
+func (t *Tablet) Keys(key util.IKey) ([]util.IKey, error) {
+
+	view, err := t.view()
+	if err != nil {
+		return nil, fmt.Errorf("Tablet::Keys - %s", err)
+	}
+	defer view.release()
+
+	return view.keys(key)
+}
+
+// get record with specified key and group as of consensus time, return nil
+// if not found or cleared at the time
+func (t *Tablet) GetAsOf(key util.IKey, group string, time util.IConsensusTime) (util.IRecord, error) {
+
+	if collection.IsNil(time) {
+		return nil, fmt.Errorf("Tablet::GetAsOf - time is nil")
+	}
+	if t.pdb.history_window == 0 {
+		return nil, fmt.Errorf("Tablet::GetAsOf - history is disabled")
+	}
+
+	view, err := t.view()
+	if err != nil {
+		return nil, fmt.Errorf("Tablet::GetAsOf - %s", err)
+	}
+	defer view.release()
+
+	return view.getAsOf(key, group, time)
+}
+
+// list of child keys with specified key as prefix, as of consensus time
+func (t *Tablet) KeysAsOf(key util.IKey, time util.IConsensusTime) ([]util.IKey, error) {
+
+	if collection.IsNil(time) {
+		return nil, fmt.Errorf("Tablet::KeysAsOf - time is nil")
+	}
+	if t.pdb.history_window == 0 {
+		return nil, fmt.Errorf("Tablet::KeysAsOf - history is disabled")
+	}
+
+	view, err := t.view()
+	if err != nil {
+		return nil, fmt.Errorf("Tablet::KeysAsOf - %s", err)
+	}
+	defer view.release()
+
+	return view.keysAsOf(key, time)
+}
+
+// snapshot of tablet with all writes up to consensus time applied so far,
+// writes after the snapshot are not seen - reads as of a time before the
+// history window may miss versions, see MVCC
+func (t *Tablet) Snapshot(time util.IConsensusTime) (*TabletSnapshot, error) {
+
+	if collection.IsNil(time) {
+		return nil, fmt.Errorf("Tablet::Snapshot - time is nil")
+	}
+	if t.pdb.history_window == 0 {
+		return nil, fmt.Errorf("Tablet::Snapshot - history is disabled")
+	}
+
+	// memtables first, same as view
+	memtables, seq, err := t.pdb.flusher.Pin(t.table)
+	if err != nil {
+		return nil, fmt.Errorf("Tablet::Snapshot - %s", err)
+	}
+
+	view, err := tablet_open_view(memtables, t.pdb.flusher.Manifest(t.table))
+	if err != nil {
+		return nil, fmt.Errorf("Tablet::Snapshot - %s", err)
+	}
+	view.before_seq = seq
+
+	return &TabletSnapshot{table: t.table, time: time, view: view}, nil
+}
+
+// current memtables and SSTables
+func (t *Tablet) view() (*tablet_view, error) {
+	// memtables first - a memtable flushed meanwhile is then seen twice, but
+	// never missed
+	return tablet_open_view(t.pdb.flusher.Memtables(t.table), t.pdb.flusher.Manifest(t.table))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// TabletSnapshot
+
+func (s *TabletSnapshot) Table() string {
+	return s.table
+}
+
+// consensus time the snapshot is pinned to
+func (s *TabletSnapshot) Time() util.IConsensusTime {
+	return s.time
+}
+
+func (s *TabletSnapshot) Get(key util.IKey, group string) (util.IRecord, error) {
+	if s.view == nil {
+		return nil, fmt.Errorf("TabletSnapshot::Get - snapshot released")
+	}
+	return s.view.getAsOf(key, group, s.time)
+}
+
+func (s *TabletSnapshot) Groups(key util.IKey) ([]string, error) {
+	if s.view == nil {
+		return nil, fmt.Errorf("TabletSnapshot::Groups - snapshot released")
+	}
+	return s.view.groupsAsOf(key, s.time)
+}
+
+func (s *TabletSnapshot) Keys(key util.IKey) ([]util.IKey, error) {
+	if s.view == nil {
+		return nil, fmt.Errorf("TabletSnapshot::Keys - snapshot released")
+	}
+	return s.view.keysAsOf(key, s.time)
+}
+
+// release SSTables held by the snapshot
+func (s *TabletSnapshot) Release() {
+	if s.view != nil {
+		s.view.release()
+		s.view = nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tablet_view
+
+// files of current manifest version by level, manifest may be nil - SSTables
+// are opened when read
+func tablet_open_view(memtables []*MemTableV1, manifest *ManifestV1) (*tablet_view, error) {
+
+	view := &tablet_view{memtables: memtables}
+	if manifest == nil {
+		return view, nil
+	}
+
+	view.version = manifest.Current()
+	view.levels = make([][]ManifestFile, COMPACTION_MAX_LEVELS)
+
+	for _, file := range view.version.Files() {
+
+		if file.level >= COMPACTION_MAX_LEVELS {
+			view.release()
+			return nil, fmt.Errorf("tablet_open_view - file %d level %d exceeding %d", file.num, file.level, COMPACTION_MAX_LEVELS)
+		}
+
+		// key range not in manifest is read from the file
+		if !file.HasRange() {
+			handle, err := view.acquire(file)
+			if err != nil {
+				view.release()
+				return nil, err
+			}
+			empty := handle.Table().Count() == 0
+			if !empty {
+				file, err = NewManifestTableFile(file.level, file.num, handle.Table(), handle.Size())
+			}
+			handle.Release()
+			if err != nil {
+				view.release()
+				return nil, err
+			} else if empty {
+				continue
+			}
+		}
+
+		view.levels[file.level] = append(view.levels[file.level], file)
+	}
+
+	sort.Slice(view.levels[0], func(a, b int) bool { return view.levels[0][a].num > view.levels[0][b].num })
+	for _, files := range view.levels[1:] {
+		files := files
+		sort.Slice(files, func(a, b int) bool { return files[a].start.Compare(files[b].start) < 0 })
+	}
+
+	return view, nil
+}
+
+func (v *tablet_view) release() {
+	if v.version != nil {
+		v.version.Release()
+		v.version = nil
+	}
+}
+
+// SSTable of a file from table cache, must be released after the probe -
+// records read must be copied before release
+func (v *tablet_view) acquire(file ManifestFile) (*TableCacheHandle, error) {
+	return v.version.manifest.tables.Acquire(v.version.FilePath(file.num))
+}
+
+// files which may hold the key, newest first - level 0 files holding the key
+// in their range, then the files of each deeper level found by binary search
+func (v *tablet_view) probe(key util.IKey) []ManifestFile {
+
+	result := []ManifestFile{}
+	for level, files := range v.levels {
+		if level == 0 {
+			for _, file := range files {
+				if file.start.Compare(key) <= 0 && file.end.Compare(key) >= 0 {
+					result = append(result, file)
+				}
+			}
+			continue
+		}
+		// files of level 1 and above do not overlap, except adjacent files
+		// sharing a key with different groups
+		for i := tablet_search(files, key); i < len(files) && files[i].start.Compare(key) <= 0; i++ {
+			result = append(result, files[i])
+		}
+	}
+
+	return result
+}
+
+// files which may hold keys with specified prefix, all files if prefix is nil
+func (v *tablet_view) probePrefix(prefix util.IKey) []ManifestFile {
+
+	result := []ManifestFile{}
+	for level, files := range v.levels {
+		if collection.IsNil(prefix) {
+			result = append(result, files...)
+			continue
+		}
+		// keys with the prefix sort together, from the prefix itself
+		overlaps := func(file ManifestFile) bool {
+			return file.start.Compare(prefix) <= 0 || keyHasPrefix(file.start, prefix)
+		}
+		if level == 0 {
+			for _, file := range files {
+				if file.end.Compare(prefix) >= 0 && overlaps(file) {
+					result = append(result, file)
+				}
+			}
+			continue
+		}
+		for i := tablet_search(files, prefix); i < len(files) && overlaps(files[i]); i++ {
+			result = append(result, files[i])
+		}
+	}
+
+	return result
+}
+
+// memtables then SSTables newest first, the first record found wins
+func (v *tablet_view) get(key util.IKey, group string) (util.IRecord, error) {
+
+	if collection.IsNil(key) {
+		return nil, fmt.Errorf("tablet_view::get - key is nil")
+	}
+
+	for _, m := range v.memtables {
+		r, err := m.Get(key, group)
+		if err != nil {
+			return nil, err
+		} else if r != nil {
+			return tablet_visible(r)
+		}
+	}
+
+	for _, file := range v.probe(key) {
+		r, found, err := v.getFile(file, key, group)
+		if err != nil || found {
+			return r, err
+		}
+	}
+
+	return nil, nil
+}
+
+// record of key and group in a file, copied before the table is released -
+// returns whether the file holds the key and group, nil record if cleared
+func (v *tablet_view) getFile(file ManifestFile, key util.IKey, group string) (util.IRecord, bool, error) {
+
+	handle, err := v.acquire(file)
+	if err != nil {
+		return nil, false, err
+	}
+	defer handle.Release()
+
+	// Get consults the bloom filter of the file before mph and records
+	r, err := handle.Table().Get(key, group)
+	if err != nil || r == nil {
+		return nil, false, err
+	}
+
+	r, err = tablet_visible(r)
+
+	return r, true, err
+}
+
+func (v *tablet_view) groups(key util.IKey) ([]string, error) {
+
+	if collection.IsNil(key) {
+		return nil, fmt.Errorf("tablet_view::groups - key is nil")
+	}
+
+	iter, release, err := v.prefixIterator(key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	result := []string{}
+	for iter.HasNext() && len(result) < util.MAX_ATTR_GROUPS {
+		r := iter.Next()
+		// records of the key come before its child keys
+		if !r.Key().Equal(key) {
+			break
+		}
+		if record_is_clear(r) {
+			continue
+		}
+		group, err := RecordGroup(r)
+		if err != nil {
+			return nil, err
+		} else if group_is_history(group) {
+			continue
+		}
+		result = append(result, group)
+	}
+
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+
+	return result, nil
+}
+
+func (v *tablet_view) keys(key util.IKey) ([]util.IKey, error) {
+
+	iter, release, err := v.prefixIterator(key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	result := []util.IKey{}
+	for iter.HasNext() {
+		r := iter.Next()
+		// skip the key itself, cleared records, and history
+		if !collection.IsNil(key) && len(r.Key().Key()) <= len(key.Key()) {
+			continue
+		}
+		if live, err := record_is_live(r); err != nil {
+			return nil, err
+		} else if !live {
+			continue
+		}
+		// skip other groups of the same key
+		if len(result) > 0 && result[len(result)-1].Equal(r.Key()) {
+			continue
+		}
+		k, _, err := util.NewMappedKey(append([]byte{}, r.Key().Buf()...))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, k)
+	}
+
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+
+	return result, nil
+}
+
+// newest version of each group of key at or before time - records of the
+// versions are held until release is called
+func (v *tablet_view) versionsAsOf(key util.IKey, time util.IConsensusTime) (*history_versions, func(), error) {
+
+	iter, release, err := v.prefixIterator(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	versions := new_history_versions(time)
+	for iter.HasNext() {
+		r := iter.Next()
+		// records of the key come before its child keys
+		if !r.Key().Equal(key) {
+			break
+		}
+		if _, err := versions.add(r); err != nil {
+			release()
+			return nil, nil, err
+		}
+	}
+
+	if iter.Error() != nil {
+		release()
+		return nil, nil, iter.Error()
+	}
+
+	return versions, release, nil
+}
+
+// newest version of key and group at or before time
+func (v *tablet_view) getAsOf(key util.IKey, group string, time util.IConsensusTime) (util.IRecord, error) {
+
+	if collection.IsNil(key) {
+		return nil, fmt.Errorf("tablet_view::getAsOf - key is nil")
+	}
+
+	versions, release, err := v.versionsAsOf(key, time)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	version, ok := versions.versions[group]
+	if !ok {
+		return nil, nil
+	}
+
+	r, err := history_original(versions.records[group], version)
+	if err != nil || r == nil {
+		return nil, err
+	}
+
+	return tablet_visible(r)
+}
+
+// groups of key not cleared as of time, maximum MAX_ATTR_GROUPS groups
+func (v *tablet_view) groupsAsOf(key util.IKey, time util.IConsensusTime) ([]string, error) {
+
+	if collection.IsNil(key) {
+		return nil, fmt.Errorf("tablet_view::groupsAsOf - key is nil")
+	}
+
+	versions, release, err := v.versionsAsOf(key, time)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	result := []string{}
+	for group, version := range versions.versions {
+		if !version.clear {
+			result = append(result, group)
+		}
+	}
+	sort.Strings(result)
+	if len(result) > util.MAX_ATTR_GROUPS {
+		result = result[:util.MAX_ATTR_GROUPS]
+	}
+
+	return result, nil
+}
+
+// child keys with any group not cleared as of time
+func (v *tablet_view) keysAsOf(key util.IKey, time util.IConsensusTime) ([]util.IKey, error) {
+
+	iter, release, err := v.prefixIterator(key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	result := []util.IKey{}
+	var current util.IKey
+	var versions *history_versions
+
+	// add current key if it exists as of time
+	done := func() error {
+		if current == nil || !versions.exists() {
+			return nil
+		}
+		k, _, err := util.NewMappedKey(append([]byte{}, current.Buf()...))
+		if err != nil {
+			return err
+		}
+		result = append(result, k)
+		return nil
+	}
+
+	for iter.HasNext() {
+		r := iter.Next()
+		// skip the key itself
+		if !collection.IsNil(key) && len(r.Key().Key()) <= len(key.Key()) {
+			continue
+		}
+		if current == nil || !current.Equal(r.Key()) {
+			if err := done(); err != nil {
+				return nil, err
+			}
+			current = r.Key()
+			versions = new_history_versions(time)
+		}
+		if _, err := versions.add(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if iter.Error() != nil {
+		return nil, iter.Error()
+	}
+
+	if err := done(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// merged iterator of records with specified key as prefix, newest first - the
+// tables iterated are held until release is called, and records must be
+// copied before release
+func (v *tablet_view) prefixIterator(key util.IKey) (ISSTableIterator, func(), error) {
+
+	iters := []ISSTableIterator{}
+	for _, m := range v.memtables {
+		var iter ISSTableIterator = m.PrefixIterator(key)
+		if v.before_seq != 0 {
+			iter = &tablet_seq_iterator{iter: iter, before_seq: v.before_seq}
+		}
+		iters = append(iters, iter)
+	}
+
+	handles := []*TableCacheHandle{}
+	release := func() {
+		for _, handle := range handles {
+			handle.Release()
+		}
+	}
+	for _, file := range v.probePrefix(key) {
+		handle, err := v.acquire(file)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		handles = append(handles, handle)
+		iters = append(iters, handle.Table().PrefixIterator(key))
+	}
+
+	return NewMergeIterator(iters), release, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tablet_seq_iterator
+//
+// tablet_seq_iterator skips history records of a memtable written from a
+// journal seq on - other records are returned, and are not read as of time.
+
+type tablet_seq_iterator struct {
+	iter       ISSTableIterator
+	before_seq uint64
+	err        error
+}
+
+func (i *tablet_seq_iterator) Next() util.IRecord {
+	if !i.HasNext() {
+		return nil
+	}
+	return i.iter.Next()
+}
+
+func (i *tablet_seq_iterator) HasNext() bool {
+	for i.err == nil && i.iter.HasNext() {
+		v, err := record_history(i.iter.Peek())
+		if err != nil {
+			i.err = err
+			return false
+		}
+		if v == nil || v.seq < i.before_seq {
+			return true
+		}
+		i.iter.Next()
+	}
+	return false
+}
+
+func (i *tablet_seq_iterator) Peek() util.IRecord {
+	if !i.HasNext() {
+		return nil
+	}
+	return i.iter.Peek()
+}
+
+func (i *tablet_seq_iterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// utilities
+
+// copy of record, nil if record is a tombstone - copies remain valid after
+// SSTables are closed
+func tablet_visible(r util.IRecord) (util.IRecord, error) {
+
+	if record_is_clear(r) {
+		return nil, nil
+	}
+
+	copied, _, err := util.NewMappedRecord(append([]byte{}, r.Buf()...))
+	if err != nil {
+		return nil, err
+	}
+
+	return copied, nil
+}
+
+// index of the first file with end key not before key, files sorted by start key
+func tablet_search(files []ManifestFile, key util.IKey) int {
+	return sort.Search(len(files), func(i int) bool { return files[i].end.Compare(key) >= 0 })
 }
@@ -0,0 +1,211 @@
+package pdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"../util"
+)
+
+func TestTabletSnapshot(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := OpenPdbV1(dir, newTestConsensusID(), "test.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tablet, err := p.Tablet("table")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flushed and unflushed records at time 1
+	for k := 0; k < 10; k++ {
+		if err := tablet.Set(util.NewLedgerTime(1), newTestRecord(fmt.Sprintf("key%03d", k), "v1")); err != nil {
+			t.Fatal(err)
+		}
+		if k == 4 {
+			if err := p.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	snapshot, err := tablet.Snapshot(util.NewLedgerTime(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	// active memtable is not rotated
+	if n := len(p.flusher.Memtables("table")); n != 1 {
+		t.Errorf("memtables %d after snapshot; want 1", n)
+	}
+
+	// write at time 1 after the snapshot is not seen
+	if err := tablet.Set(util.NewLedgerTime(1), newTestRecord("key000", "late")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tablet.Set(util.NewLedgerTime(1), newTestRecord("key100", "late")); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite at time 2, and wait for compaction
+	for i := 0; i < COMPACTION_L0_TRIGGER; i++ {
+		for k := 0; k < 10; k += 2 {
+			if err := tablet.Set(util.NewLedgerTime(2), newTestRecord(fmt.Sprintf("key%03d", k), "v2")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitTestCompaction(t, p.flusher.Manifest("table"))
+
+	for k := 0; k < 10; k++ {
+		key := newTestKey(fmt.Sprintf("key%03d", k))
+
+		r, err := snapshot.Get(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil || string(r.Value().Value()) != "v1" {
+			t.Errorf("snapshot key%03d value %v; want v1", k, r)
+		}
+
+		want := "v1"
+		if k%2 == 0 {
+			want = "v2"
+		}
+		r, err = tablet.Get(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil || string(r.Value().Value()) != want {
+			t.Errorf("tablet key%03d value %v; want %s", k, r, want)
+		}
+	}
+
+	keys, err := snapshot.Keys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 {
+		t.Errorf("snapshot keys %d; want 10", len(keys))
+	}
+
+	// snapshot before applied writes sees the writes at or before its time
+	earlier, err := tablet.Snapshot(util.NewLedgerTime(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer earlier.Release()
+
+	r, err := earlier.Get(newTestKey("key000"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || string(r.Value().Value()) != "late" {
+		t.Errorf("earlier snapshot key000 value %v; want late", r)
+	}
+	groups, err := earlier.Groups(newTestKey("key100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0] != "" {
+		t.Errorf("earlier snapshot key100 groups %v; want [\"\"]", groups)
+	}
+
+	snapshot.Release()
+	if _, err := snapshot.Get(newTestKey("key000"), ""); err == nil {
+		t.Errorf("released snapshot should fail")
+	}
+}
+
+func TestTabletViewProbe(t *testing.T) {
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := OpenManifestV1(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+
+	// level 1 files of key000 - key009, key010 - key019, ...; a level 0 file
+	// over all of them, and a file without key range in manifest
+	consensus_id := newTestConsensusID()
+	for i := 0; i < 8; i++ {
+		records := []util.IRecord{}
+		for k := 10 * i; k < 10*i+10; k++ {
+			records = append(records, newTestRecord(fmt.Sprintf("key%03d", k), "v1"))
+		}
+		addTestSSTable(t, manifest, consensus_id, 1, records)
+	}
+	addTestSSTable(t, manifest, consensus_id, 0, []util.IRecord{newTestRecord("key000", "v2"), newTestRecord("key079", "v2")})
+	num := manifest.NewFileNum()
+	buildTestSSTable(t, manifest.FilePath(num), consensus_id, []util.IRecord{newTestRecord("key100", "v1")})
+	if err := manifest.AddFile(2, num, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key    string
+		want   string
+		opened int
+	}{
+		{"key000", "v2", 1},
+		{"key035", "v1", 2},
+		{"key099", "", 0},
+		{"key100", "v1", 0},
+	} {
+		tables := NewTableCache(100)
+		manifest.SetTableCache(tables)
+		view, err := tablet_open_view(nil, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// file without key range is opened with the view
+		if tables.open != 1 {
+			t.Errorf("%d files opened with view; want 1", tables.open)
+		}
+		r, err := view.get(newTestKey(tt.key), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.want == "" && r != nil || tt.want != "" && (r == nil || string(r.Value().Value()) != tt.want) {
+			t.Errorf("%s = %v; want %s", tt.key, r, tt.want)
+		}
+		if tables.open != tt.opened+1 {
+			t.Errorf("%s opened %d files; want %d", tt.key, tables.open-1, tt.opened)
+		}
+		// tables probed are released while the view is held
+		if tables.lru.Len() != tables.open {
+			t.Errorf("%s holds %d tables in use", tt.key, tables.open-tables.lru.Len())
+		}
+		view.release()
+	}
+
+	// prefix reads open only files which may hold the prefix
+	tables := NewTableCache(100)
+	manifest.SetTableCache(tables)
+	view, err := tablet_open_view(nil, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.release()
+	keys, err := view.keys(newTestKey("key042"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 || tables.open != 3 || tables.lru.Len() != 3 {
+		t.Errorf("keys %v, opened %d files, %d in use; want none, 2 files, none", keys, tables.open-1, tables.open-tables.lru.Len())
+	}
+}
@@ -0,0 +1,167 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"../collection"
+)
+
+const (
+	BLOOM_BITS_PER_KEY = 10 // about 1% false positive rate
+	BLOOM_MAX_HASHES   = 30
+	BLOOM_SEED         = 0xbc9f1d34
+)
+
+// A BloomFilter is an immutable set membership filter - MayContain never
+// returns false for a key the filter is built with, and returns true for
+// other keys at a false positive rate decided by bits per key.
+//
+// Each key is hashed once with murmur3, and the probe positions are derived
+// from the hash by double hashing, rotating the hash as the delta.
+type BloomFilter struct {
+	hashes uint32 // number of probes per key
+	bits   []byte // bit array, length in bytes
+}
+
+// parse BloomFilter from []byte (deserialize), bits are mapped in place
+func NewBloomFilter(buf []byte) (*BloomFilter, int, error) {
+
+	pos := 0
+
+	// number of hashes
+	if len(buf) < pos+4 {
+		return nil, pos, fmt.Errorf("NewBloomFilter - missing hashes %d", len(buf))
+	}
+	hashes := binary.BigEndian.Uint32(buf[pos:])
+	if hashes < 1 || hashes > BLOOM_MAX_HASHES {
+		return nil, pos, fmt.Errorf("NewBloomFilter - unsupported hashes %d", hashes)
+	}
+	pos += 4
+
+	// bit array size
+	if len(buf) < pos+4 {
+		return nil, pos, fmt.Errorf("NewBloomFilter - missing bits length %d", len(buf))
+	}
+	bits_len := binary.BigEndian.Uint32(buf[pos:])
+	pos += 4
+
+	// bit array data
+	if len(buf) < pos+int(bits_len) || bits_len == 0 {
+		return nil, pos, fmt.Errorf("NewBloomFilter - missing bits data %d", bits_len)
+	}
+	bits := buf[pos : pos+int(bits_len)]
+	pos += int(bits_len)
+
+	return &BloomFilter{hashes: hashes, bits: bits}, pos, nil
+}
+
+// build a BloomFilter from keys, with bits_per_key bits for each key
+func BloomBuild(keys []IKey, bits_per_key int) *BloomFilter {
+
+	if bits_per_key < 1 {
+		bits_per_key = 1
+	}
+
+	// optimal number of probes is bits_per_key * ln(2)
+	hashes := uint32(float64(bits_per_key) * 0.69)
+	if hashes < 1 {
+		hashes = 1
+	} else if hashes > BLOOM_MAX_HASHES {
+		hashes = BLOOM_MAX_HASHES
+	}
+
+	// at least 64 bits, avoids high false positive rate of few keys
+	n_bits := len(keys) * bits_per_key
+	if n_bits < 64 {
+		n_bits = 64
+	}
+
+	f := &BloomFilter{hashes: hashes, bits: make([]byte, (n_bits+7)/8)}
+	for _, key := range keys {
+		f.add(key)
+	}
+
+	return f
+}
+
+// serialize to []byte
+func (f *BloomFilter) Encode() ([]byte, error) {
+
+	buf := make([]byte, 4+4, 4+4+len(f.bits))
+	binary.BigEndian.PutUint32(buf[0:], f.hashes)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(f.bits)))
+
+	return append(buf, f.bits...), nil
+}
+
+// whether key may be in the filter, false means key is not in the filter
+func (f *BloomFilter) MayContain(key IKey) bool {
+
+	buf, ok := bloom_key_buf(key)
+	if !ok {
+		return true
+	}
+
+	n_bits := uint32(len(f.bits) * 8)
+	h := collection.MurmurSeed(BLOOM_SEED).Hash(buf)
+	delta := h>>17 | h<<15
+	for i := uint32(0); i < f.hashes; i++ {
+		pos := h % n_bits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+
+	return true
+}
+
+// size of the bit array in bytes
+func (f *BloomFilter) Size() int {
+	return len(f.bits)
+}
+
+// number of probes of each key
+func (f *BloomFilter) Hashes() int {
+	return int(f.hashes)
+}
+
+func (f *BloomFilter) add(key IKey) {
+
+	buf, ok := bloom_key_buf(key)
+	if !ok {
+		return
+	}
+
+	n_bits := uint32(len(f.bits) * 8)
+	h := collection.MurmurSeed(BLOOM_SEED).Hash(buf)
+	delta := h>>17 | h<<15
+	for i := uint32(0); i < f.hashes; i++ {
+		pos := h % n_bits
+		f.bits[pos/8] |= 1 << (pos % 8)
+		h += delta
+	}
+}
+
+// estimated encoded size of a BloomFilter of count keys
+func BloomEstSize(count int, bits_per_key int) int {
+
+	n_bits := count * bits_per_key
+	if n_bits < 64 {
+		n_bits = 64
+	}
+
+	return 4 + 4 + (n_bits+7)/8
+}
+
+func bloom_key_buf(key IKey) ([]byte, bool) {
+
+	if !key.IsEncoded() {
+		if err := key.Encode(nil); err != nil {
+			return nil, false
+		}
+	}
+
+	return key.Buf(), true
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+
+	keys := []IKey{}
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, NewStringKey(fmt.Sprintf("key%05d", i)))
+	}
+
+	built := BloomBuild(keys, BLOOM_BITS_PER_KEY)
+	buf, err := built.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != BloomEstSize(len(keys), BLOOM_BITS_PER_KEY) {
+		t.Errorf("encoded size %d; want %d", len(buf), BloomEstSize(len(keys), BLOOM_BITS_PER_KEY))
+	}
+
+	f, n, err := NewBloomFilter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) {
+		t.Errorf("parsed %d bytes; want %d", n, len(buf))
+	}
+
+	// no false negative
+	for _, key := range keys {
+		if !f.MayContain(key) {
+			t.Fatalf("false negative %s", key.ToString())
+		}
+	}
+
+	// false positive rate about 1%
+	false_positive := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain(NewStringKey(fmt.Sprintf("absent%05d", i))) {
+			false_positive++
+		}
+	}
+	if false_positive > 300 {
+		t.Errorf("false positive %d of 10000", false_positive)
+	}
+
+	// empty filter
+	empty := BloomBuild(nil, BLOOM_BITS_PER_KEY)
+	if empty.MayContain(NewStringKey("key")) {
+		t.Errorf("empty filter contains key")
+	}
+
+	// corrupted
+	if _, _, err := NewBloomFilter(buf[:10]); err == nil {
+		t.Errorf("truncated filter should fail")
+	}
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 )
@@ -8,6 +10,8 @@ import (
 const (
 	CONSENSUS_TIME_LEDGER = 0x01
 	CONSENSUS_TIME_RAFT   = 0x02
+	CONSENSUS_MAGIC_SHARD = 0x01 << 3 // shard start and end present
+	SHARD_HASH_SIZE       = 32        // size of a location on the hash ring
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -143,9 +147,9 @@ func NewRaftTime(term, millis, count uint32) *RaftTime {
 func (t *RaftTime) Buf() []byte {
 	buf := make([]byte, 1+12)
 	buf[0] = CONSENSUS_TIME_RAFT
-	binary.BigEndian.PutUint32(buf, t.term)
-	binary.BigEndian.PutUint32(buf[4:], t.millis)
-	binary.BigEndian.PutUint32(buf[8:], t.count)
+	binary.BigEndian.PutUint32(buf[1:], t.term)
+	binary.BigEndian.PutUint32(buf[5:], t.millis)
+	binary.BigEndian.PutUint32(buf[9:], t.count)
 	return buf
 }
 
@@ -223,17 +227,17 @@ func (t *RaftTime) LT(ict IConsensusTime) (bool, error) {
 	if tmp, ok := ict.(*RaftTime); ok {
 		if t.term < tmp.term {
 			return true, nil
-		} else if t.term < tmp.term {
+		} else if t.term > tmp.term {
 			return false, nil
 		}
 		if t.millis < tmp.millis {
 			return true, nil
-		} else if t.millis < tmp.millis {
+		} else if t.millis > tmp.millis {
 			return false, nil
 		}
 		if t.count < tmp.count {
 			return true, nil
-		} else if t.count < tmp.count {
+		} else if t.count > tmp.count {
 			return false, nil
 		}
 		return false, nil
@@ -246,17 +250,17 @@ func (t *RaftTime) LE(ict IConsensusTime) (bool, error) {
 	if tmp, ok := ict.(*RaftTime); ok {
 		if t.term < tmp.term {
 			return true, nil
-		} else if t.term < tmp.term {
+		} else if t.term > tmp.term {
 			return false, nil
 		}
 		if t.millis < tmp.millis {
 			return true, nil
-		} else if t.millis < tmp.millis {
+		} else if t.millis > tmp.millis {
 			return false, nil
 		}
 		if t.count < tmp.count {
 			return true, nil
-		} else if t.count < tmp.count {
+		} else if t.count > tmp.count {
 			return false, nil
 		}
 		return true, nil
@@ -358,3 +362,119 @@ func (c *MappedConsensusID) Copy() IConsensusID {
 	}
 	return copy
 }
+
+func (c *MappedConsensusID) ShardStart() []byte {
+	return c.shard_start
+}
+
+func (c *MappedConsensusID) ShardEnd() []byte {
+	return c.shard_end
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Shard
+//
+// A shard is the range [shard start, shard end) of locations on the hash ring,
+// wrapping around past the largest location if shard start is not less than
+// shard end - a shard with equal start and end, or a consensus ID without
+// shard, covers the whole ring.
+//
+// A record is located on the ring by
+//
+//   SHA256( CONCAT(consensus_id, len32(domain), domain, len32(tablet), tablet,
+//                  len16(sub_key_1), sub_key_1, ..., len16(sub_key_n), sub_key_n) )
+//
+// where consensus_id is the consensus ID with shard bit cleared and shard
+// start and end removed, so the location of a record does not change when
+// shards are split or merged.  len32 is the 4 bytes big endian length of
+// domain or tablet name, and len16 the 2 bytes big endian length of a sub
+// key.
+
+// shard start and end of consensus id, nil if consensus id has no shard
+func ConsensusShard(consensus_id IConsensusID) ([]byte, []byte, error) {
+
+	c, err := NewMappedConsensusID(consensus_id.Buf())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.shard_start, c.shard_end, nil
+}
+
+// consensus id with shard start and end replaced
+func NewShardConsensusID(consensus_id IConsensusID, start, end []byte) (*MappedConsensusID, error) {
+
+	if len(start) != SHARD_HASH_SIZE || len(end) != SHARD_HASH_SIZE {
+		return nil, fmt.Errorf("NewShardConsensusID - shard start and end must be %d bytes", SHARD_HASH_SIZE)
+	}
+
+	base, err := consensus_id_unsharded(consensus_id)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := append([]byte{}, base...)
+	buf[0] |= CONSENSUS_MAGIC_SHARD
+	buf = append(buf, start...)
+	buf = append(buf, end...)
+
+	return NewMappedConsensusID(buf)
+}
+
+// location of a record with key in tablet on the hash ring
+func ShardHash(consensus_id IConsensusID, domain, tablet string, key IKey) ([]byte, error) {
+
+	base, err := consensus_id_unsharded(consensus_id)
+	if err != nil {
+		return nil, err
+	}
+
+	// domain and tablet are length prefixed, so no two of them hash the same
+	h := sha256.New()
+	h.Write(base)
+	name_length := make([]byte, 4)
+	for _, name := range []string{domain, tablet} {
+		binary.BigEndian.PutUint32(name_length, uint32(len(name)))
+		h.Write(name_length)
+		h.Write([]byte(name))
+	}
+	length := make([]byte, 2)
+	for _, sub_key := range key.Key() {
+		binary.BigEndian.PutUint16(length, uint16(len(sub_key)))
+		h.Write(length)
+		h.Write(sub_key)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// whether location is in shard [start, end), nil start and end for the whole ring
+func ShardContains(start, end, location []byte) bool {
+
+	switch cmp := bytes.Compare(start, end); {
+	case cmp < 0:
+		return bytes.Compare(start, location) <= 0 && bytes.Compare(location, end) < 0
+	case cmp > 0:
+		return bytes.Compare(start, location) <= 0 || bytes.Compare(location, end) < 0
+	default:
+		return true
+	}
+}
+
+// consensus id with shard bit cleared, and shard start and end removed
+func consensus_id_unsharded(consensus_id IConsensusID) ([]byte, error) {
+
+	c, err := NewMappedConsensusID(consensus_id.Buf())
+	if err != nil {
+		return nil, err
+	}
+
+	if c.shard_start == nil {
+		return c.buf, nil
+	}
+
+	buf := append([]byte{}, c.buf[:len(c.buf)-2*SHARD_HASH_SIZE]...)
+	buf[0] &^= CONSENSUS_MAGIC_SHARD
+
+	return buf, nil
+}
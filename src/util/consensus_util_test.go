@@ -0,0 +1,132 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+var consensusTimeTestCases = []struct {
+	input IConsensusTime
+}{
+	{NewLedgerTime(0)},
+	{NewLedgerTime(12345)},
+	{NewRaftTime(1, 2, 3)},
+	{NewRaftTime(0xffffffff, 0, 0x01020304)},
+}
+
+func TestConsensusTime(t *testing.T) {
+	for _, tt := range consensusTimeTestCases {
+		decoded, err := NewConsensusTime(tt.input.Buf())
+		if err != nil {
+			t.Errorf("error occurred: %s", err)
+			continue
+		}
+		if eq, err := decoded.EQ(tt.input); err != nil || !eq {
+			t.Errorf("got %x; want %x", decoded.Buf(), tt.input.Buf())
+		}
+	}
+}
+
+var raftTimeCompareTestCases = []struct {
+	t1 *RaftTime
+	t2 *RaftTime
+	lt bool
+	le bool
+}{
+	{NewRaftTime(1, 2, 3), NewRaftTime(1, 2, 3), false, true},
+	{NewRaftTime(1, 2, 3), NewRaftTime(1, 2, 4), true, true},
+	{NewRaftTime(1, 2, 3), NewRaftTime(1, 3, 0), true, true},
+	{NewRaftTime(1, 2, 3), NewRaftTime(2, 0, 0), true, true},
+	{NewRaftTime(2, 0, 0), NewRaftTime(1, 2, 3), false, false},
+	{NewRaftTime(1, 3, 0), NewRaftTime(1, 2, 3), false, false},
+	{NewRaftTime(1, 2, 4), NewRaftTime(1, 2, 3), false, false},
+}
+
+func TestRaftTimeCompare(t *testing.T) {
+	for _, tt := range raftTimeCompareTestCases {
+		if lt, _ := tt.t1.LT(tt.t2); lt != tt.lt {
+			t.Errorf("%v LT %v: got %v; want %v", tt.t1, tt.t2, lt, tt.lt)
+		}
+		if le, _ := tt.t1.LE(tt.t2); le != tt.le {
+			t.Errorf("%v LE %v: got %v; want %v", tt.t1, tt.t2, le, tt.le)
+		}
+		if gt, _ := tt.t2.GT(tt.t1); gt != tt.lt {
+			t.Errorf("%v GT %v: got %v; want %v", tt.t2, tt.t1, gt, tt.lt)
+		}
+	}
+}
+
+func TestShard(t *testing.T) {
+
+	buf := make([]byte, 1+32)
+	buf[0] = 0x01 << 6
+	buf[1] = 0x01
+	cluster, err := NewMappedConsensusID(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lower := make([]byte, SHARD_HASH_SIZE)
+	middle := make([]byte, SHARD_HASH_SIZE)
+	middle[0] = 0x80
+	shard, err := NewShardConsensusID(cluster, lower, middle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shard.ConsensusMagic() != 0x01<<6|CONSENSUS_MAGIC_SHARD || len(shard.Buf()) != 1+32+2*32 {
+		t.Errorf("shard consensus id %x", shard.Buf())
+	}
+	if start, end, err := ConsensusShard(shard); err != nil || !bytes.Equal(start, lower) || !bytes.Equal(end, middle) {
+		t.Errorf("shard %x - %x, %v", start, end, err)
+	}
+	if start, end, err := ConsensusShard(cluster); err != nil || start != nil || end != nil {
+		t.Errorf("cluster shard %x - %x, %v", start, end, err)
+	}
+	if _, err := NewShardConsensusID(cluster, lower, middle[:8]); err == nil {
+		t.Errorf("short shard end should fail")
+	}
+
+	// location does not depend on shard
+	key := NewKey().Add([]byte("a")).Add([]byte("b"))
+	h1, err := ShardHash(cluster, "domain", "tablet", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := ShardHash(shard, "domain", "tablet", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h1, h2) || len(h1) != SHARD_HASH_SIZE {
+		t.Errorf("location %x vs %x", h1, h2)
+	}
+	h3, _ := ShardHash(cluster, "domain", "tablet", NewKey().Add([]byte("ab")))
+	if bytes.Equal(h1, h3) {
+		t.Errorf("location of different keys equal")
+	}
+	h4, _ := ShardHash(cluster, "a", "bc", key)
+	h5, _ := ShardHash(cluster, "ab", "c", key)
+	if bytes.Equal(h4, h5) {
+		t.Errorf("location of different domain and tablet equal")
+	}
+
+	upper := append([]byte{}, middle...)
+	upper[0] = 0xc0
+	for _, tt := range []struct {
+		start, end, location []byte
+		want                 bool
+	}{
+		{lower, middle, lower, true},
+		{lower, middle, middle, false},
+		{middle, lower, middle, true},
+		{middle, lower, lower, false},
+		{middle, lower, upper, true},
+		{upper, middle, lower, true},
+		{upper, middle, middle, false},
+		{middle, middle, lower, true},
+		{nil, nil, upper, true},
+	} {
+		if got := ShardContains(tt.start, tt.end, tt.location); got != tt.want {
+			t.Errorf("ShardContains(%x, %x, %x) = %v", tt.start, tt.end, tt.location, got)
+		}
+	}
+}
@@ -236,6 +236,8 @@ func (k *MappedKey) Decode(IContext) (int, error) {
 		pos += length
 	}
 
+	// set buf length to exact length
+	k.buf = k.buf[:pos]
 	k.decoded = true
 
 	return pos, nil
@@ -296,7 +298,7 @@ func (k *MappedKey) Compare(c collection.IComparable) int {
 
 	t := c.(IKey)
 	for idx, subKey := range k.Key() {
-		if len(t.Key()) < idx {
+		if len(t.Key()) <= idx {
 			return 1
 		}
 		r := collection.CompareByteSlice(subKey, t.SubKeyAt(idx))
@@ -502,7 +504,7 @@ func (k *Key) Compare(c collection.IComparable) int {
 
 	t := c.(IKey)
 	for idx, subKey := range k.Key() {
-		if len(t.Key()) < idx {
+		if len(t.Key()) <= idx {
 			return 1
 		}
 		r := collection.CompareByteSlice(subKey, t.SubKeyAt(idx))
@@ -92,3 +92,35 @@ func testKeyEqual(k1, k2 IKey, t *testing.T) bool {
 
 	return k1.Equal(k2)
 }
+
+var keyCompareTestCases = []struct {
+	k1   IKey
+	k2   IKey
+	want int
+}{
+	{NewKey().Add([]byte("a")), NewKey().Add([]byte("a")), 0},
+	{NewKey().Add([]byte("a")), NewKey().Add([]byte("b")), -1},
+	{NewKey().Add([]byte("b")), NewKey().Add([]byte("a")), 1},
+	{NewKey().Add([]byte("a")), NewKey().Add([]byte("a")).Add([]byte("b")), -1},
+	{NewKey().Add([]byte("a")).Add([]byte("b")), NewKey().Add([]byte("a")), 1},
+	{NewKey().Add([]byte("a")).Add([]byte("b")), NewKey().Add([]byte("b")), -1},
+}
+
+func TestKeyCompare(t *testing.T) {
+	for _, tt := range keyCompareTestCases {
+		if got := tt.k1.Compare(tt.k2); got != tt.want {
+			t.Errorf("compare(%v, %v): got %d; want %d", tt.k1.Key(), tt.k2.Key(), got, tt.want)
+		}
+		err := tt.k1.Encode(nil)
+		if err != nil {
+			t.Errorf("error occurred: %s", err)
+		}
+		mapped, _, err := NewMappedKey(tt.k1.Buf())
+		if err != nil {
+			t.Errorf("error occurred: %s", err)
+		}
+		if got := mapped.Compare(tt.k2); got != tt.want {
+			t.Errorf("mapped compare(%v, %v): got %d; want %d", tt.k1.Key(), tt.k2.Key(), got, tt.want)
+		}
+	}
+}
@@ -156,6 +156,19 @@ func LCSaveKeyPairPrompt(cls int, id string, pub_key, priv_key *big.Int) error {
 	return lc_save_key_pair(cls, id, pub_key, priv_key, node_secret)
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// Data Functions
+
+// data dir of a domain on node
+func LCGetDomainDir(node_id, domain_name string) string {
+	return lc_get_domain_dir(node_id, domain_name)
+}
+
+// data dir of a consensus ID within a domain on node
+func LCGetConsensusDir(node_id, domain_name string, consensus_id IConsensusID) string {
+	return lc_get_consensus_dir(node_id, domain_name, consensus_id)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // Private Functions
 
@@ -399,6 +412,10 @@ func lc_get_domain_dir(node_id, domain_name string) string {
 	return lc_get_lib_dir(node_id) + "/domain/" + domain_name
 }
 
+func lc_get_consensus_dir(node_id, domain_name string, consensus_id IConsensusID) string {
+	return lc_get_domain_dir(node_id, domain_name) + "/" + hex.EncodeToString(consensus_id.Buf())
+}
+
 func lc_get_log_dir(node_id string) string {
 	return DEFAULT_LOG_DIR + "/" + node_id
 }
@@ -368,6 +368,21 @@ func (t *MPHTable) Lookup(s IKey) (n uint32, ok bool) {
 	}
 }
 
+// number of level 0 buckets
+func (t *MPHTable) Level0Size() int {
+	return len(t.level0)
+}
+
+// number of level 1 slots, no less than number of keys
+func (t *MPHTable) Level1Size() int {
+	return len(t.level1)
+}
+
+// whether lookup is verified by exact key, otherwise by verify hash
+func (t *MPHTable) VerifyByKey() bool {
+	return t.verifyKey != nil
+}
+
 type indexBucket struct {
 	n    int
 	vals []int
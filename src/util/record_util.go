@@ -167,14 +167,14 @@ func (r *MappedRecord) Decode(IContext) (length int, err error) {
 	hasKey := (r.buf[0] >> 6) & 0x01
 	if hasKey != 0 {
 		key, length, err = NewMappedKey(r.buf[pos:])
-	}
-	if err != nil {
-		return 0, fmt.Errorf("MappedRecord::Decode - key error [%v]", err)
-	} else if len(key.Buf()) > MAX_KEY_LENGTH {
-		return 0, fmt.Errorf("MappedRecord::Decode - key size %d larger than %d", len(key.Buf()), MAX_KEY_LENGTH)
-	} else {
-		r.key = key
-		pos += len(r.key.Buf())
+		if err != nil {
+			return 0, fmt.Errorf("MappedRecord::Decode - key error [%v]", err)
+		} else if len(key.Buf()) > MAX_KEY_LENGTH {
+			return 0, fmt.Errorf("MappedRecord::Decode - key size %d larger than %d", len(key.Buf()), MAX_KEY_LENGTH)
+		} else {
+			r.key = key
+			pos += length
+		}
 	}
 
 	// value
@@ -184,14 +184,14 @@ func (r *MappedRecord) Decode(IContext) (length int, err error) {
 	hasValue := (r.buf[0] >> 5) & 0x01
 	if hasValue != 0 {
 		value, length, err = NewStandardMappedValue(r.buf[pos:])
-	}
-	if err != nil {
-		return 0, fmt.Errorf("MappedRecord::Decode - value error [%v]", err)
-	} else if len(value.Buf()) > MAX_VALUE_LENGTH {
-		return 0, fmt.Errorf("MappedRecord::Decode - value size %d larger than %d", len(value.Buf()), MAX_VALUE_LENGTH)
-	} else {
-		r.value = value
-		pos += len(r.value.Buf())
+		if err != nil {
+			return 0, fmt.Errorf("MappedRecord::Decode - value error [%v]", err)
+		} else if len(value.Buf()) > MAX_VALUE_LENGTH {
+			return 0, fmt.Errorf("MappedRecord::Decode - value size %d larger than %d", len(value.Buf()), MAX_VALUE_LENGTH)
+		} else {
+			r.value = value
+			pos += length
+		}
 	}
 
 	// scheme
@@ -201,14 +201,14 @@ func (r *MappedRecord) Decode(IContext) (length int, err error) {
 	hasScheme := (r.buf[0] >> 4) & 0x01
 	if hasScheme != 0 {
 		scheme, length, err = NewStandardMappedValue(r.buf[pos:])
-	}
-	if err != nil {
-		return 0, fmt.Errorf("MappedRecord::Decode - scheme error [%v]", err)
-	} else if len(scheme.Buf()) > MAX_SCHEME_LENGTH {
-		return 0, fmt.Errorf("MappedRecord::Decode - scheme size %d larger than %d", len(scheme.Buf()), MAX_SCHEME_LENGTH)
-	} else {
-		r.scheme = scheme
-		pos += len(r.scheme.Buf())
+		if err != nil {
+			return 0, fmt.Errorf("MappedRecord::Decode - scheme error [%v]", err)
+		} else if len(scheme.Buf()) > MAX_SCHEME_LENGTH {
+			return 0, fmt.Errorf("MappedRecord::Decode - scheme size %d larger than %d", len(scheme.Buf()), MAX_SCHEME_LENGTH)
+		} else {
+			r.scheme = scheme
+			pos += length
+		}
 	}
 
 	// timestamp bit
@@ -310,6 +310,7 @@ type Record struct {
 	timestamp   *time.Time
 	signature_r *big.Int
 	signature_s *big.Int
+	clear       bool
 }
 
 ////////////////////////////////////////
@@ -342,6 +343,11 @@ func (r *Record) Signature() (*big.Int, *big.Int) {
 	return r.signature_r, r.signature_s
 }
 
+// whether CLEAR flag is set
+func (r *Record) IsClear() bool {
+	return r.clear
+}
+
 ////////////////////////////////////////
 // encoding, decoding, and buf
 
@@ -446,6 +452,11 @@ func (r *Record) Encode(IContext) error {
 		buf = append(buf, r.scheme.Buf()...)
 	}
 
+	// encode clear flag
+	if r.clear {
+		buf[0] |= byte(0x01) << 3
+	}
+
 	// encode timestamp
 	if r.timestamp != nil {
 
@@ -499,6 +510,7 @@ func (r *Record) Copy() IEncodable {
 	result.timestamp = r.timestamp
 	result.signature_r = r.signature_r
 	result.signature_s = r.signature_s
+	result.clear = r.clear
 
 	return result
 }
@@ -536,6 +548,7 @@ func (r *Record) CopyConstruct() (IEncodable, error) {
 	result.timestamp = r.timestamp
 	result.signature_r = r.signature_r
 	result.signature_s = r.signature_s
+	result.clear = r.clear
 
 	return result, nil
 }
@@ -597,3 +610,9 @@ func (r *Record) SetSignature(R, S *big.Int) *Record {
 	r.encoded = false
 	return r
 }
+
+func (r *Record) SetClear(clear bool) *Record {
+	r.clear = clear
+	r.encoded = false
+	return r
+}
@@ -1,11 +1,87 @@
 package util
 
-//"fmt"
-//"testing"
+import (
+	"testing"
+	"time"
+
+	"../collection"
+)
 
 var recordTestCases = []struct {
-}{}
+	input IRecord
+}{
+	{NewRecord().SetK([]byte("abc"))},
+	{NewRecord().SetK([]byte("abc")).SetV([]byte("def"))},
+	{NewRecord().SetK([]byte("abc")).SetS([]byte("ghi"))},
+	{NewRecord().SetKey(NewKey().Add([]byte("a")).Add([]byte("bc"))).SetV([]byte("def")).SetS([]byte("ghi"))},
+}
+
+func TestRecord(t *testing.T) {
+	for _, tt := range recordTestCases {
+		err := tt.input.Encode(nil)
+		if err != nil {
+			t.Errorf("error occurred: %s", err)
+			continue
+		}
+		// trailing bytes should not be part of the mapped record
+		buf := append(append([]byte{}, tt.input.Buf()...), 0xff, 0xff)
+		mapped, length, err := NewMappedRecord(buf)
+		if err != nil {
+			t.Errorf("error occurred: %s", err)
+			continue
+		}
+		if length != len(tt.input.Buf()) || !collection.EqualByteSlice(mapped.Buf(), tt.input.Buf()) {
+			t.Errorf("got %v; want %v", mapped.Buf(), tt.input.Buf())
+		}
+		if !mapped.Key().Equal(tt.input.Key()) {
+			t.Errorf("key not match: \n%s, \n%s", mapped.Key().ToString(), tt.input.Key().ToString())
+		}
+		if collection.IsNil(tt.input.Value()) != collection.IsNil(mapped.Value()) {
+			t.Errorf("value not match: %v, %v", tt.input.Value(), mapped.Value())
+		}
+		if collection.IsNil(tt.input.Scheme()) != collection.IsNil(mapped.Scheme()) {
+			t.Errorf("scheme not match: %v, %v", tt.input.Scheme(), mapped.Scheme())
+		}
+	}
+}
+
+func TestRecordTimestamp(t *testing.T) {
+	now := time.Now()
+	r := NewRecord().SetK([]byte("abc")).SetV([]byte("def")).SetTimestamp(&now)
+	err := r.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, _, err := NewMappedRecord(r.Buf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped.Timestamp().UnixNano() != now.UnixNano() {
+		t.Errorf("timestamp not match: %v, %v", mapped.Timestamp(), now)
+	}
+}
 
-func NewTestRecord(s string) IRecord {
-	return nil
+func TestRecordClear(t *testing.T) {
+	now := time.Now()
+	r := NewRecord().SetK([]byte("abc")).SetTimestamp(&now).SetClear(true)
+	err := r.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.RecordMagic()&(0x01<<3) == 0 {
+		t.Errorf("clear bit not set: %x", r.RecordMagic())
+	}
+	mapped, _, err := NewMappedRecord(r.Buf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped.Timestamp().UnixNano() != now.UnixNano() {
+		t.Errorf("timestamp not match: %v, %v", mapped.Timestamp(), now)
+	}
+	if err := r.SetClear(false).Encode(nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.RecordMagic()&(0x01<<3) != 0 {
+		t.Errorf("clear bit set: %x", r.RecordMagic())
+	}
 }
@@ -41,8 +41,20 @@ type MappedScheme struct {
 	buckets [][]byte
 }
 
-func NewMappedSchemd(buf []byte) *MappedScheme {
-	return &MappedScheme{buf: buf}
+func NewMappedScheme(buf []byte) (*MappedScheme, int, error) {
+
+	if len(buf) < 1 {
+		return nil, 0, fmt.Errorf("NewMappedScheme - invalid empty buf")
+	}
+
+	s := &MappedScheme{buf: buf}
+
+	length, err := s.Decode(nil)
+	if err != nil {
+		return nil, length, err
+	}
+
+	return s, length, nil
 }
 
 func (s *MappedScheme) Domain() []byte {
@@ -158,7 +170,7 @@ func (s *MappedScheme) Decode(IContext) (int, error) {
 	var err error
 
 	// decode domain
-	if s.buf[0]|(0x01<<7) != 0 {
+	if (s.buf[0]>>7)&0x01 != 0 {
 		s.domain, length, err = DecodeVarchar(s.buf[pos:])
 		if err != nil {
 			return 0, fmt.Errorf("MappedScheme::Decode - domain error [%v]", err)
@@ -167,7 +179,7 @@ func (s *MappedScheme) Decode(IContext) (int, error) {
 	}
 
 	// decode tablet
-	if s.buf[0]|(0x01<<6) != 0 {
+	if (s.buf[0]>>6)&0x01 != 0 {
 		s.tablet, length, err = DecodeVarchar(s.buf[pos:])
 		if err != nil {
 			return 0, fmt.Errorf("MappedScheme::Decode - tablet error [%v]", err)
@@ -176,7 +188,7 @@ func (s *MappedScheme) Decode(IContext) (int, error) {
 	}
 
 	// decode buckets
-	if s.buf[0]|(0x01<<5) != 0 {
+	if (s.buf[0]>>5)&0x01 != 0 {
 		bucketSize, length, err := DecodeUvarint64(s.buf[pos:])
 		if err != nil {
 			return 0, fmt.Errorf("MappedScheme::Decode - bucket size error [%v]", err)
@@ -192,6 +204,8 @@ func (s *MappedScheme) Decode(IContext) (int, error) {
 		}
 	}
 
+	// set buf length to exact length
+	s.buf = s.buf[:pos]
 	s.decoded = true
 
 	return pos, nil
@@ -326,7 +340,7 @@ func (s *Scheme) Encode(IContext) error {
 	buf := []byte{byte(0x00)}
 
 	if s.domain != nil {
-		buf[0] |= 0x00 << 7
+		buf[0] |= 0x01 << 7
 		buf = append(buf, EncodeVarchar(s.domain)...)
 		if len(buf) > MAX_SCHEME_LENGTH {
 			return fmt.Errorf("Scheme::Encode - scheme length [%d] exceeding maximum [%d]",
@@ -336,7 +350,7 @@ func (s *Scheme) Encode(IContext) error {
 	}
 
 	if s.tablet != nil {
-		buf[0] |= 0x00 << 6
+		buf[0] |= 0x01 << 6
 		buf = append(buf, EncodeVarchar(s.tablet)...)
 		if len(buf) > MAX_SCHEME_LENGTH {
 			return fmt.Errorf("Scheme::Encode - scheme length [%d] exceeding maximum [%d]",
@@ -346,7 +360,7 @@ func (s *Scheme) Encode(IContext) error {
 	}
 
 	if s.buckets != nil {
-		buf[0] |= 0x00 << 5
+		buf[0] |= 0x01 << 5
 		buf = append(buf, EncodeUvarint64(uint64(len(s.buckets)))...)
 		if len(buf) > MAX_SCHEME_LENGTH {
 			return fmt.Errorf("Scheme::Encode - scheme length [%d] exceeding maximum [%d]",
@@ -404,3 +418,24 @@ func (s *Scheme) CopyConstruct() (IEncodable, error) {
 
 	return s.Copy(), nil
 }
+
+////////////////////////////////////////
+// updater
+
+func (s *Scheme) SetDomain(domain []byte) *Scheme {
+	s.domain = domain
+	s.encoded = false
+	return s
+}
+
+func (s *Scheme) SetTablet(tablet []byte) *Scheme {
+	s.tablet = tablet
+	s.encoded = false
+	return s
+}
+
+func (s *Scheme) AddBucket(bucket []byte) *Scheme {
+	s.buckets = append(s.buckets, bucket)
+	s.encoded = false
+	return s
+}
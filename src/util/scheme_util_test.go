@@ -0,0 +1,45 @@
+package util
+
+import (
+	"testing"
+
+	"../collection"
+)
+
+var schemeTestCases = []struct {
+	input *Scheme
+	want  []byte
+}{
+	{NewScheme(), []byte{0x00}},
+	{NewScheme().SetDomain([]byte("d")), []byte{0x01 << 7, 0x01, 'd'}},
+	{NewScheme().SetTablet([]byte("t")), []byte{0x01 << 6, 0x01, 't'}},
+	{NewScheme().AddBucket([]byte("b")), []byte{0x01 << 5, 0x01, 0x01, 'b'}},
+	{NewScheme().SetDomain([]byte("d")).SetTablet([]byte("t")).AddBucket([]byte("b")).AddBucket([]byte("c")),
+		[]byte{0x07 << 5, 0x01, 'd', 0x01, 't', 0x02, 0x01, 'b', 0x01, 'c'}},
+}
+
+func TestScheme(t *testing.T) {
+	for _, tt := range schemeTestCases {
+		err := tt.input.Encode(nil)
+		if err != nil {
+			t.Errorf("error occurred: %s", err)
+			continue
+		}
+		if !collection.EqualByteSlice(tt.input.Buf(), tt.want) {
+			t.Errorf("got %v; want %v", tt.input.Buf(), tt.want)
+			continue
+		}
+		// trailing bytes should not be part of the mapped scheme
+		mapped, length, err := NewMappedScheme(append(append([]byte{}, tt.want...), 0xff))
+		if err != nil {
+			t.Errorf("error occurred: %s", err)
+			continue
+		}
+		if length != len(tt.want) || !collection.EqualByteSlice(mapped.Buf(), tt.want) {
+			t.Errorf("mapped got %v; want %v", mapped.Buf(), tt.want)
+		}
+		if mapped.DomainName() != tt.input.DomainName() || mapped.TabletName() != tt.input.TabletName() || len(mapped.Buckets()) != len(tt.input.Buckets()) {
+			t.Errorf("mapped not match: %s, %s, %v", mapped.DomainName(), mapped.TabletName(), mapped.Buckets())
+		}
+	}
+}